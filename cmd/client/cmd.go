@@ -2,20 +2,304 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/spf13/cobra"
 	flag "github.com/spf13/pflag"
+	"go.uber.org/zap"
 
 	"github.com/alexandear/websocket-pubsub/internal/client"
+	"github.com/alexandear/websocket-pubsub/internal/config"
+	"github.com/alexandear/websocket-pubsub/internal/distributed"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tlsconfig"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+	"github.com/alexandear/websocket-pubsub/internal/scenario"
 )
 
-func Exec() error {
-	addr := flag.String("addr", "localhost:8080", "http server address")
-	clients := flag.Int("clients", 5000, "number of clients")
+// AddFlags binds client flags to cfg.
+func AddFlags(fs *flag.FlagSet, cfg *config.Client) {
+	fs.IntVar(&cfg.Clients, "clients", cfg.Clients, "number of clients")
+	fs.Float64Var(&cfg.ConnectRate, "connect-rate", cfg.ConnectRate, "connections dialed per second, 0 dials all at once")
+	fs.IntVar(&cfg.MaxConcurrentDials, "max-dials", cfg.MaxConcurrentDials, "dials in progress at once")
+	fs.DurationVar(cfg.Hold.Ptr(), "hold", cfg.Hold.Value(), "time to keep connections open after dialing")
+	fs.StringVar(&cfg.Topic, "topic", cfg.Topic, "topic to subscribe and publish to")
+	fs.Float64Var(&cfg.PublishRatio, "publish-ratio", cfg.PublishRatio,
+		"fraction of connections publishing instead of subscribing")
+	fs.DurationVar(cfg.PublishInterval.Ptr(), "publish-interval", cfg.PublishInterval.Value(),
+		"interval between messages of every publisher")
+	fs.DurationVar(cfg.ReportInterval.Ptr(), "report-interval", cfg.ReportInterval.Value(),
+		"interval between latency lines, 0 prints only the final report")
+	fs.StringVar(&cfg.LatencyFile, "latency-file", cfg.LatencyFile, "export latency of every interval to .csv or .json file")
+	fs.StringVar(&cfg.Scenario, "scenario", cfg.Scenario, "run phases of YAML scenario file instead of the load")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "coordinate --workers running --scenario, workers register at this address")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "number of workers the coordinator waits for")
+	fs.StringVar(&cfg.Coordinator, "coordinator", cfg.Coordinator, "run as worker of the coordinator at this address")
 
-	flag.Parse()
+	AddConnFlags(fs, cfg)
+	config.AddTracingFlags(fs, &cfg.Tracing)
+	config.AddLogFlags(fs, &cfg.Log)
+}
+
+// AddConnFlags binds server address and TLS flags shared by client commands to cfg.
+func AddConnFlags(fs *flag.FlagSet, cfg *config.Client) {
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "http server address")
+	fs.StringVar(&cfg.Codec, "codec", cfg.Codec, fmt.Sprintf(
+		"v1 wire format negotiated with the server: %s, empty speaks legacy v0 JSON without negotiation",
+		strings.Join(codec.Names(), ", ")))
+	fs.BoolVar(&cfg.Compression, "compression", cfg.Compression, "offer permessage-deflate to the server")
+	fs.BoolVar(&cfg.TLS.Enabled, "tls", cfg.TLS.Enabled, "connect using wss://")
+	fs.StringVar(&cfg.TLS.CA, "ca", cfg.TLS.CA, "CA file for verifying server certificate, implies --tls")
+	fs.BoolVar(&cfg.TLS.Insecure, "insecure", cfg.TLS.Insecure, "skip server certificate verification, implies --tls")
+	fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "client certificate file for mutual TLS, implies --tls")
+	fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "client private key file for mutual TLS, implies --tls")
+}
+
+// Codec returns nil when codec is not set, so that no subprotocol is negotiated.
+// The name must be validated by config.
+func Codec(cfg config.Client) codec.Codec {
+	cd, _ := codec.ByName(cfg.Codec)
+
+	return cd
+}
+
+// DialConfig describes how sub, pub and repl commands dial the server.
+func DialConfig(cfg config.Client, tlsCfg *tls.Config) client.DialConfig {
+	return client.DialConfig{TLS: tlsCfg, Codec: Codec(cfg), Compression: cfg.Compression}
+}
+
+// TLSConfig returns nil when none of TLS settings is set.
+func TLSConfig(cfg config.ClientTLS) (*tls.Config, error) {
+	if !cfg.Enabled && cfg.CA == "" && !cfg.Insecure && cfg.Cert == "" && cfg.Key == "" {
+		return nil, nil
+	}
+
+	c, err := tlsconfig.NewClient(cfg.CA, cfg.Insecure, cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("tls config failed: %w", err)
+	}
+
+	return c, nil
+}
+
+func NewCommand() *cobra.Command {
+	cfg := config.Default()
+
+	cmd := &cobra.Command{
+		Use:   "client",
+		Short: "Generate load: ramp up connections, subscribe and publish, report results or run scenario",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cmd.SilenceUsage = true
+
+			if err := config.Reload(cmd.Flags(), &cfg); err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go func() {
+				sig := make(chan os.Signal, 1)
+				signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+				<-sig
+				cancel()
+			}()
+
+			return Run(ctx, cfg.Client, cmd.OutOrStdout())
+		},
+	}
+
+	config.AddFileFlag(cmd.Flags())
+	AddFlags(cmd.Flags(), &cfg.Client)
+
+	return cmd
+}
+
+// Run generates load until the hold ends or ctx is done, then writes report to w.
+// When scenario is set, Run runs it instead, locally or on workers of the coordinator,
+// and returns scenario.ErrFailed when it fails.
+func Run(ctx context.Context, cfg config.Client, w io.Writer) error {
+	log, err := logger.New(cfg.Log)
+	if err != nil {
+		return fmt.Errorf("logger failed: %w", err)
+	}
+
+	defer func() {
+		_ = log.Sync()
+	}()
+
+	cfg.Tracing.ServiceName = "pubsub-client"
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		return fmt.Errorf("tracing failed: %w", err)
+	}
+
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Warn("shutdown tracing failed", zap.Error(err))
+		}
+	}()
+
+	tlsCfg, err := TLSConfig(cfg.TLS)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case cfg.Listen != "":
+		return runCoordinator(ctx, log, cfg, w)
+	case cfg.Coordinator != "":
+		return runWorker(ctx, log, cfg, tlsCfg)
+	case cfg.Scenario != "":
+		return runScenario(ctx, log, cfg, tlsCfg, w)
+	}
+
+	opts := []client.Option{
+		client.WithCodec(Codec(cfg)),
+		client.WithConnectRate(cfg.ConnectRate),
+		client.WithMaxConcurrentDials(cfg.MaxConcurrentDials),
+		client.WithHold(cfg.Hold.Value()),
+		client.WithTopic(cfg.Topic),
+		client.WithPublishRatio(cfg.PublishRatio),
+		client.WithPublishInterval(cfg.PublishInterval.Value()),
+		client.WithReportInterval(cfg.ReportInterval.Value(), func(l client.LatencyInterval) {
+			_, _ = fmt.Fprintln(w, l)
+		}),
+	}
+
+	if tlsCfg != nil {
+		opts = append(opts, client.WithTLS(tlsCfg))
+	}
+
+	if cfg.Compression {
+		opts = append(opts, client.WithCompression())
+	}
 
-	app := client.NewApp(*addr, *clients)
-	app.Run(context.Background())
+	app := client.NewApp(log, cfg.Addr, cfg.Clients, opts...)
+	report := app.Run(ctx)
+
+	if err := report.Print(w); err != nil {
+		return fmt.Errorf("print report failed: %w", err)
+	}
+
+	if cfg.LatencyFile != "" {
+		if err := writeLatency(cfg.LatencyFile, report); err != nil {
+			return fmt.Errorf("export latency failed: %w", err)
+		}
+	}
 
 	return nil
 }
+
+func runScenario(ctx context.Context, log *zap.Logger, cfg config.Client, tlsCfg *tls.Config, w io.Writer) error {
+	s, err := scenario.Load(cfg.Scenario)
+	if err != nil {
+		return fmt.Errorf("load scenario failed: %w", err)
+	}
+
+	opts := []scenario.Option{
+		scenario.WithCodec(Codec(cfg)),
+		scenario.WithMaxConcurrentDials(cfg.MaxConcurrentDials),
+	}
+	if tlsCfg != nil {
+		opts = append(opts, scenario.WithTLS(tlsCfg))
+	}
+
+	if cfg.Compression {
+		opts = append(opts, scenario.WithCompression())
+	}
+
+	return printResult(scenario.New(log, cfg.Addr, opts...).Run(ctx, s), w)
+}
+
+func runCoordinator(ctx context.Context, log *zap.Logger, cfg config.Client, w io.Writer) error {
+	s, err := scenario.Load(cfg.Scenario)
+	if err != nil {
+		return fmt.Errorf("load scenario failed: %w", err)
+	}
+
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("listen failed: %w", err)
+	}
+
+	log.Info("waiting for workers", zap.String("addr", l.Addr().String()), zap.Int("workers", cfg.Workers))
+
+	result, err := distributed.NewCoordinator(log, l, cfg.Workers).Run(ctx, s)
+	if err != nil {
+		if perr := result.Print(w); perr != nil {
+			log.Warn("print result failed", zap.Error(perr))
+		}
+
+		return fmt.Errorf("coordinate failed: %w", err)
+	}
+
+	return printResult(result, w)
+}
+
+func runWorker(ctx context.Context, log *zap.Logger, cfg config.Client, tlsCfg *tls.Config) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "worker"
+	}
+
+	opts := []distributed.WorkerOption{
+		distributed.WithName(fmt.Sprintf("%s-%d", hostname, os.Getpid())),
+		distributed.WithCodec(Codec(cfg)),
+		distributed.WithMaxConcurrentDials(cfg.MaxConcurrentDials),
+	}
+	if tlsCfg != nil {
+		opts = append(opts, distributed.WithTLS(tlsCfg))
+	}
+
+	if cfg.Compression {
+		opts = append(opts, distributed.WithCompression())
+	}
+
+	if err := distributed.NewWorker(log, cfg.Addr, opts...).Run(ctx, cfg.Coordinator); err != nil {
+		return fmt.Errorf("worker failed: %w", err)
+	}
+
+	return nil
+}
+
+func printResult(result scenario.Result, w io.Writer) error {
+	if err := result.Print(w); err != nil {
+		return fmt.Errorf("print result failed: %w", err)
+	}
+
+	if !result.Passed() {
+		return scenario.ErrFailed
+	}
+
+	return nil
+}
+
+func writeLatency(file string, report client.Report) (err error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return fmt.Errorf("create file failed: %w", err)
+	}
+
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("close file failed: %w", cerr)
+		}
+	}()
+
+	if config.LatencyFormat(file) == "csv" {
+		return report.WriteLatencyCSV(f)
+	}
+
+	return report.WriteLatencyJSON(f)
+}
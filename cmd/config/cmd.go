@@ -0,0 +1,91 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+
+	"github.com/alexandear/websocket-pubsub/internal/config"
+)
+
+var ErrBadFormat = errors.New("unknown format")
+
+const (
+	formatYAML = "yaml"
+	formatJSON = "json"
+
+	redacted = "REDACTED"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect configuration",
+		Args:  cobra.NoArgs,
+	}
+
+	cmd.AddCommand(newPrintCommand())
+
+	return cmd
+}
+
+func newPrintCommand() *cobra.Command {
+	var format string
+
+	cmd := &cobra.Command{
+		Use:   "print",
+		Short: "Print effective configuration built from defaults, config file and environment variables",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cmd.SilenceUsage = true
+
+			return execPrint(cmd.Flags(), format, cmd.OutOrStdout())
+		},
+	}
+
+	config.AddFileFlag(cmd.Flags())
+	cmd.Flags().StringVar(&format, "format", formatYAML, "output format: yaml or json")
+
+	_ = cmd.RegisterFlagCompletionFunc("format",
+		func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+			return []string{formatYAML, formatJSON}, cobra.ShellCompDirectiveNoFileComp
+		})
+
+	return cmd
+}
+
+// execPrint writes effective configuration with secrets redacted.
+func execPrint(fs *flag.FlagSet, format string, w io.Writer) error {
+	cfg := config.Default()
+	if err := config.Reload(fs, &cfg); err != nil {
+		return err
+	}
+
+	if cfg.Server.AdminToken != "" {
+		cfg.Server.AdminToken = redacted
+	}
+
+	switch format {
+	case formatYAML:
+		data, err := yaml.Marshal(cfg)
+		if err != nil {
+			return fmt.Errorf("marshal yaml failed: %w", err)
+		}
+
+		_, err = w.Write(data)
+
+		return err
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(cfg)
+	default:
+		return fmt.Errorf("%s: %w", format, ErrBadFormat)
+	}
+}
@@ -0,0 +1,111 @@
+package pub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	clientcmd "github.com/alexandear/websocket-pubsub/cmd/client"
+	"github.com/alexandear/websocket-pubsub/internal/client"
+	"github.com/alexandear/websocket-pubsub/internal/config"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+)
+
+func NewCommand() *cobra.Command {
+	cfg := config.Default()
+
+	var topic string
+
+	cmd := &cobra.Command{
+		Use:   "pub --topic TOPIC [MESSAGE...]",
+		Short: "Publish messages from args or stdin line by line",
+		Long: `Publish every MESSAGE to the topic, or every line of stdin when no messages are given.
+Valid JSON is published as is, other text is published as JSON string.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			if err := config.Reload(cmd.Flags(), &cfg); err != nil {
+				return err
+			}
+
+			return Run(context.Background(), cfg.Client, topic, args, cmd.InOrStdin())
+		},
+	}
+
+	fs := cmd.Flags()
+	fs.StringVar(&topic, "topic", "", "topic to publish to")
+	_ = cmd.MarkFlagRequired("topic")
+
+	config.AddFileFlag(fs)
+	clientcmd.AddConnFlags(fs, &cfg.Client)
+	config.AddLogFlags(fs, &cfg.Client.Log)
+
+	return cmd
+}
+
+// Run publishes messages to topic, or lines of r when there are no messages.
+func Run(ctx context.Context, cfg config.Client, topic string, messages []string, r io.Reader) error {
+	log, err := logger.New(cfg.Log)
+	if err != nil {
+		return fmt.Errorf("logger failed: %w", err)
+	}
+
+	defer func() {
+		_ = log.Sync()
+	}()
+
+	tlsCfg, err := clientcmd.TLSConfig(cfg.TLS)
+	if err != nil {
+		return err
+	}
+
+	c, err := client.Dial(ctx, log, cfg.Addr, clientcmd.DialConfig(cfg, tlsCfg))
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	publish := func(message []byte) error {
+		message = bytes.TrimSpace(message)
+		if len(message) == 0 {
+			return nil
+		}
+
+		if err := c.Publish(topic, client.Data(message)); err != nil {
+			return fmt.Errorf("publish failed: %w", err)
+		}
+
+		log.Debug("published", zap.String("topic", topic), zap.ByteString("data", message))
+
+		return nil
+	}
+
+	if len(messages) > 0 {
+		for _, message := range messages {
+			if err := publish([]byte(message)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := publish(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read stdin failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package repl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/peterh/liner"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	clientcmd "github.com/alexandear/websocket-pubsub/cmd/client"
+	"github.com/alexandear/websocket-pubsub/internal/client"
+	"github.com/alexandear/websocket-pubsub/internal/config"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+	"github.com/alexandear/websocket-pubsub/internal/repl"
+)
+
+const (
+	prompt      = "pubsub> "
+	historyFile = ".pubsub_history"
+)
+
+func NewCommand() *cobra.Command {
+	cfg := config.Default()
+
+	var history string
+
+	cmd := &cobra.Command{
+		Use:   "repl",
+		Short: "Open a single websocket and send commands interactively",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cmd.SilenceUsage = true
+
+			if err := config.Reload(cmd.Flags(), &cfg); err != nil {
+				return err
+			}
+
+			return Run(cfg.Client, history)
+		},
+	}
+
+	fs := cmd.Flags()
+	fs.StringVar(&history, "history", defaultHistory(), "file keeping command history, empty disables history")
+
+	config.AddFileFlag(fs)
+	clientcmd.AddConnFlags(fs, &cfg.Client)
+	config.AddLogFlags(fs, &cfg.Client.Log)
+
+	return cmd
+}
+
+// Run reads commands from the terminal until quit, Ctrl-C or Ctrl-D.
+func Run(cfg config.Client, history string) error {
+	log, err := logger.New(cfg.Log)
+	if err != nil {
+		return fmt.Errorf("logger failed: %w", err)
+	}
+
+	defer func() {
+		_ = log.Sync()
+	}()
+
+	tlsCfg, err := clientcmd.TLSConfig(cfg.TLS)
+	if err != nil {
+		return err
+	}
+
+	c, err := client.Dial(context.Background(), log, cfg.Addr, clientcmd.DialConfig(cfg, tlsCfg))
+	if err != nil {
+		return err
+	}
+
+	// Non-zero when the user exits, so that closing the connection is not reported.
+	var quitting int32
+
+	defer func() {
+		atomic.StoreInt32(&quitting, 1)
+		c.Close()
+	}()
+
+	r := repl.New(c, os.Stdout)
+
+	go func() {
+		if err := r.ReadFrames(); err != nil {
+			log.Warn("read failed", zap.Error(err))
+		}
+
+		if atomic.LoadInt32(&quitting) == 0 {
+			fmt.Println("connection closed by server, press Ctrl-D to exit")
+		}
+	}()
+
+	line := liner.NewLiner()
+	defer line.Close()
+
+	line.SetCtrlCAborts(true)
+	line.SetCompleter(r.Complete)
+	readHistory(line, history)
+
+	defer writeHistory(line, history, log)
+
+	fmt.Printf("connected to %s, type help for commands\n", cfg.Addr)
+
+	for {
+		input, err := line.Prompt(prompt)
+		if errors.Is(err, io.EOF) || errors.Is(err, liner.ErrPromptAborted) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("read command failed: %w", err)
+		}
+
+		if strings.TrimSpace(input) != "" {
+			line.AppendHistory(input)
+		}
+
+		if err := r.Eval(input); err != nil {
+			if errors.Is(err, repl.ErrQuit) {
+				return nil
+			}
+
+			fmt.Println("error:", err)
+		}
+	}
+}
+
+func defaultHistory() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, historyFile)
+}
+
+func readHistory(line *liner.State, file string) {
+	if file == "" {
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	_, _ = line.ReadHistory(f)
+}
+
+func writeHistory(line *liner.State, file string, log *zap.Logger) {
+	if file == "" {
+		return
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		log.Warn("open history failed", zap.Error(err))
+
+		return
+	}
+
+	defer f.Close()
+
+	if _, err := line.WriteHistory(f); err != nil {
+		log.Warn("write history failed", zap.Error(err))
+	}
+}
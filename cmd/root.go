@@ -1,31 +1,81 @@
 package cmd
 
 import (
-	"errors"
 	"fmt"
 
+	"github.com/spf13/cobra"
+
 	"github.com/alexandear/websocket-pubsub/cmd/client"
+	"github.com/alexandear/websocket-pubsub/cmd/config"
+	"github.com/alexandear/websocket-pubsub/cmd/pub"
+	"github.com/alexandear/websocket-pubsub/cmd/repl"
 	"github.com/alexandear/websocket-pubsub/cmd/server"
+	"github.com/alexandear/websocket-pubsub/cmd/sub"
+	"github.com/alexandear/websocket-pubsub/cmd/version"
 )
 
-var ErrBadCommand = errors.New("wrong command")
-
 const (
-	commandClient = "client"
-	commandServer = "server"
+	shellBash       = "bash"
+	shellZsh        = "zsh"
+	shellFish       = "fish"
+	shellPowerShell = "powershell"
 )
 
+// Exec runs command chosen by args, args[0] is the program name.
 func Exec(args []string) error {
-	if len(args) <= 1 {
-		return fmt.Errorf("missing command: %w", ErrBadCommand)
+	root := NewCommand()
+	root.SetArgs(args[1:])
+
+	return root.Execute()
+}
+
+// NewCommand creates root command with all subcommands.
+func NewCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "pubsub",
+		Short: "Websocket publish-subscribe server and clients",
+		// Errors are reported by main.
+		SilenceErrors: true,
 	}
 
-	switch command := args[1]; command {
-	case commandClient:
-		return client.Exec()
-	case commandServer:
-		return server.Exec()
-	default:
-		return fmt.Errorf("unknown command %s: %w", command, ErrBadCommand)
+	root.AddCommand(
+		client.NewCommand(),
+		config.NewCommand(),
+		server.NewCommand(),
+		sub.NewCommand(),
+		pub.NewCommand(),
+		repl.NewCommand(),
+		version.NewCommand(),
+		newCompletionCommand(),
+	)
+
+	return root
+}
+
+func newCompletionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "completion {bash|zsh|fish|powershell}",
+		Short: "Generate shell completion script",
+		Long: `Generate shell completion script, e.g. for bash:
+
+  source <(pubsub completion bash)`,
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{shellBash, shellZsh, shellFish, shellPowerShell},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			root, w := cmd.Root(), cmd.OutOrStdout()
+
+			switch shell := args[0]; shell {
+			case shellBash:
+				return root.GenBashCompletion(w)
+			case shellZsh:
+				return root.GenZshCompletion(w)
+			case shellFish:
+				return root.GenFishCompletion(w, true)
+			case shellPowerShell:
+				return root.GenPowerShellCompletion(w)
+			default:
+				return fmt.Errorf("unknown shell %s", shell)
+			}
+		},
 	}
 }
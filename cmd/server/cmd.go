@@ -2,24 +2,252 @@ package server
 
 import (
 	"context"
-	"time"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
 	flag "github.com/spf13/pflag"
+	"go.uber.org/zap"
 
+	"github.com/alexandear/websocket-pubsub/internal/bridge"
+	"github.com/alexandear/websocket-pubsub/internal/broker"
+	"github.com/alexandear/websocket-pubsub/internal/config"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tlsconfig"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+	"github.com/alexandear/websocket-pubsub/internal/reload"
 	"github.com/alexandear/websocket-pubsub/internal/server"
 )
 
-const (
-	defaultBroadcast = 100 * time.Millisecond
-)
+// AddFlags binds server flags to cfg.
+func AddFlags(fs *flag.FlagSet, cfg *config.Server) {
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "http service address")
+	fs.DurationVar(cfg.Broadcast.Ptr(), "broadcast", cfg.Broadcast.Value(), "broadcast frequency")
+	fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "TLS certificate file, enables wss://")
+	fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "TLS private key file")
+	fs.StringVar(&cfg.TLS.ClientCA, "tls-client-ca", cfg.TLS.ClientCA,
+		"CA file for verifying client certificates, enables mutual TLS")
+	fs.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "bearer token enabling admin API under /admin")
+	fs.DurationVar(cfg.DrainDelay.Ptr(), "drain-delay", cfg.DrainDelay.Value(), "time to report not ready before shutdown")
+	fs.DurationVar(cfg.WedgedThreshold.Ptr(), "wedged-threshold", cfg.WedgedThreshold.Value(),
+		"time the hub loop may be unresponsive before readiness fails")
+	fs.DurationVar(cfg.STOMPHeartbeat.Ptr(), "stomp-heartbeat", cfg.STOMPHeartbeat.Value(),
+		"heart-beat interval offered to STOMP clients, 0 disables heart-beating")
+	fs.IntVar(&cfg.SendBufferSize, "send-buffer-size", cfg.SendBufferSize,
+		"outbound messages queued per client before dropping")
+	fs.IntVar(&cfg.CastSize, "cast-size", cfg.CastSize, "cast messages queued in the hub before publishers block")
+	fs.IntVar(&cfg.UpgraderBufferSize, "upgrader-buffer-size", cfg.UpgraderBufferSize,
+		"websocket read and write buffer size in bytes")
+	fs.IntVar(&cfg.MaxClients, "max-clients", cfg.MaxClients, "expected number of clients to preallocate the hub")
+	fs.IntVar(&cfg.MaxMessageSize, "max-message-size", cfg.MaxMessageSize,
+		"maximum size in bytes of messages, packets and frames of MQTT and STOMP clients")
+	fs.IntVar(&cfg.Shards, "shards", cfg.Shards, "hub shards partitioning clients, 0 uses one shard per CPU")
+	fs.StringVar(&cfg.Cluster.Listen, "cluster-listen", cfg.Cluster.Listen,
+		"address other cluster nodes connect to, enables cluster mode over TCP mesh")
+	fs.StringVar(&cfg.Cluster.Peers, "cluster-peers", cfg.Cluster.Peers,
+		"comma separated addresses of all cluster nodes, may include this node")
+	fs.StringVar(&cfg.Cluster.Redis, "cluster-redis", cfg.Cluster.Redis,
+		"Redis URL relaying messages between cluster nodes, enables cluster mode over Redis pub/sub")
+	fs.StringVar(&cfg.Cluster.RedisChannel, "cluster-redis-channel", cfg.Cluster.RedisChannel,
+		"Redis pub/sub channel shared by cluster nodes")
+	fs.StringVar(&cfg.Cluster.Node, "cluster-node", cfg.Cluster.Node, "ID of this cluster node, random when empty")
+	fs.StringVar(&cfg.Cluster.NumConnections, "cluster-num-connections", cfg.Cluster.NumConnections,
+		"what NUM_CONNECTIONS counts: node or cluster")
+	fs.StringVar(&cfg.NATS.URL, "nats-url", cfg.NATS.URL, "NATS server URL, enables the NATS bridge")
+	fs.StringVar(&cfg.NATS.Subjects, "nats-subjects", cfg.NATS.Subjects,
+		"comma separated subject=topic pairs bridged in both directions")
+	fs.StringVar(&cfg.NATS.Name, "nats-name", cfg.NATS.Name,
+		"name reported to NATS, marks messages published by the bridge")
+	fs.BoolVar(&cfg.Compression.Enabled, "compression", cfg.Compression.Enabled,
+		"negotiate permessage-deflate with clients which offer it")
+	fs.IntVar(&cfg.Compression.Level, "compression-level", cfg.Compression.Level,
+		"compression level from -2 (Huffman only) to 9 (best compression)")
+	fs.IntVar(&cfg.Compression.Threshold, "compression-threshold", cfg.Compression.Threshold,
+		"message size in bytes below which messages are sent uncompressed")
+
+	config.AddTracingFlags(fs, &cfg.Tracing)
+	config.AddLogFlags(fs, &cfg.Log)
+}
+
+func NewCommand() *cobra.Command {
+	cfg := config.Default()
+
+	cmd := &cobra.Command{
+		Use:   "server",
+		Short: "Serve websocket clients and broadcast server time",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cmd.SilenceUsage = true
+
+			fs := cmd.Flags()
+			if err := config.Reload(fs, &cfg); err != nil {
+				return err
+			}
+
+			load := func() (config.Server, error) {
+				if err := config.Reload(fs, &cfg); err != nil {
+					return config.Server{}, err
+				}
+
+				return cfg.Server, nil
+			}
+
+			return Run(cfg.Server, load)
+		},
+	}
+
+	config.AddFileFlag(cmd.Flags())
+	AddFlags(cmd.Flags(), &cfg.Server)
+
+	return cmd
+}
+
+// Run serves until SIGINT or SIGTERM. On SIGHUP or POST /admin/reload settings returned by load
+// are applied when safe at runtime, others are reported as requiring restart.
+func Run(cfg config.Server, load func() (config.Server, error)) error {
+	log, level, err := logger.NewLeveled(cfg.Log)
+	if err != nil {
+		return fmt.Errorf("logger failed: %w", err)
+	}
+
+	defer func() {
+		_ = log.Sync()
+	}()
+
+	cfg.Tracing.ServiceName = "pubsub-server"
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		return fmt.Errorf("tracing failed: %w", err)
+	}
+
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Warn("shutdown tracing failed", zap.Error(err))
+		}
+	}()
+
+	// Reloader needs the app which takes reload as an option.
+	var r *reload.Reloader
+
+	opts := []server.Option{
+		server.WithReload(func() (server.ReloadResult, error) {
+			return r.Reload()
+		}),
+		server.WithDrainDelay(cfg.DrainDelay.Value()),
+		server.WithWedgedThreshold(cfg.WedgedThreshold.Value()),
+		server.WithAdminToken(cfg.AdminToken),
+		server.WithSendBufferSize(cfg.SendBufferSize),
+		server.WithUpgraderBufferSize(cfg.UpgraderBufferSize),
+		server.WithSTOMPHeartbeat(cfg.STOMPHeartbeat.Value()),
+		server.WithMaxMessageSize(cfg.MaxMessageSize),
+	}
+
+	if cfg.Compression.Enabled {
+		opts = append(opts, server.WithCompression(cfg.Compression.Websocket()))
+	}
+
+	if cfg.TLS.Cert != "" {
+		tlsCfg, err := tlsconfig.NewServer(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.ClientCA)
+		if err != nil {
+			return fmt.Errorf("tls config failed: %w", err)
+		}
 
-func Exec() error {
-	addr := flag.String("addr", ":8080", "http service address")
-	broadcast := flag.Duration("broadcast", defaultBroadcast, "broadcast frequency")
+		opts = append(opts, server.WithTLS(tlsCfg))
+	}
+
+	hubOpts := []server.HubOption{
+		server.WithCastSize(cfg.CastSize),
+		server.WithMaxClients(cfg.MaxClients),
+		server.WithShards(cfg.Shards),
+	}
+
+	if cfg.Cluster.Enabled() {
+		clusterOpts, err := cluster(log, cfg.Cluster)
+		if err != nil {
+			return err
+		}
+
+		hubOpts = append(hubOpts, clusterOpts...)
+	}
+
+	if cfg.NATS.URL != "" {
+		log.Info("bridging nats", zap.Any("subjects", cfg.NATS.SubjectMap()))
+
+		hubOpts = append(hubOpts, server.WithBridge(bridge.NewNATS(log, cfg.NATS.URL, cfg.NATS.SubjectMap(),
+			bridge.WithName(cfg.NATS.Name))))
+	}
+
+	hub := server.NewHub(log, cfg.Broadcast.Value(), hubOpts...)
+	a := server.New(log, cfg.Addr, hub, opts...)
+	r = reload.New(log, level, cfg, load, a, hub)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		cancel()
+	}()
+
+	go reloadOnHangup(ctx, log, r)
+
+	return a.Run(ctx)
+}
+
+// cluster returns hub options joining the cluster through Redis or TCP mesh of nodes.
+func cluster(log *zap.Logger, cfg config.ServerCluster) ([]server.HubOption, error) {
+	node := cfg.Node
+	if node == "" {
+		node = uuid.New().String()
+	}
+
+	var b broker.Broker
+
+	if cfg.Redis != "" {
+		log.Info("joining cluster", zap.String("node", node), zap.String("channel", cfg.RedisChannel))
+
+		b = broker.NewRedis(log, node, cfg.Redis, broker.WithChannel(cfg.RedisChannel))
+	} else {
+		l, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			return nil, fmt.Errorf("cluster listen failed: %w", err)
+		}
+
+		log.Info("joining cluster", zap.String("node", node), zap.String("addr", l.Addr().String()),
+			zap.Strings("peers", cfg.PeerList()))
+
+		b = broker.NewMesh(log, node, l, cfg.PeerList())
+	}
+
+	opts := []server.HubOption{server.WithBroker(b)}
+	if cfg.NumConnections == config.NumConnectionsCluster {
+		opts = append(opts, server.WithClusterNumConnections())
+	}
+
+	return opts, nil
+}
 
-	flag.Parse()
+func reloadOnHangup(ctx context.Context, log *zap.Logger, r *reload.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-	a := server.New(*addr, server.NewHub(*broadcast))
+	defer signal.Stop(hup)
 
-	return a.Run(context.Background())
+	for {
+		select {
+		case <-hup:
+			if _, err := r.Reload(); err != nil {
+				log.Error("reload failed", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -0,0 +1,136 @@
+package sub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	clientcmd "github.com/alexandear/websocket-pubsub/cmd/client"
+	"github.com/alexandear/websocket-pubsub/internal/client"
+	"github.com/alexandear/websocket-pubsub/internal/config"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+)
+
+func NewCommand() *cobra.Command {
+	cfg := config.Default()
+
+	var topics []string
+
+	cmd := &cobra.Command{
+		Use:   "sub --topic TOPIC",
+		Short: "Stream messages of topics to stdout as JSON lines",
+		Long: `Stream messages of topics to stdout as JSON lines, one {"topic": ..., "data": ...} per message.
+Topic "broadcast" streams server time.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cmd.SilenceUsage = true
+
+			if err := config.Reload(cmd.Flags(), &cfg); err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go func() {
+				sig := make(chan os.Signal, 1)
+				signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+				<-sig
+				cancel()
+			}()
+
+			return Run(ctx, cfg.Client, topics, cmd.OutOrStdout())
+		},
+	}
+
+	fs := cmd.Flags()
+	fs.StringSliceVar(&topics, "topic", nil, "topic to subscribe, repeat or separate with commas for many")
+	_ = cmd.MarkFlagRequired("topic")
+
+	config.AddFileFlag(fs)
+	clientcmd.AddConnFlags(fs, &cfg.Client)
+	config.AddLogFlags(fs, &cfg.Client.Log)
+
+	return cmd
+}
+
+// Run writes messages of topics to w until ctx is done or the server closes the connection.
+func Run(ctx context.Context, cfg config.Client, topics []string, w io.Writer) error {
+	log, err := logger.New(cfg.Log)
+	if err != nil {
+		return fmt.Errorf("logger failed: %w", err)
+	}
+
+	defer func() {
+		_ = log.Sync()
+	}()
+
+	tlsCfg, err := clientcmd.TLSConfig(cfg.TLS)
+	if err != nil {
+		return err
+	}
+
+	c, err := client.Dial(ctx, log, cfg.Addr, clientcmd.DialConfig(cfg, tlsCfg))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+
+	for _, topic := range topics {
+		if err := c.SubscribeTopic(topic); err != nil {
+			return fmt.Errorf("subscribe to %s failed: %w", topic, err)
+		}
+
+		log.Debug("subscribed", zap.String("topic", topic))
+	}
+
+	enc := json.NewEncoder(w)
+
+	for {
+		resp, err := c.ReadOne()
+		if err != nil {
+			if errors.Is(err, websocket.ErrClosedConn) || ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		if err := enc.Encode(withoutTraceContext(resp)); err != nil {
+			return fmt.Errorf("write message failed: %w", err)
+		}
+	}
+}
+
+func withoutTraceContext(resp operation.Resp) operation.Resp {
+	switch r := resp.(type) {
+	case operation.RespMessage:
+		r.TraceContext = nil
+
+		return r
+	case operation.RespBroadcast:
+		r.TraceContext = nil
+
+		return r
+	case operation.RespNumConnections:
+		r.TraceContext = nil
+
+		return r
+	default:
+		return resp
+	}
+}
@@ -0,0 +1,43 @@
+package version
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/spf13/cobra"
+)
+
+// Build information set with -ldflags "-X github.com/alexandear/websocket-pubsub/cmd/version.Version=v1.0.0".
+//
+//nolint:gochecknoglobals // set by linker
+var (
+	Version = "dev"
+	Commit  = "unknown"
+	Date    = "unknown"
+)
+
+func NewCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Print build information",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return write(cmd.OutOrStdout())
+		},
+	}
+}
+
+func write(w io.Writer) error {
+	version := Version
+	if info, ok := debug.ReadBuildInfo(); ok && version == "dev" &&
+		info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+
+	_, err := fmt.Fprintf(w, "version: %s\ncommit: %s\ndate: %s\ngo: %s %s/%s\n",
+		version, Commit, Date, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+
+	return err
+}
@@ -3,10 +3,24 @@ module github.com/alexandear/websocket-pubsub
 go 1.15
 
 require (
+	github.com/fxamacker/cbor/v2 v2.3.0
 	github.com/golang/mock v1.3.1
 	github.com/golangci/golangci-lint v1.36.0
+	github.com/gomodule/redigo v1.8.9
 	github.com/google/uuid v1.2.0
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
+	github.com/peterh/liner v1.2.1
+	github.com/prometheus/client_golang v1.9.0
+	github.com/spf13/cobra v1.1.1
 	github.com/spf13/pflag v1.0.5
+	github.com/stretchr/testify v1.7.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	go.opentelemetry.io/otel v1.2.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.2.0
+	go.opentelemetry.io/otel/sdk v1.2.0
+	go.opentelemetry.io/otel/trace v1.2.0
+	go.uber.org/zap v1.16.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,18 @@
+// Package bridge exchanges messages published to topics with external messaging systems.
+package bridge
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotMapped is returned when publishing to a topic which is not mapped to the external system.
+var ErrNotMapped = errors.New("topic is not mapped")
+
+type Bridge interface {
+	// Publish sends data published by a client to topic out of the server.
+	Publish(topic string, data []byte) error
+	// Run delivers external messages with topics they are mapped to until ctx is done.
+	// Handle is called from a single goroutine.
+	Run(ctx context.Context, handle func(topic string, data []byte)) error
+}
@@ -0,0 +1,128 @@
+package bridge_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/bridge"
+	"github.com/alexandear/websocket-pubsub/internal/bridge/natstest"
+)
+
+type delivery struct {
+	topic string
+	data  string
+}
+
+func TestNATS(t *testing.T) {
+	srv := natstest.NewServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := bridge.NewNATS(zap.NewNop(), srv.URL(), map[string]string{"orders.created": "orders"},
+		bridge.WithName("node-0"))
+
+	received := make(chan delivery, 10)
+
+	go func() {
+		_ = b.Run(ctx, func(topic string, data []byte) { received <- delivery{topic: topic, data: string(data)} })
+	}()
+
+	require.Eventually(t, b.Connected, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, srv.NumSubscriptions("orders.created"))
+
+	t.Run("subject is delivered to topic", func(t *testing.T) {
+		srv.Publish(natstest.Msg{Subject: "orders.created", Data: []byte(`{"id":1}`)})
+
+		assert.Equal(t, delivery{topic: "orders", data: `{"id":1}`}, receive(t, received))
+	})
+
+	t.Run("message published by a server is not delivered back", func(t *testing.T) {
+		srv.Publish(natstest.Msg{
+			Subject: "orders.created",
+			Header:  "NATS/1.0\r\n" + bridge.OriginHeader + ": node-1\r\n\r\n",
+			Data:    []byte(`{"id":2}`),
+		})
+		srv.Publish(natstest.Msg{Subject: "orders.created", Header: "NATS/1.0\r\nX: y\r\n\r\n", Data: []byte(`{"id":3}`)})
+
+		assert.Equal(t, delivery{topic: "orders", data: `{"id":3}`}, receive(t, received))
+	})
+
+	t.Run("topic is published to subject", func(t *testing.T) {
+		require.NoError(t, b.Publish("orders", []byte(`{"id":4}`)))
+		assert.ErrorIs(t, b.Publish("news", []byte(`{"id":5}`)), bridge.ErrNotMapped)
+
+		assert.Eventually(t, func() bool { return len(srv.Published()) == 1 }, time.Second, 10*time.Millisecond)
+		assert.Equal(t, natstest.Msg{
+			Subject: "orders.created",
+			Header:  "NATS/1.0\r\n" + bridge.OriginHeader + ": node-0\r\n\r\n",
+			Data:    []byte(`{"id":4}`),
+		}, srv.Published()[0])
+
+		select {
+		case d := <-received:
+			t.Fatalf("own message is delivered back: %+v", d)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestNATS_Disconnect(t *testing.T) {
+	srv := natstest.NewServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := bridge.NewNATS(zap.NewNop(), srv.URL(), map[string]string{"orders.created": "orders"},
+		bridge.WithReconnectInterval(10*time.Millisecond))
+
+	assert.Error(t, b.Publish("orders", []byte(`1`)), "not connected")
+
+	go func() {
+		_ = b.Run(ctx, func(string, []byte) {})
+	}()
+
+	require.Eventually(t, b.Connected, time.Second, 10*time.Millisecond)
+
+	srv.Close()
+	assert.Eventually(t, func() bool { return !b.Connected() }, time.Second, 10*time.Millisecond)
+}
+
+func TestNATS_whenMessageExceedsMaxPayload(t *testing.T) {
+	srv := natstest.NewServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := bridge.NewNATS(zap.NewNop(), srv.URL(), map[string]string{"orders.created": "orders"},
+		bridge.WithReconnectInterval(time.Hour))
+
+	go func() {
+		_ = b.Run(ctx, func(string, []byte) {})
+	}()
+
+	require.Eventually(t, b.Connected, time.Second, 10*time.Millisecond)
+
+	// The payload is never sent, the size alone must drop the connection.
+	srv.Write(fmt.Sprintf("MSG orders.created orders.created %d\r\n", natstest.MaxPayload+1))
+	assert.Eventually(t, func() bool { return !b.Connected() }, time.Second, 10*time.Millisecond)
+}
+
+func receive(t *testing.T, received <-chan delivery) delivery {
+	t.Helper()
+
+	select {
+	case d := <-received:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("message is not delivered")
+
+		return delivery{}
+	}
+}
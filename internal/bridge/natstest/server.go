@@ -0,0 +1,276 @@
+// Package natstest runs an in-process server speaking enough of the NATS client protocol for the bridge.
+package natstest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// MaxPayload is the largest message size announced to clients.
+const MaxPayload = 1048576
+
+var info = fmt.Sprintf(`INFO {"server_id":"natstest","version":"2.10.0","proto":1,"headers":true,"max_payload":%d}`,
+	MaxPayload) + "\r\n"
+
+// Msg is a message published by a client of the server.
+type Msg struct {
+	Subject string
+	// Header is the raw header block, empty for messages without headers.
+	Header string
+	Data   []byte
+}
+
+// Server supports CONNECT, PING, PONG, SUB, UNSUB, PUB and HPUB with exact subjects.
+type Server struct {
+	listener net.Listener
+
+	mu        sync.Mutex
+	conns     map[*conn]struct{}
+	published []Msg
+}
+
+type conn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	w    *bufio.Writer
+	echo bool
+	// Subscription IDs by subject.
+	subs map[string][]string
+}
+
+// NewServer starts server on a random local port, it is closed at the end of the test.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	s := &Server{listener: l, conns: make(map[*conn]struct{})}
+
+	go s.serve()
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// URL returns nats:// URL to connect to the server.
+func (s *Server) URL() string {
+	return "nats://" + s.listener.Addr().String()
+}
+
+// Close stops accepting and drops connections of all clients.
+func (s *Server) Close() {
+	_ = s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+// NumSubscriptions returns number of subscriptions to subject.
+func (s *Server) NumSubscriptions(subject string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+
+	for c := range s.conns {
+		n += len(c.subs[subject])
+	}
+
+	return n
+}
+
+// Published returns messages published by clients so far.
+func (s *Server) Published() []Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Msg(nil), s.published...)
+}
+
+// Write sends raw protocol data to all clients, e.g. malformed messages.
+func (s *Server) Write(data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.write(data)
+	}
+}
+
+// Publish delivers message to subscribers as if it was published by another client.
+func (s *Server) Publish(msg Msg) {
+	s.deliver(nil, msg)
+}
+
+func (s *Server) serve() {
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &conn{Conn: nc, w: bufio.NewWriter(nc), echo: true, subs: make(map[string][]string)}
+
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c *conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+
+		_ = c.Close()
+	}()
+
+	c.write(info)
+
+	r := bufio.NewReader(c)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		op, args := strings.TrimRight(line, "\r\n"), ""
+		if i := strings.IndexByte(op, ' '); i >= 0 {
+			op, args = op[:i], op[i+1:]
+		}
+
+		if err := s.exec(c, r, strings.ToUpper(op), args); err != nil {
+			c.write(fmt.Sprintf("-ERR '%s'\r\n", err))
+
+			return
+		}
+	}
+}
+
+func (s *Server) exec(c *conn, r *bufio.Reader, op, args string) error {
+	fields := strings.Fields(args)
+
+	switch {
+	case op == "CONNECT":
+		var opts struct {
+			Echo *bool `json:"echo"`
+		}
+
+		if err := json.Unmarshal([]byte(args), &opts); err != nil {
+			return fmt.Errorf("invalid connect: %w", err)
+		}
+
+		s.mu.Lock()
+		c.echo = opts.Echo == nil || *opts.Echo
+		s.mu.Unlock()
+	case op == "PING":
+		c.write("PONG\r\n")
+	case op == "PONG":
+	case op == "SUB" && (len(fields) == 2 || len(fields) == 3):
+		s.mu.Lock()
+		c.subs[fields[0]] = append(c.subs[fields[0]], fields[len(fields)-1])
+		s.mu.Unlock()
+	case op == "UNSUB" && len(fields) >= 1:
+		s.mu.Lock()
+		for subject, sids := range c.subs {
+			for i, sid := range sids {
+				if sid == fields[0] {
+					c.subs[subject] = append(sids[:i], sids[i+1:]...)
+
+					break
+				}
+			}
+		}
+		s.mu.Unlock()
+	case op == "PUB" && (len(fields) == 2 || len(fields) == 3):
+		data, err := readPayload(r, fields[len(fields)-1])
+		if err != nil {
+			return err
+		}
+
+		s.deliver(c, Msg{Subject: fields[0], Data: data})
+	case op == "HPUB" && (len(fields) == 3 || len(fields) == 4):
+		payload, err := readPayload(r, fields[len(fields)-1])
+		if err != nil {
+			return err
+		}
+
+		headerSize, err := strconv.Atoi(fields[len(fields)-2])
+		if err != nil || headerSize > len(payload) {
+			return fmt.Errorf("invalid header size %q", fields[len(fields)-2])
+		}
+
+		s.deliver(c, Msg{Subject: fields[0], Header: string(payload[:headerSize]), Data: payload[headerSize:]})
+	default:
+		return fmt.Errorf("unknown protocol operation %q", op)
+	}
+
+	return nil
+}
+
+// deliver sends msg to subscribers, skipping publisher when it disabled echo. Nil publisher is the test.
+func (s *Server) deliver(publisher *conn, msg Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if publisher != nil {
+		s.published = append(s.published, msg)
+	}
+
+	for c := range s.conns {
+		if c == publisher && !c.echo {
+			continue
+		}
+
+		for _, sid := range c.subs[msg.Subject] {
+			if msg.Header == "" {
+				c.write(fmt.Sprintf("MSG %s %s %d\r\n%s\r\n", msg.Subject, sid, len(msg.Data), msg.Data))
+			} else {
+				c.write(fmt.Sprintf("HMSG %s %s %d %d\r\n%s%s\r\n", msg.Subject, sid, len(msg.Header),
+					len(msg.Header)+len(msg.Data), msg.Header, msg.Data))
+			}
+		}
+	}
+}
+
+func (c *conn) write(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, _ = c.w.WriteString(s)
+	_ = c.w.Flush()
+}
+
+func readPayload(r *bufio.Reader, size string) ([]byte, error) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid size %q", size)
+	}
+
+	buf := make([]byte, n+len("\r\n"))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
@@ -0,0 +1,43 @@
+// Package broker relays messages between server nodes of a cluster, so that messages published on one node
+// reach subscribers on other nodes.
+package broker
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+// Kinds of messages.
+const (
+	// KindPublish carries a message published to a topic.
+	KindPublish = "publish"
+	// KindConnections reports number of connections of the node.
+	KindConnections = "connections"
+)
+
+// Message is relayed from one node to all others.
+type Message struct {
+	Kind string `json:"kind"`
+	// Node is ID of the origin node, set by the broker.
+	Node string `json:"node"`
+
+	Topic string          `json:"topic,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	// Raw is the payload as published by a client of a protocol without JSON.
+	Raw         []byte `json:"raw,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// SentAt is Unix time in nanoseconds when the publisher sent the message.
+	SentAt       int64                  `json:"sent_at,omitempty"`
+	TraceContext operation.TraceContext `json:"trace_context,omitempty"`
+
+	Connections int `json:"connections,omitempty"`
+}
+
+type Broker interface {
+	// Publish sends msg to other nodes. Delivery is at most once, messages may be dropped while peers are unreachable.
+	Publish(msg Message) error
+	// Run delivers messages of other nodes to handle until ctx is done. Handle is called from a single goroutine.
+	Run(ctx context.Context, handle func(Message)) error
+}
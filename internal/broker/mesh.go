@@ -0,0 +1,331 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultReconnectInterval = time.Second
+	defaultSendSize          = 1024
+
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+var errPeerClosed = errors.New("peer closed connection")
+
+// Mesh connects nodes of a cluster over TCP. Every node dials all peers of a static list and sends its messages
+// as JSON lines over the dialed connections, so every message travels a single hop and is never forwarded.
+// The peer list may include the node itself, its own messages are skipped. Links are not authenticated,
+// connections from addresses other than the peers are rejected, so the listen port must not be exposed outside
+// the cluster network.
+type Mesh struct {
+	node     string
+	listener net.Listener
+	peers    []string
+	logger   *zap.Logger
+
+	reconnectInterval time.Duration
+	// sendSize is how many messages are queued per peer before dropping.
+	sendSize int
+
+	mu sync.Mutex
+	// links are connected peers by address.
+	links map[string]chan []byte
+}
+
+type MeshOption func(m *Mesh)
+
+// WithReconnectInterval sets how long to wait before dialing a peer again after the link failed.
+func WithReconnectInterval(interval time.Duration) MeshOption {
+	return func(m *Mesh) {
+		m.reconnectInterval = interval
+	}
+}
+
+// WithSendSize sets how many messages are queued per peer before dropping.
+func WithSendSize(size int) MeshOption {
+	return func(m *Mesh) {
+		m.sendSize = size
+	}
+}
+
+// NewMesh creates mesh node which accepts peers on listener and dials peers.
+func NewMesh(logger *zap.Logger, node string, listener net.Listener, peers []string, opts ...MeshOption) *Mesh {
+	m := &Mesh{
+		node:              node,
+		listener:          listener,
+		peers:             peers,
+		logger:            logger.With(zap.String("node", node)),
+		reconnectInterval: defaultReconnectInterval,
+		sendSize:          defaultSendSize,
+		links:             make(map[string]chan []byte, len(peers)),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// Connected returns number of peers the node is connected to.
+func (m *Mesh) Connected() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.links)
+}
+
+func (m *Mesh) Publish(msg Message) error {
+	msg.Node = m.node
+
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		return fmt.Errorf("marshal %s message failed: %w", msg.Kind, err)
+	}
+
+	data = append(data, '\n')
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for addr, send := range m.links {
+		select {
+		case send <- data:
+		default:
+			m.logger.Warn("peer send queue is full, message dropped", zap.String("peer", addr))
+		}
+	}
+
+	return nil
+}
+
+// Run serves peers until ctx is done, the listener is closed when Run returns.
+func (m *Mesh) Run(ctx context.Context, handle func(Message)) error {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+
+	defer wg.Wait()
+	defer cancel()
+
+	received := make(chan Message, m.sendSize)
+	errc := make(chan error, 1)
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		if err := m.accept(ctx, &wg, received); err != nil {
+			errc <- err
+		}
+	}()
+
+	for _, addr := range m.peers {
+		wg.Add(1)
+
+		go func(addr string) {
+			defer wg.Done()
+			m.connect(ctx, addr)
+		}(addr)
+	}
+
+	for {
+		select {
+		case msg := <-received:
+			handle(msg)
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (m *Mesh) accept(ctx context.Context, wg *sync.WaitGroup, received chan<- Message) error {
+	go func() {
+		<-ctx.Done()
+		_ = m.listener.Close()
+	}()
+
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("accept failed: %w", err)
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			m.receive(ctx, conn, received)
+		}()
+	}
+}
+
+// receive reads messages of a peer which dialed this node.
+func (m *Mesh) receive(ctx context.Context, conn net.Conn, received chan<- Message) {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+
+		_ = conn.Close()
+	}()
+
+	if !m.isPeer(ctx, conn.RemoteAddr()) {
+		m.logger.Warn("connection from unknown address rejected", zap.String("addr", conn.RemoteAddr().String()))
+
+		return
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+
+	for {
+		var msg Message
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.EOF) {
+				m.logger.Warn("receive from peer failed", zap.String("peer", conn.RemoteAddr().String()), zap.Error(err))
+			}
+
+			return
+		}
+
+		if msg.Node == m.node {
+			continue
+		}
+
+		select {
+		case received <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// isPeer reports whether addr has IP of a peer. Peer hosts are resolved on every call, so that peers which
+// changed address are accepted.
+func (m *Mesh) isPeer(ctx context.Context, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, peer := range m.peers {
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			continue
+		}
+
+		// Peers without host are dialed on the local system.
+		if host == "" {
+			if tcpAddr.IP.IsLoopback() {
+				return true
+			}
+
+			continue
+		}
+
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			m.logger.Debug("resolve peer failed", zap.String("peer", peer), zap.Error(err))
+
+			continue
+		}
+
+		for _, ip := range ips {
+			if ip.IP.Equal(tcpAddr.IP) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// connect keeps link to the peer, dialing it again after the link failed.
+func (m *Mesh) connect(ctx context.Context, addr string) {
+	for {
+		if err := m.link(ctx, addr); err != nil {
+			m.logger.Debug("peer link failed", zap.String("peer", addr), zap.Error(err))
+		}
+
+		select {
+		case <-time.After(m.reconnectInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// link sends messages to the peer until the connection fails or ctx is done.
+func (m *Mesh) link(ctx context.Context, addr string) error {
+	dialer := net.Dialer{Timeout: dialTimeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("dial failed: %w", err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	send := make(chan []byte, m.sendSize)
+
+	m.mu.Lock()
+	m.links[addr] = send
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.links, addr)
+		m.mu.Unlock()
+	}()
+
+	m.logger.Info("peer connected", zap.String("peer", addr))
+
+	// Peers never write to dialed connections, reading detects that the peer closed it.
+	closed := make(chan struct{})
+
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case data := <-send:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+			if _, err := conn.Write(data); err != nil {
+				return fmt.Errorf("write failed: %w", err)
+			}
+		case <-closed:
+			return errPeerClosed
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
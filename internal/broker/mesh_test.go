@@ -0,0 +1,183 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/broker"
+)
+
+func TestMesh(t *testing.T) {
+	const numNodes = 3
+
+	listeners := make([]net.Listener, numNodes)
+	peers := make([]string, numNodes)
+
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		listeners[i] = l
+		peers[i] = l.Addr().String()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type delivery struct {
+		node int
+		msg  broker.Message
+	}
+
+	received := make(chan delivery, numNodes*numNodes)
+	meshes := make([]*broker.Mesh, numNodes)
+
+	var wg sync.WaitGroup
+
+	for i := range meshes {
+		// The peer list is the same on every node, nodes skip their own messages.
+		meshes[i] = broker.NewMesh(zap.NewNop(), fmt.Sprintf("node-%d", i), listeners[i], peers,
+			broker.WithReconnectInterval(10*time.Millisecond))
+
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			err := meshes[i].Run(ctx, func(msg broker.Message) {
+				received <- delivery{node: i, msg: msg}
+			})
+			assert.NoError(t, err)
+		}(i)
+	}
+
+	assert.Eventually(t, func() bool {
+		for _, m := range meshes {
+			if m.Connected() != numNodes {
+				return false
+			}
+		}
+
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, meshes[0].Publish(broker.Message{
+		Kind: broker.KindPublish, Topic: "news", Data: json.RawMessage(`{"a":1}`), SentAt: 42,
+	}))
+
+	got := map[int]broker.Message{}
+	for len(got) < numNodes-1 {
+		select {
+		case d := <-received:
+			assert.NotContains(t, got, d.node, "message is delivered once")
+			got[d.node] = d.msg
+		case <-time.After(time.Second):
+			t.Fatal("message is not delivered to all peers")
+		}
+	}
+
+	assert.NotContains(t, got, 0, "own message is skipped")
+
+	for _, msg := range got {
+		assert.Equal(t, broker.Message{
+			Kind: broker.KindPublish, Node: "node-0", Topic: "news", Data: json.RawMessage(`{"a":1}`), SentAt: 42,
+		}, msg)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestMesh_Reconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := l.Addr().String()
+	// The peer is not listening yet.
+	require.NoError(t, l.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	self, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	m := broker.NewMesh(zap.NewNop(), "node-0", self, []string{addr}, broker.WithReconnectInterval(10*time.Millisecond))
+
+	go func() {
+		_ = m.Run(ctx, func(broker.Message) {})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, m.Connected())
+
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+
+	conns := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conns <- conn
+		}
+	}()
+
+	assert.Eventually(t, func() bool { return m.Connected() == 1 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, m.Publish(broker.Message{Kind: broker.KindConnections, Connections: 3}))
+
+	conn := <-conns
+	var msg broker.Message
+	require.NoError(t, json.NewDecoder(conn).Decode(&msg))
+	assert.Equal(t, broker.Message{Kind: broker.KindConnections, Node: "node-0", Connections: 3}, msg)
+
+	require.NoError(t, conn.Close())
+	require.NoError(t, l.Close())
+
+	assert.Eventually(t, func() bool { return m.Connected() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestMesh_rejectsUnknownAddress(t *testing.T) {
+	self, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan broker.Message, 1)
+	// The only peer is in a documentation network, so loopback connections are not from a peer.
+	m := broker.NewMesh(zap.NewNop(), "node-0", self, []string{"192.0.2.1:7000"})
+
+	go func() {
+		_ = m.Run(ctx, func(msg broker.Message) { received <- msg })
+	}()
+
+	conn, err := net.Dial("tcp", self.Addr().String())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	require.NoError(t, json.NewEncoder(conn).Encode(broker.Message{Kind: broker.KindPublish, Node: "node-1",
+		Topic: "news", Data: json.RawMessage(`1`)}))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "connection is closed")
+
+	select {
+	case msg := <-received:
+		assert.Fail(t, "message of unknown address is handled", "%+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
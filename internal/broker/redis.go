@@ -0,0 +1,239 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultRedisChannel = "pubsub"
+
+	redisMaxIdle     = 4
+	redisMaxActive   = 4
+	redisIdleTimeout = time.Minute
+	redisReadTimeout = 10 * time.Second
+
+	defaultRedisHealthCheckInterval = 10 * time.Second
+)
+
+// Redis relays messages of all nodes through a single Redis pub/sub channel.
+// Messages are published from a queue, so that a stalled Redis does not block publishers.
+type Redis struct {
+	node    string
+	channel string
+	url     string
+	pool    *redis.Pool
+	logger  *zap.Logger
+
+	reconnectInterval time.Duration
+	// healthCheckInterval is how often the subscription connection is pinged.
+	healthCheckInterval time.Duration
+	// sendSize is how many messages are queued before dropping.
+	sendSize int
+	send     chan []byte
+}
+
+type RedisOption func(r *Redis)
+
+// WithChannel sets Redis channel shared by nodes of the cluster.
+func WithChannel(channel string) RedisOption {
+	return func(r *Redis) {
+		r.channel = channel
+	}
+}
+
+// WithRedisReconnectInterval sets how long to wait before subscribing again after the connection failed.
+func WithRedisReconnectInterval(interval time.Duration) RedisOption {
+	return func(r *Redis) {
+		r.reconnectInterval = interval
+	}
+}
+
+// WithRedisHealthCheckInterval sets how often the subscription connection is pinged. The subscription is renewed
+// when nothing is received for two intervals, so that a silently dropped connection is noticed.
+func WithRedisHealthCheckInterval(interval time.Duration) RedisOption {
+	return func(r *Redis) {
+		r.healthCheckInterval = interval
+	}
+}
+
+// WithRedisSendSize sets how many messages are queued before dropping.
+func WithRedisSendSize(size int) RedisOption {
+	return func(r *Redis) {
+		r.sendSize = size
+	}
+}
+
+// NewRedis creates node which connects to Redis at url, e.g. redis://:password@localhost:6379/0.
+func NewRedis(logger *zap.Logger, node, url string, opts ...RedisOption) *Redis {
+	r := &Redis{
+		node:                node,
+		channel:             DefaultRedisChannel,
+		url:                 url,
+		logger:              logger.With(zap.String("node", node)),
+		reconnectInterval:   defaultReconnectInterval,
+		healthCheckInterval: defaultRedisHealthCheckInterval,
+		sendSize:            defaultSendSize,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	r.send = make(chan []byte, r.sendSize)
+	r.pool = &redis.Pool{
+		MaxIdle:     redisMaxIdle,
+		MaxActive:   redisMaxActive,
+		Wait:        true,
+		IdleTimeout: redisIdleTimeout,
+		Dial: func() (redis.Conn, error) {
+			return r.dial(redis.DialReadTimeout(redisReadTimeout))
+		},
+	}
+
+	return r
+}
+
+func (r *Redis) dial(opts ...redis.DialOption) (redis.Conn, error) {
+	opts = append(opts, redis.DialConnectTimeout(dialTimeout), redis.DialWriteTimeout(writeTimeout))
+
+	conn, err := redis.DialURL(r.url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("dial redis failed: %w", err)
+	}
+
+	return conn, nil
+}
+
+// Publish queues msg, it is published while Run runs.
+func (r *Redis) Publish(msg Message) error {
+	msg.Node = r.node
+
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		return fmt.Errorf("marshal %s message failed: %w", msg.Kind, err)
+	}
+
+	select {
+	case r.send <- data:
+	default:
+		r.logger.Warn("redis send queue is full, message dropped")
+	}
+
+	return nil
+}
+
+// Run publishes queued messages and subscribes to the channel until ctx is done,
+// subscribing again after the connection failed.
+func (r *Redis) Run(ctx context.Context, handle func(Message)) error {
+	defer r.pool.Close()
+
+	go r.publish(ctx)
+
+	for {
+		if err := r.subscribe(ctx, handle); err != nil {
+			r.logger.Warn("redis subscription failed", zap.Error(err))
+		}
+
+		select {
+		case <-time.After(r.reconnectInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// publish sends queued messages to the channel until ctx is done.
+func (r *Redis) publish(ctx context.Context) {
+	for {
+		select {
+		case data := <-r.send:
+			conn := r.pool.Get()
+			if _, err := conn.Do("PUBLISH", r.channel, data); err != nil {
+				r.logger.Warn("redis publish failed", zap.Error(err))
+			}
+
+			_ = conn.Close()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Redis) subscribe(ctx context.Context, handle func(Message)) error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// Closing the connection unblocks Receive.
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+
+		_ = conn.Close()
+	}()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(r.channel); err != nil {
+		return fmt.Errorf("redis subscribe failed: %w", err)
+	}
+
+	go r.healthCheck(psc, done)
+
+	for {
+		// Redis answers pings, so silence for two intervals means the connection is lost.
+		switch v := psc.ReceiveWithTimeout(2 * r.healthCheckInterval).(type) {
+		case redis.Message:
+			var msg Message
+			if err := json.Unmarshal(v.Data, &msg); err != nil {
+				r.logger.Warn("unmarshal redis message failed", zap.Error(err))
+
+				continue
+			}
+
+			if msg.Node != r.node {
+				handle(msg)
+			}
+		case redis.Subscription:
+			r.logger.Info("redis subscription", zap.String("kind", v.Kind), zap.String("channel", v.Channel))
+		case redis.Pong:
+		case error:
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("redis receive failed: %w", v)
+		}
+	}
+}
+
+// healthCheck pings the subscription connection every health check interval until done is closed.
+func (r *Redis) healthCheck(psc redis.PubSubConn, done <-chan struct{}) {
+	ticker := time.NewTicker(r.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// A failed ping leaves the receive loop to time out.
+			if err := psc.Ping(""); err != nil {
+				r.logger.Debug("redis ping failed", zap.Error(err))
+
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
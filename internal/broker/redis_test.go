@@ -0,0 +1,208 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/broker"
+	"github.com/alexandear/websocket-pubsub/internal/broker/redistest"
+)
+
+func TestRedis(t *testing.T) {
+	const numNodes = 3
+
+	srv := redistest.NewServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type delivery struct {
+		node int
+		msg  broker.Message
+	}
+
+	received := make(chan delivery, numNodes*numNodes)
+	nodes := make([]*broker.Redis, numNodes)
+
+	var wg sync.WaitGroup
+
+	for i := range nodes {
+		nodes[i] = broker.NewRedis(zap.NewNop(), fmt.Sprintf("node-%d", i), srv.URL(), broker.WithChannel("cluster"))
+
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			err := nodes[i].Run(ctx, func(msg broker.Message) {
+				received <- delivery{node: i, msg: msg}
+			})
+			assert.NoError(t, err)
+		}(i)
+	}
+
+	assert.Eventually(t, func() bool { return srv.NumSubscribers("cluster") == numNodes }, time.Second,
+		10*time.Millisecond)
+
+	require.NoError(t, nodes[0].Publish(broker.Message{
+		Kind: broker.KindPublish, Topic: "news", Data: json.RawMessage(`{"a":1}`), SentAt: 42,
+	}))
+
+	got := map[int]broker.Message{}
+	for len(got) < numNodes-1 {
+		select {
+		case d := <-received:
+			assert.NotContains(t, got, d.node, "message is delivered once")
+			got[d.node] = d.msg
+		case <-time.After(time.Second):
+			t.Fatal("message is not delivered to all nodes")
+		}
+	}
+
+	assert.NotContains(t, got, 0, "own message is skipped")
+
+	for _, msg := range got {
+		assert.Equal(t, broker.Message{
+			Kind: broker.KindPublish, Node: "node-0", Topic: "news", Data: json.RawMessage(`{"a":1}`), SentAt: 42,
+		}, msg)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestRedis_Resubscribe(t *testing.T) {
+	srv := redistest.NewServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan broker.Message, 1)
+	r := broker.NewRedis(zap.NewNop(), "node-0", srv.URL(), broker.WithRedisReconnectInterval(10*time.Millisecond))
+
+	go func() {
+		_ = r.Run(ctx, func(msg broker.Message) { received <- msg })
+	}()
+
+	assert.Eventually(t, func() bool { return srv.NumSubscribers(broker.DefaultRedisChannel) == 1 }, time.Second,
+		10*time.Millisecond)
+
+	// Drop the subscription connection, the node subscribes again.
+	srv.Close()
+	srv = redistest.NewServerAt(t, srv.Addr())
+
+	assert.Eventually(t, func() bool { return srv.NumSubscribers(broker.DefaultRedisChannel) == 1 }, time.Second,
+		10*time.Millisecond)
+
+	other := broker.NewRedis(zap.NewNop(), "node-1", srv.URL())
+
+	go func() {
+		_ = other.Run(ctx, func(broker.Message) {})
+	}()
+
+	require.NoError(t, other.Publish(broker.Message{Kind: broker.KindConnections, Connections: 3}))
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, broker.Message{Kind: broker.KindConnections, Node: "node-1", Connections: 3}, msg)
+	case <-time.After(time.Second):
+		t.Fatal("message is not delivered after resubscribe")
+	}
+}
+
+func TestRedis_ResubscribeWhenSilent(t *testing.T) {
+	srv := redistest.NewServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan broker.Message, 1)
+	r := broker.NewRedis(zap.NewNop(), "node-0", srv.URL(), broker.WithRedisReconnectInterval(10*time.Millisecond),
+		broker.WithRedisHealthCheckInterval(20*time.Millisecond))
+
+	go func() {
+		_ = r.Run(ctx, func(msg broker.Message) {
+			select {
+			case received <- msg:
+			default:
+			}
+		})
+	}()
+
+	assert.Eventually(t, func() bool { return srv.NumSubscribers(broker.DefaultRedisChannel) == 1 }, time.Second,
+		10*time.Millisecond)
+
+	// The subscription connection stays open and receives nothing, the node notices it by unanswered pings.
+	srv.Stall()
+
+	other := broker.NewRedis(zap.NewNop(), "node-1", srv.URL())
+
+	go func() {
+		_ = other.Run(ctx, func(broker.Message) {})
+	}()
+
+	// Messages published before the node subscribes again are lost.
+	assert.Eventually(t, func() bool {
+		assert.NoError(t, other.Publish(broker.Message{Kind: broker.KindConnections, Connections: 3}))
+
+		select {
+		case msg := <-received:
+			return assert.Equal(t, broker.Message{Kind: broker.KindConnections, Node: "node-1", Connections: 3}, msg)
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, time.Second, 20*time.Millisecond, "message is delivered after resubscribe")
+}
+
+func TestRedis_PublishWhenStalled(t *testing.T) {
+	// Redis which accepts connections and never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := broker.NewRedis(zap.NewNop(), "node-0", "redis://"+l.Addr().String(), broker.WithRedisSendSize(1))
+
+	go func() {
+		_ = r.Run(ctx, func(broker.Message) {})
+	}()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, r.Publish(broker.Message{Kind: broker.KindConnections, Connections: i}))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocks while redis is stalled")
+	}
+}
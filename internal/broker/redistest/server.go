@@ -0,0 +1,290 @@
+// Package redistest runs an in-process server speaking enough of RESP for Redis pub/sub.
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Server supports PING, PUBLISH, SUBSCRIBE and UNSUBSCRIBE commands.
+type Server struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	conns       map[*conn]struct{}
+	subscribers map[string]map[*conn]struct{}
+}
+
+type conn struct {
+	net.Conn
+
+	mu sync.Mutex
+	w  *bufio.Writer
+	// stalled drops replies, guarded by mu.
+	stalled bool
+}
+
+// NewServer starts server on a random local port, it is closed at the end of the test.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	return NewServerAt(t, "127.0.0.1:0")
+}
+
+// NewServerAt starts server listening on addr, it is closed at the end of the test.
+func NewServerAt(t testing.TB, addr string) *Server {
+	t.Helper()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	s := &Server{
+		listener:    l,
+		conns:       make(map[*conn]struct{}),
+		subscribers: make(map[string]map[*conn]struct{}),
+	}
+
+	go s.serve()
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Addr returns address the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// URL returns redis:// URL to connect to the server.
+func (s *Server) URL() string {
+	return "redis://" + s.Addr()
+}
+
+// Close stops accepting and drops connections of all clients.
+func (s *Server) Close() {
+	_ = s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+// Stall stops answering current connections without closing them, like a network failure nobody reports.
+func (s *Server) Stall() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.mu.Lock()
+		c.stalled = true
+		c.mu.Unlock()
+	}
+}
+
+// NumSubscribers returns number of connections subscribed to channel.
+func (s *Server) NumSubscribers(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.subscribers[channel])
+}
+
+func (s *Server) serve() {
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &conn{Conn: nc, w: bufio.NewWriter(nc)}
+
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c *conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+
+		for _, subs := range s.subscribers {
+			delete(subs, c)
+		}
+		s.mu.Unlock()
+
+		_ = c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		s.exec(c, args)
+	}
+}
+
+func (s *Server) exec(c *conn, args []string) {
+	switch cmd := strings.ToUpper(args[0]); {
+	case cmd == "PING" && s.subscribed(c):
+		// Subscribed connections receive pong as a push message.
+		data := ""
+		if len(args) > 1 {
+			data = args[1]
+		}
+
+		c.write("*2\r\n" + bulk("pong") + bulk(data))
+	case cmd == "PING":
+		c.write("+PONG\r\n")
+	case cmd == "PUBLISH" && len(args) == 3:
+		c.write(fmt.Sprintf(":%d\r\n", s.publish(args[1], args[2])))
+	case cmd == "SUBSCRIBE" || cmd == "UNSUBSCRIBE":
+		kind := strings.ToLower(cmd)
+
+		for _, channel := range args[1:] {
+			n := s.subscribe(c, channel, cmd == "SUBSCRIBE")
+			c.write("*3\r\n" + bulk(kind) + bulk(channel) + fmt.Sprintf(":%d\r\n", n))
+		}
+	default:
+		c.write(fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0]))
+	}
+}
+
+// subscribe adds or removes c from subscribers of channel and returns number of channels c is subscribed to.
+func (s *Server) subscribe(c *conn, channel string, add bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs, ok := s.subscribers[channel]
+	if !ok {
+		subs = make(map[*conn]struct{})
+		s.subscribers[channel] = subs
+	}
+
+	if add {
+		subs[c] = struct{}{}
+	} else {
+		delete(subs, c)
+	}
+
+	n := 0
+
+	for _, subs := range s.subscribers {
+		if _, ok := subs[c]; ok {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (s *Server) subscribed(c *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, subs := range s.subscribers {
+		if _, ok := subs[c]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) publish(channel, message string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.subscribers[channel] {
+		c.write("*3\r\n" + bulk("message") + bulk(channel) + bulk(message))
+	}
+
+	return len(s.subscribers[channel])
+}
+
+func (c *conn) write(reply string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stalled {
+		return
+	}
+
+	_, _ = c.w.WriteString(reply)
+	_ = c.w.Flush()
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads command sent as RESP array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readLength(r, '*')
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 1 {
+		return nil, errProtocol
+	}
+
+	args := make([]string, n)
+
+	for i := range args {
+		size, err := readLength(r, '$')
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func readLength(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) < 2 || line[0] != prefix {
+		return 0, errProtocol
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return 0, errProtocol
+	}
+
+	return n, nil
+}
@@ -2,85 +2,426 @@ package client
 
 import (
 	"context"
-	"log"
-	"math/rand"
+	"crypto/tls"
+	"fmt"
 	"sync"
 	"time"
 
 	gws "github.com/gorilla/websocket"
+	"go.uber.org/zap"
 
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
 	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
 )
 
-const pauseBetweenCommands = 2 * time.Second
+const (
+	defaultMaxConcurrentDials = 100
+	defaultPublishInterval    = time.Second
+)
 
+// App is a load generator: it ramps up connections, holds them while subscribers read
+// and publishers publish, then closes them and reports what happened.
 type App struct {
-	server string
+	server    string
+	tlsConfig *tls.Config
+	codec     codec.Codec
+	// Offer permessage-deflate to the server.
+	compression bool
+	logger      *zap.Logger
+
+	numClients int
+
+	// Connections dialed per second, zero dials all at once.
+	connectRate        float64
+	maxConcurrentDials int
+	hold               time.Duration
+
+	topic           string
+	publishRatio    float64
+	publishInterval time.Duration
+
+	// Latency is reported to onInterval every reportInterval, zero disables it.
+	reportInterval time.Duration
+	onInterval     func(LatencyInterval)
+
+	stats *stats
+}
+
+type Option func(a *App)
+
+// WithTLS dials wss:// using cfg.
+func WithTLS(cfg *tls.Config) Option {
+	return func(a *App) {
+		a.tlsConfig = cfg
+	}
+}
+
+// WithCodec negotiates protocol version and wire format cd with the server.
+func WithCodec(cd codec.Codec) Option {
+	return func(a *App) {
+		a.codec = cd
+	}
+}
+
+// WithCompression offers permessage-deflate to the server.
+func WithCompression() Option {
+	return func(a *App) {
+		a.compression = true
+	}
+}
+
+// WithConnectRate limits how many connections are dialed per second, zero dials all at once.
+func WithConnectRate(perSecond float64) Option {
+	return func(a *App) {
+		a.connectRate = perSecond
+	}
+}
+
+// WithMaxConcurrentDials limits how many dials may be in progress at once.
+func WithMaxConcurrentDials(n int) Option {
+	return func(a *App) {
+		a.maxConcurrentDials = n
+	}
+}
+
+// WithHold sets how long connections are kept open after all dials finished.
+func WithHold(hold time.Duration) Option {
+	return func(a *App) {
+		a.hold = hold
+	}
+}
+
+// WithTopic sets topic which subscribers subscribe to and publishers publish to.
+func WithTopic(topic string) Option {
+	return func(a *App) {
+		a.topic = topic
+	}
+}
+
+// WithPublishRatio sets fraction of connections which publish instead of subscribing.
+func WithPublishRatio(ratio float64) Option {
+	return func(a *App) {
+		a.publishRatio = ratio
+	}
+}
+
+// WithPublishInterval sets how often every publisher publishes.
+func WithPublishInterval(interval time.Duration) Option {
+	return func(a *App) {
+		a.publishInterval = interval
+	}
+}
 
-	clients []*Client
+// WithReportInterval calls fn with latency of messages received during every interval.
+func WithReportInterval(interval time.Duration, fn func(LatencyInterval)) Option {
+	return func(a *App) {
+		a.reportInterval = interval
+		a.onInterval = fn
+	}
 }
 
-func NewApp(server string, numClients int) *App {
+func NewApp(logger *zap.Logger, server string, numClients int, opts ...Option) *App {
 	app := &App{
-		server:  server,
-		clients: make([]*Client, 0, numClients),
+		server:             server,
+		logger:             logger,
+		numClients:         numClients,
+		maxConcurrentDials: defaultMaxConcurrentDials,
+		topic:              operation.TopicBroadcast,
+		publishInterval:    defaultPublishInterval,
+		stats:              newStats(),
 	}
 
-	for i := 1; i <= numClients; i++ {
-		app.clients = append(app.clients, NewClient())
+	for _, opt := range opts {
+		opt(app)
 	}
 
 	return app
 }
 
-func (a *App) Run(ctx context.Context) {
-	wg := &sync.WaitGroup{}
+// Run dials clients at the connect rate, holds connections for the hold duration, closes them and returns report.
+// Cancelling ctx stops dialing and holding early.
+func (a *App) Run(ctx context.Context) Report {
+	start := time.Now()
+
+	holdCtx, cancelHold := context.WithCancel(ctx)
+	defer cancelHold()
+
+	var (
+		mu      sync.Mutex
+		clients = make([]*Client, 0, a.numClients)
+
+		dialWG sync.WaitGroup
+		workWG sync.WaitGroup
+	)
+
+	report := Report{Clients: a.numClients, Hold: a.hold}
+
+	stopIntervals := a.reportIntervals(start)
+	dialSlots := make(chan struct{}, a.maxConcurrentDials)
+
+	var tick <-chan time.Time
 
-	for i, client := range a.clients {
-		i := i
-		client := client
+	if a.connectRate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / a.connectRate))
+		defer ticker.Stop()
 
-		wg.Add(1)
+		tick = ticker.C
+	}
+
+dial:
+	for i := 0; i < a.numClients; i++ {
+		if i > 0 && tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break dial
+			}
+		}
+
+		select {
+		case dialSlots <- struct{}{}:
+		case <-ctx.Done():
+			break dial
+		}
+
+		// Both cases above may be ready, prefer stopping.
+		if ctx.Err() != nil {
+			break
+		}
+
+		publisher := a.isPublisher(i)
+		if publisher {
+			report.Publishers++
+		} else {
+			report.Subscribers++
+		}
+
+		dialWG.Add(1)
 
-		go func() {
-			defer wg.Done()
+		go func(i int) {
+			defer dialWG.Done()
+
+			log := a.logger.With(zap.Int("conn", i+1))
+
+			c, err := Dial(ctx, log, a.server, DialConfig{
+				TLS: a.tlsConfig, Codec: a.codec, Compression: a.compression,
+			})
+
+			<-dialSlots
 
-			conn, _, err := gws.DefaultDialer.DialContext(ctx, "ws://"+a.server+"/ws", nil)
 			if err != nil {
-				log.Printf("dial failed: %v", err)
+				log.Debug("dial failed", zap.Error(err))
+				a.stats.connectFailed(err)
+
+				return
+			}
+
+			a.stats.connected()
 
+			mu.Lock()
+			clients = append(clients, c)
+			mu.Unlock()
+
+			workWG.Add(1)
+
+			go func() {
+				defer workWG.Done()
+
+				if publisher {
+					a.publish(holdCtx, log, c, i)
+				} else {
+					a.subscribe(holdCtx, log, c)
+				}
+			}()
+		}(i)
+	}
+
+	dialWG.Wait()
+
+	report.ConnectDuration = time.Since(start)
+
+	a.logger.Info("dialing finished",
+		zap.Int("connected", a.stats.connectedTotal()),
+		zap.Duration("duration", report.ConnectDuration))
+
+	select {
+	case <-time.After(a.hold):
+	case <-ctx.Done():
+	}
+
+	cancelHold()
+
+	for _, c := range clients {
+		c.Close()
+	}
+
+	workWG.Wait()
+	stopIntervals()
+
+	a.stats.fill(&report)
+
+	return report
+}
+
+// reportIntervals reports latency every report interval until stop is called, stop reports the last interval.
+func (a *App) reportIntervals(start time.Time) (stop func()) {
+	if a.reportInterval <= 0 {
+		return func() {}
+	}
+
+	report := func() {
+		l := a.stats.takeInterval(time.Since(start))
+		if a.onInterval != nil {
+			a.onInterval(l)
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(a.reportInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-done:
 				return
 			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		report()
+	}
+}
+
+// isPublisher spreads publishers evenly among connections.
+func (a *App) isPublisher(i int) bool {
+	return int(float64(i+1)*a.publishRatio) > int(float64(i)*a.publishRatio)
+}
+
+func (a *App) subscribe(ctx context.Context, log *zap.Logger, c *Client) {
+	var err error
+	if a.topic == operation.TopicBroadcast {
+		err = c.Subscribe()
+	} else {
+		err = c.SubscribeTopic(a.topic)
+	}
+
+	if err != nil {
+		log.Debug("subscribe failed", zap.Error(err))
+		a.stats.disconnected()
+
+		return
+	}
+
+	for {
+		resp, err := c.ReadOne()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debug("read failed", zap.Error(err))
+				a.stats.disconnected()
+			}
+
+			return
+		}
 
-			client.SetConn(websocket.NewConn(conn))
+		a.stats.received(resp, time.Now())
+	}
+}
 
-			if err := client.Subscribe(); err != nil {
-				log.Printf("client %d fails to connect: %v", i, err)
+func (a *App) publish(ctx context.Context, log *zap.Logger, c *Client, i int) {
+	ticker := time.NewTicker(a.publishInterval)
+	defer ticker.Stop()
+
+	for seq := 1; ; seq++ {
+		data := []byte(fmt.Sprintf(`{"publisher":%d,"seq":%d}`, i+1, seq))
+		if err := c.PublishAt(a.topic, data, time.Now()); err != nil {
+			if ctx.Err() != nil {
+				return
 			}
-		}()
+
+			log.Debug("publish failed", zap.Error(err))
+			a.stats.publishFailed()
+			a.stats.disconnected()
+
+			return
+		}
+
+		a.stats.published()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DialConfig describes how Dial connects to the server.
+type DialConfig struct {
+	// TLS makes Dial use wss:// when set.
+	TLS *tls.Config
+	// Codec is negotiated as websocket subprotocol, nil speaks legacy JSON without negotiation.
+	Codec codec.Codec
+	// Compression offers permessage-deflate, requests are compressed when the server accepts it.
+	Compression bool
+}
+
+// Dial connects a single client to server.
+func Dial(ctx context.Context, logger *zap.Logger, server string, cfg DialConfig) (*Client, error) {
+	dialer := *gws.DefaultDialer
+	dialer.TLSClientConfig = cfg.TLS
+	dialer.EnableCompression = cfg.Compression
+
+	cd := cfg.Codec
+	if cd != nil && cd.Subprotocol() != "" {
+		dialer.Subprotocols = []string{cd.Subprotocol()}
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, url(server, cfg.TLS), nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial failed: %w", err)
 	}
 
-	wg.Wait()
+	if cd != nil && conn.Subprotocol() != cd.Subprotocol() {
+		_ = conn.Close()
 
-	for _, client := range a.clients {
-		go client.Read()
+		return nil, fmt.Errorf("%w: server does not support %s", ErrCodec, cd.Subprotocol())
 	}
 
-	if err := a.clients[rand.Intn(len(a.clients))].NumConnections(); err != nil {
-		log.Printf("num connections failed: %v", err)
+	wsConn := websocket.NewConn(conn)
+
+	if cfg.Compression && websocket.HasCompression(resp.Header) {
+		if err := wsConn.SetCompression(websocket.Compression{Level: websocket.DefaultCompressionLevel}); err != nil {
+			_ = conn.Close()
+
+			return nil, err
+		}
 	}
 
-	time.Sleep(pauseBetweenCommands)
+	client := NewClient(logger)
+	client.SetConn(wsConn)
 
-	if err := a.clients[rand.Intn(len(a.clients))].Unsubscribe(); err != nil {
-		log.Printf("unsubscribe failed: %v", err)
+	if cd != nil {
+		client.SetCodec(cd)
 	}
 
-	time.Sleep(pauseBetweenCommands)
+	return client, nil
+}
 
-	if err := a.clients[rand.Intn(len(a.clients))].NumConnections(); err != nil {
-		log.Printf("num connections failed: %v", err)
+func url(server string, tlsConfig *tls.Config) string {
+	if tlsConfig != nil {
+		return "wss://" + server + "/ws"
 	}
 
-	time.Sleep(pauseBetweenCommands)
+	return "ws://" + server + "/ws"
 }
@@ -0,0 +1,289 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/client"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/command"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+)
+
+// newServer replies to SUBSCRIBE with a single broadcast sent now and ignores other commands.
+func newServer(t *testing.T) string {
+	t.Helper()
+
+	upgrader := gws.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var req operation.ReqCommand
+			if err := json.Unmarshal(data, &req); err != nil || req.Command != command.Subscribe {
+				continue
+			}
+
+			resp := fmt.Sprintf(`{"client_id":"id","timestamp":1,"sent_at":%d}`, time.Now().UnixNano())
+			if err := conn.WriteMessage(gws.BinaryMessage, []byte(resp)); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestApp_Run(t *testing.T) {
+	t.Run("subscribers", func(t *testing.T) {
+		app := client.NewApp(zap.NewNop(), newServer(t), 5,
+			client.WithConnectRate(1000), client.WithMaxConcurrentDials(2), client.WithHold(100*time.Millisecond))
+
+		report := app.Run(context.Background())
+
+		assert.Equal(t, 5, report.Connected)
+		assert.Equal(t, 5, report.Subscribers)
+		assert.Equal(t, 0, report.Publishers)
+		assert.Equal(t, 1.0, report.ConnectSuccessRate())
+		assert.Equal(t, map[string]int{client.ReceivedBroadcast: 5}, report.Received)
+		assert.Empty(t, report.ConnectErrors)
+		assert.Zero(t, report.Disconnects)
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		var intervals []client.LatencyInterval
+		app := client.NewApp(zap.NewNop(), newServer(t), 5, client.WithHold(100*time.Millisecond),
+			client.WithReportInterval(time.Hour, func(l client.LatencyInterval) {
+				intervals = append(intervals, l)
+			}))
+
+		report := app.Run(context.Background())
+
+		assert.Equal(t, int64(5), report.Latency.Count)
+		assert.True(t, report.Latency.P50 > 0 && report.Latency.P50 <= report.Latency.Max)
+		assert.Less(t, int64(report.Latency.Max), int64(time.Second))
+		require.Len(t, intervals, 1, "the last interval is reported when the run ends")
+		assert.Equal(t, intervals, report.Intervals)
+		assert.Equal(t, report.Latency, intervals[0].LatencySummary)
+	})
+
+	t.Run("publishers", func(t *testing.T) {
+		app := client.NewApp(zap.NewNop(), newServer(t), 5, client.WithTopic("news"), client.WithPublishRatio(0.4),
+			client.WithPublishInterval(time.Hour), client.WithHold(100*time.Millisecond))
+
+		report := app.Run(context.Background())
+
+		assert.Equal(t, 5, report.Connected)
+		assert.Equal(t, 3, report.Subscribers)
+		assert.Equal(t, 2, report.Publishers)
+		assert.Equal(t, 2, report.Published)
+		assert.Zero(t, report.PublishErrors)
+	})
+
+	t.Run("when server is down", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := l.Addr().String()
+		require.NoError(t, l.Close())
+
+		app := client.NewApp(zap.NewNop(), addr, 3, client.WithHold(0))
+
+		report := app.Run(context.Background())
+
+		assert.Zero(t, report.Connected)
+		assert.Zero(t, report.ConnectSuccessRate())
+		assert.Equal(t, map[string]int{client.ErrKindRefused: 3}, report.ConnectErrors)
+	})
+
+	t.Run("when canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		app := client.NewApp(zap.NewNop(), newServer(t), 3, client.WithConnectRate(1))
+
+		report := app.Run(ctx)
+
+		assert.Zero(t, report.Subscribers+report.Publishers+report.Connected)
+	})
+}
+
+func TestReport_Print(t *testing.T) {
+	report := client.Report{
+		Clients:         4,
+		Connected:       3,
+		ConnectErrors:   map[string]int{client.ErrKindTimeout: 1},
+		ConnectDuration: 1234567 * time.Microsecond,
+		Hold:            10 * time.Second,
+		Subscribers:     3,
+		Publishers:      1,
+		Published:       10,
+		Received:        map[string]int{client.ReceivedMessage: 20, client.ReceivedBroadcast: 5},
+		Latency: client.LatencySummary{
+			Count: 25, P50: 1500 * time.Microsecond, P90: 2 * time.Millisecond, P99: 3 * time.Millisecond,
+			P999: 4 * time.Millisecond, Max: 4123456 * time.Nanosecond,
+		},
+	}
+	out := &bytes.Buffer{}
+
+	require.NoError(t, report.Print(out))
+
+	assert.Equal(t, `clients                  4
+connected                3 (75.0%) in 1.235s
+connect errors: timeout  1
+hold                     10s
+subscribers              3
+publishers               1
+published                10
+publish errors           0
+received: broadcast      5
+received: message        20
+disconnects              0
+latency                  count=25 p50=1.5ms p90=2ms p99=3ms p999=4ms max=4.123ms
+`, out.String())
+}
+
+func TestReport_WriteLatency(t *testing.T) {
+	summary := client.LatencySummary{Count: 2, P50: 10, P90: 20, P99: 30, P999: 40, Max: 50}
+	report := client.Report{
+		Latency:   summary,
+		Intervals: []client.LatencyInterval{{Elapsed: time.Second, LatencySummary: summary}},
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		out := &bytes.Buffer{}
+
+		require.NoError(t, report.WriteLatencyCSV(out))
+
+		assert.Equal(t, `elapsed,count,p50,p90,p99,p999,max
+1000000000,2,10,20,30,40,50
+total,2,10,20,30,40,50
+`, out.String())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		out := &bytes.Buffer{}
+
+		require.NoError(t, report.WriteLatencyJSON(out))
+
+		assert.JSONEq(t, `{
+  "intervals": [{"elapsed": 1000000000, "count": 2, "p50": 10, "p90": 20, "p99": 30, "p999": 40, "max": 50}],
+  "total": {"count": 2, "p50": 10, "p90": 20, "p99": 30, "p999": 40, "max": 50}
+}`, out.String())
+	})
+}
+
+type unsupportedCodec struct {
+	codec.Codec
+}
+
+func (unsupportedCodec) Subprotocol() string {
+	return "pubsub.v9.json"
+}
+
+func TestDial_Codec(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	defer srv.Close()
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	dial := func(cd codec.Codec) *client.Client {
+		c, err := client.Dial(ctx, zap.NewNop(), addr, client.DialConfig{Codec: cd})
+		require.NoError(t, err)
+		t.Cleanup(c.Close)
+
+		return c
+	}
+
+	legacy := dial(nil)
+	assert.Equal(t, codec.Legacy, legacy.Codec())
+
+	subscribers := []*client.Client{legacy, dial(codec.Legacy), dial(codec.JSON), dial(codec.MsgPack), dial(codec.CBOR), dial(codec.Proto)}
+	// Clients are counted since they connect.
+	assert.Eventually(t, func() bool { return hub.NumClients() == len(subscribers) }, time.Second, time.Millisecond)
+
+	// The hub handles commands of a connection in order, so the reply means the subscription is registered.
+	for _, s := range subscribers {
+		require.NoError(t, s.SubscribeTopic("news"))
+		require.NoError(t, s.NumConnections())
+
+		resp, err := s.ReadOne()
+		require.NoError(t, err, s.Codec().Subprotocol())
+		assert.Equal(t, operation.RespNumConnections{NumConnections: len(subscribers)}, resp, s.Codec().Subprotocol())
+	}
+
+	require.NoError(t, dial(codec.Proto).PublishAt("news", json.RawMessage(`{"a":1}`), time.Unix(0, 42)))
+
+	for _, s := range subscribers {
+		resp, err := s.ReadOne()
+		require.NoError(t, err, s.Codec().Subprotocol())
+
+		msg, ok := resp.(operation.RespMessage)
+		require.True(t, ok, s.Codec().Subprotocol())
+		assert.Equal(t, "news", msg.Topic)
+		assert.JSONEq(t, `{"a":1}`, string(msg.Data))
+		assert.Equal(t, int64(42), msg.SentAt)
+	}
+
+	_, err := client.Dial(ctx, zap.NewNop(), addr, client.DialConfig{Codec: unsupportedCodec{codec.JSON}})
+	assert.ErrorIs(t, err, client.ErrCodec)
+}
+
+func TestDial_Compression(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub,
+		server.WithCompression(websocket.Compression{Level: websocket.DefaultCompressionLevel})))
+	defer srv.Close()
+
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	c, err := client.Dial(ctx, zap.NewNop(), addr, client.DialConfig{Codec: codec.MsgPack, Compression: true})
+	require.NoError(t, err)
+	defer c.Close()
+
+	data := json.RawMessage(`"` + strings.Repeat("compressed both ways ", 50) + `"`)
+
+	require.NoError(t, c.SubscribeTopic("news"))
+	require.NoError(t, c.PublishAt("news", data, time.Unix(0, 1)))
+
+	resp, err := c.ReadOne()
+	require.NoError(t, err)
+	assert.Equal(t, operation.RespMessage{Topic: "news", Data: data, SentAt: 1}, resp)
+}
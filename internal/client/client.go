@@ -1,66 +1,143 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
 	"github.com/alexandear/websocket-pubsub/internal/pkg/command"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
 	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
 	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
 )
 
-var ErrNilConn = errors.New("nil ws conn")
+var (
+	ErrNilConn = errors.New("nil ws conn")
+	// ErrBadResp means the frame was read but is not a known response, the connection is still usable.
+	ErrBadResp = errors.New("bad response")
+	// ErrCodec means the server did not accept the requested protocol version or wire format.
+	ErrCodec = errors.New("codec not negotiated")
+)
 
 //go:generate mockgen -source=$GOFILE -package mock -destination mock/interfaces.go
 
 type WsConn interface {
 	Close() error
-	ReadBinaryMessage() ([]byte, error)
-	WriteBinaryMessage(data []byte) error
+	ReadMessage() (websocket.MessageType, []byte, error)
+	WriteMessage(messageType websocket.MessageType, data []byte) error
 }
 
 type Client struct {
-	conn WsConn
+	conn   WsConn
+	codec  codec.Codec
+	logger *zap.Logger
 }
 
-func NewClient() *Client {
-	return &Client{}
+func NewClient(logger *zap.Logger) *Client {
+	return &Client{
+		codec:  codec.Legacy,
+		logger: logger,
+	}
 }
 
 func (c *Client) SetConn(conn WsConn) {
 	c.conn = conn
 }
 
+// SetCodec sets protocol version and wire format negotiated with the server, legacy JSON is used by default.
+func (c *Client) SetCodec(cd codec.Codec) {
+	c.codec = cd
+}
+
+func (c *Client) Codec() codec.Codec {
+	return c.codec
+}
+
 func (c *Client) Subscribe() error {
-	return c.sendCommand(command.Subscribe)
+	return c.sendCommand(operation.ReqCommand{Command: command.Subscribe})
+}
+
+// SubscribeTopic subscribes to messages published to topic.
+func (c *Client) SubscribeTopic(topic string) error {
+	return c.sendCommand(operation.ReqCommand{Command: command.Subscribe, Topic: topic})
+}
+
+// UnsubscribeTopic stops receiving messages of topic without closing the connection.
+func (c *Client) UnsubscribeTopic(topic string) error {
+	return c.sendCommand(operation.ReqCommand{Command: command.Unsubscribe, Topic: topic})
+}
+
+// Publish sends JSON data to subscribers of topic.
+func (c *Client) Publish(topic string, data json.RawMessage) error {
+	return c.sendCommand(operation.ReqCommand{Command: command.Publish, Topic: topic, Data: data})
+}
+
+// PublishAt is Publish which tells subscribers when the message was sent, so they can measure latency.
+func (c *Client) PublishAt(topic string, data json.RawMessage, sentAt time.Time) error {
+	return c.sendCommand(operation.ReqCommand{
+		Command: command.Publish, Topic: topic, Data: data, SentAt: sentAt.UnixNano(),
+	})
 }
 
 func (c *Client) NumConnections() error {
-	return c.sendCommand(command.NumConnections)
+	return c.sendCommand(operation.ReqCommand{Command: command.NumConnections})
 }
 
 func (c *Client) Unsubscribe() error {
-	return c.sendCommand(command.Unsubscribe)
+	return c.sendCommand(operation.ReqCommand{Command: command.Unsubscribe})
+}
+
+// Data returns message as is when it is valid JSON, otherwise as JSON string.
+func Data(message []byte) json.RawMessage {
+	if json.Valid(message) {
+		return message
+	}
+
+	data, _ := json.Marshal(string(message))
+
+	return data
 }
 
-func (c *Client) sendCommand(commandType command.Type) error {
+// Send writes data to the server as is regardless of codec, e.g. to check how the server handles malformed requests.
+func (c *Client) Send(data []byte) error {
 	if c.conn == nil {
 		return ErrNilConn
 	}
 
-	log.Printf("sending %s command", commandType)
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return fmt.Errorf("write binary message failed: %w", err)
+	}
 
-	b, err := json.Marshal(&operation.ReqCommand{
-		Command: commandType,
-	})
+	return nil
+}
+
+func (c *Client) sendCommand(req operation.ReqCommand) error {
+	if c.conn == nil {
+		return ErrNilConn
+	}
+
+	c.logger.Debug("sending command", zap.String("command", string(req.Command)), zap.String("topic", req.Topic))
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "pubsub.send_command",
+		trace.WithAttributes(attribute.String("pubsub.command", string(req.Command))))
+	defer span.End()
+
+	req.TraceContext = tracing.Inject(ctx)
+
+	b, err := c.codec.EncodeRequest(req)
 	if err != nil {
-		return fmt.Errorf("marshal ReqCommand failed: %w", err)
+		return err
 	}
 
-	if err := c.conn.WriteBinaryMessage(b); err != nil {
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
 		return fmt.Errorf("write binary message failed: %w", err)
 	}
 
@@ -72,7 +149,7 @@ func (c *Client) Read() {
 		resp, err := c.ReadOne()
 		if err != nil {
 			if !errors.Is(err, websocket.ErrClosedConn) {
-				log.Printf("read one err: %v", err)
+				c.logger.Warn("read failed", zap.Error(err))
 			}
 
 			return
@@ -80,9 +157,12 @@ func (c *Client) Read() {
 
 		switch r := resp.(type) {
 		case operation.RespBroadcast:
-			log.Printf("Client ID: %s, server time: %v", r.ClientID, time.Unix(int64(r.Timestamp), 0))
+			c.logger.Info("broadcast received",
+				zap.String(logger.FieldClientID, r.ClientID), zap.Time("server_time", time.Unix(int64(r.Timestamp), 0)))
 		case operation.RespNumConnections:
-			log.Printf("Num connections: %d", r.NumConnections)
+			c.logger.Info("num connections received", zap.Int("num_connections", r.NumConnections))
+		case operation.RespMessage:
+			c.logger.Info("message received", zap.String("topic", r.Topic), zap.ByteString("data", r.Data))
 		}
 	}
 }
@@ -92,7 +172,7 @@ func (c *Client) ReadOne() (operation.Resp, error) {
 		return nil, ErrNilConn
 	}
 
-	message, err := c.conn.ReadBinaryMessage()
+	_, message, err := c.conn.ReadMessage()
 	if err != nil {
 		if !errors.Is(err, websocket.ErrClosedConn) {
 			return nil, fmt.Errorf("failed to read from server: %w", err)
@@ -101,11 +181,13 @@ func (c *Client) ReadOne() (operation.Resp, error) {
 		return nil, err
 	}
 
-	resp, err := determineOperationResp(message)
+	resp, err := c.codec.DecodeResponse(message)
 	if err != nil {
-		return nil, fmt.Errorf("failed to determine operation: %w", err)
+		return nil, fmt.Errorf("%w: failed to determine operation: %v", ErrBadResp, err)
 	}
 
+	c.traceReceive(resp)
+
 	return resp, nil
 
 	// return resp, nil
@@ -117,26 +199,40 @@ func (c *Client) ReadOne() (operation.Resp, error) {
 	// }
 }
 
-func determineOperationResp(message []byte) (operation.Resp, error) {
-	var broadcast operation.RespBroadcast
-	if err := json.Unmarshal(message, &broadcast); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal RespBroadcast: %w", err)
+// traceReceive records subscriber span linked to the server span that wrote resp.
+func (c *Client) traceReceive(resp operation.Resp) {
+	var traceContext operation.TraceContext
+
+	switch r := resp.(type) {
+	case operation.RespBroadcast:
+		traceContext = r.TraceContext
+	case operation.RespNumConnections:
+		traceContext = r.TraceContext
+	case operation.RespMessage:
+		traceContext = r.TraceContext
 	}
 
-	if broadcast.Timestamp != 0 {
-		return broadcast, nil
-	}
+	sc := trace.SpanContextFromContext(tracing.Extract(context.Background(), traceContext))
+	_, span := tracing.Tracer().Start(context.Background(), "pubsub.receive", tracing.Link(sc)...)
+	span.End()
+}
+
+// SentAt returns when the server broadcast resp or the publisher sent it, false when resp carries no such time.
+func SentAt(resp operation.Resp) (time.Time, bool) {
+	var sentAt int64
 
-	var numConnections operation.RespNumConnections
-	if err := json.Unmarshal(message, &numConnections); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal RespNumConnections: %w", err)
+	switch r := resp.(type) {
+	case operation.RespBroadcast:
+		sentAt = r.SentAt
+	case operation.RespMessage:
+		sentAt = r.SentAt
 	}
 
-	if numConnections.NumConnections != 0 {
-		return numConnections, nil
+	if sentAt == 0 {
+		return time.Time{}, false
 	}
 
-	return nil, errors.New("unknown operation resp")
+	return time.Unix(0, sentAt), true
 }
 
 func (c *Client) Close() {
@@ -145,6 +241,6 @@ func (c *Client) Close() {
 	}
 
 	if err := c.conn.Close(); err != nil {
-		log.Printf("close failed: %v", err)
+		c.logger.Warn("close failed", zap.Error(err))
 	}
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 
 	"github.com/alexandear/websocket-pubsub/internal/client"
 	"github.com/alexandear/websocket-pubsub/internal/client/mock"
@@ -20,7 +21,7 @@ func TestClient_ReadOne(t *testing.T) {
 	t.Run("when does not set conn", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		cl := client.NewClient()
+		cl := client.NewClient(zap.NewNop())
 
 		resp, err := cl.ReadOne()
 
@@ -31,10 +32,10 @@ func TestClient_ReadOne(t *testing.T) {
 	t.Run("when closed conn", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		cl := client.NewClient()
+		cl := client.NewClient(zap.NewNop())
 		connm := mock.NewMockWsConn(ctrl)
 		cl.SetConn(connm)
-		connm.EXPECT().ReadBinaryMessage().Return(nil, websocket.ErrClosedConn).Times(1)
+		connm.EXPECT().ReadMessage().Return(websocket.MessageType(0), nil, websocket.ErrClosedConn).Times(1)
 
 		resp, err := cl.ReadOne()
 
@@ -45,12 +46,12 @@ func TestClient_ReadOne(t *testing.T) {
 	t.Run("when broadcast", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		cl := client.NewClient()
+		cl := client.NewClient(zap.NewNop())
 		connm := mock.NewMockWsConn(ctrl)
 		cl.SetConn(connm)
 		id := uuid.New().String()
 		ts := int(time.Now().Unix())
-		connm.EXPECT().ReadBinaryMessage().Return([]byte(
+		connm.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte(
 			fmt.Sprintf(`{"client_id":"%s","timestamp":%d}`, id, ts)), nil).Times(1)
 
 		resp, err := cl.ReadOne()
@@ -65,11 +66,11 @@ func TestClient_ReadOne(t *testing.T) {
 	t.Run("when num connections", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		cl := client.NewClient()
+		cl := client.NewClient(zap.NewNop())
 		connm := mock.NewMockWsConn(ctrl)
 		cl.SetConn(connm)
 		numConns := rand.Intn(100) + 1
-		connm.EXPECT().ReadBinaryMessage().Return([]byte(
+		connm.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte(
 			fmt.Sprintf(`{"num_connections":%d}`, numConns)), nil).Times(1)
 
 		resp, err := cl.ReadOne()
@@ -79,13 +80,30 @@ func TestClient_ReadOne(t *testing.T) {
 			NumConnections: numConns,
 		}, resp)
 	})
+
+	t.Run("when message", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		cl := client.NewClient(zap.NewNop())
+		connm := mock.NewMockWsConn(ctrl)
+		cl.SetConn(connm)
+		connm.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte(`{"topic":"news","data":{"title":"hello"}}`), nil).Times(1)
+
+		resp, err := cl.ReadOne()
+
+		assert.NoError(t, err)
+		assert.Equal(t, operation.RespMessage{
+			Topic: "news",
+			Data:  []byte(`{"title":"hello"}`),
+		}, resp)
+	})
 }
 
 func TestClient_Subscribe(t *testing.T) {
 	t.Run("when does not set conn", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		cl := client.NewClient()
+		cl := client.NewClient(zap.NewNop())
 
 		err := cl.Subscribe()
 
@@ -95,9 +113,9 @@ func TestClient_Subscribe(t *testing.T) {
 	t.Run("when ok", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		cl := client.NewClient()
+		cl := client.NewClient(zap.NewNop())
 		connm := mock.NewMockWsConn(ctrl)
-		connm.EXPECT().WriteBinaryMessage([]byte(`{"command":"SUBSCRIBE"}`)).Times(1)
+		connm.EXPECT().WriteMessage(websocket.BinaryMessage, []byte(`{"command":"SUBSCRIBE"}`)).Times(1)
 
 		cl.SetConn(connm)
 		err := cl.Subscribe()
@@ -110,7 +128,7 @@ func TestClient_NumConnections(t *testing.T) {
 	t.Run("when does not set conn", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		cl := client.NewClient()
+		cl := client.NewClient(zap.NewNop())
 
 		err := cl.NumConnections()
 
@@ -120,9 +138,9 @@ func TestClient_NumConnections(t *testing.T) {
 	t.Run("when ok", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		cl := client.NewClient()
+		cl := client.NewClient(zap.NewNop())
 		connm := mock.NewMockWsConn(ctrl)
-		connm.EXPECT().WriteBinaryMessage([]byte(`{"command":"NUM_CONNECTIONS"}`)).Times(1)
+		connm.EXPECT().WriteMessage(websocket.BinaryMessage, []byte(`{"command":"NUM_CONNECTIONS"}`)).Times(1)
 
 		cl.SetConn(connm)
 		err := cl.NumConnections()
@@ -135,7 +153,7 @@ func TestClient_Unsubscribe(t *testing.T) {
 	t.Run("when does not set conn", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		cl := client.NewClient()
+		cl := client.NewClient(zap.NewNop())
 
 		err := cl.Unsubscribe()
 
@@ -145,9 +163,9 @@ func TestClient_Unsubscribe(t *testing.T) {
 	t.Run("when ok", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		cl := client.NewClient()
+		cl := client.NewClient(zap.NewNop())
 		connm := mock.NewMockWsConn(ctrl)
-		connm.EXPECT().WriteBinaryMessage([]byte(`{"command":"UNSUBSCRIBE"}`)).Times(1)
+		connm.EXPECT().WriteMessage(websocket.BinaryMessage, []byte(`{"command":"UNSUBSCRIBE"}`)).Times(1)
 
 		cl.SetConn(connm)
 		err := cl.Unsubscribe()
@@ -155,3 +173,68 @@ func TestClient_Unsubscribe(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestClient_SubscribeTopic(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cl := client.NewClient(zap.NewNop())
+	connm := mock.NewMockWsConn(ctrl)
+	connm.EXPECT().WriteMessage(websocket.BinaryMessage, []byte(`{"command":"SUBSCRIBE","topic":"news"}`)).Times(1)
+	connm.EXPECT().WriteMessage(websocket.BinaryMessage, []byte(`{"command":"UNSUBSCRIBE","topic":"news"}`)).Times(1)
+
+	cl.SetConn(connm)
+
+	assert.NoError(t, cl.SubscribeTopic("news"))
+	assert.NoError(t, cl.UnsubscribeTopic("news"))
+}
+
+func TestClient_Publish(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cl := client.NewClient(zap.NewNop())
+	connm := mock.NewMockWsConn(ctrl)
+	connm.EXPECT().WriteMessage(websocket.BinaryMessage, []byte(`{"command":"PUBLISH","topic":"news","data":{"title":"hello"}}`)).Times(1)
+
+	cl.SetConn(connm)
+	err := cl.Publish("news", []byte(`{"title":"hello"}`))
+
+	assert.NoError(t, err)
+}
+
+func TestClient_PublishAt(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cl := client.NewClient(zap.NewNop())
+	connm := mock.NewMockWsConn(ctrl)
+	connm.EXPECT().WriteMessage(websocket.BinaryMessage,
+		[]byte(`{"command":"PUBLISH","topic":"news","data":1,"sent_at":1600000000123456789}`)).Times(1)
+
+	cl.SetConn(connm)
+	err := cl.PublishAt("news", []byte(`1`), time.Unix(0, 1600000000123456789))
+
+	assert.NoError(t, err)
+}
+
+func TestSentAt(t *testing.T) {
+	sentAt := time.Unix(0, 1600000000123456789)
+
+	for name, tc := range map[string]struct {
+		resp       operation.Resp
+		expectedOK bool
+	}{
+		"broadcast":       {resp: operation.RespBroadcast{Timestamp: 1600000000, SentAt: sentAt.UnixNano()}, expectedOK: true},
+		"message":         {resp: operation.RespMessage{Topic: "news", SentAt: sentAt.UnixNano()}, expectedOK: true},
+		"old broadcast":   {resp: operation.RespBroadcast{Timestamp: 1600000000}},
+		"num connections": {resp: operation.RespNumConnections{NumConnections: 1}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			actual, ok := client.SentAt(tc.resp)
+
+			assert.Equal(t, tc.expectedOK, ok)
+
+			if tc.expectedOK {
+				assert.True(t, sentAt.Equal(actual))
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/histogram"
+)
+
+// Latency quantiles of LatencySummary.
+const (
+	quantileP50  = 0.5
+	quantileP90  = 0.9
+	quantileP99  = 0.99
+	quantileP999 = 0.999
+)
+
+// LatencySummary describes publish-to-receive latency of delivered messages.
+// Latency is measured against sender clock, so clocks of the server, publishers and subscribers must be in sync.
+type LatencySummary struct {
+	Count int64         `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	P999  time.Duration `json:"p999"`
+	Max   time.Duration `json:"max"`
+}
+
+// LatencyInterval is latency of messages received during the interval ending at Elapsed since the start of the run.
+type LatencyInterval struct {
+	Elapsed time.Duration `json:"elapsed"`
+	LatencySummary
+}
+
+func summarize(h *histogram.Histogram) LatencySummary {
+	return LatencySummary{
+		Count: h.Count(),
+		P50:   h.Quantile(quantileP50),
+		P90:   h.Quantile(quantileP90),
+		P99:   h.Quantile(quantileP99),
+		P999:  h.Quantile(quantileP999),
+		Max:   h.Max(),
+	}
+}
+
+func (l LatencySummary) String() string {
+	return fmt.Sprintf("count=%d p50=%s p90=%s p99=%s p999=%s max=%s",
+		l.Count, round(l.P50), round(l.P90), round(l.P99), round(l.P999), round(l.Max))
+}
+
+func (l LatencyInterval) String() string {
+	return fmt.Sprintf("%s latency %s", l.Elapsed.Round(time.Millisecond), l.LatencySummary)
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
+
+// WriteLatencyCSV writes latency of every interval and the total, durations are in nanoseconds.
+func (r Report) WriteLatencyCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+
+	_ = cw.Write([]string{"elapsed", "count", "p50", "p90", "p99", "p999", "max"})
+
+	for _, l := range r.Intervals {
+		_ = cw.Write(latencyRecord(strconv.FormatInt(int64(l.Elapsed), 10), l.LatencySummary))
+	}
+
+	_ = cw.Write(latencyRecord("total", r.Latency))
+
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("write csv failed: %w", err)
+	}
+
+	return nil
+}
+
+func latencyRecord(elapsed string, l LatencySummary) []string {
+	record := []string{elapsed, strconv.FormatInt(l.Count, 10)}
+	for _, d := range []time.Duration{l.P50, l.P90, l.P99, l.P999, l.Max} {
+		record = append(record, strconv.FormatInt(int64(d), 10))
+	}
+
+	return record
+}
+
+// WriteLatencyJSON writes latency of every interval and the total, durations are in nanoseconds.
+func (r Report) WriteLatencyJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(struct {
+		Intervals []LatencyInterval `json:"intervals"`
+		Total     LatencySummary    `json:"total"`
+	}{
+		Intervals: r.Intervals,
+		Total:     r.Latency,
+	}); err != nil {
+		return fmt.Errorf("encode json failed: %w", err)
+	}
+
+	return nil
+}
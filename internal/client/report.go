@@ -0,0 +1,261 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/histogram"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+// Connect error kinds of Report.ConnectErrors.
+const (
+	ErrKindCanceled     = "canceled"
+	ErrKindRefused      = "connection_refused"
+	ErrKindReset        = "connection_reset"
+	ErrKindTimeout      = "timeout"
+	ErrKindBadHandshake = "bad_handshake"
+	ErrKindTLS          = "tls"
+	ErrKindOther        = "other"
+)
+
+// Kinds of Report.Received.
+const (
+	ReceivedBroadcast      = "broadcast"
+	ReceivedMessage        = "message"
+	ReceivedNumConnections = "num_connections"
+	receivedUnknown        = "unknown"
+)
+
+const (
+	percent          = 100
+	reportTabPadding = 2
+)
+
+// Report summarizes a load run.
+type Report struct {
+	Clients   int `json:"clients"`
+	Connected int `json:"connected"`
+	// ConnectErrors counts failed dials by error kind.
+	ConnectErrors   map[string]int `json:"connect_errors"`
+	ConnectDuration time.Duration  `json:"connect_duration"`
+	Hold            time.Duration  `json:"hold"`
+
+	Subscribers int `json:"subscribers"`
+	Publishers  int `json:"publishers"`
+
+	Published     int `json:"published"`
+	PublishErrors int `json:"publish_errors"`
+	// Received counts messages delivered to subscribers by kind: broadcast, message, num_connections.
+	Received map[string]int `json:"received"`
+	// Disconnects counts connections lost before the end of the hold.
+	Disconnects int `json:"disconnects"`
+
+	// Latency of broadcasts and messages received during the whole run.
+	Latency LatencySummary `json:"latency"`
+	// Intervals are filled when the run reports latency periodically.
+	Intervals []LatencyInterval `json:"intervals,omitempty"`
+}
+
+// ConnectSuccessRate is a fraction of dialed clients which connected.
+func (r Report) ConnectSuccessRate() float64 {
+	dialed := r.Connected
+	for _, n := range r.ConnectErrors {
+		dialed += n
+	}
+
+	if dialed == 0 {
+		return 0
+	}
+
+	return float64(r.Connected) / float64(dialed)
+}
+
+// Print writes human readable report.
+func (r Report) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, reportTabPadding, ' ', 0)
+
+	_, _ = fmt.Fprintf(tw, "clients\t%d\n", r.Clients)
+	_, _ = fmt.Fprintf(tw, "connected\t%d (%.1f%%) in %s\n", r.Connected, r.ConnectSuccessRate()*percent,
+		r.ConnectDuration.Round(time.Millisecond))
+
+	for _, kind := range sortedKeys(r.ConnectErrors) {
+		_, _ = fmt.Fprintf(tw, "connect errors: %s\t%d\n", kind, r.ConnectErrors[kind])
+	}
+
+	_, _ = fmt.Fprintf(tw, "hold\t%s\n", r.Hold)
+	_, _ = fmt.Fprintf(tw, "subscribers\t%d\n", r.Subscribers)
+	_, _ = fmt.Fprintf(tw, "publishers\t%d\n", r.Publishers)
+	_, _ = fmt.Fprintf(tw, "published\t%d\n", r.Published)
+	_, _ = fmt.Fprintf(tw, "publish errors\t%d\n", r.PublishErrors)
+
+	for _, kind := range sortedKeys(r.Received) {
+		_, _ = fmt.Fprintf(tw, "received: %s\t%d\n", kind, r.Received[kind])
+	}
+
+	_, _ = fmt.Fprintf(tw, "disconnects\t%d\n", r.Disconnects)
+	_, _ = fmt.Fprintf(tw, "latency\t%s\n", r.Latency)
+
+	return tw.Flush()
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// stats are updated concurrently by connections of a load run.
+type stats struct {
+	connectedCount     int64
+	publishedCount     int64
+	publishErrorsCount int64
+	disconnectsCount   int64
+
+	mu             sync.Mutex
+	connectErrors  map[string]int
+	receivedCounts map[string]int
+	latency        *histogram.Histogram
+	// intervalLatency is reset by every takeInterval.
+	intervalLatency *histogram.Histogram
+	intervals       []LatencyInterval
+}
+
+func newStats() *stats {
+	return &stats{
+		connectErrors:   map[string]int{},
+		receivedCounts:  map[string]int{},
+		latency:         histogram.New(),
+		intervalLatency: histogram.New(),
+	}
+}
+
+func (s *stats) connected() {
+	atomic.AddInt64(&s.connectedCount, 1)
+}
+
+func (s *stats) connectedTotal() int {
+	return int(atomic.LoadInt64(&s.connectedCount))
+}
+
+func (s *stats) connectFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connectErrors[ConnectErrorKind(err)]++
+}
+
+func (s *stats) published() {
+	atomic.AddInt64(&s.publishedCount, 1)
+}
+
+func (s *stats) publishFailed() {
+	atomic.AddInt64(&s.publishErrorsCount, 1)
+}
+
+func (s *stats) disconnected() {
+	atomic.AddInt64(&s.disconnectsCount, 1)
+}
+
+func (s *stats) received(resp operation.Resp, receivedAt time.Time) {
+	kind := receivedUnknown
+
+	switch resp.(type) {
+	case operation.RespBroadcast:
+		kind = ReceivedBroadcast
+	case operation.RespMessage:
+		kind = ReceivedMessage
+	case operation.RespNumConnections:
+		kind = ReceivedNumConnections
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.receivedCounts[kind]++
+
+	if sentAt, ok := SentAt(resp); ok {
+		latency := receivedAt.Sub(sentAt)
+		s.latency.Record(latency)
+		s.intervalLatency.Record(latency)
+	}
+}
+
+// takeInterval summarizes latency since the previous call.
+func (s *stats) takeInterval(elapsed time.Duration) LatencyInterval {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := LatencyInterval{Elapsed: elapsed, LatencySummary: summarize(s.intervalLatency)}
+	s.intervals = append(s.intervals, l)
+	s.intervalLatency.Reset()
+
+	return l
+}
+
+func (s *stats) fill(r *Report) {
+	r.Connected = s.connectedTotal()
+	r.Published = int(atomic.LoadInt64(&s.publishedCount))
+	r.PublishErrors = int(atomic.LoadInt64(&s.publishErrorsCount))
+	r.Disconnects = int(atomic.LoadInt64(&s.disconnectsCount))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ConnectErrors = make(map[string]int, len(s.connectErrors))
+	for k, v := range s.connectErrors {
+		r.ConnectErrors[k] = v
+	}
+
+	r.Received = make(map[string]int, len(s.receivedCounts))
+	for k, v := range s.receivedCounts {
+		r.Received[k] = v
+	}
+
+	r.Latency = summarize(s.latency)
+	r.Intervals = append([]LatencyInterval(nil), s.intervals...)
+}
+
+// ConnectErrorKind classifies dial error for the report.
+func ConnectErrorKind(err error) string {
+	var (
+		netErr         net.Error
+		unknownCA      x509.UnknownAuthorityError
+		hostnameErr    x509.HostnameError
+		certInvalidErr x509.CertificateInvalidError
+	)
+
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ErrKindCanceled
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrKindRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return ErrKindReset
+	case errors.Is(err, gws.ErrBadHandshake):
+		return ErrKindBadHandshake
+	case errors.As(err, &unknownCA), errors.As(err, &hostnameErr), errors.As(err, &certInvalidErr):
+		return ErrKindTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrKindTimeout
+	default:
+		return ErrKindOther
+	}
+}
@@ -0,0 +1,435 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alexandear/websocket-pubsub/internal/bridge"
+	"github.com/alexandear/websocket-pubsub/internal/broker"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+)
+
+var ErrInvalid = errors.New("invalid config")
+
+// Config is the effective configuration of all commands.
+// Values are taken from defaults, then config file, then environment variables, then flags.
+type Config struct {
+	Server Server `yaml:"server" json:"server"`
+	Client Client `yaml:"client" json:"client"`
+}
+
+type Server struct {
+	Addr            string   `yaml:"addr" json:"addr"`
+	Broadcast       Duration `yaml:"broadcast" json:"broadcast"`
+	DrainDelay      Duration `yaml:"drain_delay" json:"drain_delay"`
+	WedgedThreshold Duration `yaml:"wedged_threshold" json:"wedged_threshold"`
+	AdminToken      string   `yaml:"admin_token" json:"admin_token"`
+
+	// STOMPHeartbeat is the heart-beat interval offered to STOMP clients, zero disables heart-beating.
+	STOMPHeartbeat Duration `yaml:"stomp_heartbeat" json:"stomp_heartbeat"`
+
+	SendBufferSize     int `yaml:"send_buffer_size" json:"send_buffer_size"`
+	CastSize           int `yaml:"cast_size" json:"cast_size"`
+	UpgraderBufferSize int `yaml:"upgrader_buffer_size" json:"upgrader_buffer_size"`
+	MaxClients         int `yaml:"max_clients" json:"max_clients"`
+	// MaxMessageSize limits messages, packets and frames of MQTT and STOMP clients in bytes.
+	MaxMessageSize int `yaml:"max_message_size" json:"max_message_size"`
+	// Shards partition clients of the hub, zero uses one shard per CPU.
+	Shards int `yaml:"shards" json:"shards"`
+
+	Compression ServerCompression `yaml:"compression" json:"compression"`
+	Cluster     ServerCluster     `yaml:"cluster" json:"cluster"`
+	NATS        ServerNATS        `yaml:"nats" json:"nats"`
+	TLS         ServerTLS         `yaml:"tls" json:"tls"`
+	Log         logger.Config     `yaml:"log" json:"log"`
+	Tracing     tracing.Config    `yaml:"tracing" json:"tracing"`
+}
+
+// ServerCompression is permessage-deflate policy applied to connections which offer it.
+type ServerCompression struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Level is flate level from -2 (Huffman only) to 9 (best compression).
+	Level int `yaml:"level" json:"level"`
+	// Threshold is the message size in bytes below which messages are sent uncompressed.
+	Threshold int `yaml:"threshold" json:"threshold"`
+}
+
+// Websocket returns compression settings of connections.
+func (c ServerCompression) Websocket() websocket.Compression {
+	return websocket.Compression{Level: c.Level, Threshold: c.Threshold}
+}
+
+// Values of ServerCluster.NumConnections.
+const (
+	NumConnectionsNode    = "node"
+	NumConnectionsCluster = "cluster"
+)
+
+// ServerCluster joins server nodes which share subscriptions.
+type ServerCluster struct {
+	// Listen is the address other nodes connect to, it enables cluster mode over TCP mesh.
+	Listen string `yaml:"listen" json:"listen"`
+	// Redis is URL of Redis server relaying messages between nodes, it enables cluster mode over Redis pub/sub.
+	Redis string `yaml:"redis" json:"redis"`
+	// RedisChannel is the Redis pub/sub channel shared by nodes.
+	RedisChannel string `yaml:"redis_channel" json:"redis_channel"`
+	// Peers are comma separated addresses of all nodes, they may include this node.
+	Peers string `yaml:"peers" json:"peers"`
+	// Node identifies this node in the cluster, random when empty.
+	Node string `yaml:"node" json:"node"`
+	// NumConnections is node or cluster, cluster makes NUM_CONNECTIONS count clients of all nodes.
+	NumConnections string `yaml:"num_connections" json:"num_connections"`
+}
+
+// Enabled reports whether the server joins a cluster.
+func (c ServerCluster) Enabled() bool {
+	return c.Listen != "" || c.Redis != ""
+}
+
+// PeerList returns addresses of cluster nodes.
+func (c ServerCluster) PeerList() []string {
+	var peers []string
+
+	for _, peer := range strings.Split(c.Peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+// ServerNATS bridges NATS subjects and topics in both directions.
+type ServerNATS struct {
+	// URL of NATS server, it enables the bridge.
+	URL string `yaml:"url" json:"url"`
+	// Subjects are comma separated subject=topic pairs, each subject is mapped to a single topic.
+	Subjects string `yaml:"subjects" json:"subjects"`
+	// Name is reported to NATS server and marks messages published by the bridge.
+	Name string `yaml:"name" json:"name"`
+}
+
+// SubjectMap returns topics by NATS subject, pairs without = are skipped.
+func (n ServerNATS) SubjectMap() map[string]string {
+	m := map[string]string{}
+
+	for _, pair := range strings.Split(n.Subjects, ",") {
+		subject, topic, ok := cutPair(pair)
+		if ok {
+			m[subject] = topic
+		}
+	}
+
+	return m
+}
+
+func cutPair(pair string) (key, value string, ok bool) {
+	i := strings.IndexByte(pair, '=')
+	if i < 0 {
+		return "", "", false
+	}
+
+	key, value = strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+
+	return key, value, key != "" && value != ""
+}
+
+type ServerTLS struct {
+	Cert     string `yaml:"cert" json:"cert"`
+	Key      string `yaml:"key" json:"key"`
+	ClientCA string `yaml:"client_ca" json:"client_ca"`
+}
+
+type Client struct {
+	Addr string `yaml:"addr" json:"addr"`
+	// Codec is v1 wire format negotiated with the server, empty speaks legacy v0 JSON without negotiation.
+	Codec string `yaml:"codec" json:"codec"`
+	// Compression offers permessage-deflate to the server.
+	Compression bool `yaml:"compression" json:"compression"`
+	Clients     int  `yaml:"clients" json:"clients"`
+
+	// ConnectRate is connections dialed per second, zero dials all at once.
+	ConnectRate        float64  `yaml:"connect_rate" json:"connect_rate"`
+	MaxConcurrentDials int      `yaml:"max_concurrent_dials" json:"max_concurrent_dials"`
+	Hold               Duration `yaml:"hold" json:"hold"`
+
+	// Topic is subscribed by subscribers and published to by publishers.
+	Topic string `yaml:"topic" json:"topic"`
+	// PublishRatio is a fraction of connections publishing instead of subscribing.
+	PublishRatio    float64  `yaml:"publish_ratio" json:"publish_ratio"`
+	PublishInterval Duration `yaml:"publish_interval" json:"publish_interval"`
+
+	// ReportInterval is how often latency is printed during the run, zero prints only the final report.
+	ReportInterval Duration `yaml:"report_interval" json:"report_interval"`
+	// LatencyFile is a .csv or .json file to export latency of every interval to.
+	LatencyFile string `yaml:"latency_file" json:"latency_file"`
+
+	// Scenario is a YAML file with phases to run instead of the load described above.
+	Scenario string `yaml:"scenario" json:"scenario"`
+	// Listen makes the client a coordinator which runs Scenario on Workers registered at this address.
+	Listen  string `yaml:"listen" json:"listen"`
+	Workers int    `yaml:"workers" json:"workers"`
+	// Coordinator makes the client a worker which runs its share of the coordinator scenario.
+	Coordinator string `yaml:"coordinator" json:"coordinator"`
+
+	TLS     ClientTLS      `yaml:"tls" json:"tls"`
+	Log     logger.Config  `yaml:"log" json:"log"`
+	Tracing tracing.Config `yaml:"tracing" json:"tracing"`
+}
+
+type ClientTLS struct {
+	Enabled  bool   `yaml:"enabled" json:"enabled"`
+	CA       string `yaml:"ca" json:"ca"`
+	Insecure bool   `yaml:"insecure" json:"insecure"`
+	Cert     string `yaml:"cert" json:"cert"`
+	Key      string `yaml:"key" json:"key"`
+}
+
+func Default() Config {
+	tracingCfg := tracing.Config{SampleRatio: 1}
+
+	return Config{
+		Server: Server{
+			Addr:               ":8080",
+			Broadcast:          Duration(100 * time.Millisecond),
+			DrainDelay:         Duration(5 * time.Second),
+			WedgedThreshold:    Duration(5 * time.Second),
+			STOMPHeartbeat:     Duration(10 * time.Second),
+			SendBufferSize:     256,
+			CastSize:           1000,
+			UpgraderBufferSize: 1024,
+			MaxClients:         5000,
+			MaxMessageSize:     1 << 20,
+			Log:                logger.DefaultConfig(),
+			Tracing:            tracingCfg,
+			Compression: ServerCompression{
+				Enabled:   true,
+				Level:     websocket.DefaultCompressionLevel,
+				Threshold: 512,
+			},
+			Cluster: ServerCluster{
+				RedisChannel:   broker.DefaultRedisChannel,
+				NumConnections: NumConnectionsNode,
+			},
+			NATS: ServerNATS{
+				Name: bridge.DefaultName,
+			},
+		},
+		Client: Client{
+			Addr:               "localhost:8080",
+			Clients:            5000,
+			ConnectRate:        500,
+			MaxConcurrentDials: 100,
+			Hold:               Duration(10 * time.Second),
+			Topic:              operation.TopicBroadcast,
+			PublishInterval:    Duration(time.Second),
+			ReportInterval:     Duration(5 * time.Second),
+			Log:                logger.DefaultConfig(),
+			Tracing:            tracingCfg,
+		},
+	}
+}
+
+// Validate reports all invalid settings at once.
+func (c *Config) Validate() error {
+	var problems []string
+
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	s := c.Server
+	check(s.Addr != "", "server.addr must be set")
+	check(s.Broadcast > 0, "server.broadcast must be positive, got %s", s.Broadcast)
+	check(s.DrainDelay >= 0, "server.drain_delay must not be negative, got %s", s.DrainDelay)
+	check(s.WedgedThreshold > 0, "server.wedged_threshold must be positive, got %s", s.WedgedThreshold)
+	check(s.STOMPHeartbeat >= 0, "server.stomp_heartbeat must not be negative, got %s", s.STOMPHeartbeat)
+	check(s.SendBufferSize > 0, "server.send_buffer_size must be positive, got %d", s.SendBufferSize)
+	check(s.CastSize > 0, "server.cast_size must be positive, got %d", s.CastSize)
+	check(s.UpgraderBufferSize > 0, "server.upgrader_buffer_size must be positive, got %d", s.UpgraderBufferSize)
+	check(s.MaxClients > 0, "server.max_clients must be positive, got %d", s.MaxClients)
+	check(s.MaxMessageSize > 0, "server.max_message_size must be positive, got %d", s.MaxMessageSize)
+	check(s.Shards >= 0, "server.shards must not be negative, got %d", s.Shards)
+	check(s.Compression.Level >= websocket.MinCompressionLevel && s.Compression.Level <= websocket.MaxCompressionLevel,
+		"server.compression.level must be between %d and %d, got %d",
+		websocket.MinCompressionLevel, websocket.MaxCompressionLevel, s.Compression.Level)
+	check(s.Compression.Threshold >= 0, "server.compression.threshold must not be negative, got %d",
+		s.Compression.Threshold)
+	check(s.Cluster.NumConnections == NumConnectionsNode || s.Cluster.NumConnections == NumConnectionsCluster,
+		"server.cluster.num_connections must be node or cluster, got %q", s.Cluster.NumConnections)
+	check(s.Cluster.Peers == "" || s.Cluster.Listen != "", "server.cluster.peers requires server.cluster.listen")
+	check(s.Cluster.Listen == "" || s.Cluster.Redis == "",
+		"server.cluster.listen and server.cluster.redis must not be set together")
+	check(s.Cluster.Redis == "" || validRedisURL(s.Cluster.Redis),
+		"server.cluster.redis must be redis:// or rediss:// URL, got %q", s.Cluster.Redis)
+	check(s.Cluster.RedisChannel != "", "server.cluster.redis_channel must be set")
+	validateNATS(check, s.NATS)
+	check((s.TLS.Cert == "") == (s.TLS.Key == ""), "server.tls.cert and server.tls.key must be set together")
+	check(s.TLS.ClientCA == "" || s.TLS.Cert != "", "server.tls.client_ca requires server.tls.cert and server.tls.key")
+	validateLog(check, "server", s.Log)
+	validateTracing(check, "server", s.Tracing)
+
+	cl := c.Client
+	check(cl.Addr != "", "client.addr must be set")
+	_, knownCodec := codec.ByName(cl.Codec)
+	check(cl.Codec == "" || knownCodec, "client.codec must be one of %s, got %q",
+		strings.Join(codec.Names(), ", "), cl.Codec)
+	check(cl.Clients > 0, "client.clients must be positive, got %d", cl.Clients)
+	check(cl.ConnectRate >= 0, "client.connect_rate must not be negative, got %g", cl.ConnectRate)
+	check(cl.MaxConcurrentDials > 0, "client.max_concurrent_dials must be positive, got %d", cl.MaxConcurrentDials)
+	check(cl.Hold >= 0, "client.hold must not be negative, got %s", cl.Hold)
+	check(cl.Topic != "", "client.topic must be set")
+	check(cl.PublishRatio >= 0 && cl.PublishRatio <= 1,
+		"client.publish_ratio must be between 0 and 1, got %g", cl.PublishRatio)
+	check(cl.PublishRatio == 0 || cl.Topic != operation.TopicBroadcast,
+		"client.publish_ratio requires client.topic other than %s", operation.TopicBroadcast)
+	check(cl.PublishInterval > 0, "client.publish_interval must be positive, got %s", cl.PublishInterval)
+	check(cl.ReportInterval >= 0, "client.report_interval must not be negative, got %s", cl.ReportInterval)
+	check(cl.LatencyFile == "" || LatencyFormat(cl.LatencyFile) != "",
+		"client.latency_file must have .csv or .json extension, got %q", cl.LatencyFile)
+	check(cl.Listen == "" || cl.Coordinator == "", "client.listen and client.coordinator must not be set together")
+	check(cl.Listen == "" || cl.Scenario != "", "client.listen requires client.scenario")
+	check(cl.Listen == "" || cl.Workers > 0, "client.workers must be positive, got %d", cl.Workers)
+	check((cl.TLS.Cert == "") == (cl.TLS.Key == ""), "client.tls.cert and client.tls.key must be set together")
+	validateLog(check, "client", cl.Log)
+	validateTracing(check, "client", cl.Tracing)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w:\n  - %s", ErrInvalid, strings.Join(problems, "\n  - "))
+	}
+
+	return nil
+}
+
+// LatencyFormat returns "csv" or "json" by extension of latency file, empty when extension is unknown.
+func LatencyFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	default:
+		return ""
+	}
+}
+
+func validateLog(check func(bool, string, ...interface{}), section string, l logger.Config) {
+	switch strings.ToLower(l.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "%s.log.level must be one of debug, info, warn, error, got %q", section, l.Level)
+	}
+
+	check(l.Format == logger.FormatJSON || l.Format == logger.FormatConsole,
+		"%s.log.format must be json or console, got %q", section, l.Format)
+	check(l.SampleInitial >= 0, "%s.log.sample_initial must not be negative, got %d", section, l.SampleInitial)
+	check(l.SampleThereafter >= 0, "%s.log.sample_thereafter must not be negative, got %d", section, l.SampleThereafter)
+}
+
+func validateTracing(check func(bool, string, ...interface{}), section string, t tracing.Config) {
+	check(t.SampleRatio >= 0 && t.SampleRatio <= 1,
+		"%s.tracing.sample_ratio must be between 0 and 1, got %g", section, t.SampleRatio)
+}
+
+func validateNATS(check func(bool, string, ...interface{}), n ServerNATS) {
+	u, err := url.Parse(n.URL)
+	check(n.URL == "" || (err == nil && u.Scheme == "nats" && u.Host != ""),
+		"server.nats.url must be nats:// URL, got %q", n.URL)
+	check(n.Subjects == "" || n.URL != "", "server.nats.subjects requires server.nats.url")
+	check(n.Name != "", "server.nats.name must be set")
+
+	topics, subjects := map[string]string{}, map[string]bool{}
+
+	for _, pair := range strings.Split(n.Subjects, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		subject, topic, ok := cutPair(pair)
+		if !ok {
+			check(false, "server.nats.subjects must be subject=topic pairs, got %q", pair)
+
+			continue
+		}
+
+		check(!strings.ContainsAny(subject, "*> \t"), "server.nats.subjects must not have wildcards, got %q", subject)
+
+		if other, ok := topics[topic]; ok {
+			check(false, "server.nats.subjects map %q and %q to the same topic %q", other, subject, topic)
+		}
+
+		check(!subjects[subject], "server.nats.subjects map %q more than once", subject)
+
+		topics[topic], subjects[subject] = subject, true
+	}
+}
+
+func validRedisURL(s string) bool {
+	u, err := url.Parse(s)
+
+	return err == nil && (u.Scheme == "redis" || u.Scheme == "rediss") && u.Host != ""
+}
+
+// Duration is time.Duration written as "100ms" in config files.
+type Duration time.Duration
+
+func (d Duration) Value() time.Duration {
+	return time.Duration(d)
+}
+
+// Ptr allows binding Duration to a duration flag.
+func (d *Duration) Ptr() *time.Duration {
+	return (*time.Duration)(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	return d.parse(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"100ms\": %w", err)
+	}
+
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("parse duration failed: %w", err)
+	}
+
+	*d = Duration(v)
+
+	return nil
+}
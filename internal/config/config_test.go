@@ -0,0 +1,233 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexandear/websocket-pubsub/internal/config"
+)
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), name)
+	require.NoError(t, ioutil.WriteFile(file, []byte(data), 0o600))
+
+	return file
+}
+
+func TestDefault(t *testing.T) {
+	cfg := config.Default()
+
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestLoadFile(t *testing.T) {
+	t.Run("yaml", func(t *testing.T) {
+		file := writeFile(t, "pubsub.yaml", `
+server:
+  broadcast: 1s
+  send_buffer_size: 16
+  log:
+    level: debug
+`)
+		cfg := config.Default()
+
+		require.NoError(t, config.LoadFile(file, &cfg))
+
+		assert.Equal(t, config.Duration(time.Second), cfg.Server.Broadcast)
+		assert.Equal(t, 16, cfg.Server.SendBufferSize)
+		assert.Equal(t, "debug", cfg.Server.Log.Level)
+		assert.Equal(t, ":8080", cfg.Server.Addr)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		file := writeFile(t, "pubsub.json", `{"client": {"clients": 10, "hold": "10ms"}}`)
+		cfg := config.Default()
+
+		require.NoError(t, config.LoadFile(file, &cfg))
+
+		assert.Equal(t, 10, cfg.Client.Clients)
+		assert.Equal(t, config.Duration(10*time.Millisecond), cfg.Client.Hold)
+	})
+
+	t.Run("when unknown field", func(t *testing.T) {
+		file := writeFile(t, "pubsub.yaml", "server:\n  brodcast: 1s\n")
+		cfg := config.Default()
+
+		assert.Error(t, config.LoadFile(file, &cfg))
+	})
+
+	t.Run("when bad duration", func(t *testing.T) {
+		file := writeFile(t, "pubsub.json", `{"server": {"broadcast": 100}}`)
+		cfg := config.Default()
+
+		assert.Error(t, config.LoadFile(file, &cfg))
+	})
+}
+
+func TestLoadEnv(t *testing.T) {
+	env := map[string]string{
+		"PUBSUB_SERVER_ADDR":                 ":9090",
+		"PUBSUB_SERVER_DRAIN_DELAY":          "1s",
+		"PUBSUB_SERVER_TLS_CLIENT_CA":        "ca.pem",
+		"PUBSUB_CLIENT_TLS_INSECURE":         "true",
+		"PUBSUB_CLIENT_TRACING_SAMPLE_RATIO": "0.5",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+
+		return v, ok
+	}
+	cfg := config.Default()
+
+	require.NoError(t, config.LoadEnv(lookup, &cfg))
+
+	assert.Equal(t, ":9090", cfg.Server.Addr)
+	assert.Equal(t, config.Duration(time.Second), cfg.Server.DrainDelay)
+	assert.Equal(t, "ca.pem", cfg.Server.TLS.ClientCA)
+	assert.True(t, cfg.Client.TLS.Insecure)
+	assert.Equal(t, 0.5, cfg.Client.Tracing.SampleRatio)
+
+	t.Run("when bad value", func(t *testing.T) {
+		cfg := config.Default()
+
+		err := config.LoadEnv(func(name string) (string, bool) {
+			return "many", name == "PUBSUB_CLIENT_CLIENTS"
+		}, &cfg)
+
+		assert.EqualError(t, err, `environment variable PUBSUB_CLIENT_CLIENTS="many": `+
+			`parse int failed: strconv.Atoi: parsing "many": invalid syntax`)
+	})
+}
+
+func TestEnvNames(t *testing.T) {
+	names := config.EnvNames()
+
+	assert.Contains(t, names, "PUBSUB_SERVER_SEND_BUFFER_SIZE")
+	assert.Contains(t, names, "PUBSUB_CLIENT_LOG_LEVEL")
+	assert.Contains(t, names, "PUBSUB_SERVER_COMPRESSION_THRESHOLD")
+	assert.NotContains(t, names, "PUBSUB_SERVER_TRACING_SERVICE_NAME")
+}
+
+func TestLoad(t *testing.T) {
+	file := writeFile(t, "pubsub.yaml", "server:\n  addr: :7000\n  broadcast: 1s\n  cast_size: 10\n")
+	require.NoError(t, os.Setenv("PUBSUB_SERVER_BROADCAST", "2s"))
+	require.NoError(t, os.Setenv("PUBSUB_SERVER_CAST_SIZE", "20"))
+
+	defer func() {
+		_ = os.Unsetenv("PUBSUB_SERVER_BROADCAST")
+		_ = os.Unsetenv("PUBSUB_SERVER_CAST_SIZE")
+	}()
+
+	cfg := config.Default()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config.AddFileFlag(fs)
+	fs.DurationVar(cfg.Server.Broadcast.Ptr(), "broadcast", cfg.Server.Broadcast.Value(), "")
+	fs.IntVar(&cfg.Server.CastSize, "cast-size", cfg.Server.CastSize, "")
+
+	require.NoError(t, config.Load(fs, []string{"--config", file, "--broadcast", "3s"}, &cfg))
+
+	assert.Equal(t, ":7000", cfg.Server.Addr, "file overrides default")
+	assert.Equal(t, 20, cfg.Server.CastSize, "env overrides file")
+	assert.Equal(t, config.Duration(3*time.Second), cfg.Server.Broadcast, "flag overrides env")
+}
+
+func TestReload(t *testing.T) {
+	file := writeFile(t, "pubsub.yaml", "server:\n  broadcast: 1s\n  cast_size: 10\n")
+
+	cfg := config.Default()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config.AddFileFlag(fs)
+	fs.IntVar(&cfg.Server.CastSize, "cast-size", cfg.Server.CastSize, "")
+
+	require.NoError(t, config.Load(fs, []string{"--config", file, "--cast-size", "30"}, &cfg))
+	require.NoError(t, ioutil.WriteFile(file, []byte("server:\n  broadcast: 2s\n  cast_size: 20\n"), 0o600))
+
+	require.NoError(t, config.Reload(fs, &cfg))
+
+	assert.Equal(t, config.Duration(2*time.Second), cfg.Server.Broadcast, "file change is picked up")
+	assert.Equal(t, 30, cfg.Server.CastSize, "flag still overrides file")
+}
+
+func TestDiff(t *testing.T) {
+	a := config.Default()
+	b := config.Default()
+	b.Server.Broadcast = config.Duration(time.Second)
+	b.Server.Log.Level = "debug"
+	b.Client.TLS.Insecure = true
+
+	assert.Equal(t, []string{"server.broadcast", "server.log.level", "client.tls.insecure"}, config.Diff(a, b))
+	assert.Empty(t, config.Diff(a, a))
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Server.Broadcast = 0
+	cfg.Server.STOMPHeartbeat = config.Duration(-time.Second)
+	cfg.Server.MaxMessageSize = 0
+	cfg.Server.Shards = -1
+	cfg.Server.Cluster.Peers = "10.0.0.2:7946"
+	cfg.Server.Cluster.NumConnections = "all"
+	cfg.Server.Cluster.Redis = "localhost:6379"
+	cfg.Server.Cluster.RedisChannel = ""
+	cfg.Server.NATS.Subjects = "orders.*=orders,orders.created,events=orders,events=news"
+	cfg.Server.Compression.Level = 10
+	cfg.Server.Compression.Threshold = -1
+	cfg.Server.TLS.Cert = "cert.pem"
+	cfg.Client.Codec = "xml"
+	cfg.Client.TLS.Key = "key.pem"
+	cfg.Client.PublishRatio = 0.5
+	cfg.Client.LatencyFile = "latency.txt"
+	cfg.Client.Listen = ":7070"
+	cfg.Client.Log.Format = "xml"
+
+	err := cfg.Validate()
+
+	assert.ErrorIs(t, err, config.ErrInvalid)
+	assert.EqualError(t, err, `invalid config:
+  - server.broadcast must be positive, got 0s
+  - server.stomp_heartbeat must not be negative, got -1s
+  - server.max_message_size must be positive, got 0
+  - server.shards must not be negative, got -1
+  - server.compression.level must be between -2 and 9, got 10
+  - server.compression.threshold must not be negative, got -1
+  - server.cluster.num_connections must be node or cluster, got "all"
+  - server.cluster.peers requires server.cluster.listen
+  - server.cluster.redis must be redis:// or rediss:// URL, got "localhost:6379"
+  - server.cluster.redis_channel must be set
+  - server.nats.subjects requires server.nats.url
+  - server.nats.subjects must not have wildcards, got "orders.*"
+  - server.nats.subjects must be subject=topic pairs, got "orders.created"
+  - server.nats.subjects map "orders.*" and "events" to the same topic "orders"
+  - server.nats.subjects map "events" more than once
+  - server.tls.cert and server.tls.key must be set together
+  - client.codec must be one of json, msgpack, cbor, proto, got "xml"
+  - client.publish_ratio requires client.topic other than broadcast
+  - client.latency_file must have .csv or .json extension, got "latency.txt"
+  - client.listen requires client.scenario
+  - client.workers must be positive, got 0
+  - client.tls.cert and client.tls.key must be set together
+  - client.log.format must be json or console, got "xml"`)
+}
+
+func TestServerNATS_SubjectMap(t *testing.T) {
+	n := config.ServerNATS{Subjects: "orders.created=orders, events = news,invalid,"}
+
+	assert.Equal(t, map[string]string{"orders.created": "orders", "events": "news"}, n.SubjectMap())
+	assert.Empty(t, config.ServerNATS{}.SubjectMap())
+}
+
+func TestServerCluster_PeerList(t *testing.T) {
+	c := config.ServerCluster{Peers: "10.0.0.1:7946, 10.0.0.2:7946,,"}
+
+	assert.Equal(t, []string{"10.0.0.1:7946", "10.0.0.2:7946"}, c.PeerList())
+	assert.Empty(t, config.ServerCluster{}.PeerList())
+}
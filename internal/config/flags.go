@@ -0,0 +1,25 @@
+package config
+
+import (
+	flag "github.com/spf13/pflag"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+)
+
+// AddLogFlags binds logging flags shared by commands to cfg.
+func AddLogFlags(fs *flag.FlagSet, cfg *logger.Config) {
+	fs.StringVar(&cfg.Level, "log-level", cfg.Level, "log level: debug, info, warn or error")
+	fs.StringVar(&cfg.Format, "log-format", cfg.Format, "log format: json or console")
+	fs.IntVar(&cfg.SampleInitial, "log-sample-initial", cfg.SampleInitial,
+		"log first N entries with the same message every second, 0 disables sampling")
+	fs.IntVar(&cfg.SampleThereafter, "log-sample-thereafter", cfg.SampleThereafter,
+		"log every Nth entry with the same message after initial ones")
+}
+
+// AddTracingFlags binds tracing flags shared by commands to cfg.
+func AddTracingFlags(fs *flag.FlagSet, cfg *tracing.Config) {
+	fs.StringVar(&cfg.Endpoint, "otlp-endpoint", cfg.Endpoint, "OTLP/HTTP collector host:port, enables tracing")
+	fs.BoolVar(&cfg.Insecure, "otlp-insecure", cfg.Insecure, "export spans over plain HTTP")
+	fs.Float64Var(&cfg.SampleRatio, "trace-sample-ratio", cfg.SampleRatio, "fraction of sampled traces")
+}
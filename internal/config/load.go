@@ -0,0 +1,252 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// EnvPrefix starts names of environment variables, e.g. PUBSUB_SERVER_ADDR.
+	EnvPrefix = "PUBSUB"
+
+	// EnvFile is environment variable with config file path used when --config is not set.
+	EnvFile = EnvPrefix + "_CONFIG"
+
+	FlagFile = "config"
+)
+
+// AddFileFlag registers --config flag.
+func AddFileFlag(fs *flag.FlagSet) {
+	fs.String(FlagFile, "", "YAML or JSON config file, defaults to $"+EnvFile)
+}
+
+// Load parses args with fs which flags are bound to cfg fields and fills cfg with precedence:
+// defaults, config file, environment variables, explicitly set flags.
+func Load(fs *flag.FlagSet, args []string, cfg *Config) error {
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("parse flags failed: %w", err)
+	}
+
+	return Reload(fs, cfg)
+}
+
+// Reload fills cfg bound to already parsed fs with the same precedence as Load.
+// Called again it picks up changes of config file and environment variables while explicitly set flags still win.
+func Reload(fs *flag.FlagSet, cfg *Config) error {
+	changed := map[string]string{}
+
+	fs.Visit(func(f *flag.Flag) {
+		changed[f.Name] = f.Value.String()
+	})
+
+	*cfg = Default()
+
+	file := os.Getenv(EnvFile)
+	if f := fs.Lookup(FlagFile); f != nil && f.Changed {
+		file = f.Value.String()
+	}
+
+	if file != "" {
+		if err := LoadFile(file, cfg); err != nil {
+			return err
+		}
+	}
+
+	if err := LoadEnv(os.LookupEnv, cfg); err != nil {
+		return err
+	}
+
+	for name, value := range changed {
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("set flag %s failed: %w", name, err)
+		}
+	}
+
+	return cfg.Validate()
+}
+
+// LoadFile overrides cfg with values from YAML or JSON file chosen by extension.
+func LoadFile(file string, cfg *Config) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("read config file failed: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+
+		if err := dec.Decode(cfg); err != nil {
+			return fmt.Errorf("decode json config %s failed: %w", file, err)
+		}
+
+		return nil
+	}
+
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("decode yaml config %s failed: %w", file, err)
+	}
+
+	return nil
+}
+
+// LoadEnv overrides cfg with environment variables named after yaml keys,
+// e.g. server.tls.client_ca is PUBSUB_SERVER_TLS_CLIENT_CA.
+func LoadEnv(lookup func(string) (string, bool), cfg *Config) error {
+	return walk(reflect.ValueOf(cfg).Elem(), nil, func(keys []string, v reflect.Value) error {
+		name := envName(keys)
+
+		value, ok := lookup(name)
+		if !ok {
+			return nil
+		}
+
+		if err := setValue(v, value); err != nil {
+			return fmt.Errorf("environment variable %s=%q: %w", name, value, err)
+		}
+
+		return nil
+	})
+}
+
+// EnvNames returns names of all supported environment variables.
+func EnvNames() []string {
+	var names []string
+
+	cfg := Default()
+	_ = walk(reflect.ValueOf(&cfg).Elem(), nil, func(keys []string, _ reflect.Value) error {
+		names = append(names, envName(keys))
+
+		return nil
+	})
+
+	return names
+}
+
+// Diff returns dotted keys of settings which differ, e.g. server.log.level.
+func Diff(a, b Config) []string {
+	var keys []string
+
+	bv := reflect.ValueOf(&b).Elem()
+
+	_ = walk(reflect.ValueOf(&a).Elem(), nil, func(path []string, v reflect.Value) error {
+		other := bv
+		for _, key := range path {
+			other = fieldByKey(other, key)
+		}
+
+		if v.Interface() != other.Interface() {
+			keys = append(keys, strings.Join(path, "."))
+		}
+
+		return nil
+	})
+
+	return keys
+}
+
+func envName(keys []string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.Join(keys, "_"))
+}
+
+func fieldByKey(v reflect.Value, key string) reflect.Value {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if yamlKey(t.Field(i)) == key {
+			return v.Field(i)
+		}
+	}
+
+	return reflect.Value{}
+}
+
+func yamlKey(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("yaml"), ",")[0]
+}
+
+//nolint:gochecknoglobals // type is compared while walking config
+var durationType = reflect.TypeOf(Duration(0))
+
+// walk calls fn for every leaf setting with path of yaml keys.
+func walk(v reflect.Value, path []string, fn func(path []string, v reflect.Value) error) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := yamlKey(t.Field(i))
+		if key == "" || key == "-" {
+			continue
+		}
+
+		keys := append(append([]string{}, path...), key)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := walk(field, keys, fn); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := fn(keys, field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setValue(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parse duration failed: %w", err)
+		}
+
+		v.SetInt(int64(d))
+
+		return nil
+	}
+
+	switch v.Kind() { //nolint:exhaustive // config has no other kinds
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("parse int failed: %w", err)
+		}
+
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("parse bool failed: %w", err)
+		}
+
+		v.SetBool(b)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("parse float failed: %w", err)
+		}
+
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported kind %s", v.Kind())
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+package distributed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/scenario"
+)
+
+const (
+	defaultStartDelay      = 200 * time.Millisecond
+	defaultRegisterTimeout = 10 * time.Second
+)
+
+var ErrBadMessage = errors.New("unexpected message")
+
+// Coordinator runs a scenario on workers registered over TCP and aggregates their metrics.
+type Coordinator struct {
+	listener net.Listener
+	logger   *zap.Logger
+	workers  int
+
+	// startDelay gives every worker time to receive the phase message before the phase starts.
+	startDelay time.Duration
+	// registerTimeout is how long an accepted connection may take to send register message.
+	registerTimeout time.Duration
+
+	mu sync.Mutex
+	// phase is index of the current phase.
+	phase     int
+	snapshots []scenario.Snapshot
+}
+
+type CoordinatorOption func(c *Coordinator)
+
+// WithStartDelay sets how long after the phase message workers start the phase together.
+func WithStartDelay(delay time.Duration) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.startDelay = delay
+	}
+}
+
+// WithRegisterTimeout sets how long an accepted connection may take to register before it is dropped.
+func WithRegisterTimeout(timeout time.Duration) CoordinatorOption {
+	return func(c *Coordinator) {
+		c.registerTimeout = timeout
+	}
+}
+
+// NewCoordinator creates coordinator which accepts the number of workers on listener.
+func NewCoordinator(logger *zap.Logger, listener net.Listener, workers int, opts ...CoordinatorOption) *Coordinator {
+	c := &Coordinator{
+		listener:        listener,
+		logger:          logger,
+		workers:         workers,
+		startDelay:      defaultStartDelay,
+		registerTimeout: defaultRegisterTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// workerResult is received from a worker while phases run.
+type workerResult struct {
+	index int
+	phase int
+	err   error
+}
+
+// Run waits until all workers register, runs s on them phase by phase and returns result with metrics of all workers.
+// The listener is closed when Run returns.
+func (c *Coordinator) Run(ctx context.Context, s scenario.Scenario) (scenario.Result, error) {
+	result := scenario.Result{Name: s.Name}
+
+	peers, err := c.register(ctx)
+
+	defer func() {
+		for _, p := range peers {
+			p.close()
+		}
+	}()
+
+	if err != nil {
+		return result, err
+	}
+
+	c.snapshots = make([]scenario.Snapshot, len(peers))
+	results := make(chan workerResult, len(peers))
+
+	// Stops receive goroutines reporting results nobody waits for after Run returns.
+	done := make(chan struct{})
+	defer close(done)
+
+	for i, p := range peers {
+		share := scenario.Share(s, i, len(peers))
+		if err := p.send(message{Type: msgAssign, Index: i, Workers: len(peers), Scenario: &share}); err != nil {
+			return result, fmt.Errorf("worker %d: %w", i, err)
+		}
+
+		go c.receive(i, p, results, done)
+	}
+
+	probes := 0
+	probe := func() {
+		p := peers[probes%len(peers)]
+		probes++
+
+		if err := p.send(message{Type: msgProbe}); err != nil {
+			c.logger.Warn("probe failed", zap.Error(err))
+		}
+	}
+
+	for i, p := range s.Phases {
+		c.mu.Lock()
+		c.phase = i
+		c.mu.Unlock()
+
+		startAt := time.Now().Add(c.startDelay)
+
+		for _, peer := range peers {
+			// Workers receiving the message later start sooner, so that all start together.
+			if err := peer.send(message{Type: msgPhase, Phase: i, StartIn: time.Until(startAt)}); err != nil {
+				return result, err
+			}
+		}
+
+		if err := c.waitPhase(ctx, i, results); err != nil {
+			return result, err
+		}
+
+		failures := scenario.Check(ctx, p, c.merged, probe)
+		if ctx.Err() != nil {
+			failures = append(failures, "canceled")
+		}
+
+		pr := scenario.PhaseResult{
+			Name:     p.Name,
+			Duration: time.Since(startAt),
+			Metrics:  c.merged().Metrics(),
+			Failures: failures,
+		}
+		result.Phases = append(result.Phases, pr)
+
+		c.logger.Info("phase finished", zap.String("phase", pr.Name), zap.Bool("passed", pr.Passed()),
+			zap.Duration("duration", pr.Duration))
+
+		if !pr.Passed() {
+			result.Skipped = len(s.Phases) - i - 1
+
+			break
+		}
+	}
+
+	for _, p := range peers {
+		_ = p.send(message{Type: msgFinish})
+	}
+
+	return result, nil
+}
+
+// register accepts workers until all of them sent register message or ctx is done.
+func (c *Coordinator) register(ctx context.Context) ([]*peer, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+
+		_ = c.listener.Close()
+	}()
+
+	peers := make([]*peer, 0, c.workers)
+
+	for len(peers) < c.workers {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+
+			return peers, fmt.Errorf("accept worker failed, %d of %d registered: %w", len(peers), c.workers, err)
+		}
+
+		p := newPeer(conn)
+
+		// A connection which never registers must not stall registration of others.
+		_ = conn.SetReadDeadline(time.Now().Add(c.registerTimeout))
+
+		m, err := p.receive()
+		if err == nil {
+			err = conn.SetReadDeadline(time.Time{})
+		}
+
+		if err == nil && m.Type != msgRegister {
+			err = fmt.Errorf("%w %s, want %s", ErrBadMessage, m.Type, msgRegister)
+		}
+
+		if err != nil {
+			c.logger.Warn("worker registration failed", zap.String("remote_addr", conn.RemoteAddr().String()),
+				zap.Error(err))
+			p.close()
+
+			continue
+		}
+
+		c.logger.Info("worker registered", zap.String("name", m.Name), zap.Int("index", len(peers)),
+			zap.String("remote_addr", conn.RemoteAddr().String()))
+
+		peers = append(peers, p)
+	}
+
+	return peers, nil
+}
+
+// receive reads metrics streamed by worker index and reports done phases and errors to results until done is closed.
+func (c *Coordinator) receive(index int, p *peer, results chan<- workerResult, done <-chan struct{}) {
+	report := func(r workerResult) bool {
+		select {
+		case results <- r:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	for {
+		m, err := p.receive()
+		if err != nil {
+			report(workerResult{index: index, err: err})
+
+			return
+		}
+
+		switch m.Type {
+		case msgMetrics, msgPhaseDone:
+			if m.Snapshot != nil {
+				c.update(index, *m.Snapshot)
+			}
+
+			if m.Type == msgPhaseDone && !report(workerResult{index: index, phase: m.Phase}) {
+				return
+			}
+		default:
+			c.logger.Warn("unexpected message", zap.Int("worker", index), zap.String("type", m.Type))
+		}
+	}
+}
+
+// update keeps the latest snapshot of the current phase, snapshots of the previous phase may arrive late.
+func (c *Coordinator) update(index int, snapshot scenario.Snapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Runner counts phases from one.
+	if snapshot.Phase != c.phase+1 || snapshot.TakenAt.Before(c.snapshots[index].TakenAt) {
+		return
+	}
+
+	c.snapshots[index] = snapshot
+}
+
+// waitPhase waits until all workers finished phase.
+func (c *Coordinator) waitPhase(ctx context.Context, phase int, results <-chan workerResult) error {
+	for done := 0; done < len(c.snapshots); {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				return fmt.Errorf("worker %d lost: %w", r.index, r.err)
+			}
+
+			if r.phase == phase {
+				done++
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// merged returns metrics of the current phase of all workers.
+func (c *Coordinator) merged() scenario.Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return scenario.Merge(c.snapshots...)
+}
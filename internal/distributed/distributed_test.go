@@ -0,0 +1,245 @@
+package distributed_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/distributed"
+	"github.com/alexandear/websocket-pubsub/internal/scenario"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+)
+
+func newServer(t *testing.T) string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+	})
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestCoordinator_Run(t *testing.T) {
+	const workers = 3
+
+	s, err := scenario.Parse([]byte(`
+name: distributed
+phases:
+  - name: connect
+    connections: 10
+    assert: ["connections == 10", "num_connections == 10", "connect_errors == 0"]
+  - name: unsubscribe one
+    senders: 1
+    mix: {unsubscribe: 1}
+    assert: ["num_connections == 9", "connections == 9"]
+  - name: subscribe news
+    topic: news
+    connections: 11
+  - name: publish
+    topic: news
+    senders: 4
+    commands: 2
+    mix: {publish: 1}
+    assert: ["published == 8", "received.message == 16"]
+`))
+	require.NoError(t, err)
+
+	addr := newServer(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	workerErrs := make([]error, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			w := distributed.NewWorker(zap.NewNop(), addr, distributed.WithName("worker-"+strconv.Itoa(i)),
+				distributed.WithStreamInterval(20*time.Millisecond))
+			workerErrs[i] = w.Run(ctx, l.Addr().String())
+		}(i)
+	}
+
+	result, err := distributed.NewCoordinator(zap.NewNop(), l, workers,
+		distributed.WithStartDelay(10*time.Millisecond)).Run(ctx, s)
+
+	wg.Wait()
+
+	require.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, result.Print(out))
+	assert.True(t, result.Passed(), out.String())
+
+	for _, err := range workerErrs {
+		assert.NoError(t, err)
+	}
+}
+
+func TestCoordinator_Run_whenCanceled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	s, err := scenario.Parse([]byte("phases:\n  - connections: 1\n"))
+	require.NoError(t, err)
+
+	_, err = distributed.NewCoordinator(zap.NewNop(), l, 2).Run(ctx, s)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestCoordinator_Run_whenPhaseFailed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	goroutines := runtime.NumGoroutine()
+
+	// A connection which never registers is dropped after the register timeout.
+	silent, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	defer silent.Close()
+
+	workerDone := make(chan struct{})
+
+	go func() {
+		defer close(workerDone)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(`{"type":"register","name":"fake"}` + "\n"))
+		assert.NoError(t, err)
+
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			// Reports more than the coordinator waits for, then the phase fails.
+			if strings.Contains(line, `"type":"phase"`) {
+				_, err = conn.Write([]byte(strings.Repeat(`{"type":"phase_done"}`+"\n", 3)))
+				assert.NoError(t, err)
+			}
+		}
+	}()
+
+	s, err := scenario.Parse([]byte(`
+phases:
+  - connections: 1
+    assert: ["connections == 1"]
+    assert_timeout: 10ms
+`))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := distributed.NewCoordinator(zap.NewNop(), l, 1, distributed.WithStartDelay(0),
+		distributed.WithRegisterTimeout(50*time.Millisecond)).Run(ctx, s)
+	require.NoError(t, err)
+	assert.False(t, result.Passed())
+
+	<-workerDone
+	require.NoError(t, silent.Close())
+
+	assert.Eventually(t, func() bool {
+		// Eventually checks the condition in a goroutine of its own.
+		return runtime.NumGoroutine() <= goroutines+1
+	}, time.Second, 10*time.Millisecond, "goroutines receiving from the worker are stopped")
+}
+
+func TestWorker_Run_whenCoordinatorIsDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	err = distributed.NewWorker(zap.NewNop(), "localhost:1").Run(context.Background(), l.Addr().String())
+
+	assert.Error(t, err)
+}
+
+func TestWorker_Run_startsPhaseAfterDelay(t *testing.T) {
+	const startIn = 200 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	workerErr := make(chan error, 1)
+
+	go func() {
+		workerErr <- distributed.NewWorker(zap.NewNop(), "localhost:1").Run(ctx, l.Addr().String())
+	}()
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	require.Contains(t, line, `"type":"register"`)
+
+	_, err = conn.Write([]byte(`{"type":"assign","workers":1,"scenario":{"phases":[{"name":"idle"}]}}` + "\n"))
+	require.NoError(t, err)
+
+	// The delay is relative to receipt, clocks of the coordinator and the worker may differ.
+	sent := time.Now()
+	_, err = conn.Write([]byte(`{"type":"phase","start_in":` + strconv.Itoa(int(startIn)) + "}\n"))
+	require.NoError(t, err)
+
+	for !strings.Contains(line, `"type":"phase_done"`) {
+		line, err = r.ReadString('\n')
+		require.NoError(t, err)
+	}
+
+	assert.GreaterOrEqual(t, int64(time.Since(sent)), int64(startIn), "phase started before the delay")
+
+	_, err = conn.Write([]byte(`{"type":"finish"}` + "\n"))
+	require.NoError(t, err)
+	assert.NoError(t, <-workerErr)
+}
@@ -0,0 +1,84 @@
+package distributed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alexandear/websocket-pubsub/internal/scenario"
+)
+
+// Types of messages: a worker registers, the coordinator assigns it a share of the scenario,
+// then starts every phase on all workers at once. Workers stream metrics of the current phase
+// and report when the phase is done. The coordinator may ask a worker to probe num_connections
+// while checking assertions and finishes the run.
+const (
+	msgRegister  = "register"
+	msgAssign    = "assign"
+	msgPhase     = "phase"
+	msgMetrics   = "metrics"
+	msgPhaseDone = "phase_done"
+	msgProbe     = "probe"
+	msgFinish    = "finish"
+)
+
+// message is a line of JSON exchanged between the coordinator and a worker over TCP.
+type message struct {
+	Type string `json:"type"`
+	// Name of the registering worker.
+	Name string `json:"name,omitempty"`
+	// Index of the worker among Workers, Scenario is its share.
+	Index    int                `json:"index,omitempty"`
+	Workers  int                `json:"workers,omitempty"`
+	Scenario *scenario.Scenario `json:"scenario,omitempty"`
+	// Phase is index of the phase in the scenario.
+	Phase int `json:"phase,omitempty"`
+	// StartIn is how long after receiving the message workers start the phase. It is relative,
+	// so that clocks of the workers need not be in sync.
+	StartIn  time.Duration      `json:"start_in,omitempty"`
+	Snapshot *scenario.Snapshot `json:"snapshot,omitempty"`
+}
+
+// peer is one side of the connection between the coordinator and a worker.
+type peer struct {
+	conn net.Conn
+	dec  *json.Decoder
+
+	// Guards enc, messages are sent from several goroutines.
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newPeer(conn net.Conn) *peer {
+	return &peer{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(conn),
+	}
+}
+
+func (p *peer) send(m message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.enc.Encode(&m); err != nil {
+		return fmt.Errorf("send %s failed: %w", m.Type, err)
+	}
+
+	return nil
+}
+
+func (p *peer) receive() (message, error) {
+	var m message
+	if err := p.dec.Decode(&m); err != nil {
+		return message{}, fmt.Errorf("receive failed: %w", err)
+	}
+
+	return m, nil
+}
+
+func (p *peer) close() {
+	_ = p.conn.Close()
+}
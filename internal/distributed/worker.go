@@ -0,0 +1,232 @@
+package distributed
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
+	"github.com/alexandear/websocket-pubsub/internal/scenario"
+)
+
+const defaultStreamInterval = 250 * time.Millisecond
+
+// Worker runs its share of the coordinator scenario against the server.
+type Worker struct {
+	server string
+	logger *zap.Logger
+	name   string
+
+	tlsConfig          *tls.Config
+	codec              codec.Codec
+	compression        bool
+	maxConcurrentDials int
+
+	// streamInterval is how often metrics of the current phase are sent to the coordinator.
+	streamInterval time.Duration
+}
+
+type WorkerOption func(w *Worker)
+
+// WithName sets worker name shown by the coordinator.
+func WithName(name string) WorkerOption {
+	return func(w *Worker) {
+		w.name = name
+	}
+}
+
+// WithTLS dials wss:// using cfg.
+func WithTLS(cfg *tls.Config) WorkerOption {
+	return func(w *Worker) {
+		w.tlsConfig = cfg
+	}
+}
+
+// WithCodec negotiates protocol version and wire format cd with the server.
+func WithCodec(cd codec.Codec) WorkerOption {
+	return func(w *Worker) {
+		w.codec = cd
+	}
+}
+
+// WithCompression offers permessage-deflate to the server.
+func WithCompression() WorkerOption {
+	return func(w *Worker) {
+		w.compression = true
+	}
+}
+
+// WithMaxConcurrentDials limits how many dials may be in progress at once.
+func WithMaxConcurrentDials(n int) WorkerOption {
+	return func(w *Worker) {
+		w.maxConcurrentDials = n
+	}
+}
+
+// WithStreamInterval sets how often metrics are sent to the coordinator.
+func WithStreamInterval(interval time.Duration) WorkerOption {
+	return func(w *Worker) {
+		w.streamInterval = interval
+	}
+}
+
+func NewWorker(logger *zap.Logger, server string, opts ...WorkerOption) *Worker {
+	w := &Worker{
+		server:         server,
+		logger:         logger,
+		streamInterval: defaultStreamInterval,
+	}
+
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	return w
+}
+
+// Run registers at the coordinator, runs phases it is told to and streams metrics back until the coordinator
+// finishes the run. Connections to the server are closed when Run returns.
+func (w *Worker) Run(ctx context.Context, coordinator string) error {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", coordinator)
+	if err != nil {
+		return fmt.Errorf("dial coordinator failed: %w", err)
+	}
+
+	p := newPeer(conn)
+	defer p.close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.close()
+		case <-stop:
+		}
+	}()
+
+	if err := p.send(message{Type: msgRegister, Name: w.name}); err != nil {
+		return err
+	}
+
+	m, err := p.receive()
+	if err != nil {
+		return w.lost(ctx, err)
+	}
+
+	if m.Type != msgAssign || m.Scenario == nil {
+		return fmt.Errorf("%w %s, want %s", ErrBadMessage, m.Type, msgAssign)
+	}
+
+	share := *m.Scenario
+
+	w.logger.Info("registered", zap.Int("index", m.Index), zap.Int("workers", m.Workers))
+
+	opts := []scenario.Option{scenario.WithSeed(share.Seed)}
+	if w.tlsConfig != nil {
+		opts = append(opts, scenario.WithTLS(w.tlsConfig))
+	}
+
+	if w.codec != nil {
+		opts = append(opts, scenario.WithCodec(w.codec))
+	}
+
+	if w.compression {
+		opts = append(opts, scenario.WithCompression())
+	}
+
+	if w.maxConcurrentDials > 0 {
+		opts = append(opts, scenario.WithMaxConcurrentDials(w.maxConcurrentDials))
+	}
+
+	runner := scenario.New(w.logger, w.server, opts...)
+	defer runner.Close()
+
+	go w.stream(p, runner, stop)
+
+	for {
+		m, err := p.receive()
+		if err != nil {
+			return w.lost(ctx, err)
+		}
+
+		switch m.Type {
+		case msgPhase:
+			if m.Phase < 0 || m.Phase >= len(share.Phases) {
+				return fmt.Errorf("%w: phase %d of %d", ErrBadMessage, m.Phase, len(share.Phases))
+			}
+
+			if !sleepUntil(ctx, time.Now().Add(m.StartIn)) {
+				return ctx.Err()
+			}
+
+			runner.RunPhase(ctx, share.Phases[m.Phase])
+
+			snapshot := runner.Snapshot()
+			if err := p.send(message{Type: msgPhaseDone, Phase: m.Phase, Snapshot: &snapshot}); err != nil {
+				return w.lost(ctx, err)
+			}
+		case msgProbe:
+			runner.ProbeNumConnections()
+		case msgFinish:
+			w.logger.Info("finished")
+
+			return nil
+		default:
+			return fmt.Errorf("%w %s", ErrBadMessage, m.Type)
+		}
+	}
+}
+
+// stream sends metrics of the current phase until stop is closed.
+func (w *Worker) stream(p *peer, runner *scenario.Runner, stop <-chan struct{}) {
+	ticker := time.NewTicker(w.streamInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		snapshot := runner.Snapshot()
+		if snapshot.Phase == 0 {
+			continue
+		}
+
+		if err := p.send(message{Type: msgMetrics, Snapshot: &snapshot}); err != nil {
+			w.logger.Debug("stream metrics failed", zap.Error(err))
+
+			return
+		}
+	}
+}
+
+func (w *Worker) lost(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return fmt.Errorf("coordinator lost: %w", err)
+}
+
+// sleepUntil returns false when ctx is done first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,69 @@
+package codec
+
+import (
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+// cborCodec encodes the same maps as V1 JSON, keys are taken from json tags.
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) Version() int {
+	return V1
+}
+
+func (cborCodec) Subprotocol() string {
+	return "pubsub.v1.cbor"
+}
+
+func (cborCodec) Binary() bool {
+	return true
+}
+
+func (cborCodec) EncodeRequest(req operation.ReqCommand) ([]byte, error) {
+	data, err := cbor.Marshal(&req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal ReqCommand failed: %w", err)
+	}
+
+	return data, nil
+}
+
+func (cborCodec) DecodeRequest(data []byte) (operation.ReqCommand, error) {
+	var req operation.ReqCommand
+	if err := cbor.Unmarshal(data, &req); err != nil {
+		return operation.ReqCommand{}, fmt.Errorf("unmarshal to ReqCommand failed: %w", err)
+	}
+
+	return req, nil
+}
+
+func (cborCodec) EncodeResponse(resp operation.Resp) ([]byte, error) {
+	r, err := typedResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := cbor.Marshal(&r)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %T failed: %w", resp, err)
+	}
+
+	return data, nil
+}
+
+func (cborCodec) DecodeResponse(data []byte) (operation.Resp, error) {
+	var r response
+	if err := cbor.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("unmarshal response failed: %w", err)
+	}
+
+	return r.typed()
+}
@@ -0,0 +1,192 @@
+// Package codec encodes requests and responses of the pubsub protocol in several versions and wire formats.
+// A connection selects version and format with websocket subprotocol pubsub.vVERSION.FORMAT, e.g. pubsub.v1.msgpack.
+// Connections which negotiate no subprotocol speak legacy version 0.
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+var ErrUnknownResp = errors.New("unknown operation resp")
+
+// Protocol versions.
+const (
+	// V0 is bare JSON of clients which negotiate nothing, responses are told apart by their fields.
+	V0 = 0
+	// V1 adds binary formats and type of responses.
+	V1 = 1
+)
+
+// Types of V1 responses.
+const (
+	respTypeBroadcast      = "broadcast"
+	respTypeNumConnections = "num_connections"
+	respTypeMessage        = "message"
+)
+
+type Codec interface {
+	// Name is used in flags and configs, e.g. msgpack.
+	Name() string
+	Version() int
+	// Subprotocol is the websocket subprotocol which selects the codec, empty for V0.
+	Subprotocol() string
+	// Binary formats are not valid UTF-8, so they are always sent in binary frames.
+	Binary() bool
+
+	EncodeRequest(req operation.ReqCommand) ([]byte, error)
+	DecodeRequest(data []byte) (operation.ReqCommand, error)
+	// EncodeResponse accepts operation.RespBroadcast, operation.RespNumConnections and operation.RespMessage.
+	EncodeResponse(resp operation.Resp) ([]byte, error)
+	DecodeResponse(data []byte) (operation.Resp, error)
+}
+
+var (
+	Legacy  Codec = legacyCodec{}
+	JSON    Codec = jsonCodec{}
+	MsgPack Codec = msgpackCodec{}
+	CBOR    Codec = cborCodec{}
+	Proto   Codec = protoCodec{}
+)
+
+// codecs are negotiable codecs ordered by server preference, newer versions first.
+var codecs = []Codec{JSON, MsgPack, CBOR, Proto}
+
+// Names returns names of negotiable codecs.
+func Names() []string {
+	names := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
+
+	return names
+}
+
+// Subprotocols returns subprotocols of negotiable codecs in order of server preference.
+func Subprotocols() []string {
+	protocols := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		protocols = append(protocols, c.Subprotocol())
+	}
+
+	return protocols
+}
+
+func ByName(name string) (Codec, bool) {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// BySubprotocol returns Legacy for empty protocol as clients which negotiate nothing speak V0.
+func BySubprotocol(protocol string) (Codec, bool) {
+	if protocol == "" {
+		return Legacy, true
+	}
+
+	for _, c := range codecs {
+		if c.Subprotocol() == protocol {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+// response has fields of all responses of self-describing formats. V1 responses have type,
+// the kind of V0 responses is determined by fields which are set.
+// Data is JSON published by PUBLISH, binary formats carry it as a byte string so that clients with different
+// codecs receive the same payload.
+type response struct {
+	Type           string                 `json:"type,omitempty"`
+	ClientID       string                 `json:"client_id,omitempty"`
+	Timestamp      int                    `json:"timestamp,omitempty"`
+	SentAt         int64                  `json:"sent_at,omitempty"`
+	NumConnections *int                   `json:"num_connections,omitempty"`
+	Topic          string                 `json:"topic,omitempty"`
+	Data           json.RawMessage        `json:"data,omitempty"`
+	TraceContext   operation.TraceContext `json:"trace_context,omitempty"`
+}
+
+// typedResponse converts resp to V1 response.
+func typedResponse(resp operation.Resp) (response, error) {
+	switch r := deref(resp).(type) {
+	case operation.RespBroadcast:
+		return response{
+			Type: respTypeBroadcast, ClientID: r.ClientID, Timestamp: r.Timestamp, SentAt: r.SentAt,
+			TraceContext: r.TraceContext,
+		}, nil
+	case operation.RespNumConnections:
+		n := r.NumConnections
+
+		return response{Type: respTypeNumConnections, NumConnections: &n, TraceContext: r.TraceContext}, nil
+	case operation.RespMessage:
+		return response{
+			Type: respTypeMessage, Topic: r.Topic, Data: r.Data, SentAt: r.SentAt, TraceContext: r.TraceContext,
+		}, nil
+	default:
+		return response{}, fmt.Errorf("%w: %T", ErrUnknownResp, resp)
+	}
+}
+
+// typed converts V1 response.
+func (r response) typed() (operation.Resp, error) {
+	switch r.Type {
+	case respTypeBroadcast:
+		return operation.RespBroadcast{
+			ClientID: r.ClientID, Timestamp: r.Timestamp, SentAt: r.SentAt, TraceContext: r.TraceContext,
+		}, nil
+	case respTypeNumConnections:
+		var n int
+		if r.NumConnections != nil {
+			n = *r.NumConnections
+		}
+
+		return operation.RespNumConnections{NumConnections: n, TraceContext: r.TraceContext}, nil
+	case respTypeMessage:
+		return operation.RespMessage{
+			Topic: r.Topic, Data: r.Data, SentAt: r.SentAt, TraceContext: r.TraceContext,
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: type %q", ErrUnknownResp, r.Type)
+	}
+}
+
+// untyped converts V0 response.
+func (r response) untyped() (operation.Resp, error) {
+	switch {
+	case r.Topic != "":
+		return operation.RespMessage{
+			Topic: r.Topic, Data: r.Data, SentAt: r.SentAt, TraceContext: r.TraceContext,
+		}, nil
+	case r.Timestamp != 0:
+		return operation.RespBroadcast{
+			ClientID: r.ClientID, Timestamp: r.Timestamp, SentAt: r.SentAt, TraceContext: r.TraceContext,
+		}, nil
+	case r.NumConnections != nil:
+		return operation.RespNumConnections{NumConnections: *r.NumConnections, TraceContext: r.TraceContext}, nil
+	default:
+		return nil, ErrUnknownResp
+	}
+}
+
+// deref allows encoding pointers to responses as json.Marshal does.
+func deref(resp operation.Resp) operation.Resp {
+	switch r := resp.(type) {
+	case *operation.RespBroadcast:
+		return *r
+	case *operation.RespNumConnections:
+		return *r
+	case *operation.RespMessage:
+		return *r
+	default:
+		return resp
+	}
+}
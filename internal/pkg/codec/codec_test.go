@@ -0,0 +1,160 @@
+package codec_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/command"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+var all = []codec.Codec{codec.Legacy, codec.JSON, codec.MsgPack, codec.CBOR, codec.Proto}
+
+func TestCodec_Request(t *testing.T) {
+	for _, c := range all {
+		c := c
+		t.Run(fmt.Sprintf("v%d %s", c.Version(), c.Name()), func(t *testing.T) {
+			for _, req := range []operation.ReqCommand{
+				{Command: command.Subscribe},
+				{Command: command.Unsubscribe, Topic: "news"},
+				{
+					Command: command.Publish, Topic: "news", Data: json.RawMessage(`{"a":[1,"b"]}`), SentAt: 1600000000123456789,
+					TraceContext: operation.TraceContext{"traceparent": "00-1-2-01"},
+				},
+			} {
+				data, err := c.EncodeRequest(req)
+				require.NoError(t, err)
+
+				got, err := c.DecodeRequest(data)
+
+				require.NoError(t, err)
+				assert.Equal(t, req, got)
+			}
+		})
+	}
+}
+
+func TestCodec_Response(t *testing.T) {
+	traceContext := operation.TraceContext{"traceparent": "00-1-2-01"}
+
+	for _, c := range all {
+		c := c
+		t.Run(fmt.Sprintf("v%d %s", c.Version(), c.Name()), func(t *testing.T) {
+			for _, resp := range []operation.Resp{
+				operation.RespBroadcast{ClientID: "id", Timestamp: 1600000000, SentAt: 1600000000123456789},
+				operation.RespNumConnections{NumConnections: 3, TraceContext: traceContext},
+				operation.RespNumConnections{NumConnections: 0},
+				operation.RespMessage{Topic: "news", Data: json.RawMessage(`"hello"`), SentAt: 1, TraceContext: traceContext},
+			} {
+				data, err := c.EncodeResponse(resp)
+				require.NoError(t, err)
+
+				got, err := c.DecodeResponse(data)
+
+				require.NoError(t, err)
+				assert.Equal(t, resp, got)
+			}
+		})
+	}
+}
+
+func TestCodec_Errors(t *testing.T) {
+	for _, c := range all {
+		c := c
+		t.Run(fmt.Sprintf("v%d %s", c.Version(), c.Name()), func(t *testing.T) {
+			_, err := c.EncodeResponse("text")
+			assert.ErrorIs(t, err, codec.ErrUnknownResp)
+
+			_, err = c.DecodeResponse([]byte{0xff, 0xff})
+			assert.Error(t, err)
+
+			_, err = c.DecodeRequest([]byte{0xff, 0xff})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLegacy_Format(t *testing.T) {
+	data, err := codec.Legacy.EncodeResponse(&operation.RespBroadcast{ClientID: "id", Timestamp: 1, SentAt: 2})
+
+	require.NoError(t, err)
+	assert.Equal(t, `{"client_id":"id","timestamp":1,"sent_at":2}`, string(data))
+
+	_, err = codec.Legacy.DecodeResponse([]byte(`{"unknown":1}`))
+	assert.ErrorIs(t, err, codec.ErrUnknownResp)
+}
+
+func TestJSON_Typed(t *testing.T) {
+	data, err := codec.JSON.EncodeResponse(operation.RespNumConnections{})
+
+	require.NoError(t, err)
+	assert.Equal(t, `{"type":"num_connections","num_connections":0}`, string(data))
+
+	resp, err := codec.JSON.DecodeResponse([]byte(`{"type":"broadcast","client_id":"id"}`))
+	require.NoError(t, err)
+	assert.Equal(t, operation.RespBroadcast{ClientID: "id"}, resp, "V1 does not guess kind by fields")
+
+	_, err = codec.JSON.DecodeResponse([]byte(`{"topic":"news","data":1}`))
+	assert.ErrorIs(t, err, codec.ErrUnknownResp, "V1 requires type")
+}
+
+func TestBinary_Smaller(t *testing.T) {
+	resp := operation.RespBroadcast{ClientID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Timestamp: 1600000000,
+		SentAt: 1600000000123456789}
+	jsonData, err := codec.JSON.EncodeResponse(resp)
+	require.NoError(t, err)
+
+	for _, c := range []codec.Codec{codec.MsgPack, codec.CBOR, codec.Proto} {
+		data, err := c.EncodeResponse(resp)
+		require.NoError(t, err)
+
+		assert.Less(t, len(data), len(jsonData), c.Name())
+	}
+}
+
+func TestProto_SkipsUnknownFields(t *testing.T) {
+	var data []byte
+	data = protowire.AppendTag(data, 15, protowire.VarintType)
+	data = protowire.AppendVarint(data, 1)
+	data = protowire.AppendTag(data, 1, protowire.BytesType)
+	data = protowire.AppendString(data, string(command.NumConnections))
+	data = protowire.AppendTag(data, 16, protowire.BytesType)
+	data = protowire.AppendString(data, "future")
+
+	req, err := codec.Proto.DecodeRequest(data)
+
+	require.NoError(t, err)
+	assert.Equal(t, operation.ReqCommand{Command: command.NumConnections}, req)
+}
+
+func TestBySubprotocol(t *testing.T) {
+	for _, c := range all[1:] {
+		assert.Equal(t, codec.V1, c.Version())
+
+		got, ok := codec.BySubprotocol(c.Subprotocol())
+		assert.True(t, ok)
+		assert.Equal(t, c, got)
+
+		got, ok = codec.ByName(c.Name())
+		assert.True(t, ok)
+		assert.Equal(t, c, got)
+	}
+
+	got, ok := codec.BySubprotocol("")
+	assert.True(t, ok)
+	assert.Equal(t, codec.Legacy, got)
+	assert.Equal(t, codec.V0, got.Version())
+
+	_, ok = codec.BySubprotocol("pubsub.v9.json")
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{"pubsub.v1.json", "pubsub.v1.msgpack", "pubsub.v1.cbor", "pubsub.v1.proto"},
+		codec.Subprotocols())
+	assert.Equal(t, []string{"json", "msgpack", "cbor", "proto"}, codec.Names())
+}
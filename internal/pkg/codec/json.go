@@ -0,0 +1,67 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Version() int {
+	return V1
+}
+
+func (jsonCodec) Subprotocol() string {
+	return "pubsub.v1.json"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) EncodeRequest(req operation.ReqCommand) ([]byte, error) {
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal ReqCommand failed: %w", err)
+	}
+
+	return data, nil
+}
+
+func (jsonCodec) DecodeRequest(data []byte) (operation.ReqCommand, error) {
+	var req operation.ReqCommand
+	if err := json.Unmarshal(data, &req); err != nil {
+		return operation.ReqCommand{}, fmt.Errorf("unmarshal to ReqCommand failed: %w", err)
+	}
+
+	return req, nil
+}
+
+func (jsonCodec) EncodeResponse(resp operation.Resp) ([]byte, error) {
+	r, err := typedResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %T failed: %w", resp, err)
+	}
+
+	return data, nil
+}
+
+func (jsonCodec) DecodeResponse(data []byte) (operation.Resp, error) {
+	var r response
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("unmarshal response failed: %w", err)
+	}
+
+	return r.typed()
+}
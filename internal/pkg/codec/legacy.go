@@ -0,0 +1,77 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+// legacyCodec is V0 spoken by clients which negotiate no subprotocol. Its format must not change.
+type legacyCodec struct{}
+
+func (legacyCodec) Name() string {
+	return "json"
+}
+
+func (legacyCodec) Version() int {
+	return V0
+}
+
+func (legacyCodec) Subprotocol() string {
+	return ""
+}
+
+func (legacyCodec) Binary() bool {
+	return false
+}
+
+func (legacyCodec) EncodeRequest(req operation.ReqCommand) ([]byte, error) {
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal ReqCommand failed: %w", err)
+	}
+
+	return data, nil
+}
+
+func (legacyCodec) DecodeRequest(data []byte) (operation.ReqCommand, error) {
+	var req operation.ReqCommand
+	if err := json.Unmarshal(data, &req); err != nil {
+		return operation.ReqCommand{}, fmt.Errorf("unmarshal to ReqCommand failed: %w", err)
+	}
+
+	return req, nil
+}
+
+func (legacyCodec) EncodeResponse(resp operation.Resp) ([]byte, error) {
+	if err := checkResp(resp); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %T failed: %w", resp, err)
+	}
+
+	return data, nil
+}
+
+func (legacyCodec) DecodeResponse(data []byte) (operation.Resp, error) {
+	var r response
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("unmarshal response failed: %w", err)
+	}
+
+	return r.untyped()
+}
+
+func checkResp(resp operation.Resp) error {
+	switch resp.(type) {
+	case operation.RespBroadcast, operation.RespNumConnections, operation.RespMessage,
+		*operation.RespBroadcast, *operation.RespNumConnections, *operation.RespMessage:
+		return nil
+	default:
+		return fmt.Errorf("%w: %T", ErrUnknownResp, resp)
+	}
+}
@@ -0,0 +1,90 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+// msgpackCodec encodes the same maps as V1 JSON, keys are taken from json tags.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Version() int {
+	return V1
+}
+
+func (msgpackCodec) Subprotocol() string {
+	return "pubsub.v1.msgpack"
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) EncodeRequest(req operation.ReqCommand) ([]byte, error) {
+	data, err := msgpackMarshal(&req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal ReqCommand failed: %w", err)
+	}
+
+	return data, nil
+}
+
+func (msgpackCodec) DecodeRequest(data []byte) (operation.ReqCommand, error) {
+	var req operation.ReqCommand
+	if err := msgpackUnmarshal(data, &req); err != nil {
+		return operation.ReqCommand{}, fmt.Errorf("unmarshal to ReqCommand failed: %w", err)
+	}
+
+	return req, nil
+}
+
+func (msgpackCodec) EncodeResponse(resp operation.Resp) ([]byte, error) {
+	r, err := typedResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := msgpackMarshal(&r)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %T failed: %w", resp, err)
+	}
+
+	return data, nil
+}
+
+func (msgpackCodec) DecodeResponse(data []byte) (operation.Resp, error) {
+	var r response
+	if err := msgpackUnmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("unmarshal response failed: %w", err)
+	}
+
+	return r.typed()
+}
+
+func msgpackMarshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func msgpackUnmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
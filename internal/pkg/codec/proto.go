@@ -0,0 +1,396 @@
+package codec
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/command"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+// Field numbers of pubsub.proto.
+const (
+	protoRequestCommand      protowire.Number = 1
+	protoRequestTopic        protowire.Number = 2
+	protoRequestData         protowire.Number = 3
+	protoRequestSentAt       protowire.Number = 4
+	protoRequestTraceContext protowire.Number = 5
+
+	protoResponseBroadcast      protowire.Number = 1
+	protoResponseNumConnections protowire.Number = 2
+	protoResponseMessage        protowire.Number = 3
+	protoResponseTraceContext   protowire.Number = 4
+
+	protoBroadcastClientID  protowire.Number = 1
+	protoBroadcastTimestamp protowire.Number = 2
+	protoBroadcastSentAt    protowire.Number = 3
+
+	protoNumConnections protowire.Number = 1
+
+	protoMessageTopic  protowire.Number = 1
+	protoMessageData   protowire.Number = 2
+	protoMessageSentAt protowire.Number = 3
+
+	protoMapKey   protowire.Number = 1
+	protoMapValue protowire.Number = 2
+)
+
+// protoCodec encodes messages of pubsub.proto by hand with protowire, so no generated code is needed.
+type protoCodec struct{}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+func (protoCodec) Version() int {
+	return V1
+}
+
+func (protoCodec) Subprotocol() string {
+	return "pubsub.v1.proto"
+}
+
+func (protoCodec) Binary() bool {
+	return true
+}
+
+func (protoCodec) EncodeRequest(req operation.ReqCommand) ([]byte, error) {
+	var b []byte
+	b = appendString(b, protoRequestCommand, string(req.Command))
+	b = appendString(b, protoRequestTopic, req.Topic)
+	b = appendBytes(b, protoRequestData, req.Data)
+	b = appendInt(b, protoRequestSentAt, req.SentAt)
+	b = appendMap(b, protoRequestTraceContext, req.TraceContext)
+
+	return b, nil
+}
+
+func (protoCodec) DecodeRequest(data []byte) (operation.ReqCommand, error) {
+	var req operation.ReqCommand
+
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == protoRequestCommand && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			req.Command = command.Type(v)
+
+			return n, nil
+		case num == protoRequestTopic && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			req.Topic = v
+
+			return n, nil
+		case num == protoRequestData && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			req.Data = append([]byte(nil), v...)
+
+			return n, nil
+		case num == protoRequestSentAt && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			req.SentAt = int64(v)
+
+			return n, nil
+		case num == protoRequestTraceContext && typ == protowire.BytesType:
+			if req.TraceContext == nil {
+				req.TraceContext = operation.TraceContext{}
+			}
+
+			return consumeMapEntry(b, req.TraceContext)
+		default:
+			return skipField(num, typ, b)
+		}
+	})
+	if err != nil {
+		return operation.ReqCommand{}, fmt.Errorf("unmarshal to ReqCommand failed: %w", err)
+	}
+
+	return req, nil
+}
+
+func (protoCodec) EncodeResponse(resp operation.Resp) ([]byte, error) {
+	var (
+		b            []byte
+		traceContext operation.TraceContext
+	)
+
+	switch r := deref(resp).(type) {
+	case operation.RespBroadcast:
+		var m []byte
+		m = appendString(m, protoBroadcastClientID, r.ClientID)
+		m = appendInt(m, protoBroadcastTimestamp, int64(r.Timestamp))
+		m = appendInt(m, protoBroadcastSentAt, r.SentAt)
+		b = appendMessage(b, protoResponseBroadcast, m)
+		traceContext = r.TraceContext
+	case operation.RespNumConnections:
+		var m []byte
+		m = appendInt(m, protoNumConnections, int64(r.NumConnections))
+		b = appendMessage(b, protoResponseNumConnections, m)
+		traceContext = r.TraceContext
+	case operation.RespMessage:
+		var m []byte
+		m = appendString(m, protoMessageTopic, r.Topic)
+		m = appendBytes(m, protoMessageData, r.Data)
+		m = appendInt(m, protoMessageSentAt, r.SentAt)
+		b = appendMessage(b, protoResponseMessage, m)
+		traceContext = r.TraceContext
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnknownResp, resp)
+	}
+
+	return appendMap(b, protoResponseTraceContext, traceContext), nil
+}
+
+func (protoCodec) DecodeResponse(data []byte) (operation.Resp, error) {
+	var (
+		resp         operation.Resp
+		traceContext operation.TraceContext
+	)
+
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType {
+			return skipField(num, typ, b)
+		}
+
+		var err error
+
+		switch num {
+		case protoResponseBroadcast:
+			resp, err = decodeBroadcast(b)
+		case protoResponseNumConnections:
+			resp, err = decodeNumConnections(b)
+		case protoResponseMessage:
+			resp, err = decodeMessage(b)
+		case protoResponseTraceContext:
+			if traceContext == nil {
+				traceContext = operation.TraceContext{}
+			}
+
+			return consumeMapEntry(b, traceContext)
+		default:
+			return skipField(num, typ, b)
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		_, n := protowire.ConsumeBytes(b)
+
+		return n, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal response failed: %w", err)
+	}
+
+	switch r := resp.(type) {
+	case operation.RespBroadcast:
+		r.TraceContext = traceContext
+
+		return r, nil
+	case operation.RespNumConnections:
+		r.TraceContext = traceContext
+
+		return r, nil
+	case operation.RespMessage:
+		r.TraceContext = traceContext
+
+		return r, nil
+	default:
+		return nil, ErrUnknownResp
+	}
+}
+
+func decodeBroadcast(b []byte) (operation.RespBroadcast, error) {
+	var r operation.RespBroadcast
+
+	err := consumeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == protoBroadcastClientID && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			r.ClientID = v
+
+			return n, nil
+		case num == protoBroadcastTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.Timestamp = int(v)
+
+			return n, nil
+		case num == protoBroadcastSentAt && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.SentAt = int64(v)
+
+			return n, nil
+		default:
+			return skipField(num, typ, b)
+		}
+	})
+
+	return r, err
+}
+
+func decodeNumConnections(b []byte) (operation.RespNumConnections, error) {
+	var r operation.RespNumConnections
+
+	err := consumeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == protoNumConnections && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			r.NumConnections = int(v)
+
+			return n, nil
+		}
+
+		return skipField(num, typ, b)
+	})
+
+	return r, err
+}
+
+func decodeMessage(b []byte) (operation.RespMessage, error) {
+	var r operation.RespMessage
+
+	err := consumeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == protoMessageTopic && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			r.Topic = v
+
+			return n, nil
+		case num == protoMessageData && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			r.Data = append([]byte(nil), v...)
+
+			return n, nil
+		case num == protoMessageSentAt && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.SentAt = int64(v)
+
+			return n, nil
+		default:
+			return skipField(num, typ, b)
+		}
+	})
+
+	return r, err
+}
+
+// consumeFields calls field with the value of every field, field returns length of the value or negative protowire
+// error code. Unknown fields are skipped for forward compatibility.
+func consumeFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// consumeMessage consumes fields of the length-prefixed message at the start of b.
+func consumeMessage(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	m, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return protowire.ParseError(n)
+	}
+
+	return consumeFields(m, field)
+}
+
+func consumeMapEntry(b []byte, m map[string]string) (int, error) {
+	var key, value string
+
+	entry, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+
+	err := consumeFields(entry, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == protoMapKey && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			key = v
+
+			return n, nil
+		case num == protoMapValue && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			value = v
+
+			return n, nil
+		default:
+			return skipField(num, typ, b)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	m[key] = value
+
+	return n, nil
+}
+
+func skipField(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+	return protowire.ConsumeFieldValue(num, typ, b), nil
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendString(b, v)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendBytes(b, v)
+}
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// appendMessage appends message m even when it is empty, so that oneof kind is set.
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendBytes(b, m)
+}
+
+func appendMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	for k, v := range m {
+		var entry []byte
+		entry = appendString(entry, protoMapKey, k)
+		entry = appendString(entry, protoMapValue, v)
+		b = appendMessage(b, num, entry)
+	}
+
+	return b
+}
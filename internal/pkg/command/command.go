@@ -6,4 +6,5 @@ const (
 	Subscribe      Type = "SUBSCRIBE"
 	Unsubscribe    Type = "UNSUBSCRIBE"
 	NumConnections Type = "NUM_CONNECTIONS"
+	Publish        Type = "PUBLISH"
 )
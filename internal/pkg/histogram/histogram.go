@@ -0,0 +1,154 @@
+package histogram
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// subBucketBits gives 64 linear sub-buckets per power of two, so recorded values
+// are reported with at most 1/64 (about 1.6%) relative error, like HDR histogram with 2 significant digits.
+const (
+	subBucketBits  = 7
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount / 2
+)
+
+// Histogram counts durations in log-linear buckets. It is not safe for concurrent use.
+type Histogram struct {
+	counts []int64
+	total  int64
+	min    time.Duration
+	max    time.Duration
+}
+
+func New() *Histogram {
+	return &Histogram{}
+}
+
+// Record adds d, negative durations are recorded as zero.
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	i := index(uint64(d))
+	if i >= len(h.counts) {
+		counts := make([]int64, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+
+	h.counts[i]++
+
+	if h.total == 0 || d < h.min {
+		h.min = d
+	}
+
+	if d > h.max {
+		h.max = d
+	}
+
+	h.total++
+}
+
+// Merge adds all values recorded by other.
+func (h *Histogram) Merge(other *Histogram) {
+	if other.total == 0 {
+		return
+	}
+
+	if len(other.counts) > len(h.counts) {
+		counts := make([]int64, len(other.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+
+	if h.total == 0 || other.min < h.min {
+		h.min = other.min
+	}
+
+	if other.max > h.max {
+		h.max = other.max
+	}
+
+	h.total += other.total
+}
+
+// Reset removes all recorded values.
+func (h *Histogram) Reset() {
+	*h = Histogram{counts: h.counts[:0]}
+}
+
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+func (h *Histogram) Min() time.Duration {
+	return h.min
+}
+
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Quantile returns the highest value equivalent to the value at quantile q in [0, 1],
+// zero when nothing is recorded.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(q * float64(h.total)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			v := time.Duration(highestEquivalent(i))
+			if v > h.max {
+				return h.max
+			}
+
+			if v < h.min {
+				return h.min
+			}
+
+			return v
+		}
+	}
+
+	return h.max
+}
+
+// index returns bucket of v: values below subBucketCount have own buckets,
+// larger ones share subBucketHalf buckets per power of two.
+func index(v uint64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+
+	shift := bits.Len64(v) - subBucketBits
+	top := v >> uint(shift)
+
+	return subBucketCount + (shift-1)*subBucketHalf + int(top-subBucketHalf)
+}
+
+func highestEquivalent(i int) uint64 {
+	if i < subBucketCount {
+		return uint64(i)
+	}
+
+	shift := (i-subBucketCount)/subBucketHalf + 1
+	top := uint64((i-subBucketCount)%subBucketHalf + subBucketHalf)
+
+	return (top+1)<<uint(shift) - 1
+}
@@ -0,0 +1,62 @@
+package histogram_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/histogram"
+)
+
+func TestHistogram(t *testing.T) {
+	t.Run("when empty", func(t *testing.T) {
+		h := histogram.New()
+
+		assert.Zero(t, h.Count())
+		assert.Zero(t, h.Quantile(0.99))
+	})
+
+	t.Run("quantiles", func(t *testing.T) {
+		h := histogram.New()
+		for i := 1; i <= 1000; i++ {
+			h.Record(time.Duration(i) * time.Millisecond)
+		}
+
+		assert.Equal(t, int64(1000), h.Count())
+		assert.Equal(t, time.Millisecond, h.Min())
+		assert.Equal(t, time.Second, h.Max())
+		assert.InEpsilon(t, float64(500*time.Millisecond), float64(h.Quantile(0.5)), 1.0/64)
+		assert.InEpsilon(t, float64(990*time.Millisecond), float64(h.Quantile(0.99)), 1.0/64)
+		assert.Equal(t, time.Second, h.Quantile(1))
+		assert.InEpsilon(t, float64(time.Millisecond), float64(h.Quantile(0)), 1.0/64)
+	})
+
+	t.Run("small values are exact", func(t *testing.T) {
+		h := histogram.New()
+		h.Record(3)
+		h.Record(100)
+		h.Record(-5)
+
+		assert.Equal(t, time.Duration(0), h.Quantile(0.1))
+		assert.Equal(t, time.Duration(3), h.Quantile(0.5))
+		assert.Equal(t, time.Duration(100), h.Quantile(1))
+	})
+
+	t.Run("merge and reset", func(t *testing.T) {
+		a, b := histogram.New(), histogram.New()
+		a.Record(time.Millisecond)
+		b.Record(time.Hour)
+
+		a.Merge(b)
+
+		assert.Equal(t, int64(2), a.Count())
+		assert.Equal(t, time.Millisecond, a.Min())
+		assert.Equal(t, time.Hour, a.Max())
+
+		a.Reset()
+
+		assert.Zero(t, a.Count())
+		assert.Zero(t, a.Max())
+	})
+}
@@ -0,0 +1,102 @@
+// Package logger builds the structured logger of server and client commands.
+//
+// *zap.Logger is the logging abstraction of the module: it is created here from Config and injected into
+// server.App, server.Hub, clients and the load generator, which annotate it with fields using the helpers below
+// instead of formatting free-form strings. Tests inject zap.NewNop.
+package logger
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var ErrBadFormat = errors.New("unknown log format")
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+
+	// Field keys shared by server and client logs.
+	FieldClientID   = "client_id"
+	FieldRemoteAddr = "remote_addr"
+	FieldPrincipal  = "principal"
+)
+
+// Connection annotates l with fields of a websocket connection, principal is empty without mutual TLS.
+func Connection(l *zap.Logger, remoteAddr, principal string) *zap.Logger {
+	return l.With(zap.String(FieldRemoteAddr, remoteAddr), zap.String(FieldPrincipal, principal))
+}
+
+// Client annotates l with ID of a client.
+func Client(l *zap.Logger, id string) *zap.Logger {
+	return l.With(zap.String(FieldClientID, id))
+}
+
+type Config struct {
+	// Level is one of debug, info, warn, error.
+	Level string `yaml:"level" json:"level"`
+	// Format is json or console.
+	Format string `yaml:"format" json:"format"`
+
+	// SampleInitial entries with the same level and message are logged every second,
+	// then every SampleThereafter one. Zero SampleInitial disables sampling.
+	SampleInitial    int `yaml:"sample_initial" json:"sample_initial"`
+	SampleThereafter int `yaml:"sample_thereafter" json:"sample_thereafter"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Level:            "info",
+		Format:           FormatJSON,
+		SampleInitial:    100,
+		SampleThereafter: 100,
+	}
+}
+
+// New creates logger writing to stderr.
+func New(cfg Config) (*zap.Logger, error) {
+	l, _, err := NewLeveled(cfg)
+
+	return l, err
+}
+
+// NewLeveled creates logger writing to stderr with level which may be changed at runtime.
+func NewLeveled(cfg Config) (*zap.Logger, zap.AtomicLevel, error) {
+	level := zap.NewAtomicLevel()
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, level, fmt.Errorf("parse log level failed: %w", err)
+	}
+
+	if cfg.Format != FormatJSON && cfg.Format != FormatConsole {
+		return nil, level, fmt.Errorf("%s: %w", cfg.Format, ErrBadFormat)
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "time"
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	zcfg := zap.Config{
+		Level:            level,
+		Encoding:         cfg.Format,
+		EncoderConfig:    encoderConfig,
+		OutputPaths:      []string{"stderr"},
+		ErrorOutputPaths: []string{"stderr"},
+	}
+
+	if cfg.SampleInitial > 0 {
+		zcfg.Sampling = &zap.SamplingConfig{
+			Initial:    cfg.SampleInitial,
+			Thereafter: cfg.SampleThereafter,
+		}
+	}
+
+	l, err := zcfg.Build()
+	if err != nil {
+		return nil, level, fmt.Errorf("build logger failed: %w", err)
+	}
+
+	return l, level, nil
+}
@@ -0,0 +1,74 @@
+package logger_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("when default config", func(t *testing.T) {
+		l, err := logger.New(logger.DefaultConfig())
+
+		require.NoError(t, err)
+		assert.True(t, l.Core().Enabled(zapcore.InfoLevel))
+		assert.False(t, l.Core().Enabled(zapcore.DebugLevel))
+	})
+
+	t.Run("when debug level without sampling", func(t *testing.T) {
+		cfg := logger.DefaultConfig()
+		cfg.Level = "debug"
+		cfg.Format = logger.FormatConsole
+		cfg.SampleInitial = 0
+
+		l, err := logger.New(cfg)
+
+		require.NoError(t, err)
+		assert.True(t, l.Core().Enabled(zapcore.DebugLevel))
+	})
+
+	t.Run("when unknown level", func(t *testing.T) {
+		cfg := logger.DefaultConfig()
+		cfg.Level = "verbose"
+
+		_, err := logger.New(cfg)
+
+		assert.Error(t, err)
+	})
+
+	t.Run("when unknown format", func(t *testing.T) {
+		cfg := logger.DefaultConfig()
+		cfg.Format = "xml"
+
+		_, err := logger.New(cfg)
+
+		assert.ErrorIs(t, err, logger.ErrBadFormat)
+	})
+}
+
+func TestNewLeveled(t *testing.T) {
+	l, level, err := logger.NewLeveled(logger.DefaultConfig())
+	require.NoError(t, err)
+
+	require.NoError(t, level.UnmarshalText([]byte("debug")))
+
+	assert.True(t, l.Core().Enabled(zapcore.DebugLevel))
+}
+
+func TestConnection(t *testing.T) {
+	var buf bytes.Buffer
+
+	l := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}),
+		zapcore.AddSync(&buf), zapcore.InfoLevel))
+
+	logger.Client(logger.Connection(l, "10.0.0.1:5000", "CN=device"), "id").Info("connected")
+
+	assert.JSONEq(t, `{"msg":"connected","remote_addr":"10.0.0.1:5000","principal":"CN=device","client_id":"id"}`,
+		buf.String())
+}
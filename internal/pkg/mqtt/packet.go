@@ -0,0 +1,564 @@
+// Package mqtt encodes and decodes MQTT 3.1.1 control packets.
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Subprotocol is the websocket subprotocol of MQTT connections.
+const Subprotocol = "mqtt"
+
+const (
+	ProtocolName  = "MQTT"
+	ProtocolLevel = 4
+
+	// SubackFailure is the SUBACK return code of rejected subscriptions.
+	SubackFailure = 0x80
+
+	maxRemainingLength = 268_435_455
+)
+
+// CONNACK return codes.
+const (
+	Accepted                  = 0
+	RefusedProtocolVersion    = 1
+	RefusedIdentifierRejected = 2
+)
+
+type PacketType byte
+
+const (
+	TypeConnect     PacketType = 1
+	TypeConnack     PacketType = 2
+	TypePublish     PacketType = 3
+	TypePuback      PacketType = 4
+	TypeSubscribe   PacketType = 8
+	TypeSuback      PacketType = 9
+	TypeUnsubscribe PacketType = 10
+	TypeUnsuback    PacketType = 11
+	TypePingreq     PacketType = 12
+	TypePingresp    PacketType = 13
+	TypeDisconnect  PacketType = 14
+)
+
+var (
+	ErrMalformed = errors.New("malformed packet")
+	ErrTooLarge  = errors.New("packet too large")
+)
+
+// Packet is a control packet.
+type Packet interface {
+	// Encode returns packet with the fixed header.
+	Encode() []byte
+}
+
+type Connect struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	CleanSession  bool
+	KeepAlive     uint16
+	ClientID      string
+	// Will is sent when the connection is lost, nil without will.
+	Will     *Will
+	Username *string
+	Password []byte
+}
+
+type Will struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+type Connack struct {
+	SessionPresent bool
+	ReturnCode     byte
+}
+
+type Publish struct {
+	Dup    bool
+	QoS    byte
+	Retain bool
+	Topic  string
+	// PacketID is set for QoS 1 and 2.
+	PacketID uint16
+	Payload  []byte
+}
+
+type Puback struct {
+	PacketID uint16
+}
+
+type Subscribe struct {
+	PacketID      uint16
+	Subscriptions []Subscription
+}
+
+type Subscription struct {
+	Topic string
+	QoS   byte
+}
+
+type Suback struct {
+	PacketID uint16
+	// ReturnCodes are granted QoS or SubackFailure for each subscription.
+	ReturnCodes []byte
+}
+
+type Unsubscribe struct {
+	PacketID uint16
+	Topics   []string
+}
+
+type Unsuback struct {
+	PacketID uint16
+}
+
+type Pingreq struct{}
+
+type Pingresp struct{}
+
+type Disconnect struct{}
+
+// Connect flags.
+const (
+	flagCleanSession = 1 << 1
+	flagWill         = 1 << 2
+	flagWillRetain   = 1 << 5
+	flagPassword     = 1 << 6
+	flagUsername     = 1 << 7
+	willQoSShift     = 3
+)
+
+func (p *Connect) Encode() []byte {
+	var body bytes.Buffer
+
+	writeString(&body, p.ProtocolName)
+	body.WriteByte(p.ProtocolLevel)
+
+	var flags byte
+	if p.CleanSession {
+		flags |= flagCleanSession
+	}
+
+	if p.Will != nil {
+		flags |= flagWill | p.Will.QoS<<willQoSShift
+		if p.Will.Retain {
+			flags |= flagWillRetain
+		}
+	}
+
+	if p.Username != nil {
+		flags |= flagUsername
+	}
+
+	if p.Password != nil {
+		flags |= flagPassword
+	}
+
+	body.WriteByte(flags)
+	writeUint16(&body, p.KeepAlive)
+	writeString(&body, p.ClientID)
+
+	if p.Will != nil {
+		writeString(&body, p.Will.Topic)
+		writeBytes(&body, p.Will.Payload)
+	}
+
+	if p.Username != nil {
+		writeString(&body, *p.Username)
+	}
+
+	if p.Password != nil {
+		writeBytes(&body, p.Password)
+	}
+
+	return encode(TypeConnect, 0, body.Bytes())
+}
+
+func (p *Connack) Encode() []byte {
+	var ack byte
+	if p.SessionPresent {
+		ack = 1
+	}
+
+	return encode(TypeConnack, 0, []byte{ack, p.ReturnCode})
+}
+
+func (p *Publish) Encode() []byte {
+	var body bytes.Buffer
+
+	writeString(&body, p.Topic)
+
+	if p.QoS > 0 {
+		writeUint16(&body, p.PacketID)
+	}
+
+	body.Write(p.Payload)
+
+	flags := p.QoS << 1
+	if p.Dup {
+		flags |= 1 << 3
+	}
+
+	if p.Retain {
+		flags |= 1
+	}
+
+	return encode(TypePublish, flags, body.Bytes())
+}
+
+func (p *Puback) Encode() []byte {
+	return encode(TypePuback, 0, packetID(p.PacketID))
+}
+
+func (p *Subscribe) Encode() []byte {
+	var body bytes.Buffer
+
+	writeUint16(&body, p.PacketID)
+
+	for _, s := range p.Subscriptions {
+		writeString(&body, s.Topic)
+		body.WriteByte(s.QoS)
+	}
+
+	return encode(TypeSubscribe, 0b0010, body.Bytes())
+}
+
+func (p *Suback) Encode() []byte {
+	return encode(TypeSuback, 0, append(packetID(p.PacketID), p.ReturnCodes...))
+}
+
+func (p *Unsubscribe) Encode() []byte {
+	var body bytes.Buffer
+
+	writeUint16(&body, p.PacketID)
+
+	for _, topic := range p.Topics {
+		writeString(&body, topic)
+	}
+
+	return encode(TypeUnsubscribe, 0b0010, body.Bytes())
+}
+
+func (p *Unsuback) Encode() []byte {
+	return encode(TypeUnsuback, 0, packetID(p.PacketID))
+}
+
+func (p *Pingreq) Encode() []byte {
+	return encode(TypePingreq, 0, nil)
+}
+
+func (p *Pingresp) Encode() []byte {
+	return encode(TypePingresp, 0, nil)
+}
+
+func (p *Disconnect) Encode() []byte {
+	return encode(TypeDisconnect, 0, nil)
+}
+
+func encode(t PacketType, flags byte, body []byte) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteByte(byte(t)<<4 | flags)
+
+	// Remaining length is encoded in 7 bits per byte, the high bit marks continuation.
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+
+		if n > 0 {
+			b |= 128
+		}
+
+		buf.WriteByte(b)
+
+		if n == 0 {
+			break
+		}
+	}
+
+	buf.Write(body)
+
+	return buf.Bytes()
+}
+
+func packetID(id uint16) []byte {
+	return []byte{byte(id >> 8), byte(id)}
+}
+
+func writeUint16(buf *bytes.Buffer, v uint16) {
+	buf.Write(packetID(v))
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeBytes(buf, []byte(s))
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUint16(buf, uint16(len(b)))
+	buf.Write(b)
+}
+
+// ReadPacket reads a single control packet whose remaining length is at most maxSize bytes.
+func ReadPacket(r *bufio.Reader, maxSize int) (Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := readRemainingLength(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The body is allocated before it is read, so the peer must not choose its size freely.
+	if length > maxSize {
+		return nil, fmt.Errorf("remaining length %d exceeds %d: %w", length, maxSize, ErrTooLarge)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("read packet body failed: %w", err)
+	}
+
+	t, flags := PacketType(header>>4), header&0x0f
+
+	p, err := decode(t, flags, &decoder{buf: body})
+	if err != nil {
+		return nil, fmt.Errorf("packet type %d: %w", t, err)
+	}
+
+	return p, nil
+}
+
+func readRemainingLength(r *bufio.Reader) (int, error) {
+	length, multiplier := 0, 1
+
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		length += int(b&127) * multiplier
+		if b&128 == 0 {
+			return length, nil
+		}
+
+		multiplier *= 128
+	}
+
+	return 0, fmt.Errorf("remaining length exceeds %d: %w", maxRemainingLength, ErrMalformed)
+}
+
+func decode(t PacketType, flags byte, d *decoder) (Packet, error) {
+	var p Packet
+
+	switch t {
+	case TypePublish:
+		p = decodePublish(flags, d)
+	case TypeSubscribe, TypeUnsubscribe:
+		if flags != 0b0010 {
+			return nil, fmt.Errorf("reserved flags %04b: %w", flags, ErrMalformed)
+		}
+
+		if t == TypeSubscribe {
+			p = decodeSubscribe(d)
+		} else {
+			p = decodeUnsubscribe(d)
+		}
+	default:
+		if flags != 0 {
+			return nil, fmt.Errorf("reserved flags %04b: %w", flags, ErrMalformed)
+		}
+
+		p = decodeFlagless(t, d)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if p == nil {
+		return nil, fmt.Errorf("unsupported packet type: %w", ErrMalformed)
+	}
+
+	if len(d.buf) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes: %w", len(d.buf), ErrMalformed)
+	}
+
+	return p, nil
+}
+
+func decodeFlagless(t PacketType, d *decoder) Packet {
+	switch t {
+	case TypeConnect:
+		return decodeConnect(d)
+	case TypeConnack:
+		ack, code := d.readByte(), d.readByte()
+
+		return &Connack{SessionPresent: ack&1 == 1, ReturnCode: code}
+	case TypePuback:
+		return &Puback{PacketID: d.readUint16()}
+	case TypeSuback:
+		id := d.readUint16()
+
+		return &Suback{PacketID: id, ReturnCodes: d.readRest()}
+	case TypeUnsuback:
+		return &Unsuback{PacketID: d.readUint16()}
+	case TypePingreq:
+		return &Pingreq{}
+	case TypePingresp:
+		return &Pingresp{}
+	case TypeDisconnect:
+		return &Disconnect{}
+	default:
+		return nil
+	}
+}
+
+func decodeConnect(d *decoder) *Connect {
+	p := &Connect{ProtocolName: d.readString(), ProtocolLevel: d.readByte()}
+	flags := d.readByte()
+	p.CleanSession = flags&flagCleanSession != 0
+	p.KeepAlive = d.readUint16()
+	p.ClientID = d.readString()
+
+	if flags&1 != 0 {
+		d.fail("reserved connect flag is set")
+	}
+
+	if flags&flagWill != 0 {
+		p.Will = &Will{
+			QoS:     flags >> willQoSShift & 0b11,
+			Retain:  flags&flagWillRetain != 0,
+			Topic:   d.readString(),
+			Payload: d.readBytes(),
+		}
+	}
+
+	if flags&flagUsername != 0 {
+		username := d.readString()
+		p.Username = &username
+	}
+
+	if flags&flagPassword != 0 {
+		p.Password = d.readBytes()
+	}
+
+	return p
+}
+
+func decodePublish(flags byte, d *decoder) *Publish {
+	p := &Publish{
+		Dup:    flags&(1<<3) != 0,
+		QoS:    flags >> 1 & 0b11,
+		Retain: flags&1 != 0,
+		Topic:  d.readString(),
+	}
+
+	if p.QoS == 3 {
+		d.fail("qos 3")
+	}
+
+	if p.QoS > 0 {
+		p.PacketID = d.readUint16()
+	}
+
+	p.Payload = d.readRest()
+
+	return p
+}
+
+func decodeSubscribe(d *decoder) *Subscribe {
+	p := &Subscribe{PacketID: d.readUint16()}
+
+	for len(d.buf) > 0 && d.err == nil {
+		p.Subscriptions = append(p.Subscriptions, Subscription{Topic: d.readString(), QoS: d.readByte()})
+	}
+
+	if len(p.Subscriptions) == 0 {
+		d.fail("no subscriptions")
+	}
+
+	return p
+}
+
+func decodeUnsubscribe(d *decoder) *Unsubscribe {
+	p := &Unsubscribe{PacketID: d.readUint16()}
+
+	for len(d.buf) > 0 && d.err == nil {
+		p.Topics = append(p.Topics, d.readString())
+	}
+
+	if len(p.Topics) == 0 {
+		d.fail("no topics")
+	}
+
+	return p
+}
+
+// decoder reads fields of the packet body, the first error is kept and following reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(reason string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%s: %w", reason, ErrMalformed)
+	}
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if len(d.buf) < n {
+		d.fail("unexpected end of packet")
+
+		return nil
+	}
+
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+
+	return b
+}
+
+func (d *decoder) readByte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (d *decoder) readUint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (d *decoder) readBytes() []byte {
+	return d.next(int(d.readUint16()))
+}
+
+func (d *decoder) readString() string {
+	return string(d.readBytes())
+}
+
+func (d *decoder) readRest() []byte {
+	return d.next(len(d.buf))
+}
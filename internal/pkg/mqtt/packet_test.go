@@ -0,0 +1,93 @@
+package mqtt_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/mqtt"
+)
+
+const maxPacketSize = 64 << 10
+
+func TestPacket(t *testing.T) {
+	username := "device"
+
+	for _, p := range []mqtt.Packet{
+		&mqtt.Connect{ProtocolName: mqtt.ProtocolName, ProtocolLevel: mqtt.ProtocolLevel, CleanSession: true,
+			KeepAlive: 60, ClientID: "sensor-1"},
+		&mqtt.Connect{ProtocolName: mqtt.ProtocolName, ProtocolLevel: mqtt.ProtocolLevel, KeepAlive: 10,
+			ClientID: "sensor-2", Will: &mqtt.Will{Topic: "status", Payload: []byte("offline"), QoS: 1, Retain: true},
+			Username: &username, Password: []byte("secret")},
+		&mqtt.Connack{SessionPresent: true, ReturnCode: mqtt.RefusedIdentifierRejected},
+		&mqtt.Publish{Topic: "news", Payload: []byte("hello")},
+		&mqtt.Publish{Dup: true, QoS: 1, Retain: true, Topic: "news", PacketID: 7, Payload: []byte{}},
+		&mqtt.Publish{QoS: 1, Topic: "big", PacketID: 1, Payload: bytes.Repeat([]byte("x"), 20000)},
+		&mqtt.Puback{PacketID: 7},
+		&mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{{Topic: "news", QoS: 1}, {Topic: "a/+"}}},
+		&mqtt.Suback{PacketID: 1, ReturnCodes: []byte{1, mqtt.SubackFailure}},
+		&mqtt.Unsubscribe{PacketID: 2, Topics: []string{"news", "a/+"}},
+		&mqtt.Unsuback{PacketID: 2},
+		&mqtt.Pingreq{},
+		&mqtt.Pingresp{},
+		&mqtt.Disconnect{},
+	} {
+		p := p
+		t.Run(fmt.Sprintf("%T", p), func(t *testing.T) {
+			got, err := mqtt.ReadPacket(bufio.NewReader(bytes.NewReader(p.Encode())), maxPacketSize)
+
+			require.NoError(t, err)
+			assert.Equal(t, p, got)
+		})
+	}
+}
+
+func TestReadPacket_Stream(t *testing.T) {
+	stream := append((&mqtt.Pingreq{}).Encode(), (&mqtt.Puback{PacketID: 3}).Encode()...)
+	r := bufio.NewReader(bytes.NewReader(stream))
+
+	p, err := mqtt.ReadPacket(r, maxPacketSize)
+	require.NoError(t, err)
+	assert.Equal(t, &mqtt.Pingreq{}, p)
+
+	p, err = mqtt.ReadPacket(r, maxPacketSize)
+	require.NoError(t, err)
+	assert.Equal(t, &mqtt.Puback{PacketID: 3}, p)
+}
+
+func TestReadPacket_Malformed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"remaining length over 4 bytes": {0x30, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"subscribe reserved flags":      {0x80, 0x05, 0x00, 0x01, 0x00, 0x00, 0x00},
+		"subscribe without topics":      {0x82, 0x02, 0x00, 0x01},
+		"publish qos 3":                 {0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01},
+		"truncated string":              {0x30, 0x02, 0x00, 0x05},
+		"trailing bytes":                {0xc0, 0x01, 0x00},
+		"unsupported type":              {0x50, 0x02, 0x00, 0x01},
+	} {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			_, err := mqtt.ReadPacket(bufio.NewReader(bytes.NewReader(data)), maxPacketSize)
+
+			assert.ErrorIs(t, err, mqtt.ErrMalformed)
+		})
+	}
+
+	_, err := mqtt.ReadPacket(bufio.NewReader(strings.NewReader("\x30\x05\x00")), maxPacketSize)
+	assert.Error(t, err, "truncated body")
+}
+
+func TestReadPacket_TooLarge(t *testing.T) {
+	// CONNECT with the largest remaining length, the body is never sent.
+	_, err := mqtt.ReadPacket(bufio.NewReader(bytes.NewReader([]byte{0x10, 0xff, 0xff, 0xff, 0x7f})), maxPacketSize)
+	assert.ErrorIs(t, err, mqtt.ErrTooLarge)
+
+	p := &mqtt.Publish{Topic: "news", Payload: bytes.Repeat([]byte("x"), maxPacketSize)}
+	_, err = mqtt.ReadPacket(bufio.NewReader(bytes.NewReader(p.Encode())), maxPacketSize)
+	assert.ErrorIs(t, err, mqtt.ErrTooLarge)
+}
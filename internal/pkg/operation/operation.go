@@ -1,11 +1,26 @@
 package operation
 
 import (
+	"encoding/json"
+
 	"github.com/alexandear/websocket-pubsub/internal/pkg/command"
 )
 
+// TraceContext is W3C trace context of the sender span, absent when tracing is disabled.
+type TraceContext map[string]string
+
+// TopicBroadcast is the topic of server time broadcasts, clients subscribe to it when topic is not set.
+const TopicBroadcast = "broadcast"
+
 type ReqCommand struct {
 	Command command.Type `json:"command"`
+	// Topic of SUBSCRIBE, UNSUBSCRIBE and PUBLISH. UNSUBSCRIBE without topic closes the connection.
+	Topic string `json:"topic,omitempty"`
+	// Data is JSON payload of PUBLISH.
+	Data json.RawMessage `json:"data,omitempty"`
+	// SentAt is Unix time in nanoseconds when PUBLISH was sent, the server stamps receive time when it is not set.
+	SentAt       int64        `json:"sent_at,omitempty"`
+	TraceContext TraceContext `json:"trace_context,omitempty"`
 }
 
 type Resp interface{}
@@ -13,8 +28,20 @@ type Resp interface{}
 type RespBroadcast struct {
 	ClientID  string `json:"client_id"`
 	Timestamp int    `json:"timestamp"`
+	// SentAt is Unix time in nanoseconds, Timestamp is kept in seconds for older clients.
+	SentAt       int64        `json:"sent_at"`
+	TraceContext TraceContext `json:"trace_context,omitempty"`
 }
 
 type RespNumConnections struct {
-	NumConnections int `json:"num_connections"`
+	NumConnections int          `json:"num_connections"`
+	TraceContext   TraceContext `json:"trace_context,omitempty"`
+}
+
+// RespMessage is data published to the topic.
+type RespMessage struct {
+	Topic        string          `json:"topic"`
+	Data         json.RawMessage `json:"data"`
+	SentAt       int64           `json:"sent_at,omitempty"`
+	TraceContext TraceContext    `json:"trace_context,omitempty"`
 }
@@ -0,0 +1,318 @@
+// Package stomp encodes and decodes STOMP 1.2 frames.
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Subprotocol is the websocket subprotocol of STOMP 1.2 connections.
+const Subprotocol = "v12.stomp"
+
+const Version = "1.2"
+
+// Client commands.
+const (
+	Connect     = "CONNECT"
+	Stomp       = "STOMP"
+	Send        = "SEND"
+	Subscribe   = "SUBSCRIBE"
+	Unsubscribe = "UNSUBSCRIBE"
+	Ack         = "ACK"
+	Nack        = "NACK"
+	Begin       = "BEGIN"
+	Commit      = "COMMIT"
+	Abort       = "ABORT"
+	Disconnect  = "DISCONNECT"
+)
+
+// Server commands.
+const (
+	Connected = "CONNECTED"
+	Message   = "MESSAGE"
+	Receipt   = "RECEIPT"
+	Error     = "ERROR"
+)
+
+// Headers.
+const (
+	HeaderAcceptVersion = "accept-version"
+	HeaderAck           = "ack"
+	HeaderContentLength = "content-length"
+	HeaderContentType   = "content-type"
+	HeaderDestination   = "destination"
+	HeaderHeartBeat     = "heart-beat"
+	HeaderHost          = "host"
+	HeaderID            = "id"
+	HeaderMessage       = "message"
+	HeaderMessageID     = "message-id"
+	HeaderReceipt       = "receipt"
+	HeaderReceiptID     = "receipt-id"
+	HeaderServer        = "server"
+	HeaderSession       = "session"
+	HeaderSubscription  = "subscription"
+	HeaderVersion       = "version"
+)
+
+// maxHeaders limits headers of a frame read.
+const maxHeaders = 1000
+
+var ErrMalformed = errors.New("malformed frame")
+
+// Frame is a STOMP frame. Headers keep the order of the wire, the first of repeated headers wins.
+type Frame struct {
+	Command string
+	Headers []Header
+	Body    []byte
+}
+
+type Header struct {
+	Key   string
+	Value string
+}
+
+// New creates frame with headers given as key, value pairs.
+func New(command string, headers ...string) *Frame {
+	f := &Frame{Command: command}
+
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.Headers = append(f.Headers, Header{Key: headers[i], Value: headers[i+1]})
+	}
+
+	return f
+}
+
+// Get returns value of the first header with key.
+func (f *Frame) Get(key string) (string, bool) {
+	for _, h := range f.Headers {
+		if h.Key == key {
+			return h.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Set replaces value of header with key or adds the header.
+func (f *Frame) Set(key, value string) {
+	for i, h := range f.Headers {
+		if h.Key == key {
+			f.Headers[i].Value = value
+
+			return
+		}
+	}
+
+	f.Headers = append(f.Headers, Header{Key: key, Value: value})
+}
+
+// Encode returns the frame terminated by NUL, frames with body have content-length header.
+func (f *Frame) Encode() []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(f.Command)
+	buf.WriteByte('\n')
+
+	// Headers of CONNECT and CONNECTED are not escaped for compatibility with STOMP 1.0.
+	escape := f.Command != Connect && f.Command != Connected
+
+	for _, h := range f.Headers {
+		if h.Key == HeaderContentLength {
+			continue
+		}
+
+		if escape {
+			buf.WriteString(escaper.Replace(h.Key) + ":" + escaper.Replace(h.Value) + "\n")
+		} else {
+			buf.WriteString(h.Key + ":" + h.Value + "\n")
+		}
+	}
+
+	if len(f.Body) > 0 {
+		buf.WriteString(HeaderContentLength + ":" + strconv.Itoa(len(f.Body)) + "\n")
+	}
+
+	buf.WriteByte('\n')
+	buf.Write(f.Body)
+	buf.WriteByte(0)
+
+	return buf.Bytes()
+}
+
+var (
+	escaper   = strings.NewReplacer("\\", `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+	unescaper = strings.NewReplacer(`\\`, "\\", `\r`, "\r", `\n`, "\n", `\c`, ":")
+)
+
+// ReadFrame reads the next frame of at most maxSize bytes, skipping heart-beat EOLs before it.
+func ReadFrame(r *bufio.Reader, maxSize int) (*Frame, error) {
+	fr := &frameReader{r: r, maxSize: maxSize}
+
+	var command string
+
+	for command == "" {
+		// Heart-beats do not count towards the frame size.
+		fr.left = maxSize
+
+		line, err := fr.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		command = line
+	}
+
+	f := &Frame{Command: command}
+	escaped := command != Connect && command != Connected
+
+	for {
+		line, err := fr.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if line == "" {
+			break
+		}
+
+		if len(f.Headers) == maxHeaders {
+			return nil, fmt.Errorf("more than %d headers: %w", maxHeaders, ErrMalformed)
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("header %q without colon: %w", line, ErrMalformed)
+		}
+
+		h := Header{Key: line[:i], Value: line[i+1:]}
+		if escaped {
+			if !validEscapes(line) {
+				return nil, fmt.Errorf("header %q has undefined escape: %w", line, ErrMalformed)
+			}
+
+			h.Key, h.Value = unescaper.Replace(h.Key), unescaper.Replace(h.Value)
+		}
+
+		f.Headers = append(f.Headers, h)
+	}
+
+	body, err := fr.readBody(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames without body compare equal to frames created by New.
+	if len(body) > 0 {
+		f.Body = body
+	}
+
+	return f, nil
+}
+
+// frameReader reads a frame counting read bytes against the frame size, so that nothing larger is buffered.
+type frameReader struct {
+	r       *bufio.Reader
+	maxSize int
+	left    int
+}
+
+func (fr *frameReader) consume(n int) error {
+	if n > fr.left {
+		return fr.errTooLarge()
+	}
+
+	fr.left -= n
+
+	return nil
+}
+
+func (fr *frameReader) errTooLarge() error {
+	return fmt.Errorf("frame exceeds %d bytes: %w", fr.maxSize, ErrMalformed)
+}
+
+// readBody reads content-length bytes followed by NUL, or up to NUL without content-length.
+func (fr *frameReader) readBody(f *Frame) ([]byte, error) {
+	length, ok := f.Get(HeaderContentLength)
+	if !ok {
+		body, err := fr.readUntil(0)
+		if err != nil {
+			return nil, fmt.Errorf("read body failed: %w", err)
+		}
+
+		return body[:len(body)-1], nil
+	}
+
+	n, err := strconv.Atoi(length)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("content-length %q: %w", length, ErrMalformed)
+	}
+
+	// The body is allocated before it is read, NUL follows it.
+	if n >= fr.left {
+		return nil, fr.errTooLarge()
+	}
+
+	fr.left -= n + 1
+
+	body := make([]byte, n+1)
+	if _, err := io.ReadFull(fr.r, body); err != nil {
+		return nil, fmt.Errorf("read body failed: %w", err)
+	}
+
+	if body[n] != 0 {
+		return nil, fmt.Errorf("body is not terminated by NUL: %w", ErrMalformed)
+	}
+
+	return body[:n], nil
+}
+
+// readLine reads line ended by LF or CRLF.
+func (fr *frameReader) readLine() (string, error) {
+	line, err := fr.readUntil('\n')
+	if err != nil {
+		return "", err
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+
+	return string(bytes.TrimSuffix(line, []byte("\r"))), nil
+}
+
+// readUntil reads up to and including delim.
+func (fr *frameReader) readUntil(delim byte) ([]byte, error) {
+	var data []byte
+
+	for {
+		chunk, err := fr.r.ReadSlice(delim)
+		if err := fr.consume(len(chunk)); err != nil {
+			return nil, err
+		}
+
+		data = append(data, chunk...)
+
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return data, err
+		}
+	}
+}
+
+func validEscapes(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			continue
+		}
+
+		if i+1 == len(s) || !strings.ContainsRune(`\rnc`, rune(s[i+1])) {
+			return false
+		}
+
+		i++
+	}
+
+	return true
+}
@@ -0,0 +1,93 @@
+package stomp_test
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/stomp"
+)
+
+const maxFrameSize = 64 << 10
+
+func TestFrame(t *testing.T) {
+	for _, f := range []*stomp.Frame{
+		stomp.New(stomp.Connect, stomp.HeaderAcceptVersion, "1.2", stomp.HeaderHeartBeat, "1000,0"),
+		stomp.New(stomp.Subscribe, stomp.HeaderID, "sub-0", stomp.HeaderDestination, "/topic/news"),
+		{
+			Command: stomp.Send,
+			Headers: []stomp.Header{{Key: stomp.HeaderDestination, Value: "/topic/a:b\nc\\d"}},
+			Body:    []byte("with\x00nul"),
+		},
+		stomp.New(stomp.Disconnect),
+	} {
+		f := f
+		t.Run(f.Command, func(t *testing.T) {
+			got, err := stomp.ReadFrame(bufio.NewReader(strings.NewReader(string(f.Encode()))), maxFrameSize)
+			require.NoError(t, err)
+
+			if len(f.Body) > 0 {
+				f.Set(stomp.HeaderContentLength, strconv.Itoa(len(f.Body)))
+			}
+
+			assert.Equal(t, f.Command, got.Command)
+			assert.Equal(t, f.Headers, got.Headers)
+			assert.Equal(t, string(f.Body), string(got.Body))
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(
+		"\n\r\nSEND\r\ndestination:news\r\ndestination:ignored\r\n\r\nhello\x00\n" +
+			"CONNECT\naccept-version:1.2\nlogin:a\\c\n\n\x00",
+	))
+
+	f, err := stomp.ReadFrame(r, maxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, stomp.Send, f.Command, "heart-beats before the frame are skipped")
+	assert.Equal(t, "hello", string(f.Body))
+
+	destination, ok := f.Get(stomp.HeaderDestination)
+	assert.True(t, ok)
+	assert.Equal(t, "news", destination, "the first of repeated headers wins")
+
+	f, err = stomp.ReadFrame(r, maxFrameSize)
+	require.NoError(t, err)
+
+	login, _ := f.Get("login")
+	assert.Equal(t, `a\c`, login, "CONNECT headers are not unescaped")
+}
+
+func TestReadFrame_Malformed(t *testing.T) {
+	for name, data := range map[string]string{
+		"header without colon":     "SEND\ndestination\n\n\x00",
+		"undefined escape":         "SEND\ndestination:a\\t\n\n\x00",
+		"negative content-length":  "SEND\ncontent-length:-1\n\n\x00",
+		"body longer than length":  "SEND\ncontent-length:1\n\nab\x00",
+		"content-length too large": "SEND\ncontent-length:9223372036854775807\n\n\x00",
+		"body too large":           "SEND\n\n" + strings.Repeat("a", maxFrameSize) + "\x00",
+		"header too large":         "SEND\ndestination:" + strings.Repeat("a", maxFrameSize) + "\n\n\x00",
+		"too many headers":         "SEND\n" + strings.Repeat("a:b\n", 1001) + "\n\x00",
+	} {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			_, err := stomp.ReadFrame(bufio.NewReader(strings.NewReader(data)), maxFrameSize)
+
+			assert.ErrorIs(t, err, stomp.ErrMalformed)
+		})
+	}
+}
+
+func TestReadFrame_MaxSize(t *testing.T) {
+	frame := "SEND\n\n" + strings.Repeat("a", maxFrameSize-7) + "\x00"
+	r := bufio.NewReader(strings.NewReader(strings.Repeat("\n", maxFrameSize) + frame))
+
+	f, err := stomp.ReadFrame(r, maxFrameSize)
+	require.NoError(t, err, "heart-beats do not count towards the frame size")
+	assert.Len(t, f.Body, maxFrameSize-7)
+}
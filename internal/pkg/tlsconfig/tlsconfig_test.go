@@ -0,0 +1,69 @@
+package tlsconfig_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tlsconfig"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tlsconfig/tlstest"
+)
+
+func TestNewServer(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	kp := ca.Issue(t, "server", "127.0.0.1")
+
+	t.Run("without client CA", func(t *testing.T) {
+		cfg, err := tlsconfig.NewServer(kp.CertFile, kp.KeyFile, "")
+
+		require.NoError(t, err)
+		assert.Len(t, cfg.Certificates, 1)
+		assert.Equal(t, tls.NoClientCert, cfg.ClientAuth)
+	})
+
+	t.Run("with client CA", func(t *testing.T) {
+		cfg, err := tlsconfig.NewServer(kp.CertFile, kp.KeyFile, ca.CertFile)
+
+		require.NoError(t, err)
+		assert.NotNil(t, cfg.ClientCAs)
+		assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	})
+
+	t.Run("when client CA is not a certificate", func(t *testing.T) {
+		_, err := tlsconfig.NewServer(kp.CertFile, kp.KeyFile, kp.KeyFile)
+
+		assert.ErrorIs(t, err, tlsconfig.ErrNoCertificates)
+	})
+
+	t.Run("when missing key", func(t *testing.T) {
+		_, err := tlsconfig.NewServer(kp.CertFile, "", "")
+
+		assert.Error(t, err)
+	})
+}
+
+func TestNewClient(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	kp := ca.Issue(t, "client")
+
+	cfg, err := tlsconfig.NewClient(ca.CertFile, true, kp.CertFile, kp.KeyFile)
+
+	require.NoError(t, err)
+	assert.NotNil(t, cfg.RootCAs)
+	assert.True(t, cfg.InsecureSkipVerify)
+	assert.Len(t, cfg.Certificates, 1)
+}
+
+func TestPrincipal(t *testing.T) {
+	assert.Empty(t, tlsconfig.Principal(nil))
+	assert.Empty(t, tlsconfig.Principal(&tls.ConnectionState{}))
+	assert.Equal(t, "CN=alice,O=Acme", tlsconfig.Principal(&tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{
+			Subject: pkix.Name{CommonName: "alice", Organization: []string{"Acme"}},
+		}},
+	}))
+}
@@ -0,0 +1,141 @@
+// Package tlstest generates certificates in-process for tests.
+package tlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const validity = time.Hour
+
+// CA is a self-signed certificate authority.
+type CA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	// CertFile is a path to the PEM encoded CA certificate.
+	CertFile string
+}
+
+// KeyPair is a pair of paths to PEM encoded certificate and private key.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+func NewCA(t testing.TB) *CA {
+	t.Helper()
+
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          serialNumber(t),
+		Subject:               pkix.Name{CommonName: "tlstest CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create CA certificate failed: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse CA certificate failed: %v", err)
+	}
+
+	return &CA{
+		cert:     cert,
+		key:      key,
+		CertFile: writePEM(t, "ca.pem", "CERTIFICATE", der),
+	}
+}
+
+// Issue signs certificate for commonName valid for both server and client authentication.
+// hosts are added as DNS names or IP addresses.
+func (ca *CA) Issue(t testing.TB, commonName string, hosts ...string) KeyPair {
+	t.Helper()
+
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber(t),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create certificate failed: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal private key failed: %v", err)
+	}
+
+	return KeyPair{
+		CertFile: writePEM(t, commonName+".pem", "CERTIFICATE", der),
+		KeyFile:  writePEM(t, commonName+"-key.pem", "EC PRIVATE KEY", keyDER),
+	}
+}
+
+func newKey(t testing.TB) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key failed: %v", err)
+	}
+
+	return key
+}
+
+func serialNumber(t testing.TB) *big.Int {
+	t.Helper()
+
+	const serialBits = 128
+
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), serialBits))
+	if err != nil {
+		t.Fatalf("generate serial number failed: %v", err)
+	}
+
+	return n
+}
+
+func writePEM(t testing.TB, name, blockType string, der []byte) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+
+	if err := ioutil.WriteFile(file, data, 0o600); err != nil {
+		t.Fatalf("write %s failed: %v", file, err)
+	}
+
+	return file
+}
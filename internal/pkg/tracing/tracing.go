@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/alexandear/websocket-pubsub"
+
+type Config struct {
+	// Endpoint is OTLP/HTTP collector host:port. Tracing is disabled when empty.
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	// Insecure sends spans over plain HTTP.
+	Insecure bool `yaml:"insecure" json:"insecure"`
+	// SampleRatio is a fraction of traces started by this service that are sampled.
+	SampleRatio float64 `yaml:"sample_ratio" json:"sample_ratio"`
+
+	ServiceName string `yaml:"-" json:"-"`
+}
+
+//nolint:gochecknoglobals // W3C trace context is the only supported format
+var propagator = propagation.TraceContext{}
+
+// Setup registers global tracer provider exporting to cfg.Endpoint.
+// Returned function flushes and stops exporting.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create otlp exporter failed: %w", err)
+	}
+
+	tp := NewProvider(sdktrace.NewBatchSpanProcessor(exporter), cfg.ServiceName, cfg.SampleRatio)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagator)
+
+	return tp.Shutdown, nil
+}
+
+// NewProvider creates tracer provider, tests use it with in-memory exporter.
+func NewProvider(processor sdktrace.SpanProcessor, serviceName string, sampleRatio float64) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+}
+
+// Tracer returns tracer of the global provider.
+func Tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(instrumentationName)
+}
+
+// Inject returns trace context of ctx for embedding into a message envelope, nil without active span.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+
+	if len(carrier) == 0 {
+		return nil
+	}
+
+	return carrier
+}
+
+// Extract returns ctx with remote span context from a message envelope.
+func Extract(ctx context.Context, traceContext map[string]string) context.Context {
+	if len(traceContext) == 0 {
+		return ctx
+	}
+
+	return propagator.Extract(ctx, propagation.MapCarrier(traceContext))
+}
+
+// ExtractHTTP returns ctx with remote span context from HTTP headers.
+func ExtractHTTP(ctx context.Context, carrier propagation.HeaderCarrier) context.Context {
+	return propagator.Extract(ctx, carrier)
+}
+
+// Link returns link to span context from a message envelope or no options when it is not valid.
+func Link(sc trace.SpanContext) []trace.SpanStartOption {
+	if !sc.IsValid() {
+		return nil
+	}
+
+	return []trace.SpanStartOption{trace.WithLinks(trace.Link{SpanContext: sc})}
+}
@@ -0,0 +1,51 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+)
+
+func TestInjectExtract(t *testing.T) {
+	t.Run("when no span", func(t *testing.T) {
+		assert.Nil(t, tracing.Inject(context.Background()))
+		assert.Equal(t, context.Background(), tracing.Extract(context.Background(), nil))
+	})
+
+	t.Run("when span", func(t *testing.T) {
+		tp := tracing.NewProvider(tracetest.NewSpanRecorder(), "test", 1)
+		ctx, span := tp.Tracer("test").Start(context.Background(), "publish")
+		defer span.End()
+
+		traceContext := tracing.Inject(ctx)
+
+		require.Contains(t, traceContext, "traceparent")
+		sc := trace.SpanContextFromContext(tracing.Extract(context.Background(), traceContext))
+		assert.Equal(t, span.SpanContext().TraceID(), sc.TraceID())
+		assert.Equal(t, span.SpanContext().SpanID(), sc.SpanID())
+		assert.True(t, sc.IsRemote())
+	})
+}
+
+func TestSetup(t *testing.T) {
+	shutdown, err := tracing.Setup(context.Background(), tracing.Config{})
+
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
+
+func TestLink(t *testing.T) {
+	assert.Nil(t, tracing.Link(trace.SpanContext{}))
+
+	tp := tracing.NewProvider(tracetest.NewSpanRecorder(), "test", 1)
+	_, span := tp.Tracer("test").Start(context.Background(), "publish")
+	defer span.End()
+
+	assert.Len(t, tracing.Link(span.SpanContext()), 1)
+}
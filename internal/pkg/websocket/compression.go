@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Compression levels of permessage-deflate, see compress/flate.
+const (
+	MinCompressionLevel     = flate.HuffmanOnly
+	MaxCompressionLevel     = flate.BestCompression
+	DefaultCompressionLevel = flate.BestSpeed
+)
+
+var errNotHijacker = errors.New("response writer does not implement http.Hijacker")
+
+// Compression is permessage-deflate policy of a connection.
+type Compression struct {
+	Level int
+	// Threshold is the payload size in bytes below which messages are sent uncompressed.
+	Threshold int
+}
+
+// WriteStats describe a written data message.
+type WriteStats struct {
+	Size int
+	// WireSize is the size of the frame written to the network, zero when the connection does not count bytes.
+	WireSize   int
+	Compressed bool
+}
+
+// HasCompression reports whether handshake header offers or accepts permessage-deflate.
+func HasCompression(header http.Header) bool {
+	for _, v := range header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name := strings.TrimSpace(strings.SplitN(ext, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// CountWritten makes the connection hijacked from w count written bytes, so that Conn reports sizes of compressed
+// frames. It must wrap the response writer passed to the upgrader.
+func CountWritten(w http.ResponseWriter) http.ResponseWriter {
+	return &countingResponseWriter{ResponseWriter: w}
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errNotHijacker
+	}
+
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("hijack failed: %w", err)
+	}
+
+	return &countingConn{Conn: conn}, rw, nil
+}
+
+type countingConn struct {
+	net.Conn
+
+	// written must be accessed atomically, control frames may be written concurrently with data frames.
+	written int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+
+	return n, err
+}
+
+func (c *countingConn) Written() int64 {
+	return atomic.LoadInt64(&c.written)
+}
@@ -9,39 +9,112 @@ import (
 
 var ErrClosedConn = errors.New("closed connection")
 
+const (
+	CloseNormalClosure   = websocket.CloseNormalClosure
+	ClosePolicyViolation = websocket.ClosePolicyViolation
+)
+
+// MessageType is the type of data frame.
+type MessageType int
+
+const (
+	TextMessage   MessageType = websocket.TextMessage
+	BinaryMessage MessageType = websocket.BinaryMessage
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case TextMessage:
+		return "text"
+	case BinaryMessage:
+		return "binary"
+	default:
+		return fmt.Sprintf("MessageType(%d)", int(t))
+	}
+}
+
 type Conn struct {
 	conn *websocket.Conn
+
+	// counter is set when the connection was hijacked from response writer wrapped with CountWritten.
+	counter   *countingConn
+	compress  bool
+	threshold int
+	onWrite   func(WriteStats)
 }
 
 func NewConn(conn *websocket.Conn) *Conn {
-	return &Conn{conn: conn}
+	counter, _ := conn.UnderlyingConn().(*countingConn)
+
+	return &Conn{conn: conn, counter: counter}
+}
+
+// SetCompression compresses data messages not smaller than the threshold. It must be called only when
+// permessage-deflate was negotiated and before writing messages.
+func (c *Conn) SetCompression(compression Compression) error {
+	if err := c.conn.SetCompressionLevel(compression.Level); err != nil {
+		return fmt.Errorf("set compression level %d failed: %w", compression.Level, err)
+	}
+
+	c.compress = true
+	c.threshold = compression.Threshold
+
+	return nil
 }
 
-func (c *Conn) ReadBinaryMessage() ([]byte, error) {
+// SetReadLimit sets the maximum size in bytes of a message read, larger messages close the connection.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.conn.SetReadLimit(limit)
+}
+
+// OnWrite sets fn called after each written data message. It must be set before writing messages.
+func (c *Conn) OnWrite(fn func(WriteStats)) {
+	c.onWrite = fn
+}
+
+// ReadMessage reads text or binary data frame.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
 	messageType, message, err := c.conn.ReadMessage()
 	if err != nil {
 		if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-			return nil, fmt.Errorf("read message failed: %w", err)
+			return 0, nil, fmt.Errorf("read message failed: %w", err)
 		}
 
-		return nil, ErrClosedConn
+		return 0, nil, ErrClosedConn
 	}
 
-	if messageType != websocket.BinaryMessage {
-		return nil, fmt.Errorf("unexpected message type: %d", messageType)
-	}
-
-	return message, nil
+	return MessageType(messageType), message, nil
 }
 
 func (c *Conn) Close() error {
 	return c.conn.Close()
 }
 
-func (c *Conn) WriteCloseMessage() {
-	_ = c.conn.WriteMessage(websocket.CloseMessage, []byte("normal closing"))
+func (c *Conn) WriteCloseMessage(code int, reason string) {
+	_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
 }
 
-func (c *Conn) WriteBinaryMessage(data []byte) error {
-	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	compressed := c.compress && len(data) >= c.threshold
+	c.conn.EnableWriteCompression(compressed)
+
+	var before int64
+	if c.counter != nil {
+		before = c.counter.Written()
+	}
+
+	if err := c.conn.WriteMessage(int(messageType), data); err != nil {
+		return err
+	}
+
+	if c.onWrite != nil {
+		stats := WriteStats{Size: len(data), Compressed: compressed}
+		if c.counter != nil {
+			stats.WireSize = int(c.counter.Written() - before)
+		}
+
+		c.onWrite(stats)
+	}
+
+	return nil
 }
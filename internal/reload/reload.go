@@ -0,0 +1,129 @@
+// Package reload applies server settings which are safe to change at runtime.
+package reload
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/config"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+)
+
+// App is the part of server.App changed at runtime.
+type App interface {
+	SetDrainDelay(delay time.Duration)
+	SetWedgedThreshold(threshold time.Duration)
+	SetSendBufferSize(size int)
+	SetCompression(compression websocket.Compression)
+}
+
+// Hub is the part of server.Hub changed at runtime.
+type Hub interface {
+	SetBroadcastFrequency(frequency time.Duration)
+}
+
+// Reloader applies changed settings which are safe to change at runtime.
+// Other changed settings are reported as requiring restart.
+type Reloader struct {
+	mu sync.Mutex
+
+	// current is the configuration in effect.
+	current config.Server
+	load    func() (config.Server, error)
+
+	logger *zap.Logger
+	level  zap.AtomicLevel
+	app    App
+	hub    Hub
+}
+
+// New creates reloader of current configuration, load reads the configuration again. Level is the level of logger
+// which is changed by server.log.level.
+func New(logger *zap.Logger, level zap.AtomicLevel, current config.Server, load func() (config.Server, error),
+	app App, hub Hub) *Reloader {
+	return &Reloader{
+		current: current,
+		load:    load,
+		logger:  logger,
+		level:   level,
+		app:     app,
+		hub:     hub,
+	}
+}
+
+// appliers returns functions keyed as in config.Diff which make setting of next effective.
+func (r *Reloader) appliers() map[string]func(next config.Server) {
+	appliers := map[string]func(next config.Server){
+		"server.broadcast": func(next config.Server) {
+			r.hub.SetBroadcastFrequency(next.Broadcast.Value())
+			r.current.Broadcast = next.Broadcast
+		},
+		"server.drain_delay": func(next config.Server) {
+			r.app.SetDrainDelay(next.DrainDelay.Value())
+			r.current.DrainDelay = next.DrainDelay
+		},
+		"server.wedged_threshold": func(next config.Server) {
+			r.app.SetWedgedThreshold(next.WedgedThreshold.Value())
+			r.current.WedgedThreshold = next.WedgedThreshold
+		},
+		"server.send_buffer_size": func(next config.Server) {
+			r.app.SetSendBufferSize(next.SendBufferSize)
+			r.current.SendBufferSize = next.SendBufferSize
+		},
+		"server.log.level": func(next config.Server) {
+			// Level is already validated by config.
+			_ = r.level.UnmarshalText([]byte(next.Log.Level))
+			r.current.Log.Level = next.Log.Level
+		},
+	}
+
+	// Compression settings have no effect until compression is enabled, which requires restart.
+	if r.current.Compression.Enabled {
+		appliers["server.compression.level"] = func(next config.Server) {
+			r.current.Compression.Level = next.Compression.Level
+			r.app.SetCompression(r.current.Compression.Websocket())
+		}
+		appliers["server.compression.threshold"] = func(next config.Server) {
+			r.current.Compression.Threshold = next.Compression.Threshold
+			r.app.SetCompression(r.current.Compression.Websocket())
+		}
+	}
+
+	return appliers
+}
+
+func (r *Reloader) Reload() (server.ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := r.load()
+	if err != nil {
+		return server.ReloadResult{}, fmt.Errorf("reload config failed: %w", err)
+	}
+
+	result := server.ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	appliers := r.appliers()
+
+	for _, key := range config.Diff(config.Config{Server: r.current}, config.Config{Server: next}) {
+		apply, ok := appliers[key]
+		if !ok {
+			result.RestartRequired = append(result.RestartRequired, key)
+
+			continue
+		}
+
+		apply(next)
+		result.Applied = append(result.Applied, key)
+	}
+
+	r.logger.Info("config reloaded",
+		zap.Strings("applied", result.Applied),
+		zap.Strings("restart_required", result.RestartRequired),
+	)
+
+	return result, nil
+}
@@ -0,0 +1,168 @@
+package reload_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/config"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+	"github.com/alexandear/websocket-pubsub/internal/reload"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+)
+
+// fakeTarget records settings changed at runtime.
+type fakeTarget struct {
+	drainDelay      time.Duration
+	wedgedThreshold time.Duration
+	sendBufferSize  int
+	compression     *websocket.Compression
+	broadcast       time.Duration
+}
+
+func (f *fakeTarget) SetDrainDelay(delay time.Duration) {
+	f.drainDelay = delay
+}
+
+func (f *fakeTarget) SetWedgedThreshold(threshold time.Duration) {
+	f.wedgedThreshold = threshold
+}
+
+func (f *fakeTarget) SetSendBufferSize(size int) {
+	f.sendBufferSize = size
+}
+
+func (f *fakeTarget) SetCompression(compression websocket.Compression) {
+	f.compression = &compression
+}
+
+func (f *fakeTarget) SetBroadcastFrequency(frequency time.Duration) {
+	f.broadcast = frequency
+}
+
+func TestReloader_Reload(t *testing.T) {
+	for name, tc := range map[string]struct {
+		current func(cfg *config.Server)
+		next    func(cfg *config.Server)
+		want    server.ReloadResult
+		target  fakeTarget
+	}{
+		"nothing changed": {
+			want: server.ReloadResult{Applied: []string{}, RestartRequired: []string{}},
+		},
+		"runtime settings": {
+			next: func(cfg *config.Server) {
+				cfg.Broadcast = config.Duration(time.Second)
+				cfg.DrainDelay = config.Duration(time.Minute)
+				cfg.WedgedThreshold = config.Duration(time.Hour)
+				cfg.SendBufferSize = 10
+			},
+			want: server.ReloadResult{
+				Applied: []string{
+					"server.broadcast", "server.drain_delay", "server.wedged_threshold", "server.send_buffer_size",
+				},
+				RestartRequired: []string{},
+			},
+			target: fakeTarget{
+				broadcast:       time.Second,
+				drainDelay:      time.Minute,
+				wedgedThreshold: time.Hour,
+				sendBufferSize:  10,
+			},
+		},
+		"restart settings": {
+			next: func(cfg *config.Server) {
+				cfg.Addr = ":9090"
+				cfg.Shards = 2
+				cfg.Compression.Enabled = false
+			},
+			want: server.ReloadResult{
+				Applied:         []string{},
+				RestartRequired: []string{"server.addr", "server.shards", "server.compression.enabled"},
+			},
+		},
+		"compression when enabled": {
+			next: func(cfg *config.Server) {
+				cfg.Compression.Level = 9
+				cfg.Compression.Threshold = 100
+			},
+			want: server.ReloadResult{
+				Applied:         []string{"server.compression.level", "server.compression.threshold"},
+				RestartRequired: []string{},
+			},
+			target: fakeTarget{compression: &websocket.Compression{Level: 9, Threshold: 100}},
+		},
+		"compression when disabled": {
+			current: func(cfg *config.Server) {
+				cfg.Compression.Enabled = false
+			},
+			next: func(cfg *config.Server) {
+				cfg.Compression.Enabled = false
+				cfg.Compression.Level = 9
+				cfg.Compression.Threshold = 100
+			},
+			want: server.ReloadResult{
+				Applied:         []string{},
+				RestartRequired: []string{"server.compression.level", "server.compression.threshold"},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			current := config.Default().Server
+			if tc.current != nil {
+				tc.current(&current)
+			}
+
+			next := current
+			if tc.next != nil {
+				tc.next(&next)
+			}
+
+			target := &fakeTarget{}
+			r := reload.New(zap.NewNop(), zap.NewAtomicLevel(), current, func() (config.Server, error) {
+				return next, nil
+			}, target, target)
+
+			result, err := r.Reload()
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, result)
+			assert.Equal(t, tc.target, *target)
+
+			result, err = r.Reload()
+			require.NoError(t, err)
+			assert.Empty(t, result.Applied, "applied settings are in effect")
+			assert.Equal(t, tc.want.RestartRequired, result.RestartRequired, "restart is still required")
+		})
+	}
+}
+
+func TestReloader_ReloadLogLevel(t *testing.T) {
+	current := config.Default().Server
+	next := current
+	next.Log.Level = "debug"
+
+	level := zap.NewAtomicLevel()
+	r := reload.New(zap.NewNop(), level, current, func() (config.Server, error) {
+		return next, nil
+	}, &fakeTarget{}, &fakeTarget{})
+
+	result, err := r.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"server.log.level"}, result.Applied)
+	assert.Equal(t, zap.DebugLevel, level.Level())
+}
+
+func TestReloader_ReloadFailed(t *testing.T) {
+	errLoad := errors.New("bad file")
+	r := reload.New(zap.NewNop(), zap.NewAtomicLevel(), config.Default().Server, func() (config.Server, error) {
+		return config.Server{}, errLoad
+	}, &fakeTarget{}, &fakeTarget{})
+
+	_, err := r.Reload()
+	assert.ErrorIs(t, err, errLoad)
+}
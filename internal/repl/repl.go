@@ -0,0 +1,261 @@
+package repl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexandear/websocket-pubsub/internal/client"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+)
+
+var (
+	// ErrQuit is returned by Eval when the user asks to exit.
+	ErrQuit = errors.New("quit")
+
+	ErrBadCommand = errors.New("bad command")
+)
+
+const (
+	cmdSubscribe   = "subscribe"
+	cmdUnsubscribe = "unsubscribe"
+	cmdPublish     = "publish"
+	cmdCount       = "count"
+	cmdHelp        = "help"
+	cmdQuit        = "quit"
+	cmdExit        = "exit"
+
+	usage = `Commands:
+  subscribe [TOPIC]      subscribe to TOPIC, to server time broadcasts without TOPIC
+  unsubscribe [TOPIC]    unsubscribe from TOPIC, close the connection without TOPIC
+  publish TOPIC DATA     publish DATA to TOPIC, DATA which is not JSON is sent as string
+  count                  request number of connections
+  {...}                  send raw JSON request
+  help                   show this help
+  quit, exit             close the connection and exit
+`
+)
+
+//nolint:gochecknoglobals // completion candidates
+var commands = []string{cmdSubscribe, cmdUnsubscribe, cmdPublish, cmdCount, cmdHelp, cmdQuit, cmdExit}
+
+// REPL evaluates commands typed by the user and prints inbound frames of a single connection.
+type REPL struct {
+	client *client.Client
+
+	// Guards writes to out and fields below.
+	mu  sync.Mutex
+	out io.Writer
+
+	// Topics used in the session, completed after topic commands.
+	topics map[string]struct{}
+
+	connectedAt time.Time
+	lastFrameAt time.Time
+
+	now func() time.Time
+}
+
+type Option func(r *REPL)
+
+// WithClock replaces time.Now used for frame timing.
+func WithClock(now func() time.Time) Option {
+	return func(r *REPL) {
+		r.now = now
+	}
+}
+
+// New creates REPL for connected c printing to out.
+func New(c *client.Client, out io.Writer, opts ...Option) *REPL {
+	r := &REPL{
+		client: c,
+		out:    out,
+		topics: map[string]struct{}{operation.TopicBroadcast: {}},
+		now:    time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	r.connectedAt = r.now()
+	r.lastFrameAt = r.connectedAt
+
+	return r
+}
+
+// Eval runs a single command line.
+func (r *REPL) Eval(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(line, "{") {
+		if !json.Valid([]byte(line)) {
+			return fmt.Errorf("invalid JSON: %w", ErrBadCommand)
+		}
+
+		return r.client.Send([]byte(line))
+	}
+
+	fields := strings.Fields(line)
+	name, args := fields[0], fields[1:]
+
+	switch name {
+	case cmdSubscribe:
+		if len(args) == 0 {
+			return r.client.Subscribe()
+		}
+
+		r.addTopic(args[0])
+
+		return r.client.SubscribeTopic(args[0])
+	case cmdUnsubscribe:
+		if len(args) == 0 {
+			return r.client.Unsubscribe()
+		}
+
+		return r.client.UnsubscribeTopic(args[0])
+	case cmdPublish:
+		if len(args) < 2 {
+			return fmt.Errorf("usage: publish TOPIC DATA: %w", ErrBadCommand)
+		}
+
+		r.addTopic(args[0])
+
+		// Keep DATA spacing as typed.
+		data := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[len(cmdPublish):]), args[0]))
+
+		return r.client.Publish(args[0], client.Data([]byte(data)))
+	case cmdCount:
+		return r.client.NumConnections()
+	case cmdHelp:
+		r.print(usage)
+
+		return nil
+	case cmdQuit, cmdExit:
+		return ErrQuit
+	default:
+		return fmt.Errorf("unknown command %q, type help: %w", name, ErrBadCommand)
+	}
+}
+
+// Complete returns candidates for line: command names, then topics used in the session.
+func (r *REPL) Complete(line string) []string {
+	fields := strings.Fields(line)
+	trailingSpace := strings.HasSuffix(line, " ")
+
+	var candidates []string
+
+	switch {
+	case len(fields) == 0 || len(fields) == 1 && !trailingSpace:
+		prefix := ""
+		if len(fields) == 1 {
+			prefix = fields[0]
+		}
+
+		for _, name := range commands {
+			if strings.HasPrefix(name, prefix) {
+				candidates = append(candidates, name)
+			}
+		}
+	case fields[0] == cmdSubscribe || fields[0] == cmdUnsubscribe || fields[0] == cmdPublish:
+		if len(fields) > 2 || len(fields) == 2 && trailingSpace {
+			return nil
+		}
+
+		prefix := ""
+		if len(fields) == 2 {
+			prefix = fields[1]
+		}
+
+		for _, topic := range r.sessionTopics() {
+			if strings.HasPrefix(topic, prefix) {
+				candidates = append(candidates, fields[0]+" "+topic)
+			}
+		}
+	}
+
+	return candidates
+}
+
+// ReadFrames prints inbound frames until the connection is closed.
+func (r *REPL) ReadFrames() error {
+	for {
+		resp, err := r.client.ReadOne()
+
+		switch {
+		case err == nil:
+			r.printFrame(resp)
+		case errors.Is(err, client.ErrBadResp):
+			r.print(fmt.Sprintf("<- %s\n", err))
+		case errors.Is(err, websocket.ErrClosedConn):
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+func (r *REPL) printFrame(resp operation.Resp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	sinceConnect, sinceLast := now.Sub(r.connectedAt), now.Sub(r.lastFrameAt)
+	r.lastFrameAt = now
+
+	kind := "unknown"
+
+	switch v := resp.(type) {
+	case operation.RespBroadcast:
+		kind = operation.TopicBroadcast
+	case operation.RespNumConnections:
+		kind = "num_connections"
+	case operation.RespMessage:
+		kind = "message " + v.Topic
+	}
+
+	body, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		body = []byte(fmt.Sprintf("%+v", resp))
+	}
+
+	_, _ = fmt.Fprintf(r.out, "<- %s +%s (Δ%s) %s\n%s\n", now.Format("15:04:05.000"),
+		sinceConnect.Round(time.Millisecond), sinceLast.Round(time.Millisecond), kind, body)
+}
+
+func (r *REPL) print(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, _ = io.WriteString(r.out, s)
+}
+
+func (r *REPL) addTopic(topic string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.topics[topic] = struct{}{}
+}
+
+func (r *REPL) sessionTopics() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	topics := make([]string, 0, len(r.topics))
+	for topic := range r.topics {
+		topics = append(topics, topic)
+	}
+
+	sort.Strings(topics)
+
+	return topics
+}
@@ -0,0 +1,127 @@
+package repl_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/client"
+	"github.com/alexandear/websocket-pubsub/internal/client/mock"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+	"github.com/alexandear/websocket-pubsub/internal/repl"
+)
+
+func newREPL(t *testing.T, opts ...repl.Option) (*repl.REPL, *mock.MockWsConn, *bytes.Buffer) {
+	t.Helper()
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	connm := mock.NewMockWsConn(ctrl)
+	c := client.NewClient(zap.NewNop())
+	c.SetConn(connm)
+
+	out := &bytes.Buffer{}
+
+	return repl.New(c, out, opts...), connm, out
+}
+
+func TestREPL_Eval(t *testing.T) {
+	for name, tc := range map[string]struct {
+		line     string
+		expected string
+	}{
+		"subscribe":         {line: "subscribe", expected: `{"command":"SUBSCRIBE"}`},
+		"subscribe topic":   {line: "subscribe news", expected: `{"command":"SUBSCRIBE","topic":"news"}`},
+		"unsubscribe topic": {line: "unsubscribe news", expected: `{"command":"UNSUBSCRIBE","topic":"news"}`},
+		"count":             {line: "  count ", expected: `{"command":"NUM_CONNECTIONS"}`},
+		"publish json": {
+			line:     `publish news {"title": "hello world"}`,
+			expected: `{"command":"PUBLISH","topic":"news","data":{"title":"hello world"}}`,
+		},
+		"publish text": {
+			line:     "publish news hello world",
+			expected: `{"command":"PUBLISH","topic":"news","data":"hello world"}`,
+		},
+		"raw json": {line: `{"command":"PING"}`, expected: `{"command":"PING"}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, connm, _ := newREPL(t)
+			connm.EXPECT().WriteMessage(websocket.BinaryMessage, []byte(tc.expected)).Times(1)
+
+			assert.NoError(t, r.Eval(tc.line))
+		})
+	}
+
+	t.Run("when bad commands", func(t *testing.T) {
+		r, _, _ := newREPL(t)
+
+		assert.ErrorIs(t, r.Eval("ping"), repl.ErrBadCommand)
+		assert.ErrorIs(t, r.Eval("publish news"), repl.ErrBadCommand)
+		assert.ErrorIs(t, r.Eval(`{"command":`), repl.ErrBadCommand)
+		assert.NoError(t, r.Eval("   "))
+	})
+
+	t.Run("when help and quit", func(t *testing.T) {
+		r, _, out := newREPL(t)
+
+		assert.NoError(t, r.Eval("help"))
+		assert.Contains(t, out.String(), "subscribe [TOPIC]")
+		assert.ErrorIs(t, r.Eval("quit"), repl.ErrQuit)
+		assert.ErrorIs(t, r.Eval("exit"), repl.ErrQuit)
+	})
+}
+
+func TestREPL_Complete(t *testing.T) {
+	r, connm, _ := newREPL(t)
+	connm.EXPECT().WriteMessage(websocket.BinaryMessage, gomock.Any()).Times(1)
+	assert.NoError(t, r.Eval("subscribe news"))
+
+	assert.Equal(t, []string{"subscribe"}, r.Complete("sub"))
+	assert.Equal(t, []string{"unsubscribe"}, r.Complete("un"))
+	assert.Equal(t, []string{"subscribe broadcast", "subscribe news"}, r.Complete("subscribe "))
+	assert.Equal(t, []string{"publish news"}, r.Complete("publish n"))
+	assert.Empty(t, r.Complete("publish news "))
+	assert.Empty(t, r.Complete("count "))
+}
+
+func TestREPL_ReadFrames(t *testing.T) {
+	start := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := start
+	r, connm, out := newREPL(t, repl.WithClock(func() time.Time {
+		return now
+	}))
+
+	gomock.InOrder(
+		connm.EXPECT().ReadMessage().DoAndReturn(func() (websocket.MessageType, []byte, error) {
+			now = now.Add(1500 * time.Millisecond)
+
+			return websocket.BinaryMessage, []byte(`{"topic":"news","data":"hello"}`), nil
+		}),
+		connm.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte(`{}`), nil),
+		connm.EXPECT().ReadMessage().DoAndReturn(func() (websocket.MessageType, []byte, error) {
+			now = now.Add(250 * time.Millisecond)
+
+			return websocket.TextMessage, []byte(`{"num_connections":3}`), nil
+		}),
+		connm.EXPECT().ReadMessage().Return(websocket.MessageType(0), nil, websocket.ErrClosedConn),
+	)
+
+	assert.NoError(t, r.ReadFrames())
+
+	assert.Equal(t, `<- 03:04:06.500 +1.5s (Δ1.5s) message news
+{
+  "topic": "news",
+  "data": "hello"
+}
+<- bad response: failed to determine operation: unknown operation resp
+<- 03:04:06.750 +1.75s (Δ250ms) num_connections
+{
+  "num_connections": 3
+}
+`, out.String())
+}
@@ -0,0 +1,91 @@
+package scenario
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Result of a scenario run, phases after the first failed one are absent.
+type Result struct {
+	Name   string        `json:"name"`
+	Phases []PhaseResult `json:"phases"`
+	// Skipped is the number of phases not run after the failed one.
+	Skipped int `json:"skipped"`
+}
+
+// PhaseResult holds metrics counted during the phase and failed assertions.
+type PhaseResult struct {
+	Name     string         `json:"name"`
+	Duration time.Duration  `json:"duration"`
+	Metrics  map[string]int `json:"metrics"`
+	Failures []string       `json:"failures,omitempty"`
+}
+
+func (r PhaseResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// Passed reports whether all phases of the scenario ran and passed.
+func (r Result) Passed() bool {
+	if r.Skipped > 0 {
+		return false
+	}
+
+	for _, p := range r.Phases {
+		if !p.Passed() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Print writes human readable result.
+func (r Result) Print(w io.Writer) error {
+	if r.Name != "" {
+		if _, err := fmt.Fprintf(w, "scenario %s\n", r.Name); err != nil {
+			return err
+		}
+	}
+
+	for i, p := range r.Phases {
+		status := "ok"
+		if !p.Passed() {
+			status = "FAILED"
+		}
+
+		names := make([]string, 0, len(p.Metrics))
+		for name := range p.Metrics {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		metrics := make([]string, 0, len(names))
+		for _, name := range names {
+			metrics = append(metrics, fmt.Sprintf("%s=%d", name, p.Metrics[name]))
+		}
+
+		if _, err := fmt.Fprintf(w, "%d. %s: %s in %s\n   %s\n", i+1, p.Name, status,
+			p.Duration.Round(time.Millisecond), strings.Join(metrics, " ")); err != nil {
+			return err
+		}
+
+		for _, f := range p.Failures {
+			if _, err := fmt.Fprintf(w, "   assertion failed: %s\n", f); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.Skipped > 0 {
+		if _, err := fmt.Fprintf(w, "%d phases skipped\n", r.Skipped); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,542 @@
+package scenario
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/client"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+const (
+	defaultMaxConcurrentDials = 100
+	assertPollInterval        = 100 * time.Millisecond
+)
+
+// Runner runs scenarios against the server, keeping connections open between phases.
+// Its methods must not be called concurrently, except Snapshot.
+type Runner struct {
+	server             string
+	tlsConfig          *tls.Config
+	codec              codec.Codec
+	compression        bool
+	logger             *zap.Logger
+	maxConcurrentDials int
+
+	// rng is used by the goroutine running phases only.
+	rng *rand.Rand
+
+	mu     sync.Mutex
+	conns  map[*conn]struct{}
+	nextID int
+	phases int
+	stats  Snapshot
+
+	readers sync.WaitGroup
+}
+
+type Option func(r *Runner)
+
+// WithTLS dials wss:// using cfg.
+func WithTLS(cfg *tls.Config) Option {
+	return func(r *Runner) {
+		r.tlsConfig = cfg
+	}
+}
+
+// WithCodec negotiates protocol version and wire format cd with the server.
+func WithCodec(cd codec.Codec) Option {
+	return func(r *Runner) {
+		r.codec = cd
+	}
+}
+
+// WithCompression offers permessage-deflate to the server.
+func WithCompression() Option {
+	return func(r *Runner) {
+		r.compression = true
+	}
+}
+
+// WithSeed makes choice of connections and commands by RunPhase repeatable, Run uses seed of the scenario.
+func WithSeed(seed int64) Option {
+	return func(r *Runner) {
+		r.rng = rand.New(rand.NewSource(seed))
+	}
+}
+
+// WithMaxConcurrentDials limits how many dials may be in progress at once.
+func WithMaxConcurrentDials(n int) Option {
+	return func(r *Runner) {
+		r.maxConcurrentDials = n
+	}
+}
+
+func New(logger *zap.Logger, server string, opts ...Option) *Runner {
+	r := &Runner{
+		server:             server,
+		logger:             logger,
+		maxConcurrentDials: defaultMaxConcurrentDials,
+		rng:                rand.New(rand.NewSource(defaultSeed)),
+		conns:              map[*conn]struct{}{},
+		stats:              newSnapshot(),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+type conn struct {
+	id     int
+	client *client.Client
+	// closing is set under Runner.mu when the runner closes the connection or asks the server to close it.
+	closing bool
+}
+
+// Run runs phases one after another using seed of s and stops after the first failed one.
+// All connections are closed at the end.
+func (r *Runner) Run(ctx context.Context, s Scenario) Result {
+	r.rng = rand.New(rand.NewSource(s.Seed))
+	result := Result{Name: s.Name}
+
+	defer r.Close()
+
+	for i, p := range s.Phases {
+		start := time.Now()
+
+		r.RunPhase(ctx, p)
+
+		failures := Check(ctx, p, r.Snapshot, r.ProbeNumConnections)
+		if ctx.Err() != nil {
+			failures = append(failures, "canceled")
+		}
+
+		pr := PhaseResult{
+			Name:     p.Name,
+			Duration: time.Since(start),
+			Metrics:  r.Snapshot().Metrics(),
+			Failures: failures,
+		}
+		result.Phases = append(result.Phases, pr)
+
+		r.logger.Info("phase finished", zap.String("phase", pr.Name), zap.Bool("passed", pr.Passed()),
+			zap.Duration("duration", pr.Duration))
+
+		if !pr.Passed() {
+			result.Skipped = len(s.Phases) - i - 1
+
+			break
+		}
+	}
+
+	return result
+}
+
+// RunPhase resets metrics, opens or closes connections, sends commands and waits as described by p.
+// Assertions are not checked.
+func (r *Runner) RunPhase(ctx context.Context, p Phase) {
+	r.mu.Lock()
+	r.phases++
+	r.stats = newSnapshot()
+	r.stats.Phase = r.phases
+	r.mu.Unlock()
+
+	if p.Connections != nil {
+		r.resize(ctx, *p.Connections, p)
+	}
+
+	r.sendCommands(ctx, p)
+
+	sleep(ctx, p.Wait.Value())
+}
+
+// resize dials or closes connections until target connections are open.
+func (r *Runner) resize(ctx context.Context, target int, p Phase) {
+	open := r.openConns()
+
+	if len(open) > target {
+		r.rng.Shuffle(len(open), func(i, j int) { open[i], open[j] = open[j], open[i] })
+
+		for _, c := range open[:len(open)-target] {
+			r.close(c)
+		}
+
+		return
+	}
+
+	var tick <-chan time.Time
+
+	if p.ConnectRate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / p.ConnectRate))
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	var wg sync.WaitGroup
+
+	dialSlots := make(chan struct{}, r.maxConcurrentDials)
+
+	for i := len(open); i < target; i++ {
+		if i > len(open) && tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+			}
+		}
+
+		select {
+		case dialSlots <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			r.dial(ctx, p.Topic)
+
+			<-dialSlots
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (r *Runner) dial(ctx context.Context, topic string) {
+	c, err := client.Dial(ctx, r.logger, r.server, client.DialConfig{
+		TLS: r.tlsConfig, Codec: r.codec, Compression: r.compression,
+	})
+	if err == nil {
+		err = subscribe(c, topic)
+		if err != nil {
+			c.Close()
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.logger.Debug("connect failed", zap.Error(err))
+		r.stats.Counts[MetricConnectErrors]++
+
+		return
+	}
+
+	r.nextID++
+	cn := &conn{id: r.nextID, client: c}
+	r.conns[cn] = struct{}{}
+
+	r.readers.Add(1)
+
+	go r.read(cn)
+}
+
+func (r *Runner) read(c *conn) {
+	defer r.readers.Done()
+
+	for {
+		resp, err := c.client.ReadOne()
+		if errors.Is(err, client.ErrBadResp) {
+			continue
+		}
+
+		if err != nil {
+			r.mu.Lock()
+			if !c.closing {
+				r.logger.Debug("connection lost", zap.Int("conn", c.id), zap.Error(err))
+				r.stats.Counts[MetricDisconnects]++
+			}
+
+			delete(r.conns, c)
+			r.mu.Unlock()
+
+			return
+		}
+
+		r.received(resp)
+	}
+}
+
+func (r *Runner) received(resp operation.Resp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch resp := resp.(type) {
+	case operation.RespBroadcast:
+		r.stats.Counts[MetricReceivedBroadcast]++
+	case operation.RespMessage:
+		r.stats.Counts[MetricReceivedMessage]++
+	case operation.RespNumConnections:
+		r.stats.Counts[MetricReceivedNumConnections]++
+		r.stats.NumConnections = resp.NumConnections
+		r.stats.NumConnectionsAt = time.Now()
+	}
+}
+
+// sendCommands sends commands of the mix from random senders concurrently.
+func (r *Runner) sendCommands(ctx context.Context, p Phase) {
+	if p.Commands == 0 {
+		return
+	}
+
+	senders := r.openConns()
+	r.rng.Shuffle(len(senders), func(i, j int) { senders[i], senders[j] = senders[j], senders[i] })
+
+	if p.Senders > 0 && p.Senders < len(senders) {
+		senders = senders[:p.Senders]
+	}
+
+	var wg sync.WaitGroup
+
+	for _, c := range senders {
+		// Commands are chosen before starting goroutines so that rng use is repeatable.
+		commands := make([]string, p.Commands)
+		for i := range commands {
+			commands[i] = pick(r.rng, p.Mix)
+		}
+
+		wg.Add(1)
+
+		go func(c *conn) {
+			defer wg.Done()
+
+			for i, cmd := range commands {
+				if i > 0 && !sleep(ctx, p.ThinkTime.Value()) {
+					return
+				}
+
+				if !r.send(c, cmd, p, i) {
+					return
+				}
+			}
+		}(c)
+	}
+
+	wg.Wait()
+}
+
+// send returns false when the connection must not be used anymore.
+func (r *Runner) send(c *conn, cmd string, p Phase, seq int) bool {
+	var err error
+
+	switch cmd {
+	case mixSubscribe:
+		err = subscribe(c.client, p.Topic)
+	case mixUnsubscribe:
+		// The server closes the connection, it is not an unexpected disconnect.
+		r.mu.Lock()
+		c.closing = true
+		delete(r.conns, c)
+		r.mu.Unlock()
+
+		err = c.client.Unsubscribe()
+	case mixNumConnections:
+		err = c.client.NumConnections()
+	case mixPublish:
+		data := []byte(fmt.Sprintf(`{"phase":%q,"conn":%d,"seq":%d}`, p.Name, c.id, seq+1))
+		err = c.client.PublishAt(p.Topic, data, time.Now())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.logger.Debug("send failed", zap.Int("conn", c.id), zap.String("command", cmd), zap.Error(err))
+		r.stats.Counts[MetricSendErrors]++
+
+		return false
+	}
+
+	if cmd == mixPublish {
+		r.stats.Counts[MetricPublished]++
+	}
+
+	return cmd != mixUnsubscribe
+}
+
+// Check waits until all assertions of p hold for snapshot metrics or the assert timeout passes
+// and returns failed ones. While num_connections assertion fails, probe is called to ask the server again.
+func Check(ctx context.Context, p Phase, snapshot func() Snapshot, probe func()) []string {
+	if len(p.Assert) == 0 {
+		return nil
+	}
+
+	assertions := make([]Assertion, 0, len(p.Assert))
+
+	for _, expr := range p.Assert {
+		a, _ := ParseAssertion(expr)
+		assertions = append(assertions, a)
+	}
+
+	deadline := time.Now().Add(p.AssertTimeout.Value())
+
+	for {
+		failures, needProbe := failed(assertions, snapshot().Metrics())
+		if len(failures) == 0 || time.Now().After(deadline) {
+			return failures
+		}
+
+		if needProbe {
+			probe()
+		}
+
+		if !sleep(ctx, assertPollInterval) {
+			failures, _ = failed(assertions, snapshot().Metrics())
+
+			return failures
+		}
+	}
+}
+
+func failed(assertions []Assertion, metrics map[string]int) (failures []string, probe bool) {
+	for _, a := range assertions {
+		actual, ok := metrics[a.Metric]
+
+		switch {
+		case !ok:
+			failures = append(failures, fmt.Sprintf("%s: no value", a))
+		case !a.Holds(actual):
+			failures = append(failures, fmt.Sprintf("%s: got %d", a, actual))
+		default:
+			continue
+		}
+
+		if a.Metric == MetricNumConnections {
+			probe = true
+		}
+	}
+
+	return failures, probe
+}
+
+// ProbeNumConnections sends NUM_CONNECTIONS from a random open connection.
+func (r *Runner) ProbeNumConnections() {
+	open := r.openConns()
+	if len(open) == 0 {
+		return
+	}
+
+	c := open[r.rng.Intn(len(open))]
+	if err := c.client.NumConnections(); err != nil {
+		r.logger.Debug("num connections probe failed", zap.Int("conn", c.id), zap.Error(err))
+	}
+}
+
+// Snapshot returns metrics of the current phase.
+func (r *Runner) Snapshot() Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot := r.stats
+	snapshot.TakenAt = time.Now()
+	snapshot.Counts = make(map[string]int, len(r.stats.Counts)+1)
+
+	for name, n := range r.stats.Counts {
+		snapshot.Counts[name] = n
+	}
+
+	snapshot.Counts[MetricConnections] = len(r.conns)
+
+	return snapshot
+}
+
+// openConns returns open connections ordered by id.
+func (r *Runner) openConns() []*conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conns := make([]*conn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+
+	return conns
+}
+
+func (r *Runner) close(c *conn) {
+	r.mu.Lock()
+	c.closing = true
+	delete(r.conns, c)
+	r.mu.Unlock()
+
+	c.client.Close()
+}
+
+// Close closes all connections.
+func (r *Runner) Close() {
+	for _, c := range r.openConns() {
+		r.close(c)
+	}
+
+	r.readers.Wait()
+}
+
+func subscribe(c *client.Client, topic string) error {
+	if topic == operation.TopicBroadcast {
+		return c.Subscribe()
+	}
+
+	return c.SubscribeTopic(topic)
+}
+
+// pick chooses command of the mix with probability proportional to its weight.
+func pick(rng *rand.Rand, mix map[string]int) string {
+	total := 0
+	for _, w := range mix {
+		total += w
+	}
+
+	names := sortedKeys(mix)
+	if total == 0 {
+		return names[rng.Intn(len(names))]
+	}
+
+	n := rng.Intn(total)
+
+	for _, name := range names {
+		n -= mix[name]
+		if n < 0 {
+			return name
+		}
+	}
+
+	return names[len(names)-1]
+}
+
+// sleep returns false when ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
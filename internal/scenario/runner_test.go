@@ -0,0 +1,114 @@
+package scenario_test
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/scenario"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+)
+
+func newServer(t *testing.T) string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := server.NewHub(zap.NewNop(), 20*time.Millisecond)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+	})
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestRunner_Run(t *testing.T) {
+	t.Run("passed", func(t *testing.T) {
+		s, err := scenario.Parse([]byte(`
+name: unsubscribe one
+phases:
+  - name: connect
+    connections: 10
+    connect_rate: 1000
+    assert: ["connections == 10", "num_connections == 10"]
+  - name: unsubscribe
+    senders: 1
+    mix: {unsubscribe: 1}
+    assert: ["num_connections == 9", "connections == 9", "disconnects == 0"]
+  - name: publish
+    connections: 12
+    topic: news
+    senders: 2
+    commands: 3
+    mix: {publish: 1}
+    think_time: 1ms
+    assert: ["published == 6", "received.message >= 6", "received.broadcast > 0"]
+  - name: shrink
+    connections: 4
+    assert: ["num_connections == 4", "connections == 4"]
+`))
+		require.NoError(t, err)
+
+		result := scenario.New(zap.NewNop(), newServer(t)).Run(context.Background(), s)
+
+		out := &bytes.Buffer{}
+		require.NoError(t, result.Print(out))
+		assert.True(t, result.Passed(), out.String())
+		assert.Len(t, result.Phases, 4)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		s, err := scenario.Parse([]byte(`
+phases:
+  - connections: 2
+    assert: ["num_connections == 3"]
+    assert_timeout: 200ms
+  - connections: 1
+`))
+		require.NoError(t, err)
+
+		result := scenario.New(zap.NewNop(), newServer(t)).Run(context.Background(), s)
+
+		assert.False(t, result.Passed())
+		assert.Equal(t, 1, result.Skipped)
+		require.Len(t, result.Phases, 1)
+		assert.Equal(t, []string{"num_connections == 3: got 2"}, result.Phases[0].Failures)
+	})
+}
+
+func TestResult_Print(t *testing.T) {
+	result := scenario.Result{
+		Name: "demo",
+		Phases: []scenario.PhaseResult{
+			{Name: "connect", Duration: 1234 * time.Millisecond, Metrics: map[string]int{"connections": 2, "disconnects": 0}},
+			{
+				Name: "count", Duration: time.Second, Metrics: map[string]int{"connections": 2, "num_connections": 2},
+				Failures: []string{"num_connections == 3: got 2"},
+			},
+		},
+		Skipped: 1,
+	}
+	out := &bytes.Buffer{}
+
+	require.NoError(t, result.Print(out))
+
+	assert.Equal(t, `scenario demo
+1. connect: ok in 1.234s
+   connections=2 disconnects=0
+2. count: FAILED in 1s
+   connections=2 num_connections=2
+   assertion failed: num_connections == 3: got 2
+1 phases skipped
+`, out.String())
+}
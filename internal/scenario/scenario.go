@@ -0,0 +1,312 @@
+package scenario
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/alexandear/websocket-pubsub/internal/config"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/command"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+)
+
+const (
+	defaultSeed          = 1
+	defaultAssertTimeout = 5 * time.Second
+)
+
+var (
+	ErrInvalid = errors.New("invalid scenario")
+	// ErrFailed means a phase assertion failed.
+	ErrFailed = errors.New("scenario failed")
+)
+
+// Scenario is a sequence of phases run one after another against the server.
+type Scenario struct {
+	Name string `yaml:"name" json:"name"`
+	// Seed makes choice of connections and commands repeatable.
+	Seed   int64   `yaml:"seed" json:"seed"`
+	Phases []Phase `yaml:"phases" json:"phases"`
+}
+
+// Phase opens or closes connections, sends commands from them and checks assertions.
+type Phase struct {
+	Name string `yaml:"name" json:"name"`
+
+	// Connections is the number of open connections during the phase, connections of the previous
+	// phase are kept when it is not set. New connections subscribe to Topic.
+	Connections *int `yaml:"connections" json:"connections"`
+	// ConnectRate is connections dialed per second, zero dials all at once.
+	ConnectRate float64 `yaml:"connect_rate" json:"connect_rate"`
+	// Topic is subscribed by new connections and used by subscribe and publish commands.
+	Topic string `yaml:"topic" json:"topic"`
+
+	// Senders is the number of random open connections sending commands, zero means all.
+	Senders int `yaml:"senders" json:"senders"`
+	// Commands is the number of commands sent by every sender.
+	Commands int `yaml:"commands" json:"commands"`
+	// Mix is weight of every command: subscribe, unsubscribe, num_connections, publish.
+	Mix map[string]int `yaml:"mix" json:"mix"`
+	// ThinkTime is a pause between commands of a sender.
+	ThinkTime config.Duration `yaml:"think_time" json:"think_time"`
+
+	// Wait is a pause after all commands are sent, e.g. to receive broadcasts.
+	Wait config.Duration `yaml:"wait" json:"wait"`
+	// Assert are expressions like "num_connections == 4999" which must hold within AssertTimeout after Wait.
+	Assert        []string        `yaml:"assert" json:"assert"`
+	AssertTimeout config.Duration `yaml:"assert_timeout" json:"assert_timeout"`
+}
+
+// Load reads scenario from YAML file, fills defaults and validates it.
+func Load(file string) (Scenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Scenario{}, fmt.Errorf("read scenario file failed: %w", err)
+	}
+
+	return Parse(data)
+}
+
+// Parse decodes scenario from YAML, fills defaults and validates it.
+func Parse(data []byte) (Scenario, error) {
+	var s Scenario
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return Scenario{}, fmt.Errorf("decode yaml scenario failed: %w", err)
+	}
+
+	s.setDefaults()
+
+	if err := s.Validate(); err != nil {
+		return Scenario{}, err
+	}
+
+	return s, nil
+}
+
+func (s *Scenario) setDefaults() {
+	if s.Seed == 0 {
+		s.Seed = defaultSeed
+	}
+
+	for i := range s.Phases {
+		p := &s.Phases[i]
+
+		if p.Name == "" {
+			p.Name = "phase " + strconv.Itoa(i+1)
+		}
+
+		if p.Topic == "" {
+			p.Topic = operation.TopicBroadcast
+		}
+
+		if p.Commands == 0 && len(p.Mix) > 0 {
+			p.Commands = 1
+		}
+
+		if p.AssertTimeout == 0 {
+			p.AssertTimeout = config.Duration(defaultAssertTimeout)
+		}
+	}
+}
+
+// Validate reports all invalid settings at once.
+func (s Scenario) Validate() error {
+	var problems []string
+
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(len(s.Phases) > 0, "phases must be set")
+
+	for _, p := range s.Phases {
+		check(p.Connections == nil || *p.Connections >= 0,
+			"%s: connections must not be negative, got %d", p.Name, p.connections())
+		check(p.ConnectRate >= 0, "%s: connect_rate must not be negative, got %g", p.Name, p.ConnectRate)
+		check(p.Senders >= 0, "%s: senders must not be negative, got %d", p.Name, p.Senders)
+		check(p.Commands >= 0, "%s: commands must not be negative, got %d", p.Name, p.Commands)
+		check(p.Commands == 0 || len(p.Mix) > 0, "%s: commands require mix", p.Name)
+
+		for _, name := range sortedKeys(p.Mix) {
+			_, ok := mixCommands[name]
+			check(ok, "%s: mix command must be one of subscribe, unsubscribe, num_connections, publish, got %q",
+				p.Name, name)
+			check(p.Mix[name] >= 0, "%s: mix weight of %s must not be negative, got %d", p.Name, name, p.Mix[name])
+		}
+
+		check(p.Mix[mixPublish] == 0 || p.Topic != operation.TopicBroadcast,
+			"%s: publish requires topic other than %s", p.Name, operation.TopicBroadcast)
+		check(p.ThinkTime >= 0, "%s: think_time must not be negative, got %s", p.Name, p.ThinkTime)
+		check(p.Wait >= 0, "%s: wait must not be negative, got %s", p.Name, p.Wait)
+
+		for _, expr := range p.Assert {
+			_, err := ParseAssertion(expr)
+			check(err == nil, "%s: %v", p.Name, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w:\n  - %s", ErrInvalid, strings.Join(problems, "\n  - "))
+	}
+
+	return nil
+}
+
+// Share returns part of s run by worker index of workers: connections, connect rate and senders
+// of every phase are divided between workers, seed differs per worker. Assertions are left as is
+// because they are checked against metrics of all workers.
+func Share(s Scenario, index, workers int) Scenario {
+	shared := s
+	shared.Seed = s.Seed + int64(index)
+	shared.Phases = make([]Phase, len(s.Phases))
+
+	for i, p := range s.Phases {
+		if p.Connections != nil {
+			n := share(*p.Connections, index, workers)
+			p.Connections = &n
+		}
+
+		p.ConnectRate /= float64(workers)
+
+		if p.Senders > 0 {
+			p.Senders = share(p.Senders, index, workers)
+			if p.Senders == 0 {
+				p.Commands = 0
+			}
+		}
+
+		shared.Phases[i] = p
+	}
+
+	return shared
+}
+
+// share divides n between workers, first workers get the remainder.
+func share(n, index, workers int) int {
+	part := n / workers
+	if index < n%workers {
+		part++
+	}
+
+	return part
+}
+
+func (p Phase) connections() int {
+	if p.Connections == nil {
+		return 0
+	}
+
+	return *p.Connections
+}
+
+// Commands of Phase.Mix.
+const (
+	mixSubscribe      = "subscribe"
+	mixUnsubscribe    = "unsubscribe"
+	mixNumConnections = "num_connections"
+	mixPublish        = "publish"
+)
+
+var mixCommands = map[string]command.Type{
+	mixSubscribe:      command.Subscribe,
+	mixUnsubscribe:    command.Unsubscribe,
+	mixNumConnections: command.NumConnections,
+	mixPublish:        command.Publish,
+}
+
+// Metrics of assertions.
+const (
+	MetricConnections            = "connections"
+	MetricNumConnections         = "num_connections"
+	MetricConnectErrors          = "connect_errors"
+	MetricDisconnects            = "disconnects"
+	MetricPublished              = "published"
+	MetricSendErrors             = "send_errors"
+	MetricReceivedBroadcast      = "received.broadcast"
+	MetricReceivedMessage        = "received.message"
+	MetricReceivedNumConnections = "received.num_connections"
+)
+
+var metrics = map[string]bool{
+	MetricConnections:            true,
+	MetricNumConnections:         true,
+	MetricConnectErrors:          true,
+	MetricDisconnects:            true,
+	MetricPublished:              true,
+	MetricSendErrors:             true,
+	MetricReceivedBroadcast:      true,
+	MetricReceivedMessage:        true,
+	MetricReceivedNumConnections: true,
+}
+
+var assertionRe = regexp.MustCompile(`^\s*([a-z_.]+)\s*(==|!=|<=|>=|<|>)\s*(-?\d+)\s*$`)
+
+// Assertion compares metric of a phase with a value.
+type Assertion struct {
+	Metric string
+	Op     string
+	Value  int
+}
+
+// ParseAssertion parses expression like "num_connections == 4999".
+func ParseAssertion(expr string) (Assertion, error) {
+	m := assertionRe.FindStringSubmatch(expr)
+	if m == nil {
+		return Assertion{}, fmt.Errorf("assertion %q must look like \"metric == 10\"", expr)
+	}
+
+	if !metrics[m[1]] {
+		return Assertion{}, fmt.Errorf("assertion %q: unknown metric %q", expr, m[1])
+	}
+
+	value, err := strconv.Atoi(m[3])
+	if err != nil {
+		return Assertion{}, fmt.Errorf("assertion %q: %w", expr, err)
+	}
+
+	return Assertion{Metric: m[1], Op: m[2], Value: value}, nil
+}
+
+// Holds reports whether actual metric value satisfies the assertion.
+func (a Assertion) Holds(actual int) bool {
+	switch a.Op {
+	case "==":
+		return actual == a.Value
+	case "!=":
+		return actual != a.Value
+	case "<":
+		return actual < a.Value
+	case "<=":
+		return actual <= a.Value
+	case ">":
+		return actual > a.Value
+	case ">=":
+		return actual >= a.Value
+	default:
+		return false
+	}
+}
+
+func (a Assertion) String() string {
+	return fmt.Sprintf("%s %s %d", a.Metric, a.Op, a.Value)
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,150 @@
+package scenario_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexandear/websocket-pubsub/internal/config"
+	"github.com/alexandear/websocket-pubsub/internal/scenario"
+)
+
+func TestParse(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		s, err := scenario.Parse([]byte(`
+name: unsubscribe one
+phases:
+  - connections: 10
+  - name: unsubscribe
+    senders: 1
+    mix: {unsubscribe: 1}
+    think_time: 10ms
+    assert: ["num_connections == 9"]
+`))
+
+		require.NoError(t, err)
+		ten := 10
+		assert.Equal(t, scenario.Scenario{
+			Name: "unsubscribe one",
+			Seed: 1,
+			Phases: []scenario.Phase{
+				{
+					Name:          "phase 1",
+					Connections:   &ten,
+					Topic:         "broadcast",
+					AssertTimeout: config.Duration(5 * time.Second),
+				},
+				{
+					Name:          "unsubscribe",
+					Topic:         "broadcast",
+					Senders:       1,
+					Commands:      1,
+					Mix:           map[string]int{"unsubscribe": 1},
+					ThinkTime:     config.Duration(10 * time.Millisecond),
+					Assert:        []string{"num_connections == 9"},
+					AssertTimeout: config.Duration(5 * time.Second),
+				},
+			},
+		}, s)
+	})
+
+	t.Run("when unknown field", func(t *testing.T) {
+		_, err := scenario.Parse([]byte("phases:\n  - connectoins: 1\n"))
+
+		assert.Error(t, err)
+	})
+
+	t.Run("when invalid", func(t *testing.T) {
+		_, err := scenario.Parse([]byte(`
+phases:
+  - connections: -1
+    commands: 2
+  - mix: {publish: 1, ping: 1}
+    assert: ["num_connections = 1", "latency < 1"]
+`))
+
+		assert.ErrorIs(t, err, scenario.ErrInvalid)
+		assert.EqualError(t, err, `invalid scenario:
+  - phase 1: connections must not be negative, got -1
+  - phase 1: commands require mix
+  - phase 2: mix command must be one of subscribe, unsubscribe, num_connections, publish, got "ping"
+  - phase 2: publish requires topic other than broadcast
+  - phase 2: assertion "num_connections = 1" must look like "metric == 10"
+  - phase 2: assertion "latency < 1": unknown metric "latency"`)
+	})
+
+	t.Run("when no phases", func(t *testing.T) {
+		_, err := scenario.Parse([]byte("name: empty\n"))
+
+		assert.EqualError(t, err, "invalid scenario:\n  - phases must be set")
+	})
+}
+
+func TestAssertion(t *testing.T) {
+	for expr, tc := range map[string]struct {
+		actual   int
+		expected bool
+	}{
+		"num_connections == 4999": {actual: 4999, expected: true},
+		"connections != 0":        {actual: 0, expected: false},
+		"disconnects < 1":         {actual: 0, expected: true},
+		"published <= 10":         {actual: 11, expected: false},
+		"received.message > 5":    {actual: 6, expected: true},
+		" connect_errors>=-1 ":    {actual: -1, expected: true},
+	} {
+		t.Run(expr, func(t *testing.T) {
+			a, err := scenario.ParseAssertion(expr)
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, a.Holds(tc.actual))
+		})
+	}
+}
+
+func TestShare(t *testing.T) {
+	ten := 10
+	s := scenario.Scenario{
+		Seed: 7,
+		Phases: []scenario.Phase{
+			{Connections: &ten, ConnectRate: 300},
+			{Senders: 1, Commands: 2, Mix: map[string]int{"unsubscribe": 1}},
+		},
+	}
+
+	var connections, senders, commands []int
+
+	for i := 0; i < 3; i++ {
+		share := scenario.Share(s, i, 3)
+
+		assert.Equal(t, int64(7+i), share.Seed)
+		assert.Equal(t, 100.0, share.Phases[0].ConnectRate)
+		connections = append(connections, *share.Phases[0].Connections)
+		senders = append(senders, share.Phases[1].Senders)
+		commands = append(commands, share.Phases[1].Commands)
+	}
+
+	assert.Equal(t, []int{4, 3, 3}, connections)
+	assert.Equal(t, []int{1, 0, 0}, senders)
+	assert.Equal(t, []int{2, 0, 0}, commands)
+	assert.Equal(t, 10, *s.Phases[0].Connections, "scenario is not changed")
+}
+
+func TestMerge(t *testing.T) {
+	now := time.Now()
+
+	merged := scenario.Merge(
+		scenario.Snapshot{Counts: map[string]int{"connections": 2, "published": 1}, NumConnections: -1},
+		scenario.Snapshot{Counts: map[string]int{"connections": 3}, NumConnections: 5, NumConnectionsAt: now},
+		scenario.Snapshot{NumConnections: 4, NumConnectionsAt: now.Add(-time.Second)},
+	)
+
+	assert.Equal(t, 5, merged.Metrics()["connections"])
+	assert.Equal(t, 1, merged.Metrics()["published"])
+	assert.Equal(t, 0, merged.Metrics()["disconnects"])
+	assert.Equal(t, 5, merged.Metrics()["num_connections"])
+
+	_, ok := scenario.Merge().Metrics()["num_connections"]
+	assert.False(t, ok)
+}
@@ -0,0 +1,57 @@
+package scenario
+
+import (
+	"time"
+)
+
+// Snapshot holds metrics counted from the start of a phase.
+type Snapshot struct {
+	// Phase is the number of phases started by the runner, zero before the first one.
+	Phase   int       `json:"phase"`
+	TakenAt time.Time `json:"taken_at"`
+	// Counts are all metrics except num_connections.
+	Counts map[string]int `json:"counts"`
+	// NumConnections is the last NUM_CONNECTIONS response received at NumConnectionsAt, -1 when there was none.
+	NumConnections   int       `json:"num_connections"`
+	NumConnectionsAt time.Time `json:"num_connections_at"`
+}
+
+func newSnapshot() Snapshot {
+	return Snapshot{Counts: map[string]int{}, NumConnections: -1}
+}
+
+// Metrics returns all metrics with zero counts, num_connections is absent when it was not received.
+func (s Snapshot) Metrics() map[string]int {
+	m := make(map[string]int, len(metrics))
+
+	for name := range metrics {
+		if name != MetricNumConnections {
+			m[name] = s.Counts[name]
+		}
+	}
+
+	if s.NumConnections >= 0 {
+		m[MetricNumConnections] = s.NumConnections
+	}
+
+	return m
+}
+
+// Merge sums counts of snapshots taken by several runners and keeps the latest num_connections.
+// Phase and TakenAt are not set.
+func Merge(snapshots ...Snapshot) Snapshot {
+	merged := newSnapshot()
+
+	for _, s := range snapshots {
+		for name, n := range s.Counts {
+			merged.Counts[name] += n
+		}
+
+		if s.NumConnections >= 0 && (merged.NumConnections < 0 || s.NumConnectionsAt.After(merged.NumConnectionsAt)) {
+			merged.NumConnections = s.NumConnections
+			merged.NumConnectionsAt = s.NumConnectionsAt
+		}
+	}
+
+	return merged
+}
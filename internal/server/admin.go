@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const defaultKickReason = "kicked by admin"
+
+type kickRequest struct {
+	Reason string `json:"reason"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// ReloadResult lists dotted config keys which changed on reload, e.g. server.log.level.
+type ReloadResult struct {
+	// Applied settings are in effect without restart.
+	Applied []string `json:"applied"`
+	// RestartRequired settings changed but take effect only after restart.
+	RestartRequired []string `json:"restart_required"`
+}
+
+// ReloadFunc reads configuration again and applies settings which are safe to change at runtime.
+type ReloadFunc func() (ReloadResult, error)
+
+// registerAdmin mounts admin API under /admin when admin token is configured.
+func (a *App) registerAdmin() {
+	if a.adminToken == "" {
+		return
+	}
+
+	admin := a.router.PathPrefix("/admin").Subrouter()
+	admin.Use(a.adminAuth)
+	admin.HandleFunc("/clients", a.serveAdminClients).Methods(http.MethodGet)
+	admin.HandleFunc("/clients/{id}", a.serveAdminClient).Methods(http.MethodGet)
+	admin.HandleFunc("/clients/{id}/kick", a.serveAdminKick).Methods(http.MethodPost)
+	admin.HandleFunc("/topics", a.serveAdminTopics).Methods(http.MethodGet)
+
+	if a.reload != nil {
+		admin.HandleFunc("/reload", a.serveAdminReload).Methods(http.MethodPost)
+	}
+}
+
+// adminAuth requires "Authorization: Bearer <admin token>" header.
+func (a *App) adminAuth(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + a.adminToken)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			a.writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "unauthorized"})
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *App) serveAdminClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := a.hub.Clients(r.Context())
+	if err != nil {
+		a.writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+
+		return
+	}
+
+	a.writeJSON(w, http.StatusOK, clients)
+}
+
+func (a *App) serveAdminClient(w http.ResponseWriter, r *http.Request) {
+	client, found, err := a.hub.Client(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		a.writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+
+		return
+	}
+
+	if !found {
+		a.writeJSON(w, http.StatusNotFound, errorResponse{Error: "client not found"})
+
+		return
+	}
+
+	a.writeJSON(w, http.StatusOK, client)
+}
+
+func (a *App) serveAdminKick(w http.ResponseWriter, r *http.Request) {
+	req := kickRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			a.writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid request body: " + err.Error()})
+
+			return
+		}
+	}
+
+	if req.Reason == "" {
+		req.Reason = defaultKickReason
+	}
+
+	found, err := a.hub.Kick(r.Context(), mux.Vars(r)["id"], req.Reason)
+	if err != nil {
+		a.writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+
+		return
+	}
+
+	if !found {
+		a.writeJSON(w, http.StatusNotFound, errorResponse{Error: "client not found"})
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *App) serveAdminTopics(w http.ResponseWriter, r *http.Request) {
+	topics, err := a.hub.Topics(r.Context())
+	if err != nil {
+		a.writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error()})
+
+		return
+	}
+
+	a.writeJSON(w, http.StatusOK, topics)
+}
+
+func (a *App) serveAdminReload(w http.ResponseWriter, _ *http.Request) {
+	result, err := a.reload()
+	if err != nil {
+		a.writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+
+		return
+	}
+
+	a.writeJSON(w, http.StatusOK, result)
+}
+
+func (a *App) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		a.logger.Warn("write json response failed", zap.Error(err))
+	}
+}
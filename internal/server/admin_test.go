@@ -0,0 +1,150 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/server"
+	"github.com/alexandear/websocket-pubsub/internal/server/mock"
+)
+
+const adminToken = "secret"
+
+func adminRequest(method, target, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	return req
+}
+
+func TestApp_Admin(t *testing.T) {
+	t.Run("when admin token is not set", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		app := server.New(zap.NewNop(), "", mock.NewMockHubI(ctrl))
+		rec := httptest.NewRecorder()
+
+		app.ServeHTTP(rec, adminRequest(http.MethodGet, "/admin/clients", ""))
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("when wrong token", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		app := server.New(zap.NewNop(), "", mock.NewMockHubI(ctrl), server.WithAdminToken(adminToken))
+		req := adminRequest(http.MethodGet, "/admin/clients", "")
+		req.Header.Set("Authorization", "Bearer wrong")
+		rec := httptest.NewRecorder()
+
+		app.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("clients", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		hubm := mock.NewMockHubI(ctrl)
+		connectedAt := time.Now().UTC().Truncate(time.Second)
+		clients := []server.ClientInfo{{
+			ID:            "id",
+			RemoteAddr:    "127.0.0.1:1234",
+			Subscriptions: []string{"broadcast"},
+			ConnectedAt:   connectedAt,
+			QueueDepth:    3,
+		}}
+		hubm.EXPECT().Clients(gomock.Any()).Return(clients, nil).Times(1)
+		app := server.New(zap.NewNop(), "", hubm, server.WithAdminToken(adminToken))
+		rec := httptest.NewRecorder()
+
+		app.ServeHTTP(rec, adminRequest(http.MethodGet, "/admin/clients", ""))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var actual []server.ClientInfo
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&actual))
+		assert.Equal(t, clients, actual)
+	})
+
+	t.Run("client when not found", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		hubm := mock.NewMockHubI(ctrl)
+		hubm.EXPECT().Client(gomock.Any(), "id").Return(server.ClientInfo{}, false, nil).Times(1)
+		app := server.New(zap.NewNop(), "", hubm, server.WithAdminToken(adminToken))
+		rec := httptest.NewRecorder()
+
+		app.ServeHTTP(rec, adminRequest(http.MethodGet, "/admin/clients/id", ""))
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("kick", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		hubm := mock.NewMockHubI(ctrl)
+		hubm.EXPECT().Kick(gomock.Any(), "id", "spam").Return(true, nil).Times(1)
+		app := server.New(zap.NewNop(), "", hubm, server.WithAdminToken(adminToken))
+		rec := httptest.NewRecorder()
+
+		app.ServeHTTP(rec, adminRequest(http.MethodPost, "/admin/clients/id/kick", `{"reason":"spam"}`))
+
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	})
+
+	t.Run("topics", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		hubm := mock.NewMockHubI(ctrl)
+		hubm.EXPECT().Topics(gomock.Any()).Return(nil, context.DeadlineExceeded).Times(1)
+		app := server.New(zap.NewNop(), "", hubm, server.WithAdminToken(adminToken))
+		rec := httptest.NewRecorder()
+
+		app.ServeHTTP(rec, adminRequest(http.MethodGet, "/admin/topics", ""))
+
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		result := server.ReloadResult{Applied: []string{"server.broadcast"}, RestartRequired: []string{"server.addr"}}
+		app := server.New(zap.NewNop(), "", mock.NewMockHubI(ctrl), server.WithAdminToken(adminToken),
+			server.WithReload(func() (server.ReloadResult, error) {
+				return result, nil
+			}))
+		rec := httptest.NewRecorder()
+
+		app.ServeHTTP(rec, adminRequest(http.MethodPost, "/admin/reload", ""))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var actual server.ReloadResult
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&actual))
+		assert.Equal(t, result, actual)
+	})
+
+	t.Run("reload when config is invalid", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		app := server.New(zap.NewNop(), "", mock.NewMockHubI(ctrl), server.WithAdminToken(adminToken),
+			server.WithReload(func() (server.ReloadResult, error) {
+				return server.ReloadResult{}, errors.New("invalid config")
+			}))
+		rec := httptest.NewRecorder()
+
+		app.ServeHTTP(rec, adminRequest(http.MethodPost, "/admin/reload", ""))
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	})
+}
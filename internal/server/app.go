@@ -2,59 +2,379 @@ package server
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	gws "github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/mqtt"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/stomp"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tlsconfig"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
 	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
 )
 
-const upgraderBufferSize = 1024
+const (
+	defaultUpgraderBufferSize = 1024
+	defaultMaxMessageSize     = 1 << 20
+	shutdownTimeout           = 10 * time.Second
+)
+
+var (
+	errDraining      = errors.New("draining")
+	errHubNotRunning = errors.New("hub loop is not running")
+	errHubWedged     = errors.New("hub loop is wedged")
+)
 
 type App struct {
-	addr string
+	// Non-zero after Run context is done, must be accessed atomically.
+	draining int32
+
+	addr   string
+	logger *zap.Logger
+
+	upgrader  gws.Upgrader
+	hub       HubI
+	router    *mux.Router
+	tlsConfig *tls.Config
+
+	// Guards settings which may be changed while running.
+	mu              sync.RWMutex
+	wedgedThreshold time.Duration
+	drainDelay      time.Duration
+	sendBufferSize  int
+	compression     websocket.Compression
+
+	stompHeartbeat time.Duration
+	// maxMessageSize limits messages and packets of MQTT and STOMP clients, which are buffered before parsing.
+	maxMessageSize int
+
+	adminToken string
+	reload     ReloadFunc
+}
+
+type Option func(a *App)
+
+// WithTLS serves wss:// using cfg. Peer certificate subject becomes the client principal.
+func WithTLS(cfg *tls.Config) Option {
+	return func(a *App) {
+		a.tlsConfig = cfg
+	}
+}
+
+// WithWedgedThreshold sets how long the hub loop may not service its channels before the app is not ready.
+func WithWedgedThreshold(threshold time.Duration) Option {
+	return func(a *App) {
+		a.wedgedThreshold = threshold
+	}
+}
+
+// WithDrainDelay sets how long the app keeps serving as not ready before shutting down,
+// so that load balancers stop routing new connections.
+func WithDrainDelay(delay time.Duration) Option {
+	return func(a *App) {
+		a.drainDelay = delay
+	}
+}
+
+// WithAdminToken enables admin API under /admin authenticated by bearer token.
+func WithAdminToken(token string) Option {
+	return func(a *App) {
+		a.adminToken = token
+	}
+}
+
+// WithUpgraderBufferSize sets websocket read and write buffer sizes in bytes.
+func WithUpgraderBufferSize(size int) Option {
+	return func(a *App) {
+		a.upgrader.ReadBufferSize = size
+		a.upgrader.WriteBufferSize = size
+	}
+}
+
+// WithSendBufferSize sets how many outbound messages are queued per client before dropping.
+func WithSendBufferSize(size int) Option {
+	return func(a *App) {
+		a.sendBufferSize = size
+	}
+}
 
-	upgrader gws.Upgrader
-	hub      HubI
-	router   *mux.Router
+// WithCompression enables permessage-deflate for clients which offer it.
+// Messages smaller than compression threshold are sent uncompressed.
+func WithCompression(compression websocket.Compression) Option {
+	return func(a *App) {
+		a.upgrader.EnableCompression = true
+		a.compression = compression
+	}
 }
 
-func New(addr string, hub HubI) *App {
+// WithSTOMPHeartbeat sets the interval STOMP clients are offered heart-beats at, zero disables heart-beating.
+func WithSTOMPHeartbeat(interval time.Duration) Option {
+	return func(a *App) {
+		a.stompHeartbeat = interval
+	}
+}
+
+// WithMaxMessageSize sets the maximum size in bytes of websocket messages, MQTT packets and STOMP frames
+// read from MQTT and STOMP clients.
+func WithMaxMessageSize(size int) Option {
+	return func(a *App) {
+		a.maxMessageSize = size
+	}
+}
+
+// WithReload enables POST /admin/reload which calls fn.
+func WithReload(fn ReloadFunc) Option {
+	return func(a *App) {
+		a.reload = fn
+	}
+}
+
+func New(logger *zap.Logger, addr string, hub HubI, opts ...Option) *App {
 	a := &App{
-		addr: addr,
+		addr:   addr,
+		logger: logger,
 		upgrader: gws.Upgrader{
-			ReadBufferSize:  upgraderBufferSize,
-			WriteBufferSize: upgraderBufferSize,
+			ReadBufferSize:  defaultUpgraderBufferSize,
+			WriteBufferSize: defaultUpgraderBufferSize,
+			Subprotocols:    append(codec.Subprotocols(), mqtt.Subprotocol, stomp.Subprotocol),
 		},
-		hub:    hub,
-		router: mux.NewRouter(),
+		hub:             hub,
+		router:          mux.NewRouter(),
+		wedgedThreshold: defaultWedgedThreshold,
+		sendBufferSize:  defaultSendBufferSize,
+		stompHeartbeat:  defaultSTOMPHeartbeat,
+		maxMessageSize:  defaultMaxMessageSize,
+	}
+
+	for _, opt := range opts {
+		opt(a)
 	}
 
 	a.router.HandleFunc("/ws", a.serveWs).Methods(http.MethodGet)
+	a.router.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	a.router.HandleFunc("/healthz", a.serveHealthz).Methods(http.MethodGet)
+	a.router.HandleFunc("/readyz", a.serveReadyz).Methods(http.MethodGet)
+	a.registerAdmin()
 
 	return a
 }
 
+// Run serves until ctx is done, then drains: reports not ready for the drain delay and shuts down.
 func (a *App) Run(ctx context.Context) error {
-	go a.hub.Run(ctx)
+	hubCtx, hubCancel := context.WithCancel(context.Background())
+	defer hubCancel()
+
+	go a.hub.Run(hubCtx)
+
+	srv := &http.Server{
+		Addr:      a.addr,
+		Handler:   a.router,
+		TLSConfig: a.tlsConfig,
+	}
+
+	errc := make(chan error, 1)
+
+	go func() {
+		if a.tlsConfig != nil {
+			a.logger.Info("listening", zap.String("addr", a.addr), zap.Bool("tls", true))
+
+			errc <- srv.ListenAndServeTLS("", "")
+
+			return
+		}
+
+		a.logger.Info("listening", zap.String("addr", a.addr), zap.Bool("tls", false))
+
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	atomic.StoreInt32(&a.draining, 1)
 
-	log.Printf("listening on %s", a.addr)
+	drainDelay := a.DrainDelay()
 
-	return http.ListenAndServe(a.addr, a.router)
+	a.logger.Info("draining", zap.Duration("drain_delay", drainDelay))
+
+	time.Sleep(drainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutdown failed: %w", err)
+	}
+
+	return nil
+}
+
+// DrainDelay returns how long the app reports not ready before shutting down.
+func (a *App) DrainDelay() time.Duration {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.drainDelay
+}
+
+// SetDrainDelay changes drain delay of a running app.
+func (a *App) SetDrainDelay(delay time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.drainDelay = delay
+}
+
+// WedgedThreshold returns how long the hub loop may be unresponsive before the app is not ready.
+func (a *App) WedgedThreshold() time.Duration {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.wedgedThreshold
+}
+
+// SetWedgedThreshold changes wedged threshold of a running app.
+func (a *App) SetWedgedThreshold(threshold time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.wedgedThreshold = threshold
+}
+
+// SendBufferSize returns how many outbound messages are queued per client before dropping.
+func (a *App) SendBufferSize() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.sendBufferSize
+}
+
+// SetSendBufferSize changes send buffer size of clients connected afterwards.
+func (a *App) SetSendBufferSize(size int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.sendBufferSize = size
+}
+
+// Compression returns permessage-deflate policy of new connections.
+func (a *App) Compression() websocket.Compression {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.compression
+}
+
+// SetCompression changes permessage-deflate policy of clients connected afterwards.
+// It has no effect when compression is not enabled by WithCompression.
+func (a *App) SetCompression(compression websocket.Compression) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.compression = compression
+}
+
+func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.router.ServeHTTP(w, r)
 }
 
 // serveWs handles websocket requests from the peer.
 func (a *App) serveWs(w http.ResponseWriter, r *http.Request) {
-	conn, err := a.upgrader.Upgrade(w, r, nil)
+	principal := tlsconfig.Principal(r.TLS)
+	connLogger := logger.Connection(a.logger, r.RemoteAddr, principal)
+
+	ctx := tracing.ExtractHTTP(r.Context(), propagation.HeaderCarrier(r.Header))
+	_, span := tracing.Tracer().Start(ctx, "pubsub.upgrade", trace.WithAttributes(
+		attribute.String("net.peer.addr", r.RemoteAddr),
+		attribute.String("pubsub.principal", principal),
+	))
+
+	// Upgrader negotiates permessage-deflate whenever the client offers it.
+	compress := a.upgrader.EnableCompression && websocket.HasCompression(r.Header)
+
+	conn, err := a.upgrader.Upgrade(websocket.CountWritten(w), r, nil)
 	if err != nil {
-		log.Printf("upgrade failed: %v", err)
+		connLogger.Warn("upgrade failed", zap.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
 
 		return
 	}
 
+	span.End()
+
+	// Upgrader negotiates only codecs, MQTT and STOMP, clients which negotiate nothing speak legacy V0.
+	cd, _ := codec.BySubprotocol(conn.Subprotocol())
+
+	var version, codecName string
+
+	switch conn.Subprotocol() {
+	case mqtt.Subprotocol:
+		version, codecName = mqttVersion, mqtt.Subprotocol
+	case stomp.Subprotocol:
+		version, codecName = stomp.Version, stompCodec
+	default:
+		version, codecName = fmt.Sprintf("v%d", cd.Version()), cd.Name()
+	}
+
+	connLogger = connLogger.With(zap.String("protocol_version", version), zap.String("codec", codecName))
+	connectionsNegotiated.WithLabelValues(version, codecName).Inc()
+
 	wsConn := websocket.NewConn(conn)
-	client := NewClient(a.hub, wsConn)
+	wsConn.OnWrite(observeWrite)
+
+	if compress {
+		compression := a.Compression()
+		if err := wsConn.SetCompression(compression); err != nil {
+			connLogger.Warn("set compression failed", zap.Error(err))
+		}
+
+		connLogger = connLogger.With(zap.Int("compression_level", compression.Level))
+	}
+
+	switch conn.Subprotocol() {
+	case mqtt.Subprotocol:
+		wsConn.SetReadLimit(int64(a.maxMessageSize))
+
+		client := newMQTTClient(connLogger, a.hub, wsConn, a.SendBufferSize(), a.maxMessageSize)
+		client.SetPrincipal(principal)
+		client.SetRemoteAddr(r.RemoteAddr)
+		client.Run(r.Context())
+
+		return
+	case stomp.Subprotocol:
+		wsConn.SetReadLimit(int64(a.maxMessageSize))
+
+		client := newSTOMPClient(connLogger, a.hub, wsConn, a.SendBufferSize(), a.maxMessageSize, a.stompHeartbeat)
+		client.SetPrincipal(principal)
+		client.SetRemoteAddr(r.RemoteAddr)
+		client.Run(r.Context())
+
+		return
+	}
+
+	client := newClient(connLogger, a.hub, wsConn, a.SendBufferSize())
+	client.SetCodec(cd)
+	client.SetPrincipal(principal)
+	client.SetRemoteAddr(r.RemoteAddr)
 	client.Run(r.Context())
 }
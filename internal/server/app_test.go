@@ -0,0 +1,403 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/command"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tlsconfig"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tlsconfig/tlstest"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+	"github.com/alexandear/websocket-pubsub/internal/server/mock"
+)
+
+func TestApp_MutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	serverKP := ca.Issue(t, "server", "127.0.0.1")
+	clientKP := ca.Issue(t, "alice")
+
+	serverCfg, err := tlsconfig.NewServer(serverKP.CertFile, serverKP.KeyFile, ca.CertFile)
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	hubm := mock.NewMockHubI(ctrl)
+	subscribed := make(chan server.ClientI, 1)
+	hubm.EXPECT().Subscribe(gomock.Any(), "broadcast").Do(func(client server.ClientI, _ string) {
+		subscribed <- client
+	}).Times(1)
+	hubm.EXPECT().Register(gomock.Any()).AnyTimes()
+	hubm.EXPECT().Unsubscribe(gomock.Any()).AnyTimes()
+
+	srv := httptest.NewUnstartedServer(server.New(zap.NewNop(), "", hubm, server.WithTLS(serverCfg)))
+	srv.TLS = serverCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	url := "wss://" + strings.TrimPrefix(srv.URL, "https://") + "/ws"
+
+	t.Run("when client has no certificate", func(t *testing.T) {
+		cfg, err := tlsconfig.NewClient(ca.CertFile, false, "", "")
+		require.NoError(t, err)
+
+		dialer := *gws.DefaultDialer
+		dialer.TLSClientConfig = cfg
+		_, _, err = dialer.Dial(url, nil)
+
+		assert.Error(t, err)
+	})
+
+	t.Run("when client has certificate", func(t *testing.T) {
+		cfg, err := tlsconfig.NewClient(ca.CertFile, false, clientKP.CertFile, clientKP.KeyFile)
+		require.NoError(t, err)
+
+		dialer := *gws.DefaultDialer
+		dialer.TLSClientConfig = cfg
+		conn, _, err := dialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte(`{"command":"SUBSCRIBE"}`)))
+
+		select {
+		case client := <-subscribed:
+			assert.Equal(t, "CN=alice", client.(*server.Client).Principal())
+		case <-time.After(time.Second):
+			t.Fatal("client is not subscribed")
+		}
+	})
+}
+
+func TestApp_Metrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	app := server.New(zap.NewNop(), "", mock.NewMockHubI(ctrl))
+	rec := httptest.NewRecorder()
+
+	app.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "pubsub_connections")
+	assert.Contains(t, string(body), "pubsub_hub_loop_duration_seconds")
+}
+
+func TestApp_ProtocolVersions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	dial := func(subprotocols ...string) *gws.Conn {
+		dialer := *gws.DefaultDialer
+		dialer.Subprotocols = subprotocols
+
+		conn, resp, err := dialer.Dial(url, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		assert.Equal(t, resp.Header.Get("Sec-WebSocket-Protocol"), conn.Subprotocol())
+
+		return conn
+	}
+
+	legacy, v1 := dial(), dial("pubsub.v2.json", codec.JSON.Subprotocol())
+	assert.Empty(t, legacy.Subprotocol())
+	assert.Equal(t, codec.JSON.Subprotocol(), v1.Subprotocol(), "unknown versions are skipped")
+
+	for _, conn := range []*gws.Conn{legacy, v1} {
+		require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte(`{"command":"SUBSCRIBE","topic":"news"}`)))
+		require.NoError(t, conn.WriteMessage(gws.BinaryMessage, []byte(`{"command":"NUM_CONNECTIONS"}`)))
+
+		_, _, err := conn.ReadMessage()
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, legacy.WriteMessage(gws.BinaryMessage, []byte(`{"command":"PUBLISH","topic":"news","data":1}`)))
+
+	for conn, expected := range map[*gws.Conn]string{
+		legacy: `{"topic":"news","data":1}`,
+		v1:     `{"type":"message","topic":"news","data":1}`,
+	} {
+		_, resp, err := conn.ReadMessage()
+		require.NoError(t, err)
+
+		var got map[string]interface{}
+		require.NoError(t, json.Unmarshal(resp, &got))
+		delete(got, "sent_at")
+
+		actual, err := json.Marshal(got)
+		require.NoError(t, err)
+		assert.JSONEq(t, expected, string(actual))
+	}
+}
+
+func TestApp_MixedFrames(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	dial := func(subprotocols ...string) *gws.Conn {
+		dialer := *gws.DefaultDialer
+		dialer.Subprotocols = subprotocols
+
+		conn, _, err := dialer.Dial(url, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		return conn
+	}
+
+	roundTrip := func(conn *gws.Conn, messageType int, request []byte) (int, string) {
+		require.NoError(t, conn.WriteMessage(messageType, request))
+
+		respType, resp, err := conn.ReadMessage()
+		require.NoError(t, err)
+
+		return respType, string(resp)
+	}
+
+	t.Run("json echoes frame type", func(t *testing.T) {
+		conn := dial()
+		numConnections := []byte(`{"command":"NUM_CONNECTIONS"}`)
+
+		require.NoError(t, conn.WriteMessage(gws.TextMessage, []byte(`{"command":"SUBSCRIBE","topic":"news"}`)))
+
+		respType, resp := roundTrip(conn, gws.TextMessage, numConnections)
+		assert.Equal(t, gws.TextMessage, respType)
+		assert.JSONEq(t, `{"num_connections":1}`, resp)
+
+		respType, _ = roundTrip(conn, gws.BinaryMessage, numConnections)
+		assert.Equal(t, gws.BinaryMessage, respType)
+
+		respType, _ = roundTrip(conn, gws.TextMessage, numConnections)
+		assert.Equal(t, gws.TextMessage, respType)
+	})
+
+	t.Run("binary codec always writes binary", func(t *testing.T) {
+		conn := dial(codec.MsgPack.Subprotocol())
+		subscribe, err := codec.MsgPack.EncodeRequest(operation.ReqCommand{Command: command.Subscribe})
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteMessage(gws.BinaryMessage, subscribe))
+
+		request, err := codec.MsgPack.EncodeRequest(operation.ReqCommand{Command: command.NumConnections})
+		require.NoError(t, err)
+
+		respType, resp := roundTrip(conn, gws.TextMessage, request)
+
+		assert.Equal(t, gws.BinaryMessage, respType)
+		decoded, err := codec.MsgPack.DecodeResponse([]byte(resp))
+		require.NoError(t, err)
+		assert.IsType(t, operation.RespNumConnections{}, decoded)
+	})
+
+	t.Run("publish reaches subscribers in their frame types", func(t *testing.T) {
+		text, binary := dial(), dial()
+		subscribe := []byte(`{"command":"SUBSCRIBE","topic":"sport"}`)
+		numConnections := []byte(`{"command":"NUM_CONNECTIONS"}`)
+
+		// The reply means the subscription is registered.
+		require.NoError(t, text.WriteMessage(gws.TextMessage, subscribe))
+		roundTrip(text, gws.TextMessage, numConnections)
+		require.NoError(t, binary.WriteMessage(gws.BinaryMessage, subscribe))
+		roundTrip(binary, gws.BinaryMessage, numConnections)
+
+		require.NoError(t, dial().WriteMessage(gws.TextMessage, []byte(`{"command":"PUBLISH","topic":"sport","data":1}`)))
+
+		for conn, expected := range map[*gws.Conn]int{text: gws.TextMessage, binary: gws.BinaryMessage} {
+			respType, resp, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, expected, respType)
+			assert.Contains(t, string(resp), `"data":1`)
+		}
+	})
+}
+
+func TestApp_CrossCodecPublish(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	dial := func(cd codec.Codec) *gws.Conn {
+		dialer := *gws.DefaultDialer
+		dialer.Subprotocols = []string{cd.Subprotocol()}
+
+		conn, _, err := dialer.Dial(url, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		return conn
+	}
+
+	request := func(cd codec.Codec, req operation.ReqCommand) []byte {
+		data, err := cd.EncodeRequest(req)
+		require.NoError(t, err)
+
+		return data
+	}
+
+	jsonSubscriber, msgpackSubscriber := dial(codec.JSON), dial(codec.MsgPack)
+
+	for conn, cd := range map[*gws.Conn]codec.Codec{jsonSubscriber: codec.JSON, msgpackSubscriber: codec.MsgPack} {
+		require.NoError(t, conn.WriteMessage(gws.BinaryMessage,
+			request(cd, operation.ReqCommand{Command: command.Subscribe, Topic: "news"})))
+		require.NoError(t, conn.WriteMessage(gws.BinaryMessage,
+			request(cd, operation.ReqCommand{Command: command.NumConnections})))
+
+		// The reply means the subscription is registered.
+		_, _, err := conn.ReadMessage()
+		require.NoError(t, err)
+	}
+
+	publisher := dial(codec.MsgPack)
+
+	for _, data := range []string{"\xffnot json", `{"id":1}`} {
+		require.NoError(t, publisher.WriteMessage(gws.BinaryMessage, request(codec.MsgPack, operation.ReqCommand{
+			Command: command.Publish, Topic: "news", Data: json.RawMessage(data),
+		})))
+	}
+
+	for conn, cd := range map[*gws.Conn]codec.Codec{jsonSubscriber: codec.JSON, msgpackSubscriber: codec.MsgPack} {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+		_, resp, err := conn.ReadMessage()
+		require.NoError(t, err)
+
+		decoded, err := cd.DecodeResponse(resp)
+		require.NoError(t, err)
+
+		message, ok := decoded.(operation.RespMessage)
+		require.True(t, ok, "got %T", decoded)
+		assert.JSONEq(t, `{"id":1}`, string(message.Data), "%s subscriber: data which is not JSON is rejected", cd.Name())
+	}
+}
+
+type countingReadConn struct {
+	net.Conn
+
+	read int
+}
+
+func (c *countingReadConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read += n
+
+	return n, err
+}
+
+func TestApp_Compression(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	a := server.New(zap.NewNop(), "", hub, server.WithCompression(websocket.Compression{Level: 1, Threshold: 256}))
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	dial := func(compression bool) (*gws.Conn, *countingReadConn) {
+		counting := &countingReadConn{}
+		dialer := *gws.DefaultDialer
+		dialer.EnableCompression = compression
+		dialer.NetDial = func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			counting.Conn = conn
+
+			return counting, nil
+		}
+
+		conn, resp, err := dialer.Dial(url, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		assert.Equal(t, compression, strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"))
+
+		return conn, counting
+	}
+
+	// readWire returns the payload of the next message and number of bytes it took on the wire.
+	readWire := func(conn *gws.Conn, counting *countingReadConn) (string, int) {
+		before := counting.read
+
+		_, message, err := conn.ReadMessage()
+		require.NoError(t, err)
+
+		return string(message), counting.read - before
+	}
+
+	compressed, compressedWire := dial(true)
+	plain, plainWire := dial(false)
+
+	subscribe := func(conn *gws.Conn, counting *countingReadConn) (string, int) {
+		require.NoError(t, conn.WriteMessage(gws.TextMessage, []byte(`{"command":"SUBSCRIBE","topic":"logs"}`)))
+		require.NoError(t, conn.WriteMessage(gws.TextMessage, []byte(`{"command":"NUM_CONNECTIONS"}`)))
+
+		// The reply means the subscription is registered.
+		return readWire(conn, counting)
+	}
+
+	_, _ = subscribe(plain, plainWire)
+
+	resp, wire := subscribe(compressed, compressedWire)
+	assert.JSONEq(t, `{"num_connections":2}`, resp)
+	assert.Greater(t, wire, len(resp), "small message is sent uncompressed")
+
+	data := `"` + strings.Repeat("log line repeats itself ", 100) + `"`
+	require.NoError(t, plain.WriteMessage(gws.TextMessage,
+		[]byte(`{"command":"PUBLISH","topic":"logs","data":`+data+`}`)))
+
+	resp, wire = readWire(compressed, compressedWire)
+	assert.Contains(t, resp, data)
+	assert.Less(t, wire, len(resp)/4, "large message is compressed")
+
+	resp, wire = readWire(plain, plainWire)
+	assert.Contains(t, resp, data)
+	assert.Greater(t, wire, len(resp), "connection which did not offer compression is not compressed")
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/bridge"
+)
+
+// WithBridge exchanges messages of mapped topics with an external messaging system: messages published
+// by clients of this node are sent to the bridge and messages of the bridge are delivered to local subscribers.
+func WithBridge(b bridge.Bridge) HubOption {
+	return func(o *hubOptions) {
+		o.bridge = b
+	}
+}
+
+func (h *Hub) runBridge(ctx context.Context) {
+	if err := h.bridge.Run(ctx, h.receiveBridged); err != nil {
+		h.logger.Error("bridge failed", zap.Error(err))
+	}
+}
+
+func (h *Hub) bridgePublish(data PublishData) {
+	err := h.bridge.Publish(data.Topic, messagePayload(data.Data, data.Raw))
+	if errors.Is(err, bridge.ErrNotMapped) {
+		return
+	}
+
+	if err != nil {
+		h.logger.Warn("bridge publish failed", zap.String("topic", data.Topic), zap.Error(err))
+
+		return
+	}
+
+	bridgeMessages.WithLabelValues(directionSent).Inc()
+}
+
+// receiveBridged delivers message of the external system to local subscribers. Other nodes of the cluster
+// receive it from their own bridge.
+func (h *Hub) receiveBridged(topic string, payload []byte) {
+	bridgeMessages.WithLabelValues(directionReceived).Inc()
+
+	h.castLocal(PublishData{Topic: topic, Data: jsonPayload(payload), Raw: payload, SentAt: time.Now()})
+}
@@ -0,0 +1,95 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/bridge"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+	"github.com/alexandear/websocket-pubsub/internal/server/mock"
+)
+
+type bridged struct {
+	topic string
+	data  string
+}
+
+// fakeBridge maps topic orders, records published messages and delivers messages sent to delivered.
+type fakeBridge struct {
+	published chan bridged
+	delivered chan bridged
+}
+
+func (b *fakeBridge) Publish(topic string, data []byte) error {
+	if topic != "orders" {
+		return bridge.ErrNotMapped
+	}
+
+	b.published <- bridged{topic: topic, data: string(data)}
+
+	return nil
+}
+
+func (b *fakeBridge) Run(ctx context.Context, handle func(topic string, data []byte)) error {
+	for {
+		select {
+		case msg := <-b.delivered:
+			handle(msg.topic, []byte(msg.data))
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func TestHub_Bridge(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	b := &fakeBridge{published: make(chan bridged, 10), delivered: make(chan bridged)}
+	h := server.NewHub(zap.NewNop(), time.Hour, server.WithBridge(b))
+
+	received := make(chan server.ResponseMessage, 3)
+	clientm := mock.NewMockClientI(ctrl)
+	clientm.EXPECT().ID().Return("id").AnyTimes()
+	clientm.EXPECT().Response(gomock.Any()).Do(func(m server.ResponseMessage) { received <- m }).Times(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go h.Run(ctx)
+
+	h.Subscribe(clientm, "orders")
+
+	h.Cast(server.PublishData{Topic: "orders", Data: []byte(`"hello"`), SentAt: time.Unix(0, 42)})
+	assert.Equal(t, bridged{topic: "orders", data: "hello"}, <-b.published, "JSON string is sent unquoted")
+	assert.Equal(t, server.ResponsePublish{Topic: "orders", Data: []byte(`"hello"`), SentAt: time.Unix(0, 42)},
+		<-received)
+
+	for _, tc := range []struct {
+		payload string
+		want    json.RawMessage
+	}{
+		{payload: `{"id":1}`, want: json.RawMessage(`{"id":1}`)},
+		{payload: `created`, want: json.RawMessage(`"created"`)},
+	} {
+		b.delivered <- bridged{topic: "orders", data: tc.payload}
+
+		resp, ok := (<-received).(server.ResponsePublish)
+		require.True(t, ok)
+		assert.Equal(t, "orders", resp.Topic)
+		assert.Equal(t, tc.want, resp.Data)
+	}
+
+	select {
+	case msg := <-b.published:
+		t.Fatalf("message of the bridge is sent back: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -5,52 +5,104 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 
+	"github.com/alexandear/websocket-pubsub/internal/pkg/codec"
 	"github.com/alexandear/websocket-pubsub/internal/pkg/command"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
 	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
 	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
 )
 
 const (
-	sendBufferSize = 256
+	defaultSendBufferSize = 256
+)
+
+var (
+	errBadTopic = errors.New("bad topic")
+	errBadData  = errors.New("data is not JSON")
+	// errUnsubscribed stops reading requests of the client which asked to terminate the connection.
+	errUnsubscribed = errors.New("client unsubscribed")
 )
 
 //go:generate mockgen -source=$GOFILE -package mock -destination mock/interfaces.go
 
 type HubI interface {
-	Subscribe(client ClientI)
+	Register(client ClientI)
+	Subscribe(client ClientI, topic string)
+	UnsubscribeTopic(client ClientI, topic string)
 	Unsubscribe(client ClientI)
 	Cast(data CastData)
 	Run(ctx context.Context)
+	LastServiced() time.Time
+	Clients(ctx context.Context) ([]ClientInfo, error)
+	Client(ctx context.Context, id string) (ClientInfo, bool, error)
+	Kick(ctx context.Context, id, reason string) (bool, error)
+	Topics(ctx context.Context) ([]TopicInfo, error)
 }
 
 type WsConn interface {
 	Close() error
-	ReadBinaryMessage() ([]byte, error)
-	WriteBinaryMessage(data []byte) error
-	WriteCloseMessage()
+	ReadMessage() (websocket.MessageType, []byte, error)
+	WriteMessage(messageType websocket.MessageType, data []byte) error
+	WriteCloseMessage(code int, reason string)
 }
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	id string
 
-	hub  HubI
-	conn WsConn
+	// Subject of the verified peer certificate, empty without mutual TLS.
+	principal  string
+	remoteAddr string
+
+	connectedAt time.Time
+
+	// Close frame reason, set before closing kicked.
+	closeReason string
+	// Closed by Kick, the write goroutine closes the connection then.
+	kicked   chan struct{}
+	kickOnce sync.Once
+
+	hub    HubI
+	conn   WsConn
+	codec  codec.Codec
+	logger *zap.Logger
+
+	// messageType is websocket.MessageType of the last request, responses are written in frames of the same type.
+	messageType int32
 
-	// Buffered channel of outbound messages.
-	response chan ResponseMessage
+	// Buffered channel of outbound messages, closed once by the hub.
+	response  chan ResponseMessage
+	closeOnce sync.Once
 }
 
-func NewClient(hub HubI, conn WsConn) *Client {
+// NewClient creates client logging with l annotated by client ID.
+func NewClient(l *zap.Logger, hub HubI, conn WsConn) *Client {
+	return newClient(l, hub, conn, defaultSendBufferSize)
+}
+
+func newClient(l *zap.Logger, hub HubI, conn WsConn, sendBufferSize int) *Client {
+	id := uuid.New().String()
 	client := &Client{
-		id:       uuid.New().String(),
-		hub:      hub,
-		conn:     conn,
-		response: make(chan ResponseMessage, sendBufferSize),
+		id:          id,
+		logger:      logger.Client(l, id),
+		hub:         hub,
+		conn:        conn,
+		codec:       codec.Legacy,
+		messageType: int32(websocket.BinaryMessage),
+		connectedAt: time.Now(),
+		kicked:      make(chan struct{}),
+		response:    make(chan ResponseMessage, sendBufferSize),
 	}
 
 	return client
@@ -60,6 +112,36 @@ func (c *Client) ID() string {
 	return c.id
 }
 
+// SetPrincipal must be called before Run.
+func (c *Client) SetPrincipal(principal string) {
+	c.principal = principal
+}
+
+func (c *Client) Principal() string {
+	return c.principal
+}
+
+// SetCodec sets protocol version and wire format negotiated by the connection, must be called before Run.
+func (c *Client) SetCodec(cd codec.Codec) {
+	c.codec = cd
+}
+
+// SetRemoteAddr must be called before Run.
+func (c *Client) SetRemoteAddr(remoteAddr string) {
+	c.remoteAddr = remoteAddr
+}
+
+// Info is called by the hub for admin queries.
+func (c *Client) Info() ClientInfo {
+	return ClientInfo{
+		ID:          c.id,
+		RemoteAddr:  c.remoteAddr,
+		Principal:   c.principal,
+		ConnectedAt: c.connectedAt,
+		QueueDepth:  len(c.response),
+	}
+}
+
 // Run allow collection of memory referenced by the caller by doing all work in new goroutines.
 func (c *Client) Run(ctx context.Context) {
 	go c.write()
@@ -71,53 +153,120 @@ func (c *Client) Run(ctx context.Context) {
 }
 
 func (c *Client) CloseResponse() {
-	close(c.response)
+	c.closeOnce.Do(func() {
+		close(c.response)
+	})
 }
 
+// Kick closes the connection with reason sent in the close frame. Response stays open, as the read goroutine
+// may subscribe again until it notices the closed connection, and is closed when the client unsubscribes.
+func (c *Client) Kick(reason string) {
+	c.kickOnce.Do(func() {
+		c.closeReason = reason
+		close(c.kicked)
+	})
+}
+
+// Response enqueues message for writing. Message is dropped when the send buffer is full
+// so that a slow client cannot block the hub.
 func (c *Client) Response(message ResponseMessage) {
-	c.response <- message
+	select {
+	case c.response <- message:
+		sendBufferOccupancy.Observe(occupancy(c.response))
+	default:
+		messagesDropped.WithLabelValues(topic(message)).Inc()
+	}
 }
 
 // read pumps messages from the websocket connection to the hub.
 func (c *Client) read() {
-	defer func() {
-		c.hub.Unsubscribe(c)
-		_ = c.conn.Close()
-	}()
+	connections.Inc()
+
+	defer connections.Dec()
+
+	c.hub.Register(c)
 
 	for {
-		message, err := c.conn.ReadBinaryMessage()
+		messageType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if !errors.Is(err, websocket.ErrClosedConn) {
-				log.Printf("failed to read from client: %v", err)
+				c.logger.Warn("read from client failed", zap.Error(err))
 			}
 
+			c.hub.Unsubscribe(c)
+			_ = c.conn.Close()
+
 			return
 		}
 
+		atomic.StoreInt32(&c.messageType, int32(messageType))
+
 		if err := c.processCommand(message); err != nil {
-			log.Printf("failed to process command: %v", err)
+			// The client is unsubscribed already, the write goroutine closes the connection after the close frame.
+			if errors.Is(err, errUnsubscribed) {
+				return
+			}
+
+			c.logger.Warn("process command failed", zap.Error(err))
 		}
 	}
 }
 
 func (c *Client) processCommand(data []byte) error {
-	req := &operation.ReqCommand{}
-	if err := json.Unmarshal(data, req); err != nil {
-		return fmt.Errorf("unmarshal to ReqCommand failed: %w", err)
+	req, err := c.codec.DecodeRequest(data)
+	if err != nil {
+		return err
 	}
 
+	ctx := tracing.Extract(context.Background(), req.TraceContext)
+	_, span := tracing.Tracer().Start(ctx, "pubsub.command", trace.WithAttributes(
+		attribute.String("pubsub.command", string(req.Command)),
+		attribute.String("pubsub.client_id", c.id),
+	))
+
+	defer span.End()
+
+	commandsReceived.WithLabelValues(commandLabel(req.Command)).Inc()
+	c.logger.Debug("command received", zap.String("command", string(req.Command)))
+
 	switch req.Command {
 	case command.Subscribe:
-		c.hub.Subscribe(c)
+		topic := req.Topic
+		if topic == "" {
+			topic = topicBroadcast
+		}
+
+		c.hub.Subscribe(c, topic)
 	case command.Unsubscribe:
-		c.hub.Unsubscribe(c)
+		if req.Topic == "" {
+			c.hub.Unsubscribe(c)
+
+			return errUnsubscribed
+		}
+
+		c.hub.UnsubscribeTopic(c, req.Topic)
 	case command.NumConnections:
-		c.hub.Cast(UnicastData{ClientID: c.id})
+		c.hub.Cast(UnicastData{ClientID: c.id, SpanContext: span.SpanContext()})
+	case command.Publish:
+		if req.Topic == "" || req.Topic == topicBroadcast {
+			return fmt.Errorf("publish to %q: %w", req.Topic, errBadTopic)
+		}
+
+		// Binary codecs carry data as bytes, subscribers with other codecs and the cluster need it as JSON.
+		if len(req.Data) > 0 && !json.Valid(req.Data) {
+			return fmt.Errorf("publish to %q: %w", req.Topic, errBadData)
+		}
+
+		sentAt := time.Now()
+		if req.SentAt != 0 {
+			sentAt = time.Unix(0, req.SentAt)
+		}
+
+		c.hub.Cast(PublishData{Topic: req.Topic, Data: req.Data, SentAt: sentAt, SpanContext: span.SpanContext()})
 	default:
 		c.hub.Unsubscribe(c)
 
-		return nil
+		return errUnsubscribed
 	}
 
 	return nil
@@ -129,53 +278,123 @@ func (c *Client) write() {
 		_ = c.conn.Close()
 	}()
 
-	opened := true
-	for opened {
+	for {
 		var message ResponseMessage
-		message, opened = <-c.response
 
-		if !opened {
-			c.conn.WriteCloseMessage()
+		select {
+		case <-c.kicked:
+			c.conn.WriteCloseMessage(websocket.ClosePolicyViolation, c.closeReason)
 
 			return
+		case m, opened := <-c.response:
+			if !opened {
+				c.conn.WriteCloseMessage(websocket.CloseNormalClosure, "")
+
+				return
+			}
+
+			message = m
 		}
 
 		if err := c.writeMessage(message); err != nil {
-			log.Printf("write message failed: %v", err)
+			c.logger.Warn("write message failed", zap.Error(err))
+
+			continue
 		}
+
+		messagesDelivered.WithLabelValues(topic(message)).Inc()
 	}
 }
 
-func (c *Client) writeMessage(message ResponseMessage) error {
-	var resp json.RawMessage
+func (c *Client) writeMessage(message ResponseMessage) (err error) {
+	ctx := trace.ContextWithSpanContext(context.Background(), responseSpanContext(message))
+	ctx, span := tracing.Tracer().Start(ctx, "pubsub.write", trace.WithAttributes(
+		attribute.String("pubsub.topic", topic(message)),
+		attribute.String("pubsub.client_id", c.id),
+	))
+
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		span.End()
+	}()
+
+	traceContext := tracing.Inject(ctx)
+
+	var resp operation.Resp
 
 	switch m := message.(type) {
 	case ResponseUnicast:
-		r, err := json.Marshal(&operation.RespNumConnections{
+		resp = &operation.RespNumConnections{
 			NumConnections: m.NumConnections,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to marshal num connections response: %w", err)
+			TraceContext:   traceContext,
 		}
-
-		resp = r
 	case ResponseBroadcast:
-		r, err := json.Marshal(&operation.RespBroadcast{
-			ClientID:  m.ClientID,
-			Timestamp: int(m.Time.Unix()),
-		})
-		if err != nil {
-			return fmt.Errorf("failed to marshal broadcast response: %w", err)
+		resp = &operation.RespBroadcast{
+			ClientID:     m.ClientID,
+			Timestamp:    int(m.Time.Unix()),
+			SentAt:       unixNano(m.Time),
+			TraceContext: traceContext,
+		}
+	case ResponsePublish:
+		resp = &operation.RespMessage{
+			Topic:        m.Topic,
+			Data:         m.Data,
+			SentAt:       unixNano(m.SentAt),
+			TraceContext: traceContext,
 		}
-
-		resp = r
 	default:
 		return fmt.Errorf("unknown response message type: %+v", m)
 	}
 
-	if err := c.conn.WriteBinaryMessage(resp); err != nil {
+	start := time.Now()
+
+	data, err := c.codec.EncodeResponse(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s response: %w", c.codec.Name(), err)
+	}
+
+	marshalDuration.Observe(time.Since(start).Seconds())
+
+	start = time.Now()
+
+	if err := c.conn.WriteMessage(c.responseType(), data); err != nil {
 		return fmt.Errorf("failed to write message: %w", err)
 	}
 
+	writeDuration.Observe(time.Since(start).Seconds())
+
 	return nil
 }
+
+// responseType echoes frame type of the client, so that browsers and tools like wscat sending JSON in text frames
+// receive text frames.
+func (c *Client) responseType() websocket.MessageType {
+	if c.codec.Binary() {
+		return websocket.BinaryMessage
+	}
+
+	return websocket.MessageType(atomic.LoadInt32(&c.messageType))
+}
+
+// unixNano returns zero for zero t.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+// commandLabel bounds metrics label cardinality to known commands.
+func commandLabel(commandType command.Type) string {
+	switch commandType {
+	case command.Subscribe, command.Unsubscribe, command.NumConnections, command.Publish:
+		return string(commandType)
+	default:
+		return topicUnknown
+	}
+}
@@ -4,11 +4,19 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
+	gws "github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 
 	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
 	"github.com/alexandear/websocket-pubsub/internal/server"
@@ -22,11 +30,12 @@ func TestClient_Run(t *testing.T) {
 			defer ctrl.Finish()
 			hubm := mock.NewMockHubI(ctrl)
 			connm := mock.NewMockWsConn(ctrl)
-			client := server.NewClient(hubm, connm)
+			client := server.NewClient(zap.NewNop(), hubm, connm)
 
+			hubm.EXPECT().Register(gomock.Any()).Times(1)
 			hubm.EXPECT().Unsubscribe(gomock.Any()).Times(1)
 
-			connm.EXPECT().ReadBinaryMessage().Return(nil, websocket.ErrClosedConn).Times(1)
+			connm.EXPECT().ReadMessage().Return(websocket.MessageType(0), nil, websocket.ErrClosedConn).Times(1)
 			connm.EXPECT().Close().Times(1)
 
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -36,23 +45,41 @@ func TestClient_Run(t *testing.T) {
 
 		t.Run("when commands", func(t *testing.T) {
 			for name, tc := range map[string]struct {
-				command      string
+				request      string
 				hubmExpectFn func(mock *mock.MockHubI, clientID string)
 			}{
 				"subscribe": {
-					command: "SUBSCRIBE",
+					request: `{"command":"SUBSCRIBE"}`,
 					hubmExpectFn: func(mock *mock.MockHubI, clientID string) {
-						mock.EXPECT().Subscribe(gomock.Any())
+						mock.EXPECT().Subscribe(gomock.Any(), "broadcast")
 					},
 				},
-				"unsubscribe": {
-					command: "UNSUBSCRIBE",
+				"subscribe topic": {
+					request: `{"command":"SUBSCRIBE","topic":"news"}`,
 					hubmExpectFn: func(mock *mock.MockHubI, clientID string) {
-						mock.EXPECT().Unsubscribe(gomock.Any())
+						mock.EXPECT().Subscribe(gomock.Any(), "news")
 					},
 				},
+				"unsubscribe topic": {
+					request: `{"command":"UNSUBSCRIBE","topic":"news"}`,
+					hubmExpectFn: func(mock *mock.MockHubI, clientID string) {
+						mock.EXPECT().UnsubscribeTopic(gomock.Any(), "news")
+					},
+				},
+				"publish": {
+					request: `{"command":"PUBLISH","topic":"news","data":{"title":"hello"},"sent_at":1600000000123456789}`,
+					hubmExpectFn: func(mock *mock.MockHubI, clientID string) {
+						mock.EXPECT().Cast(server.PublishData{
+							Topic: "news", Data: []byte(`{"title":"hello"}`), SentAt: time.Unix(0, 1600000000123456789),
+						})
+					},
+				},
+				"publish to broadcast": {
+					request:      `{"command":"PUBLISH","topic":"broadcast","data":1}`,
+					hubmExpectFn: func(mock *mock.MockHubI, clientID string) {},
+				},
 				"num_connections": {
-					command: "NUM_CONNECTIONS",
+					request: `{"command":"NUM_CONNECTIONS"}`,
 					hubmExpectFn: func(mock *mock.MockHubI, clientID string) {
 						mock.EXPECT().Cast(server.UnicastData{ClientID: clientID})
 					},
@@ -63,14 +90,14 @@ func TestClient_Run(t *testing.T) {
 					defer ctrl.Finish()
 					hubm := mock.NewMockHubI(ctrl)
 					connm := mock.NewMockWsConn(ctrl)
-					client := server.NewClient(hubm, connm)
+					client := server.NewClient(zap.NewNop(), hubm, connm)
 
 					tc.hubmExpectFn(hubm, client.ID())
+					hubm.EXPECT().Register(gomock.Any()).Times(1)
 					hubm.EXPECT().Unsubscribe(gomock.Any()).Times(1)
 
-					connm.EXPECT().ReadBinaryMessage().Return([]byte(
-						fmt.Sprintf(`{"command":"%s"}`, tc.command)), nil).Times(1)
-					connm.EXPECT().ReadBinaryMessage().Return(nil, websocket.ErrClosedConn).Times(1)
+					connm.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte(tc.request), nil).Times(1)
+					connm.EXPECT().ReadMessage().Return(websocket.MessageType(0), nil, websocket.ErrClosedConn).Times(1)
 					connm.EXPECT().Close().Times(1)
 
 					ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -91,24 +118,34 @@ func TestClient_Run(t *testing.T) {
 		}{
 			"when response broadcast": {
 				responseMessage: server.ResponseBroadcast{ClientID: id, Time: now},
-				expectedResp:    fmt.Sprintf(`{"client_id":"%s","timestamp":%d}`, id, now.Unix()),
+				expectedResp: fmt.Sprintf(`{"client_id":"%s","timestamp":%d,"sent_at":%d}`,
+					id, now.Unix(), now.UnixNano()),
 			},
 			"when response num connections": {
 				responseMessage: server.ResponseUnicast{NumConnections: numConns},
 				expectedResp:    fmt.Sprintf(`{"num_connections":%d}`, numConns),
 			},
+			"when response publish": {
+				responseMessage: server.ResponsePublish{Topic: "news", Data: []byte(`"hello"`)},
+				expectedResp:    `{"topic":"news","data":"hello"}`,
+			},
+			"when response publish with sent at": {
+				responseMessage: server.ResponsePublish{Topic: "news", Data: []byte(`"hello"`), SentAt: now},
+				expectedResp:    fmt.Sprintf(`{"topic":"news","data":"hello","sent_at":%d}`, now.UnixNano()),
+			},
 		} {
 			t.Run(name, func(t *testing.T) {
 				ctrl := gomock.NewController(t)
 				defer ctrl.Finish()
 				hubm := mock.NewMockHubI(ctrl)
 				connm := mock.NewMockWsConn(ctrl)
-				client := server.NewClient(hubm, connm)
+				client := server.NewClient(zap.NewNop(), hubm, connm)
 
+				hubm.EXPECT().Register(gomock.Any()).Times(1)
 				hubm.EXPECT().Unsubscribe(gomock.Any()).Times(1)
 
-				connm.EXPECT().ReadBinaryMessage().Return(nil, websocket.ErrClosedConn).Times(1)
-				connm.EXPECT().WriteBinaryMessage([]byte(tc.expectedResp))
+				connm.EXPECT().ReadMessage().Return(websocket.MessageType(0), nil, websocket.ErrClosedConn).Times(1)
+				connm.EXPECT().WriteMessage(websocket.BinaryMessage, []byte(tc.expectedResp))
 				connm.EXPECT().Close().Times(1)
 
 				client.Response(tc.responseMessage)
@@ -120,3 +157,117 @@ func TestClient_Run(t *testing.T) {
 		}
 	})
 }
+
+func TestClient_Run_whenTerminated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	for name, request := range map[string]string{
+		"unsubscribe":     `{"command":"UNSUBSCRIBE"}`,
+		"unknown command": `{"command":"HELLO"}`,
+	} {
+		request := request
+		t.Run(name, func(t *testing.T) {
+			// The client has never subscribed.
+			conn, _, err := gws.DefaultDialer.Dial(url, nil)
+			require.NoError(t, err)
+
+			defer conn.Close()
+
+			require.NoError(t, conn.WriteMessage(gws.TextMessage, []byte(request)))
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+			_, _, err = conn.ReadMessage()
+			assert.True(t, gws.IsCloseError(err, gws.CloseNormalClosure), "got %v", err)
+		})
+	}
+}
+
+func TestClient_Kick(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	hubm := mock.NewMockHubI(ctrl)
+	connm := mock.NewMockWsConn(ctrl)
+	client := server.NewClient(zap.NewNop(), hubm, connm)
+
+	hubm.EXPECT().Register(gomock.Any()).Times(1)
+	hubm.EXPECT().Unsubscribe(gomock.Any()).Times(1)
+
+	connm.EXPECT().ReadMessage().Return(websocket.MessageType(0), nil, websocket.ErrClosedConn).Times(1)
+	connm.EXPECT().WriteCloseMessage(websocket.ClosePolicyViolation, "spam").Times(1)
+	connm.EXPECT().Close().MinTimes(1)
+
+	client.Kick("spam")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	client.Run(ctx)
+	cancel()
+}
+
+func TestClient_Response(t *testing.T) {
+	t.Run("when send buffer is full", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		client := server.NewClient(zap.NewNop(), mock.NewMockHubI(ctrl), mock.NewMockWsConn(ctrl))
+		dropped := server.MessagesDropped.WithLabelValues("broadcast")
+		before := testutil.ToFloat64(dropped)
+
+		done := make(chan struct{})
+
+		// Nothing writes to the connection, so a blocking Response would never return.
+		go func() {
+			defer close(done)
+
+			for i := 0; i < server.SendBufferSize+1; i++ {
+				client.Response(server.ResponseBroadcast{ClientID: client.ID(), Time: time.Now()})
+			}
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("response blocks on full send buffer")
+		}
+
+		assert.Equal(t, before+1, testutil.ToFloat64(dropped), "the message over the buffer is dropped")
+		assert.Equal(t, server.SendBufferSize, client.Info().QueueDepth, "queued messages are kept")
+	})
+
+	t.Run("occupancy is a fraction of the send buffer", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		client := server.NewClient(zap.NewNop(), mock.NewMockHubI(ctrl), mock.NewMockWsConn(ctrl))
+		before := occupancyHistogram(t)
+
+		for i := 0; i < server.SendBufferSize; i++ {
+			client.Response(server.ResponseBroadcast{ClientID: client.ID(), Time: time.Now()})
+		}
+
+		after := occupancyHistogram(t)
+		buckets := after.GetBucket()
+		require.NotEmpty(t, buckets)
+
+		full := buckets[len(buckets)-1]
+		assert.Equal(t, 1.0, full.GetUpperBound())
+		assert.Equal(t, uint64(server.SendBufferSize), after.GetSampleCount()-before.GetSampleCount())
+		assert.Equal(t, after.GetSampleCount(), full.GetCumulativeCount(), "full buffer is observed as one")
+	})
+}
+
+func occupancyHistogram(t *testing.T) *dto.Histogram {
+	t.Helper()
+
+	var m dto.Metric
+	require.NoError(t, server.SendBufferOccupancy.Write(&m))
+
+	return m.GetHistogram()
+}
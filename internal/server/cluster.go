@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/broker"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+)
+
+const (
+	defaultReportInterval = time.Second
+
+	// peerExpiryIntervals is how many report intervals clients of a silent node are still counted.
+	peerExpiryIntervals = 3
+)
+
+type peerConnections struct {
+	n          int
+	reportedAt time.Time
+}
+
+// WithBroker joins the hub to a cluster: messages published on this node are relayed to other nodes
+// and messages published on other nodes are delivered to local subscribers.
+func WithBroker(b broker.Broker) HubOption {
+	return func(o *hubOptions) {
+		o.broker = b
+	}
+}
+
+// WithReportInterval sets how often number of clients is reported to other nodes of the cluster.
+func WithReportInterval(interval time.Duration) HubOption {
+	return func(o *hubOptions) {
+		o.reportInterval = interval
+	}
+}
+
+// WithClusterNumConnections makes NUM_CONNECTIONS report clients of all nodes of the cluster.
+// Clients of other nodes are counted as last reported by them.
+func WithClusterNumConnections() HubOption {
+	return func(o *hubOptions) {
+		o.clusterNumConnections = true
+	}
+}
+
+// relay delivers messages of other nodes and reports number of clients to them until ctx is done.
+func (h *Hub) relay(ctx context.Context) {
+	go h.reportConnections(ctx)
+
+	if err := h.broker.Run(ctx, h.receive); err != nil {
+		h.logger.Error("broker failed", zap.Error(err))
+	}
+}
+
+func (h *Hub) reportConnections(ctx context.Context) {
+	ticker := time.NewTicker(h.reportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := h.broker.Publish(broker.Message{Kind: broker.KindConnections, Connections: h.NumClients()}); err != nil {
+			h.logger.Warn("report connections failed", zap.Error(err))
+		}
+	}
+}
+
+func (h *Hub) relayPublish(data PublishData) {
+	ctx := trace.ContextWithSpanContext(context.Background(), data.SpanContext)
+
+	err := h.broker.Publish(broker.Message{
+		Kind:         broker.KindPublish,
+		Topic:        data.Topic,
+		Data:         data.Data,
+		Raw:          data.Raw,
+		ContentType:  data.ContentType,
+		SentAt:       data.SentAt.UnixNano(),
+		TraceContext: tracing.Inject(ctx),
+	})
+	if err != nil {
+		h.logger.Warn("relay publish failed", zap.String("topic", data.Topic), zap.Error(err))
+
+		return
+	}
+
+	brokerMessages.WithLabelValues(directionSent, msgKindLabel(broker.KindPublish)).Inc()
+}
+
+// receive handles message of another node.
+func (h *Hub) receive(msg broker.Message) {
+	brokerMessages.WithLabelValues(directionReceived, msgKindLabel(msg.Kind)).Inc()
+
+	switch msg.Kind {
+	case broker.KindPublish:
+		ctx := tracing.Extract(context.Background(), msg.TraceContext)
+
+		h.castLocal(PublishData{
+			Topic:       msg.Topic,
+			Data:        msg.Data,
+			Raw:         msg.Raw,
+			ContentType: msg.ContentType,
+			SentAt:      time.Unix(0, msg.SentAt),
+			SpanContext: trace.SpanContextFromContext(ctx),
+		})
+	case broker.KindConnections:
+		h.peersMu.Lock()
+		h.peers[msg.Node] = peerConnections{n: msg.Connections, reportedAt: time.Now()}
+		h.peersMu.Unlock()
+	default:
+		h.logger.Warn("unknown broker message", zap.String("kind", msg.Kind), zap.String("node", msg.Node))
+	}
+}
+
+// numConnections returns number of clients reported by NUM_CONNECTIONS.
+func (h *Hub) numConnections() int {
+	n := h.NumClients()
+	if !h.clusterNumConnections {
+		return n
+	}
+
+	h.peersMu.Lock()
+	defer h.peersMu.Unlock()
+
+	expiry := peerExpiryIntervals * h.reportInterval
+
+	for node, peer := range h.peers {
+		if time.Since(peer.reportedAt) > expiry {
+			delete(h.peers, node)
+
+			continue
+		}
+
+		n += peer.n
+	}
+
+	return n
+}
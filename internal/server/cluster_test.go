@@ -0,0 +1,190 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/broker"
+	"github.com/alexandear/websocket-pubsub/internal/broker/redistest"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+	"github.com/alexandear/websocket-pubsub/internal/server/mock"
+)
+
+func TestApp_Cluster(t *testing.T) {
+	const numNodes = 3
+
+	t.Run("mesh", func(t *testing.T) {
+		listeners := make([]net.Listener, numNodes)
+		peers := make([]string, numNodes)
+
+		for i := range listeners {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+
+			listeners[i] = l
+			peers[i] = l.Addr().String()
+		}
+
+		meshes := make([]*broker.Mesh, numNodes)
+		brokers := make([]broker.Broker, numNodes)
+
+		for i := range meshes {
+			meshes[i] = broker.NewMesh(zap.NewNop(), fmt.Sprintf("node-%d", i), listeners[i], peers,
+				broker.WithReconnectInterval(10*time.Millisecond))
+			brokers[i] = meshes[i]
+		}
+
+		testCluster(t, brokers, func() bool {
+			for _, m := range meshes {
+				if m.Connected() != numNodes {
+					return false
+				}
+			}
+
+			return true
+		})
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		srv := redistest.NewServer(t)
+		brokers := make([]broker.Broker, numNodes)
+
+		for i := range brokers {
+			brokers[i] = broker.NewRedis(zap.NewNop(), fmt.Sprintf("node-%d", i), srv.URL(),
+				broker.WithRedisReconnectInterval(10*time.Millisecond))
+		}
+
+		testCluster(t, brokers, func() bool {
+			return srv.NumSubscribers(broker.DefaultRedisChannel) == numNodes
+		})
+	})
+}
+
+// testCluster runs a node per broker and checks that clients of all nodes share subscriptions
+// once connected reports that brokers are ready.
+func testCluster(t *testing.T, brokers []broker.Broker, connected func() bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	urls := make([]string, len(brokers))
+
+	for i, b := range brokers {
+		hub := server.NewHub(zap.NewNop(), time.Hour, server.WithBroker(b),
+			server.WithReportInterval(10*time.Millisecond), server.WithClusterNumConnections())
+
+		go hub.Run(ctx)
+
+		srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+		defer srv.Close()
+
+		urls[i] = "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	}
+
+	require.Eventually(t, connected, time.Second, 10*time.Millisecond)
+
+	conns := make([]*gws.Conn, len(brokers))
+
+	for i, url := range urls {
+		conn, _, err := gws.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+
+		defer conn.Close()
+
+		conns[i] = conn
+		require.NoError(t, conn.WriteMessage(gws.TextMessage, []byte(`{"command":"SUBSCRIBE","topic":"news"}`)))
+	}
+
+	t.Run("num connections counts clients of all nodes", func(t *testing.T) {
+		want := fmt.Sprintf(`{"num_connections":%d}`, len(brokers))
+
+		assert.Eventually(t, func() bool {
+			require.NoError(t, conns[0].WriteMessage(gws.TextMessage, []byte(`{"command":"NUM_CONNECTIONS"}`)))
+
+			_, resp, err := conns[0].ReadMessage()
+			require.NoError(t, err)
+
+			return string(resp) == want
+		}, time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("published message reaches subscribers of all nodes", func(t *testing.T) {
+		require.NoError(t, conns[1].WriteMessage(gws.TextMessage,
+			[]byte(`{"command":"PUBLISH","topic":"news","data":"hello"}`)))
+
+		for i, conn := range conns {
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+			_, resp, err := conn.ReadMessage()
+			require.NoError(t, err, "node %d", i)
+			assert.Contains(t, string(resp), `"topic":"news","data":"hello"`, "node %d", i)
+		}
+	})
+}
+
+// fakeBroker records published messages and delivers messages sent to delivered.
+type fakeBroker struct {
+	published chan broker.Message
+	delivered chan broker.Message
+}
+
+func (b *fakeBroker) Publish(msg broker.Message) error {
+	b.published <- msg
+
+	return nil
+}
+
+func (b *fakeBroker) Run(ctx context.Context, handle func(broker.Message)) error {
+	for {
+		select {
+		case msg := <-b.delivered:
+			handle(msg)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func TestHub_Broker(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	b := &fakeBroker{published: make(chan broker.Message, 10), delivered: make(chan broker.Message)}
+	h := server.NewHub(zap.NewNop(), time.Hour, server.WithBroker(b), server.WithReportInterval(time.Hour))
+
+	received := make(chan server.ResponseMessage, 2)
+	clientm := mock.NewMockClientI(ctrl)
+	clientm.EXPECT().ID().Return("id").AnyTimes()
+	clientm.EXPECT().Response(gomock.Any()).Do(func(m server.ResponseMessage) { received <- m }).Times(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go h.Run(ctx)
+
+	h.Subscribe(clientm, "news")
+
+	h.Cast(server.PublishData{Topic: "news", Data: []byte(`1`), SentAt: time.Unix(0, 42)})
+	assert.Equal(t, broker.Message{Kind: broker.KindPublish, Topic: "news", Data: []byte(`1`), SentAt: 42},
+		<-b.published)
+	assert.Equal(t, server.ResponsePublish{Topic: "news", Data: []byte(`1`), SentAt: time.Unix(0, 42)}, <-received)
+
+	b.delivered <- broker.Message{Kind: broker.KindPublish, Node: "other", Topic: "news", Data: []byte(`2`), SentAt: 43}
+	assert.Equal(t, server.ResponsePublish{Topic: "news", Data: []byte(`2`), SentAt: time.Unix(0, 43)}, <-received)
+
+	select {
+	case msg := <-b.published:
+		t.Fatalf("message of other node is relayed back: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,10 @@
+package server
+
+const SendBufferSize = defaultSendBufferSize
+
+//nolint:gochecknoglobals // exported for tests only
+var (
+	MessagesDropped     = messagesDropped
+	SendBufferOccupancy = sendBufferOccupancy
+	Subscribes          = subscribes
+)
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWedgedThreshold = 5 * time.Second
+)
+
+// serveHealthz reports that the process is alive.
+func (a *App) serveHealthz(w http.ResponseWriter, _ *http.Request) {
+	writeProbe(w, nil)
+}
+
+// serveReadyz reports whether the app accepts new connections.
+func (a *App) serveReadyz(w http.ResponseWriter, _ *http.Request) {
+	writeProbe(w, a.ready())
+}
+
+func (a *App) ready() error {
+	if atomic.LoadInt32(&a.draining) != 0 {
+		return errDraining
+	}
+
+	lastServiced := a.hub.LastServiced()
+	if lastServiced.IsZero() {
+		return errHubNotRunning
+	}
+
+	if since := time.Since(lastServiced); since > a.WedgedThreshold() {
+		return fmt.Errorf("hub loop has not serviced its channels for %s: %w", since.Round(time.Millisecond), errHubWedged)
+	}
+
+	return nil
+}
+
+func writeProbe(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintln(w, err)
+
+		return
+	}
+
+	_, _ = fmt.Fprintln(w, "ok")
+}
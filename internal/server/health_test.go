@@ -0,0 +1,85 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/server"
+	"github.com/alexandear/websocket-pubsub/internal/server/mock"
+)
+
+func TestApp_Healthz(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	app := server.New(zap.NewNop(), "", mock.NewMockHubI(ctrl))
+	rec := httptest.NewRecorder()
+
+	app.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestApp_Readyz(t *testing.T) {
+	for name, tc := range map[string]struct {
+		lastServiced time.Time
+		expectedCode int
+	}{
+		"when hub is running": {
+			lastServiced: time.Now(),
+			expectedCode: http.StatusOK,
+		},
+		"when hub is not running": {
+			lastServiced: time.Time{},
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		"when hub is wedged": {
+			lastServiced: time.Now().Add(-time.Minute),
+			expectedCode: http.StatusServiceUnavailable,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			hubm := mock.NewMockHubI(ctrl)
+			hubm.EXPECT().LastServiced().Return(tc.lastServiced).Times(1)
+			app := server.New(zap.NewNop(), "", hubm, server.WithWedgedThreshold(time.Second))
+			rec := httptest.NewRecorder()
+
+			app.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+		})
+	}
+
+	t.Run("when draining", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		hubm := mock.NewMockHubI(ctrl)
+		hubm.EXPECT().Run(gomock.Any()).AnyTimes()
+		hubm.EXPECT().LastServiced().Return(time.Now()).AnyTimes()
+		app := server.New(zap.NewNop(), "127.0.0.1:0", hubm, server.WithDrainDelay(time.Second))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+
+		go func() {
+			done <- app.Run(ctx)
+		}()
+
+		cancel()
+
+		assert.Eventually(t, func() bool {
+			rec := httptest.NewRecorder()
+			app.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			return rec.Code == http.StatusServiceUnavailable
+		}, time.Second, 10*time.Millisecond)
+		assert.NoError(t, <-done)
+	})
+}
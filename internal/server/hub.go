@@ -2,13 +2,27 @@ package server
 
 import (
 	"context"
-	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/bridge"
+	"github.com/alexandear/websocket-pubsub/internal/broker"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
 )
 
 const (
-	maxClients = 5000
-	castSize   = 1000
+	defaultMaxClients = 5000
+	defaultCastSize   = 1000
+
+	// heartbeatInterval keeps LastServiced fresh while the hub is idle.
+	heartbeatInterval = time.Second
 )
 
 //go:generate mockgen -source=$GOFILE -package mock -destination mock/client.go
@@ -17,105 +31,448 @@ type ClientI interface {
 	ID() string
 	CloseResponse()
 	Response(message ResponseMessage)
+	Info() ClientInfo
+	Kick(reason string)
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the clients.
+// Clients are partitioned across shards, each delivering messages to its clients in its own goroutine.
 type Hub struct {
-	// Registered clients.
-	clients map[ClientI]struct{}
+	// Number of registered clients, must be accessed atomically.
+	// Must be first for 64-bit atomic alignment.
+	numClients int64
+
+	// Interval of server time broadcasts, must be accessed atomically.
+	broadcastFrequency int64
+
+	// Wakes broadcastServerTime after broadcastFrequency changed.
+	broadcastReset chan struct{}
+
+	shards []*shard
+
+	// Guards assignment of clients to shards.
+	mu       sync.Mutex
+	assigned map[ClientI]*shard
+
+	// Relays published messages to other nodes, nil when the node is not in a cluster.
+	broker         broker.Broker
+	reportInterval time.Duration
+	// Makes NUM_CONNECTIONS count clients of all nodes.
+	clusterNumConnections bool
+
+	// Exchanges published messages with an external messaging system, may be nil.
+	bridge bridge.Bridge
+
+	// Guards peers.
+	peersMu sync.Mutex
+	// Number of clients of other nodes by node ID.
+	peers map[string]peerConnections
 
-	// Broadcast or unicast messages.
-	cast chan CastData
+	logger *zap.Logger
+}
+
+type subscription struct {
+	client ClientI
+	topic  string
+}
+
+type HubOption func(o *hubOptions)
+
+type hubOptions struct {
+	castSize   int
+	maxClients int
+	shards     int
 
-	// Register requests from the clients.
-	subscribe chan ClientI
+	broker                broker.Broker
+	reportInterval        time.Duration
+	clusterNumConnections bool
 
-	// Unregister requests from clients.
-	unsubscribe chan ClientI
+	bridge bridge.Bridge
+}
 
-	broadcastFrequency time.Duration
+// WithCastSize sets how many cast messages may be queued before publishers block.
+func WithCastSize(size int) HubOption {
+	return func(o *hubOptions) {
+		o.castSize = size
+	}
+}
+
+// WithMaxClients preallocates the hub for the expected number of clients.
+func WithMaxClients(n int) HubOption {
+	return func(o *hubOptions) {
+		o.maxClients = n
+	}
 }
 
-func NewHub(broadcastFrequency time.Duration) *Hub {
-	return &Hub{
-		cast:               make(chan CastData, castSize),
-		subscribe:          make(chan ClientI),
-		unsubscribe:        make(chan ClientI),
-		clients:            make(map[ClientI]struct{}, maxClients),
-		broadcastFrequency: broadcastFrequency,
+// WithShards partitions clients across n shards, zero uses one shard per CPU.
+func WithShards(n int) HubOption {
+	return func(o *hubOptions) {
+		o.shards = n
 	}
 }
 
+func NewHub(logger *zap.Logger, broadcastFrequency time.Duration, opts ...HubOption) *Hub {
+	o := hubOptions{
+		castSize:       defaultCastSize,
+		maxClients:     defaultMaxClients,
+		reportInterval: defaultReportInterval,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.shards <= 0 {
+		o.shards = runtime.GOMAXPROCS(0)
+	}
+
+	h := &Hub{
+		logger:                logger,
+		assigned:              make(map[ClientI]*shard, o.maxClients),
+		broadcastFrequency:    int64(broadcastFrequency),
+		broadcastReset:        make(chan struct{}, 1),
+		broker:                o.broker,
+		reportInterval:        o.reportInterval,
+		clusterNumConnections: o.clusterNumConnections,
+		bridge:                o.bridge,
+		peers:                 map[string]peerConnections{},
+	}
+
+	h.shards = make([]*shard, o.shards)
+	for i := range h.shards {
+		h.shards[i] = newShard(h, i, o.castSize, o.maxClients/o.shards)
+	}
+
+	return h
+}
+
 func (h *Hub) Run(ctx context.Context) {
 	go h.broadcastServerTime()
 
-	for {
-		select {
-		case client := <-h.subscribe:
-			h.clients[client] = struct{}{}
-		case client := <-h.unsubscribe:
-			if _, ok := h.clients[client]; ok {
-				client.CloseResponse()
-				delete(h.clients, client)
+	if h.broker != nil {
+		go h.relay(ctx)
+	}
+
+	if h.bridge != nil {
+		go h.runBridge(ctx)
+	}
+
+	var wg sync.WaitGroup
+
+	for _, s := range h.shards {
+		wg.Add(1)
+
+		go func(s *shard) {
+			defer wg.Done()
+			s.run(ctx)
+		}(s)
+	}
+
+	wg.Wait()
+
+	h.logger.Info("hub stopped", zap.Error(ctx.Err()))
+}
+
+// NumClients returns number of registered clients across all shards.
+func (h *Hub) NumClients() int {
+	return int(atomic.LoadInt64(&h.numClients))
+}
+
+// LastServiced returns when the least recently serviced shard loop last serviced its channels.
+// Zero time means a loop is not running.
+func (h *Hub) LastServiced() time.Time {
+	var oldest int64
+
+	for _, s := range h.shards {
+		nsec := atomic.LoadInt64(&s.lastServiced)
+		if nsec == 0 {
+			return time.Time{}
+		}
+
+		if oldest == 0 || nsec < oldest {
+			oldest = nsec
+		}
+	}
+
+	return time.Unix(0, oldest)
+}
+
+// BroadcastFrequency returns interval of server time broadcasts.
+func (h *Hub) BroadcastFrequency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.broadcastFrequency))
+}
+
+// SetBroadcastFrequency changes interval of server time broadcasts without restarting the hub.
+func (h *Hub) SetBroadcastFrequency(frequency time.Duration) {
+	atomic.StoreInt64(&h.broadcastFrequency, int64(frequency))
+
+	select {
+	case h.broadcastReset <- struct{}{}:
+	default:
+	}
+}
+
+// Register adds connected client without subscriptions, so that it is counted in NUM_CONNECTIONS
+// and listed by admin queries.
+func (h *Hub) Register(client ClientI) {
+	h.assign(client).register <- client
+}
+
+// Subscribe adds topic to client subscriptions, registering the client when it is not registered.
+// Client is counted in NUM_CONNECTIONS once Subscribe returns.
+func (h *Hub) Subscribe(client ClientI, topic string) {
+	h.assign(client).subscribe <- subscription{client: client, topic: topic}
+}
+
+// UnsubscribeTopic removes topic from client subscriptions, client stays registered.
+func (h *Hub) UnsubscribeTopic(client ClientI, topic string) {
+	if s := h.shardOf(client); s != nil {
+		s.leave <- subscription{client: client, topic: topic}
+	}
+}
+
+// Unsubscribe unregisters client and closes its response, so that the client closes the connection.
+func (h *Hub) Unsubscribe(client ClientI) {
+	s := h.release(client)
+	if s == nil {
+		// No shard delivers to the client, e.g. it was kicked.
+		client.CloseResponse()
+
+		return
+	}
+
+	s.unsubscribe <- client
+}
+
+// Cast delivers data to clients, published messages are relayed to other nodes of the cluster
+// and to the bridge.
+func (h *Hub) Cast(data CastData) {
+	h.castLocal(data)
+
+	publish, ok := data.(PublishData)
+	if !ok {
+		return
+	}
+
+	if h.broker != nil {
+		h.relayPublish(publish)
+	}
+
+	if h.bridge != nil {
+		h.bridgePublish(publish)
+	}
+}
+
+// castLocal delivers data to every shard. Unicast is delivered to every shard too,
+// as it is addressed by client ID and only the shard of the client responds.
+func (h *Hub) castLocal(data CastData) {
+	for _, s := range h.shards {
+		s.cast <- data
+	}
+}
+
+// Clients returns subscribed clients ordered by connect time.
+func (h *Hub) Clients(ctx context.Context) ([]ClientInfo, error) {
+	infos := make([]ClientInfo, 0, h.NumClients())
+
+	for _, s := range h.shards {
+		s := s
+
+		if err := s.query(ctx, func() {
+			for client, topics := range s.clients {
+				infos = append(infos, clientInfo(client, topics))
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+
+	return infos, nil
+}
+
+// Client returns subscribed client by id.
+func (h *Hub) Client(ctx context.Context, id string) (info ClientInfo, found bool, err error) {
+	for _, s := range h.shards {
+		s := s
+
+		err = s.query(ctx, func() {
+			if client := s.findClient(id); client != nil {
+				info, found = clientInfo(client, s.clients[client]), true
 			}
-		case data := <-h.cast:
-			for client := range h.clients {
-				if response := h.responseMessage(data, client.ID()); response != nil {
-					client.Response(response)
+		})
+		if err != nil || found {
+			return info, found, err
+		}
+	}
+
+	return info, false, nil
+}
+
+// Kick disconnects client by id sending reason in the close frame. The client is released at once,
+// a subscription already in flight registers it again until its read goroutine unsubscribes.
+func (h *Hub) Kick(ctx context.Context, id, reason string) (found bool, err error) {
+	for _, s := range h.shards {
+		s := s
+
+		err = s.query(ctx, func() {
+			client := s.findClient(id)
+			if client == nil {
+				return
+			}
+
+			h.logger.Info("kicking client", zap.String(logger.FieldClientID, id), zap.String("reason", reason))
+
+			client.Kick(reason)
+			delete(s.clients, client)
+			h.release(client)
+			unsubscribes.Inc()
+
+			found = true
+		})
+		if err != nil || found {
+			return found, err
+		}
+	}
+
+	return false, nil
+}
+
+// Topics returns topics with subscriber counts ordered by name.
+func (h *Hub) Topics(ctx context.Context) ([]TopicInfo, error) {
+	subscribers := map[string]int{}
+
+	for _, s := range h.shards {
+		s := s
+
+		if err := s.query(ctx, func() {
+			for _, clientTopics := range s.clients {
+				for topic := range clientTopics {
+					subscribers[topic]++
 				}
 			}
-		case <-ctx.Done():
-			log.Println("context done")
-			return
+		}); err != nil {
+			return nil, err
 		}
 	}
+
+	topics := make([]TopicInfo, 0, len(subscribers))
+	for name, n := range subscribers {
+		topics = append(topics, TopicInfo{Name: name, Subscribers: n})
+	}
+
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+
+	return topics, nil
 }
 
-func (h *Hub) Subscribe(client ClientI) {
-	h.subscribe <- client
+// assign returns shard of client, assigning new client to the least loaded shard.
+func (h *Hub) assign(client ClientI) *shard {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.assigned[client]; ok {
+		return s
+	}
+
+	least := h.shards[0]
+	for _, s := range h.shards[1:] {
+		if s.load < least.load {
+			least = s
+		}
+	}
+
+	least.load++
+	h.assigned[client] = least
+	atomic.AddInt64(&h.numClients, 1)
+
+	return least
 }
 
-func (h *Hub) Unsubscribe(client ClientI) {
-	h.unsubscribe <- client
+// shardOf returns shard of client, nil when client is not registered.
+func (h *Hub) shardOf(client ClientI) *shard {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.assigned[client]
 }
 
-func (h *Hub) Cast(data CastData) {
-	h.cast <- data
+// release unassigns client and returns its shard, nil when client is not registered.
+func (h *Hub) release(client ClientI) *shard {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.assigned[client]
+	if !ok {
+		return nil
+	}
+
+	s.load--
+	delete(h.assigned, client)
+	atomic.AddInt64(&h.numClients, -1)
+
+	return s
+}
+
+func clientInfo(client ClientI, topics map[string]struct{}) ClientInfo {
+	info := client.Info()
+
+	info.Subscriptions = make([]string, 0, len(topics))
+	for topic := range topics {
+		info.Subscriptions = append(info.Subscriptions, topic)
+	}
+
+	sort.Strings(info.Subscriptions)
+
+	return info
 }
 
 func (h *Hub) broadcastServerTime() {
-	log.Printf("broadcasting server time with frequency %s", h.broadcastFrequency)
+	frequency := h.BroadcastFrequency()
+
+	h.logger.Info("broadcasting server time", zap.Duration("frequency", frequency))
 
-	ticker := time.NewTicker(h.broadcastFrequency)
+	ticker := time.NewTicker(frequency)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		now := time.Now().UTC()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.broadcastReset:
+			frequency = h.BroadcastFrequency()
+			ticker.Reset(frequency)
+			h.logger.Info("broadcast frequency changed", zap.Duration("frequency", frequency))
 
-		h.cast <- BroadcastData{
-			Time: now,
+			continue
 		}
+
+		now := time.Now().UTC()
+
+		_, span := tracing.Tracer().Start(context.Background(), "pubsub.broadcast")
+
+		h.castLocal(BroadcastData{
+			Time:        now,
+			SpanContext: span.SpanContext(),
+		})
+
+		span.End()
 	}
 }
 
-func (h *Hub) responseMessage(data CastData, clientID string) ResponseMessage {
+func castSpanContext(data CastData) trace.SpanContext {
 	switch data := data.(type) {
 	case UnicastData:
-		if clientID != data.ClientID {
-			return nil
-		}
-
-		return ResponseUnicast{
-			NumConnections: len(h.clients),
-		}
+		return data.SpanContext
 	case BroadcastData:
-		return ResponseBroadcast{
-			ClientID: clientID,
-			Time:     data.Time,
-		}
+		return data.SpanContext
+	case PublishData:
+		return data.SpanContext
 	default:
-		log.Printf("unknown data type %+v", data)
-
-		return nil
+		return trace.SpanContext{}
 	}
 }
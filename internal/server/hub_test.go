@@ -2,12 +2,24 @@ package server_test
 
 import (
 	"context"
+	"fmt"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
+	gws "github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
 	"github.com/alexandear/websocket-pubsub/internal/server"
 	"github.com/alexandear/websocket-pubsub/internal/server/mock"
 )
@@ -16,37 +28,364 @@ func TestHub_Run(t *testing.T) {
 	t.Run("unicast", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		h := server.NewHub(100 * time.Second)
+		h := server.NewHub(zap.NewNop(), 100*time.Second)
 		clientm := mock.NewMockClientI(ctrl)
 		id := uuid.New().String()
 		clientm.EXPECT().ID().Return(id).Times(1)
 		clientm.EXPECT().Response(server.ResponseUnicast{NumConnections: 1}).Times(1)
+		subscribes := testutil.ToFloat64(server.Subscribes)
 
 		go func() {
-			h.Subscribe(clientm)
+			h.Subscribe(clientm, "broadcast")
 			h.Cast(server.UnicastData{ClientID: id})
 		}()
 
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 		h.Run(ctx)
 		cancel()
+
+		assert.Equal(t, subscribes+1, testutil.ToFloat64(server.Subscribes))
+	})
+
+	t.Run("publish", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		h := server.NewHub(zap.NewNop(), 100*time.Second)
+		subscriberm := mock.NewMockClientI(ctrl)
+		subscriberm.EXPECT().ID().Return(uuid.New().String()).AnyTimes()
+		subscriberm.EXPECT().Response(server.ResponsePublish{Topic: "news", Data: []byte(`"hello"`)}).Times(1)
+		otherm := mock.NewMockClientI(ctrl)
+		otherm.EXPECT().ID().Return(uuid.New().String()).AnyTimes()
+
+		go func() {
+			h.Subscribe(subscriberm, "news")
+			h.Subscribe(otherm, "broadcast")
+			h.Subscribe(otherm, "sport")
+			h.Cast(server.PublishData{Topic: "news", Data: []byte(`"hello"`)})
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		h.Run(ctx)
+		cancel()
 	})
 
 	t.Run("broadcast", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		defer ctrl.Finish()
-		h := server.NewHub(100 * time.Millisecond)
+		h := server.NewHub(zap.NewNop(), 100*time.Millisecond)
 		clientm := mock.NewMockClientI(ctrl)
 		id := uuid.New().String()
 		clientm.EXPECT().ID().Return(id).AnyTimes()
 		clientm.EXPECT().Response(gomock.Any()).AnyTimes()
 
 		go func() {
-			h.Subscribe(clientm)
+			h.Subscribe(clientm, "broadcast")
 		}()
 
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 		h.Run(ctx)
 		cancel()
 	})
+
+	t.Run("set broadcast frequency", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		h := server.NewHub(zap.NewNop(), 100*time.Second)
+		clientm := mock.NewMockClientI(ctrl)
+		clientm.EXPECT().ID().Return(uuid.New().String()).AnyTimes()
+		received := make(chan struct{}, 1)
+		clientm.EXPECT().Response(gomock.Any()).Do(func(server.ResponseMessage) {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}).MinTimes(1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		go h.Run(ctx)
+		h.Subscribe(clientm, "broadcast")
+		h.SetBroadcastFrequency(10 * time.Millisecond)
+
+		assert.Equal(t, 10*time.Millisecond, h.BroadcastFrequency())
+
+		select {
+		case <-received:
+		case <-ctx.Done():
+			t.Fatal("broadcast is not received after frequency changed")
+		}
+	})
+
+	t.Run("last serviced", func(t *testing.T) {
+		h := server.NewHub(zap.NewNop(), 100*time.Second)
+		assert.True(t, h.LastServiced().IsZero())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+
+		go func() {
+			h.Run(ctx)
+			close(done)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return time.Since(h.LastServiced()) < time.Second
+		}, time.Second, 10*time.Millisecond)
+
+		cancel()
+		<-done
+
+		assert.True(t, h.LastServiced().IsZero())
+	})
+
+	t.Run("admin queries", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		h := server.NewHub(zap.NewNop(), 100*time.Second)
+		clientm := mock.NewMockClientI(ctrl)
+		id := uuid.New().String()
+		clientm.EXPECT().ID().Return(id).AnyTimes()
+		clientm.EXPECT().Info().Return(server.ClientInfo{ID: id}).AnyTimes()
+		clientm.EXPECT().Kick("spam").Times(1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go h.Run(ctx)
+
+		h.Subscribe(clientm, "broadcast")
+		h.Subscribe(clientm, "news")
+		h.Subscribe(clientm, "sport")
+		h.UnsubscribeTopic(clientm, "sport")
+
+		clients, err := h.Clients(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []server.ClientInfo{{ID: id, Subscriptions: []string{"broadcast", "news"}}}, clients)
+
+		topics, err := h.Topics(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []server.TopicInfo{{Name: "broadcast", Subscribers: 1}, {Name: "news", Subscribers: 1}}, topics)
+
+		found, err := h.Kick(ctx, id, "spam")
+		assert.NoError(t, err)
+		assert.True(t, found)
+
+		_, found, err = h.Client(ctx, id)
+		assert.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("sharded", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		h := server.NewHub(zap.NewNop(), 100*time.Second, server.WithShards(4))
+		const numClients = 10
+		var delivered sync.WaitGroup
+		done := func(server.ResponseMessage) { delivered.Done() }
+		clients := make([]*mock.MockClientI, numClients)
+		for i := range clients {
+			clients[i] = mock.NewMockClientI(ctrl)
+			clients[i].EXPECT().ID().Return(uuid.New().String()).AnyTimes()
+			clients[i].EXPECT().Info().Return(server.ClientInfo{}).AnyTimes()
+			clients[i].EXPECT().Response(server.ResponsePublish{Topic: "news", Data: []byte(`1`)}).Do(done).Times(1)
+		}
+		clients[0].EXPECT().Response(server.ResponseUnicast{NumConnections: numClients}).Do(done).Times(1)
+		clients[0].EXPECT().CloseResponse().Times(1)
+		last := clients[numClients-1]
+		last.EXPECT().Response(server.ResponseUnicast{NumConnections: numClients - 1}).Do(done).Times(1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go h.Run(ctx)
+
+		for _, c := range clients {
+			h.Subscribe(c, "news")
+		}
+
+		assert.Equal(t, numClients, h.NumClients())
+
+		delivered.Add(numClients + 1)
+		h.Cast(server.UnicastData{ClientID: clients[0].ID()})
+		h.Cast(server.PublishData{Topic: "news", Data: []byte(`1`)})
+		delivered.Wait()
+
+		infos, err := h.Clients(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, infos, numClients)
+
+		h.Unsubscribe(clients[0])
+
+		delivered.Add(1)
+		h.Cast(server.UnicastData{ClientID: last.ID()})
+		delivered.Wait()
+
+		topics, err := h.Topics(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []server.TopicInfo{{Name: "news", Subscribers: numClients - 1}}, topics)
+	})
+
+	t.Run("admin queries when hub is not running", func(t *testing.T) {
+		h := server.NewHub(zap.NewNop(), 100*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := h.Clients(ctx)
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestHub_KickWhileSubscribing(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	h := server.NewHub(zap.NewNop(), time.Hour)
+	connm := mock.NewMockWsConn(ctrl)
+	client := server.NewClient(zap.NewNop(), h, connm)
+
+	subscribe := []byte(`{"command":"SUBSCRIBE","topic":"news"}`)
+	inFlight := make(chan struct{})
+	closed := make(chan struct{})
+
+	gomock.InOrder(
+		connm.EXPECT().ReadMessage().Return(websocket.TextMessage, subscribe, nil),
+		// The subscription is read before the kick and reaches the hub after it.
+		connm.EXPECT().ReadMessage().DoAndReturn(func() (websocket.MessageType, []byte, error) {
+			<-inFlight
+
+			return websocket.TextMessage, subscribe, nil
+		}),
+		connm.EXPECT().ReadMessage().DoAndReturn(func() (websocket.MessageType, []byte, error) {
+			<-closed
+
+			return 0, nil, websocket.ErrClosedConn
+		}),
+	)
+	connm.EXPECT().WriteCloseMessage(websocket.ClosePolicyViolation, "spam").Times(1)
+	connm.EXPECT().WriteMessage(gomock.Any(), gomock.Any()).AnyTimes()
+	connm.EXPECT().Close().AnyTimes()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go h.Run(ctx)
+	go client.Run(ctx)
+
+	registered := func() bool {
+		_, found, err := h.Client(ctx, client.ID())
+
+		return err == nil && found
+	}
+
+	assert.Eventually(t, registered, time.Second, time.Millisecond)
+
+	found, err := h.Kick(ctx, client.ID(), "spam")
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	close(inFlight)
+	assert.Eventually(t, registered, time.Second, time.Millisecond, "in flight subscription registers again")
+
+	// Fan-out to the kicked client must not send on closed response.
+	h.Cast(server.PublishData{Topic: "news", Data: []byte(`1`)})
+
+	close(closed)
+	assert.Eventually(t, func() bool { return h.NumClients() == 0 }, time.Second, time.Millisecond)
+
+	// Response is closed once, unsubscribing again is a no-op.
+	h.Unsubscribe(client)
+	h.Cast(server.PublishData{Topic: "news", Data: []byte(`2`)})
+	_, err = h.Topics(ctx)
+	assert.NoError(t, err, "hub loop is still running")
+}
+
+func TestHub_KickWithoutSubscriptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := server.NewHub(zap.NewNop(), time.Hour)
+
+	go h.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", h))
+	defer srv.Close()
+
+	// A publisher never subscribes.
+	conn, _, err := gws.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	var clients []server.ClientInfo
+
+	assert.Eventually(t, func() bool {
+		clients, err = h.Clients(ctx)
+
+		return err == nil && len(clients) == 1
+	}, time.Second, time.Millisecond, "connected client is listed")
+	require.Len(t, clients, 1)
+
+	_, found, err := h.Client(ctx, clients[0].ID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = h.Kick(ctx, clients[0].ID, "spam")
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, gws.IsCloseError(err, gws.ClosePolicyViolation), "got %v", err)
+	assert.Eventually(t, func() bool { return h.NumClients() == 0 }, time.Second, time.Millisecond)
+}
+
+// benchClient counts delivered messages without a connection.
+type benchClient struct {
+	id       string
+	received int64
+}
+
+func (c *benchClient) ID() string                      { return c.id }
+func (c *benchClient) CloseResponse()                  {}
+func (c *benchClient) Response(server.ResponseMessage) { atomic.AddInt64(&c.received, 1) }
+func (c *benchClient) Info() server.ClientInfo         { return server.ClientInfo{ID: c.id} }
+func (c *benchClient) Kick(string)                     {}
+
+// BenchmarkHub_Publish compares fan-out of a single hub loop, shards=1, with sharded hubs.
+func BenchmarkHub_Publish(b *testing.B) {
+	const numClients = 5000
+
+	for _, shards := range []int{1, 2, 4, 8} {
+		shards := shards
+
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			h := server.NewHub(zap.NewNop(), time.Hour, server.WithShards(shards))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go h.Run(ctx)
+
+			clients := make([]*benchClient, numClients)
+			for i := range clients {
+				clients[i] = &benchClient{id: uuid.New().String()}
+				h.Subscribe(clients[i], "news")
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				h.Cast(server.PublishData{Topic: "news", Data: []byte(`1`)})
+			}
+
+			for _, c := range clients {
+				for atomic.LoadInt64(&c.received) < int64(b.N) {
+					runtime.Gosched()
+				}
+			}
+		})
+	}
 }
@@ -1,17 +1,41 @@
 package server
 
 import (
+	"encoding/json"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type CastData interface{}
 
 type BroadcastData struct {
 	Time time.Time
+
+	// Publisher span, parent of the hub fan-out span.
+	SpanContext trace.SpanContext
 }
 
 type UnicastData struct {
 	ClientID string
+
+	// Publisher span, parent of the hub fan-out span.
+	SpanContext trace.SpanContext
+}
+
+// PublishData is published by a client to subscribers of the topic.
+type PublishData struct {
+	Topic string
+	Data  json.RawMessage
+	// Raw is the payload as published by a client of a protocol without JSON, nil for JSON clients.
+	Raw []byte
+	// ContentType is MIME type of Raw given by the publisher, empty when unknown.
+	ContentType string
+	// SentAt is when the publisher sent the message.
+	SentAt time.Time
+
+	// Publisher span, parent of the hub fan-out span.
+	SpanContext trace.SpanContext
 }
 
 type ResponseMessage interface{}
@@ -19,8 +43,87 @@ type ResponseMessage interface{}
 type ResponseBroadcast struct {
 	ClientID string
 	Time     time.Time
+
+	// Hub fan-out span, parent of the client write span.
+	SpanContext trace.SpanContext
 }
 
 type ResponseUnicast struct {
 	NumConnections int
+
+	// Hub fan-out span, parent of the client write span.
+	SpanContext trace.SpanContext
+}
+
+type ResponsePublish struct {
+	Topic       string
+	Data        json.RawMessage
+	Raw         []byte
+	ContentType string
+	SentAt      time.Time
+
+	// Hub fan-out span, parent of the client write span.
+	SpanContext trace.SpanContext
+}
+
+func responseSpanContext(message ResponseMessage) trace.SpanContext {
+	switch m := message.(type) {
+	case ResponseBroadcast:
+		return m.SpanContext
+	case ResponseUnicast:
+		return m.SpanContext
+	case ResponsePublish:
+		return m.SpanContext
+	default:
+		return trace.SpanContext{}
+	}
+}
+
+// messagePayload returns published message for protocols without JSON: raw payload as published
+// when the publisher did not use JSON, data with JSON strings unquoted otherwise.
+func messagePayload(data json.RawMessage, raw []byte) []byte {
+	if raw != nil {
+		return raw
+	}
+
+	return rawPayload(data)
+}
+
+// rawPayload returns JSON string data unquoted, so that text published by clients reaches protocols
+// without JSON as is. Other JSON is returned unchanged.
+func rawPayload(data json.RawMessage) []byte {
+	var text string
+	if json.Unmarshal(data, &text) == nil {
+		return []byte(text)
+	}
+
+	return data
+}
+
+// jsonPayload returns payload of protocols without JSON as data of published message,
+// payload which is not JSON becomes JSON string.
+func jsonPayload(payload []byte) json.RawMessage {
+	if json.Valid(payload) {
+		return payload
+	}
+
+	data, _ := json.Marshal(string(payload))
+
+	return data
+}
+
+// ClientInfo describes connected client for admin queries.
+type ClientInfo struct {
+	ID            string    `json:"id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Principal     string    `json:"principal,omitempty"`
+	Subscriptions []string  `json:"subscriptions"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	QueueDepth    int       `json:"queue_depth"`
+}
+
+// TopicInfo describes topic for admin queries.
+type TopicInfo struct {
+	Name        string `json:"name"`
+	Subscribers int    `json:"subscribers"`
 }
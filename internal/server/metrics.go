@@ -0,0 +1,185 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/alexandear/websocket-pubsub/internal/broker"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+)
+
+const (
+	metricsNamespace = "pubsub"
+
+	topicBroadcast = operation.TopicBroadcast
+	topicUnicast   = "unicast"
+	// topicPublish labels all published messages to bound label cardinality.
+	topicPublish = "publish"
+	topicUnknown = "unknown"
+
+	directionSent     = "sent"
+	directionReceived = "received"
+)
+
+//nolint:gochecknoglobals // collectors are registered once in the default registry
+var (
+	connections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections",
+		Help:      "Number of open websocket connections.",
+	})
+
+	subscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "subscribers",
+		Help:      "Number of clients registered in the hub.",
+	})
+
+	subscribes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "subscribes_total",
+		Help:      "Number of handled subscribe requests.",
+	})
+
+	unsubscribes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unsubscribes_total",
+		Help:      "Number of handled unsubscribe requests.",
+	})
+
+	connectionsNegotiated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections_negotiated_total",
+		Help:      "Number of upgraded connections by negotiated protocol version and codec.",
+	}, []string{"version", "codec"})
+
+	commandsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "commands_received_total",
+		Help:      "Number of commands read from clients.",
+	}, []string{"command"})
+
+	messagesDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_delivered_total",
+		Help:      "Number of messages written to websocket connections.",
+	}, []string{"topic"})
+
+	messagesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_dropped_total",
+		Help:      "Number of messages dropped because client send buffer is full.",
+	}, []string{"topic"})
+
+	// Send buffer size is configurable and reloadable, so occupancy is a fraction of the capacity.
+	sendBufferOccupancy = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "send_buffer_occupancy_ratio",
+		Help:      "Fraction of client send buffer capacity queued, observed on enqueue.",
+		Buckets:   []float64{0, 0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 0.9, 1},
+	})
+
+	marshalDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "marshal_duration_seconds",
+		Help:      "Time spent marshaling response messages.",
+		Buckets:   prometheus.ExponentialBuckets(0.000_001, 4, 10),
+	})
+
+	writeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "write_duration_seconds",
+		Help:      "Time spent writing messages to websocket connections.",
+		Buckets:   prometheus.ExponentialBuckets(0.000_01, 4, 10),
+	})
+
+	messageBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "message_bytes_total",
+		Help:      "Payload bytes of messages written to websocket connections.",
+	}, []string{"compressed"})
+
+	wireBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "wire_bytes_total",
+		Help:      "Bytes of message frames written to the network.",
+	}, []string{"compressed"})
+
+	compressionRatio = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "compression_ratio",
+		Help:      "Ratio of wire bytes to payload bytes of compressed messages.",
+		Buckets:   prometheus.LinearBuckets(0.1, 0.1, 12),
+	})
+
+	brokerMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "broker_messages_total",
+		Help:      "Number of messages relayed to and received from other nodes of the cluster.",
+	}, []string{"direction", "kind"})
+
+	bridgeMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bridge_messages_total",
+		Help:      "Number of messages sent to and received from the external messaging system.",
+	}, []string{"direction"})
+
+	hubLoopDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "hub_loop_duration_seconds",
+		Help:      "Time spent handling one hub loop iteration.",
+		Buckets:   prometheus.ExponentialBuckets(0.000_001, 4, 12),
+	})
+)
+
+// topic returns metrics label for the response message.
+func topic(message ResponseMessage) string {
+	switch message.(type) {
+	case ResponseBroadcast:
+		return topicBroadcast
+	case ResponseUnicast:
+		return topicUnicast
+	case ResponsePublish:
+		return topicPublish
+	default:
+		return topicUnknown
+	}
+}
+
+// observeWrite records sizes of a message written to websocket connection.
+func observeWrite(stats websocket.WriteStats) {
+	compressed := strconv.FormatBool(stats.Compressed)
+	messageBytes.WithLabelValues(compressed).Add(float64(stats.Size))
+
+	if stats.WireSize == 0 {
+		return
+	}
+
+	wireBytes.WithLabelValues(compressed).Add(float64(stats.WireSize))
+
+	if stats.Compressed && stats.Size > 0 {
+		compressionRatio.Observe(float64(stats.WireSize) / float64(stats.Size))
+	}
+}
+
+// msgKindLabel bounds label cardinality of broker messages of other nodes.
+func msgKindLabel(kind string) string {
+	switch kind {
+	case broker.KindPublish, broker.KindConnections:
+		return kind
+	default:
+		return topicUnknown
+	}
+}
+
+// occupancy returns fraction of response capacity queued, unbuffered response is always full.
+func occupancy(response chan ResponseMessage) float64 {
+	if cap(response) == 0 {
+		return 1
+	}
+
+	return float64(len(response)) / float64(cap(response))
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/command"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/mqtt"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+)
+
+const (
+	mqttVersion = "3.1.1"
+
+	// mqttMaxQoS is the highest QoS granted to subscriptions, QoS 2 is downgraded.
+	mqttMaxQoS = 1
+)
+
+var (
+	errMQTTProtocol = errors.New("mqtt protocol violation")
+	errTextFrame    = errors.New("mqtt packets must be sent in binary frames")
+)
+
+// MQTTClient serves an MQTT 3.1.1 connection, packets are mapped onto the hub. Sessions are not persisted,
+// QoS 1 messages are acknowledged but not redelivered after reconnect.
+type MQTTClient struct {
+	session
+
+	// Guards qos.
+	mu sync.Mutex
+	// Granted QoS by subscribed topic.
+	qos map[string]byte
+
+	// Identifier of the last QoS 1 message, used by the write goroutine only.
+	packetID uint16
+
+	maxPacketSize int
+}
+
+func newMQTTClient(l *zap.Logger, hub HubI, conn WsConn, sendBufferSize, maxPacketSize int) *MQTTClient {
+	return &MQTTClient{
+		session:       newSession(l, hub, conn, sendBufferSize, websocket.BinaryMessage),
+		qos:           make(map[string]byte),
+		maxPacketSize: maxPacketSize,
+	}
+}
+
+// Run allow collection of memory referenced by the caller by doing all work in new goroutines.
+func (c *MQTTClient) Run(ctx context.Context) {
+	go c.read()
+
+	for range ctx.Done() {
+		return
+	}
+}
+
+// read pumps packets from the websocket connection to the hub.
+func (c *MQTTClient) read() {
+	connections.Inc()
+
+	// Closes the connection when the client is silent for too long.
+	keepAlive := time.AfterFunc(connectTimeout, func() {
+		c.logger.Info("mqtt keep alive expired")
+		_ = c.conn.Close()
+	})
+
+	defer func() {
+		keepAlive.Stop()
+		c.hub.Unsubscribe(c)
+		close(c.done)
+		connections.Dec()
+	}()
+
+	r := bufio.NewReader(&frameReader{conn: c.conn, binary: true})
+
+	interval, err := c.connect(r)
+	if err != nil {
+		c.logFailure(err)
+		_ = c.conn.Close()
+
+		return
+	}
+
+	c.hub.Register(c)
+
+	// The write goroutine closes the connection after answering pending requests.
+	go c.write(c.publishPacket, nil, 0)
+
+	for {
+		if interval > 0 {
+			keepAlive.Reset(interval)
+		} else {
+			keepAlive.Stop()
+		}
+
+		p, err := mqtt.ReadPacket(r, c.maxPacketSize)
+		if err != nil {
+			c.logFailure(err)
+
+			return
+		}
+
+		if _, ok := p.(*mqtt.Disconnect); ok {
+			return
+		}
+
+		if err := c.processPacket(p); err != nil {
+			c.logFailure(err)
+
+			return
+		}
+	}
+}
+
+func (c *MQTTClient) logFailure(err error) {
+	if errors.Is(err, websocket.ErrClosedConn) || errors.Is(err, io.EOF) {
+		return
+	}
+
+	c.logger.Warn("mqtt connection failed", zap.Error(err))
+}
+
+// connect handles CONNECT, which must be the first packet, and returns how long the client may be silent:
+// one and a half keep alive interval requested by the client.
+func (c *MQTTClient) connect(r *bufio.Reader) (time.Duration, error) {
+	p, err := mqtt.ReadPacket(r, c.maxPacketSize)
+	if err != nil {
+		return 0, err
+	}
+
+	connect, ok := p.(*mqtt.Connect)
+	if !ok {
+		return 0, fmt.Errorf("first packet is %T: %w", p, errMQTTProtocol)
+	}
+
+	if connect.ProtocolName != mqtt.ProtocolName || connect.ProtocolLevel != mqtt.ProtocolLevel {
+		_ = c.handshake(&mqtt.Connack{ReturnCode: mqtt.RefusedProtocolVersion})
+
+		return 0, fmt.Errorf("protocol %s level %d: %w", connect.ProtocolName, connect.ProtocolLevel, errMQTTProtocol)
+	}
+
+	if connect.ClientID == "" && !connect.CleanSession {
+		_ = c.handshake(&mqtt.Connack{ReturnCode: mqtt.RefusedIdentifierRejected})
+
+		return 0, fmt.Errorf("empty client identifier requires clean session: %w", errMQTTProtocol)
+	}
+
+	c.logger = c.logger.With(zap.String("mqtt_client_id", connect.ClientID))
+
+	if err := c.handshake(&mqtt.Connack{ReturnCode: mqtt.Accepted}); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(connect.KeepAlive) * time.Second * 3 / 2, nil
+}
+
+func (c *MQTTClient) processPacket(p mqtt.Packet) error {
+	switch p := p.(type) {
+	case *mqtt.Subscribe:
+		commandsReceived.WithLabelValues(commandLabel(command.Subscribe)).Inc()
+
+		codes := make([]byte, len(p.Subscriptions))
+
+		for i, sub := range p.Subscriptions {
+			// The hub matches topics exactly, filters with wildcards are rejected.
+			if !validMQTTTopic(sub.Topic) {
+				codes[i] = mqtt.SubackFailure
+
+				continue
+			}
+
+			qos := sub.QoS
+			if qos > mqttMaxQoS {
+				qos = mqttMaxQoS
+			}
+
+			c.mu.Lock()
+			c.qos[sub.Topic] = qos
+			c.mu.Unlock()
+
+			c.hub.Subscribe(c, sub.Topic)
+			codes[i] = qos
+		}
+
+		c.answer(&mqtt.Suback{PacketID: p.PacketID, ReturnCodes: codes})
+	case *mqtt.Unsubscribe:
+		commandsReceived.WithLabelValues(commandLabel(command.Unsubscribe)).Inc()
+
+		for _, topic := range p.Topics {
+			c.hub.UnsubscribeTopic(c, topic)
+
+			c.mu.Lock()
+			delete(c.qos, topic)
+			c.mu.Unlock()
+		}
+
+		c.answer(&mqtt.Unsuback{PacketID: p.PacketID})
+	case *mqtt.Publish:
+		return c.publish(p)
+	case *mqtt.Puback:
+		// Messages are not redelivered, so acknowledgements need no bookkeeping.
+	case *mqtt.Pingreq:
+		c.answer(&mqtt.Pingresp{})
+	default:
+		return fmt.Errorf("unexpected %T: %w", p, errMQTTProtocol)
+	}
+
+	return nil
+}
+
+func (c *MQTTClient) publish(p *mqtt.Publish) error {
+	if p.QoS > mqttMaxQoS {
+		return fmt.Errorf("qos %d is not supported: %w", p.QoS, errMQTTProtocol)
+	}
+
+	if !validMQTTTopic(p.Topic) {
+		return fmt.Errorf("publish to %q: %w", p.Topic, errMQTTProtocol)
+	}
+
+	_, span := tracing.Tracer().Start(context.Background(), "pubsub.command", trace.WithAttributes(
+		attribute.String("pubsub.command", string(command.Publish)),
+		attribute.String("pubsub.client_id", c.id),
+	))
+
+	defer span.End()
+
+	commandsReceived.WithLabelValues(commandLabel(command.Publish)).Inc()
+
+	if p.Topic == topicBroadcast {
+		c.logger.Warn("publish failed", zap.Error(fmt.Errorf("publish to %q: %w", p.Topic, errBadTopic)))
+	} else {
+		c.hub.Cast(PublishData{
+			Topic:       p.Topic,
+			Data:        jsonPayload(p.Payload),
+			Raw:         p.Payload,
+			SentAt:      time.Now(),
+			SpanContext: span.SpanContext(),
+		})
+	}
+
+	if p.QoS == 1 {
+		c.answer(&mqtt.Puback{PacketID: p.PacketID})
+	}
+
+	return nil
+}
+
+// validMQTTTopic reports whether topic is a non-empty topic name without wildcards.
+func validMQTTTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
+
+// publishPacket returns PUBLISH for message, nil for messages MQTT clients cannot request.
+// It is called by the write goroutine.
+func (c *MQTTClient) publishPacket(message ResponseMessage) frame {
+	switch m := message.(type) {
+	case ResponsePublish:
+		c.mu.Lock()
+		qos := c.qos[m.Topic]
+		c.mu.Unlock()
+
+		p := &mqtt.Publish{QoS: qos, Topic: m.Topic, Payload: messagePayload(m.Data, m.Raw)}
+
+		if qos > 0 {
+			// Packet identifier zero is not allowed.
+			c.packetID++
+			if c.packetID == 0 {
+				c.packetID++
+			}
+
+			p.PacketID = c.packetID
+		}
+
+		return p
+	case ResponseBroadcast:
+		payload, _ := json.Marshal(operation.RespBroadcast{
+			ClientID:  m.ClientID,
+			Timestamp: int(m.Time.Unix()),
+			SentAt:    unixNano(m.Time),
+		})
+
+		return &mqtt.Publish{Topic: topicBroadcast, Payload: payload}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,223 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/mqtt"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+)
+
+func TestApp_MQTT(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	device := dialMQTT(t, url)
+	connect := (&mqtt.Connect{ProtocolName: mqtt.ProtocolName, ProtocolLevel: mqtt.ProtocolLevel, CleanSession: true,
+		KeepAlive: 60, ClientID: "sensor-1"}).Encode()
+	// A packet may span frames.
+	require.NoError(t, device.conn.WriteMessage(gws.BinaryMessage, connect[:5]))
+	require.NoError(t, device.conn.WriteMessage(gws.BinaryMessage, connect[5:]))
+	assert.Equal(t, &mqtt.Connack{ReturnCode: mqtt.Accepted}, device.receive(t))
+
+	device.send(t, &mqtt.Subscribe{PacketID: 1, Subscriptions: []mqtt.Subscription{
+		{Topic: "orders", QoS: 2},
+		{Topic: "sensors/+"},
+	}})
+	assert.Equal(t, &mqtt.Suback{PacketID: 1, ReturnCodes: []byte{1, mqtt.SubackFailure}}, device.receive(t),
+		"QoS 2 is downgraded, wildcards are rejected")
+
+	web, _, err := gws.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+
+	defer web.Close()
+
+	require.NoError(t, web.WriteMessage(gws.TextMessage, []byte(`{"command":"SUBSCRIBE","topic":"orders"}`)))
+	require.NoError(t, web.WriteMessage(gws.TextMessage, []byte(`{"command":"NUM_CONNECTIONS"}`)))
+
+	_, resp, err := web.ReadMessage()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"num_connections":2}`, string(resp), "the device is counted")
+
+	t.Run("message published by json client reaches the device", func(t *testing.T) {
+		require.NoError(t, web.WriteMessage(gws.TextMessage,
+			[]byte(`{"command":"PUBLISH","topic":"orders","data":"hello"}`)))
+
+		_, _, err := web.ReadMessage()
+		require.NoError(t, err)
+
+		assert.Equal(t, &mqtt.Publish{QoS: 1, Topic: "orders", PacketID: 1, Payload: []byte("hello")},
+			device.receive(t))
+		device.send(t, &mqtt.Puback{PacketID: 1})
+	})
+
+	t.Run("message published by the device reaches json client", func(t *testing.T) {
+		device.send(t, &mqtt.Publish{QoS: 1, Topic: "orders", PacketID: 7, Payload: []byte(`{"id":1}`)})
+
+		// The device is subscribed too, acknowledgement and the message may be written in any order.
+		got := []mqtt.Packet{device.receive(t), device.receive(t)}
+		assert.ElementsMatch(t, []mqtt.Packet{
+			&mqtt.Puback{PacketID: 7},
+			&mqtt.Publish{QoS: 1, Topic: "orders", PacketID: 2, Payload: []byte(`{"id":1}`)},
+		}, got)
+
+		_, resp, err := web.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(resp), `"topic":"orders","data":{"id":1}`)
+	})
+
+	t.Run("payload reaches devices as is", func(t *testing.T) {
+		for i, payload := range [][]byte{{0xff, 0xfe}, []byte(`"quoted"`)} {
+			device.send(t, &mqtt.Publish{Topic: "orders", Payload: payload})
+			assert.Equal(t, &mqtt.Publish{QoS: 1, Topic: "orders", PacketID: uint16(3 + i), Payload: payload},
+				device.receive(t))
+
+			_, _, err := web.ReadMessage()
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		device.send(t, &mqtt.Pingreq{})
+		assert.Equal(t, &mqtt.Pingresp{}, device.receive(t))
+	})
+
+	t.Run("disconnect closes the connection", func(t *testing.T) {
+		device.send(t, &mqtt.Disconnect{})
+
+		_, _, err := device.conn.ReadMessage()
+		assert.True(t, gws.IsCloseError(err, gws.CloseNormalClosure), "got %v", err)
+	})
+}
+
+func TestApp_MQTTRefused(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	for name, tc := range map[string]struct {
+		connect *mqtt.Connect
+		code    byte
+	}{
+		"protocol level": {
+			connect: &mqtt.Connect{ProtocolName: "MQIsdp", ProtocolLevel: 3, CleanSession: true, ClientID: "old"},
+			code:    mqtt.RefusedProtocolVersion,
+		},
+		"empty client identifier without clean session": {
+			connect: &mqtt.Connect{ProtocolName: mqtt.ProtocolName, ProtocolLevel: mqtt.ProtocolLevel},
+			code:    mqtt.RefusedIdentifierRejected,
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			device := dialMQTT(t, url)
+			device.send(t, tc.connect)
+			assert.Equal(t, &mqtt.Connack{ReturnCode: tc.code}, device.receive(t))
+
+			_, _, err := device.conn.ReadMessage()
+			assert.Error(t, err, "connection is closed")
+		})
+	}
+}
+
+func TestApp_MQTTTooLarge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub,
+		server.WithMaxMessageSize(1024)))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	t.Run("packet", func(t *testing.T) {
+		device := dialMQTT(t, url)
+		// CONNECT with the largest remaining length, the body is never sent.
+		require.NoError(t, device.conn.WriteMessage(gws.BinaryMessage, []byte{0x10, 0xff, 0xff, 0xff, 0x7f}))
+		require.NoError(t, device.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+		_, _, err := device.conn.ReadMessage()
+
+		var closeErr *gws.CloseError
+		assert.ErrorAs(t, err, &closeErr, "connection is closed before the deadline")
+	})
+
+	t.Run("websocket message", func(t *testing.T) {
+		device := dialMQTT(t, url)
+		require.NoError(t, device.conn.WriteMessage(gws.BinaryMessage, make([]byte, 2048)))
+		require.NoError(t, device.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+		_, _, err := device.conn.ReadMessage()
+		assert.True(t, gws.IsCloseError(err, gws.CloseMessageTooBig), "got %v", err)
+	})
+}
+
+type mqttConn struct {
+	conn *gws.Conn
+}
+
+func dialMQTT(t *testing.T, url string) *mqttConn {
+	t.Helper()
+
+	dialer := *gws.DefaultDialer
+	dialer.Subprotocols = []string{mqtt.Subprotocol}
+
+	conn, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.Equal(t, mqtt.Subprotocol, conn.Subprotocol())
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return &mqttConn{conn: conn}
+}
+
+func (c *mqttConn) send(t *testing.T, p mqtt.Packet) {
+	t.Helper()
+
+	require.NoError(t, c.conn.WriteMessage(gws.BinaryMessage, p.Encode()))
+}
+
+func (c *mqttConn) receive(t *testing.T) mqtt.Packet {
+	t.Helper()
+
+	require.NoError(t, c.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	messageType, data, err := c.conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, gws.BinaryMessage, messageType)
+
+	p, err := mqtt.ReadPacket(bufio.NewReader(bytes.NewReader(data)), len(data))
+	require.NoError(t, err)
+
+	return p
+}
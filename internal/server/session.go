@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/logger"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+)
+
+// connectTimeout is how long a session may stay without handshake.
+const connectTimeout = 10 * time.Second
+
+// frame is a packet of a protocol served by a session.
+type frame interface {
+	Encode() []byte
+}
+
+// session is a client speaking a protocol other than pub/sub codecs, such as MQTT or STOMP. The read goroutine
+// handshakes, starts the write goroutine and maps requests onto the hub, answers are written by the write goroutine.
+type session struct {
+	id string
+
+	principal   string
+	remoteAddr  string
+	connectedAt time.Time
+
+	// Close frame reason, set before closing kicked.
+	closeReason string
+	// Closed by Kick, the write goroutine closes the connection then.
+	kicked   chan struct{}
+	kickOnce *sync.Once
+
+	hub    HubI
+	conn   WsConn
+	logger *zap.Logger
+
+	// messageType of written websocket frames, text frames with invalid UTF-8 are written as binary.
+	messageType websocket.MessageType
+
+	// Frames answering requests of the client.
+	answers chan frame
+	// Closed when the read goroutine is done.
+	done chan struct{}
+	// Closed when the write goroutine is done.
+	writeDone chan struct{}
+
+	// Buffered channel of outbound messages, closed once by the hub.
+	response  chan ResponseMessage
+	closeOnce *sync.Once
+}
+
+func newSession(l *zap.Logger, hub HubI, conn WsConn, sendBufferSize int, messageType websocket.MessageType) session {
+	id := uuid.New().String()
+
+	return session{
+		id:          id,
+		logger:      logger.Client(l, id),
+		hub:         hub,
+		conn:        conn,
+		messageType: messageType,
+		connectedAt: time.Now(),
+		answers:     make(chan frame, 1),
+		done:        make(chan struct{}),
+		writeDone:   make(chan struct{}),
+		kicked:      make(chan struct{}),
+		kickOnce:    &sync.Once{},
+		response:    make(chan ResponseMessage, sendBufferSize),
+		closeOnce:   &sync.Once{},
+	}
+}
+
+func (s *session) ID() string {
+	return s.id
+}
+
+// SetPrincipal must be called before Run.
+func (s *session) SetPrincipal(principal string) {
+	s.principal = principal
+}
+
+// SetRemoteAddr must be called before Run.
+func (s *session) SetRemoteAddr(remoteAddr string) {
+	s.remoteAddr = remoteAddr
+}
+
+// Info is called by the hub for admin queries.
+func (s *session) Info() ClientInfo {
+	return ClientInfo{
+		ID:          s.id,
+		RemoteAddr:  s.remoteAddr,
+		Principal:   s.principal,
+		ConnectedAt: s.connectedAt,
+		QueueDepth:  len(s.response),
+	}
+}
+
+func (s *session) CloseResponse() {
+	s.closeOnce.Do(func() {
+		close(s.response)
+	})
+}
+
+// Kick closes the connection with reason sent in the close frame. Response is closed when the client unsubscribes.
+func (s *session) Kick(reason string) {
+	s.kickOnce.Do(func() {
+		s.closeReason = reason
+		close(s.kicked)
+	})
+}
+
+// Response enqueues message for writing. Message is dropped when the send buffer is full
+// so that a slow client cannot block the hub.
+func (s *session) Response(message ResponseMessage) {
+	select {
+	case s.response <- message:
+		sendBufferOccupancy.Observe(occupancy(s.response))
+	default:
+		messagesDropped.WithLabelValues(topic(message)).Inc()
+	}
+}
+
+// handshake writes the answer to the first request of the client, before the write goroutine is started.
+func (s *session) handshake(f frame) error {
+	if err := s.writeFrame(f); err != nil {
+		return fmt.Errorf("write handshake failed: %w", err)
+	}
+
+	return nil
+}
+
+// answer queues frame for the write goroutine unless it is done.
+func (s *session) answer(f frame) {
+	select {
+	case s.answers <- f:
+	case <-s.writeDone:
+	}
+}
+
+// write pumps answers and messages from the hub to the websocket connection until the read goroutine is done
+// or the hub closes response. Encode converts messages to frames, nil frames are skipped. Heartbeat is written
+// every heartbeatInterval, zero interval disables heartbeats.
+func (s *session) write(encode func(ResponseMessage) frame, heartbeat frame, heartbeatInterval time.Duration) {
+	defer func() {
+		close(s.writeDone)
+		_ = s.conn.Close()
+	}()
+
+	var heartbeats <-chan time.Time
+
+	if heartbeatInterval > 0 {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		heartbeats = ticker.C
+	}
+
+	for {
+		select {
+		case f := <-s.answers:
+			if err := s.writeFrame(f); err != nil {
+				s.logger.Warn("write answer failed", zap.Error(err))
+			}
+		case message, opened := <-s.response:
+			if !opened {
+				s.flushAnswers()
+				s.conn.WriteCloseMessage(websocket.CloseNormalClosure, "")
+
+				return
+			}
+
+			f := encode(message)
+			if f == nil {
+				continue
+			}
+
+			if err := s.writeMessage(message, f); err != nil {
+				s.logger.Warn("write message failed", zap.Error(err))
+
+				continue
+			}
+
+			messagesDelivered.WithLabelValues(topic(message)).Inc()
+		case <-heartbeats:
+			if err := s.writeFrame(heartbeat); err != nil {
+				s.logger.Warn("write heartbeat failed", zap.Error(err))
+			}
+		case <-s.kicked:
+			s.conn.WriteCloseMessage(websocket.ClosePolicyViolation, s.closeReason)
+
+			return
+		case <-s.done:
+			s.flushAnswers()
+			s.conn.WriteCloseMessage(websocket.CloseNormalClosure, "")
+
+			return
+		}
+	}
+}
+
+// flushAnswers writes answers queued before the connection is closed.
+func (s *session) flushAnswers() {
+	for {
+		select {
+		case f := <-s.answers:
+			_ = s.writeFrame(f)
+		default:
+			return
+		}
+	}
+}
+
+func (s *session) writeMessage(message ResponseMessage, f frame) error {
+	ctx := trace.ContextWithSpanContext(context.Background(), responseSpanContext(message))
+	_, span := tracing.Tracer().Start(ctx, "pubsub.write", trace.WithAttributes(
+		attribute.String("pubsub.topic", topic(message)),
+		attribute.String("pubsub.client_id", s.id),
+	))
+
+	defer span.End()
+
+	start := time.Now()
+
+	if err := s.writeFrame(f); err != nil {
+		span.RecordError(err)
+
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+
+	writeDuration.Observe(time.Since(start).Seconds())
+
+	return nil
+}
+
+// writeFrame writes f in a message of the session type. Text messages must be valid UTF-8, browsers close
+// the connection otherwise, so frames carrying binary payloads are written in binary messages.
+func (s *session) writeFrame(f frame) error {
+	data := f.Encode()
+
+	messageType := s.messageType
+	if messageType == websocket.TextMessage && !utf8.Valid(data) {
+		messageType = websocket.BinaryMessage
+	}
+
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// frameReader reads a stream of protocol frames which may span websocket messages.
+type frameReader struct {
+	conn WsConn
+	buf  []byte
+
+	// binary rejects text messages.
+	binary bool
+	// received is called for every websocket message, may be nil.
+	received func()
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		messageType, data, err := r.conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		if r.binary && messageType != websocket.BinaryMessage {
+			return 0, errTextFrame
+		}
+
+		if r.received != nil {
+			r.received()
+		}
+
+		r.buf = data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
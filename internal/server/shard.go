@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+)
+
+// shard owns a partition of hub clients and delivers cast messages to them in its own goroutine.
+type shard struct {
+	// Unix nanoseconds of the last loop iteration, zero when the loop is not running.
+	// Must be first for 64-bit atomic alignment.
+	lastServiced int64
+
+	index int
+	hub   *Hub
+
+	// Number of clients assigned to the shard, guarded by Hub.mu.
+	load int
+
+	// Registered clients with their subscribed topics.
+	clients map[ClientI]map[string]struct{}
+
+	// Broadcast or unicast messages.
+	cast chan CastData
+
+	// Register requests of connected clients.
+	register chan ClientI
+
+	// Subscribe requests from the clients.
+	subscribe chan subscription
+
+	// Unsubscribe requests from a single topic.
+	leave chan subscription
+
+	// Unregister requests from clients.
+	unsubscribe chan ClientI
+
+	// Admin queries executed in the shard goroutine.
+	queries chan func()
+
+	logger *zap.Logger
+}
+
+func newShard(hub *Hub, index, castSize, maxClients int) *shard {
+	return &shard{
+		index:       index,
+		hub:         hub,
+		clients:     make(map[ClientI]map[string]struct{}, maxClients),
+		cast:        make(chan CastData, castSize),
+		register:    make(chan ClientI),
+		subscribe:   make(chan subscription),
+		leave:       make(chan subscription),
+		unsubscribe: make(chan ClientI),
+		queries:     make(chan func()),
+		logger:      hub.logger.With(zap.Int("shard", index)),
+	}
+}
+
+func (s *shard) run(ctx context.Context) {
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	defer atomic.StoreInt64(&s.lastServiced, 0)
+
+	for {
+		atomic.StoreInt64(&s.lastServiced, time.Now().UnixNano())
+
+		select {
+		case <-heartbeat.C:
+		case client := <-s.register:
+			start := time.Now()
+			if _, ok := s.clients[client]; !ok {
+				s.clients[client] = make(map[string]struct{})
+			}
+			s.observeLoop(start)
+		case sub := <-s.subscribe:
+			start := time.Now()
+			s.addSubscription(sub)
+			subscribes.Inc()
+			s.observeLoop(start)
+		case sub := <-s.leave:
+			start := time.Now()
+			if topics, ok := s.clients[sub.client]; ok {
+				delete(topics, sub.topic)
+			}
+			s.observeLoop(start)
+		case client := <-s.unsubscribe:
+			start := time.Now()
+			if _, ok := s.clients[client]; ok {
+				client.CloseResponse()
+				delete(s.clients, client)
+				unsubscribes.Inc()
+			}
+			s.observeLoop(start)
+		case data := <-s.cast:
+			start := time.Now()
+			s.fanOut(data)
+			s.observeLoop(start)
+		case query := <-s.queries:
+			start := time.Now()
+			query()
+			s.observeLoop(start)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *shard) observeLoop(start time.Time) {
+	subscribers.Set(float64(s.hub.NumClients()))
+	hubLoopDuration.Observe(time.Since(start).Seconds())
+}
+
+// query runs fn in the shard goroutine and waits for it to finish.
+func (s *shard) query(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+
+	select {
+	case s.queries <- func() {
+		fn()
+		close(done)
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	<-done
+
+	return nil
+}
+
+func (s *shard) findClient(id string) ClientI {
+	for client := range s.clients {
+		if client.ID() == id {
+			return client
+		}
+	}
+
+	return nil
+}
+
+func (s *shard) addSubscription(sub subscription) {
+	topics, ok := s.clients[sub.client]
+	if !ok {
+		topics = make(map[string]struct{}, 1)
+		s.clients[sub.client] = topics
+	}
+
+	topics[sub.topic] = struct{}{}
+}
+
+// fanOut delivers data to matching clients within a span child of the publisher span.
+func (s *shard) fanOut(data CastData) {
+	ctx := trace.ContextWithSpanContext(context.Background(), castSpanContext(data))
+	_, span := tracing.Tracer().Start(ctx, "pubsub.fanout", trace.WithAttributes(
+		attribute.Int("pubsub.shard", s.index),
+	))
+
+	defer span.End()
+
+	recipients := 0
+
+	for client, topics := range s.clients {
+		if response := s.responseMessage(data, client.ID(), topics, span.SpanContext()); response != nil {
+			client.Response(response)
+			recipients++
+		}
+	}
+
+	span.SetAttributes(attribute.Int("pubsub.recipients", recipients))
+}
+
+func (s *shard) responseMessage(data CastData, clientID string, topics map[string]struct{},
+	sc trace.SpanContext) ResponseMessage {
+	switch data := data.(type) {
+	case UnicastData:
+		if clientID != data.ClientID {
+			return nil
+		}
+
+		return ResponseUnicast{
+			NumConnections: s.hub.numConnections(),
+			SpanContext:    sc,
+		}
+	case BroadcastData:
+		if _, ok := topics[topicBroadcast]; !ok {
+			return nil
+		}
+
+		return ResponseBroadcast{
+			ClientID:    clientID,
+			Time:        data.Time,
+			SpanContext: sc,
+		}
+	case PublishData:
+		if _, ok := topics[data.Topic]; !ok {
+			return nil
+		}
+
+		return ResponsePublish{
+			Topic:       data.Topic,
+			Data:        data.Data,
+			Raw:         data.Raw,
+			ContentType: data.ContentType,
+			SentAt:      data.SentAt,
+			SpanContext: sc,
+		}
+	default:
+		s.logger.Error("unknown cast data type", zap.String("type", fmt.Sprintf("%T", data)))
+
+		return nil
+	}
+}
@@ -0,0 +1,520 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/command"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/stomp"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+)
+
+const (
+	stompCodec  = "stomp"
+	stompServer = "pubsub"
+
+	// stompTopicPrefix is stripped from destinations, both /topic/news and news are topic news.
+	stompTopicPrefix = "/topic/"
+
+	stompAckAuto = "auto"
+
+	stompContentTypeJSON = "application/json"
+	stompContentTypeText = "text/plain"
+
+	defaultSTOMPHeartbeat = 10 * time.Second
+)
+
+var errSTOMPProtocol = errors.New("stomp protocol violation")
+
+// stompHeartbeat is EOL sent when the server heart-beats.
+type stompHeartbeat struct{}
+
+func (stompHeartbeat) Encode() []byte {
+	return []byte{'\n'}
+}
+
+// stompFrames are frames written in a single websocket message.
+type stompFrames []*stomp.Frame
+
+func (fs stompFrames) Encode() []byte {
+	var buf bytes.Buffer
+
+	for _, f := range fs {
+		buf.Write(f.Encode())
+	}
+
+	return buf.Bytes()
+}
+
+type stompSubscription struct {
+	destination string
+	topic       string
+	ack         string
+}
+
+// STOMPClient serves a STOMP 1.2 connection, destinations are mapped onto hub topics. Acknowledgements are
+// accepted but messages are never redelivered, transactions are not supported.
+type STOMPClient struct {
+	session
+
+	// heartbeat is the interval the server offers to send and wants to receive heart-beats at.
+	heartbeat time.Duration
+
+	// Guards subscriptions.
+	mu sync.Mutex
+	// Subscriptions by ID.
+	subscriptions map[string]stompSubscription
+
+	// Identifier of the last message, used by the write goroutine only.
+	messageID uint64
+
+	maxFrameSize int
+}
+
+func newSTOMPClient(l *zap.Logger, hub HubI, conn WsConn, sendBufferSize, maxFrameSize int,
+	heartbeat time.Duration) *STOMPClient {
+	return &STOMPClient{
+		session:       newSession(l, hub, conn, sendBufferSize, websocket.TextMessage),
+		heartbeat:     heartbeat,
+		subscriptions: make(map[string]stompSubscription),
+		maxFrameSize:  maxFrameSize,
+	}
+}
+
+// Run allow collection of memory referenced by the caller by doing all work in new goroutines.
+func (c *STOMPClient) Run(ctx context.Context) {
+	go c.read()
+
+	for range ctx.Done() {
+		return
+	}
+}
+
+// read pumps frames from the websocket connection to the hub.
+func (c *STOMPClient) read() {
+	connections.Inc()
+
+	// Closes the connection when the client is silent for too long.
+	keepAlive := time.AfterFunc(connectTimeout, func() {
+		c.logger.Info("stomp heart-beat expired")
+		_ = c.conn.Close()
+	})
+
+	var timeout time.Duration
+
+	received := func() {
+		if timeout > 0 {
+			keepAlive.Reset(timeout)
+		}
+	}
+
+	defer func() {
+		keepAlive.Stop()
+		c.hub.Unsubscribe(c)
+		close(c.done)
+		connections.Dec()
+	}()
+
+	r := bufio.NewReader(&frameReader{conn: c.conn, received: received})
+
+	send, receive, err := c.connect(r)
+	if err != nil {
+		c.logFailure(err)
+		_ = c.conn.Close()
+
+		return
+	}
+
+	c.hub.Register(c)
+
+	// Client heart-beats may arrive late by half of the interval.
+	timeout = receive * 3 / 2
+	if timeout == 0 {
+		keepAlive.Stop()
+	} else {
+		keepAlive.Reset(timeout)
+	}
+
+	// The write goroutine closes the connection after answering pending requests.
+	go c.write(c.messageFrames, stompHeartbeat{}, send)
+
+	for {
+		f, err := stomp.ReadFrame(r, c.maxFrameSize)
+		if err != nil {
+			c.logFailure(err)
+
+			return
+		}
+
+		if err := c.processFrame(f); err != nil {
+			c.logFailure(err)
+			c.answer(stompError(f, err))
+
+			return
+		}
+
+		if receipt, ok := f.Get(stomp.HeaderReceipt); ok {
+			c.answer(stomp.New(stomp.Receipt, stomp.HeaderReceiptID, receipt))
+		}
+
+		if f.Command == stomp.Disconnect {
+			return
+		}
+	}
+}
+
+func (c *STOMPClient) logFailure(err error) {
+	if errors.Is(err, websocket.ErrClosedConn) || errors.Is(err, io.EOF) {
+		return
+	}
+
+	c.logger.Warn("stomp connection failed", zap.Error(err))
+}
+
+// stompError returns ERROR answering frame f which failed with err.
+func stompError(f *stomp.Frame, err error) *stomp.Frame {
+	e := stomp.New(stomp.Error, stomp.HeaderMessage, err.Error())
+
+	if receipt, ok := f.Get(stomp.HeaderReceipt); ok {
+		e.Set(stomp.HeaderReceiptID, receipt)
+	}
+
+	return e
+}
+
+// connect handles CONNECT or STOMP, which must be the first frame, and returns negotiated heart-beat intervals:
+// how often the server sends heart-beats and how often the client does, zero when disabled.
+func (c *STOMPClient) connect(r *bufio.Reader) (send, receive time.Duration, err error) {
+	f, err := stomp.ReadFrame(r, c.maxFrameSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	refuse := func(err error) (time.Duration, time.Duration, error) {
+		_ = c.handshake(stompError(f, err))
+
+		return 0, 0, err
+	}
+
+	if f.Command != stomp.Connect && f.Command != stomp.Stomp {
+		return refuse(fmt.Errorf("first frame is %s: %w", f.Command, errSTOMPProtocol))
+	}
+
+	versions, _ := f.Get(stomp.HeaderAcceptVersion)
+	if !acceptsVersion(versions, stomp.Version) {
+		return refuse(fmt.Errorf("accept-version %q does not include %s: %w", versions, stomp.Version,
+			errSTOMPProtocol))
+	}
+
+	clientSend, clientReceive := time.Duration(0), time.Duration(0)
+
+	if heartBeat, ok := f.Get(stomp.HeaderHeartBeat); ok {
+		clientSend, clientReceive, err = parseHeartBeat(heartBeat)
+		if err != nil {
+			return refuse(err)
+		}
+	}
+
+	if c.heartbeat > 0 {
+		send, receive = negotiateHeartBeat(c.heartbeat, clientReceive), negotiateHeartBeat(c.heartbeat, clientSend)
+	}
+
+	ms := strconv.FormatInt(c.heartbeat.Milliseconds(), 10)
+
+	connected := stomp.New(stomp.Connected,
+		stomp.HeaderVersion, stomp.Version,
+		stomp.HeaderHeartBeat, ms+","+ms,
+		stomp.HeaderServer, stompServer,
+		stomp.HeaderSession, c.id,
+	)
+
+	if err := c.handshake(connected); err != nil {
+		return 0, 0, err
+	}
+
+	return send, receive, nil
+}
+
+// acceptsVersion reports whether comma separated versions include version.
+func acceptsVersion(versions, version string) bool {
+	for _, v := range strings.Split(versions, ",") {
+		if v == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHeartBeat parses heart-beat header "cx,cy" of the client: the interval it can send heart-beats at
+// and the interval it wants to receive them at in milliseconds.
+func parseHeartBeat(header string) (send, receive time.Duration, err error) {
+	parts := strings.Split(header, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("heart-beat %q: %w", header, errSTOMPProtocol)
+	}
+
+	intervals := make([]time.Duration, len(parts))
+
+	for i, part := range parts {
+		ms, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("heart-beat %q: %w", header, errSTOMPProtocol)
+		}
+
+		intervals[i] = time.Duration(ms) * time.Millisecond
+	}
+
+	return intervals[0], intervals[1], nil
+}
+
+// negotiateHeartBeat returns the larger of intervals, zero when the peer does not heart-beat.
+func negotiateHeartBeat(server, client time.Duration) time.Duration {
+	if client == 0 {
+		return 0
+	}
+
+	if client > server {
+		return client
+	}
+
+	return server
+}
+
+func (c *STOMPClient) processFrame(f *stomp.Frame) error {
+	switch f.Command {
+	case stomp.Subscribe:
+		return c.subscribe(f)
+	case stomp.Unsubscribe:
+		commandsReceived.WithLabelValues(commandLabel(command.Unsubscribe)).Inc()
+
+		id, ok := f.Get(stomp.HeaderID)
+		if !ok {
+			return fmt.Errorf("%s without id: %w", f.Command, errSTOMPProtocol)
+		}
+
+		c.unsubscribe(id)
+	case stomp.Send:
+		return c.send(f)
+	case stomp.Ack, stomp.Nack:
+		// Messages are not redelivered, so acknowledgements need no bookkeeping.
+		if _, ok := f.Get(stomp.HeaderID); !ok {
+			return fmt.Errorf("%s without id: %w", f.Command, errSTOMPProtocol)
+		}
+	case stomp.Disconnect:
+	default:
+		return fmt.Errorf("unsupported %s: %w", f.Command, errSTOMPProtocol)
+	}
+
+	return nil
+}
+
+func (c *STOMPClient) subscribe(f *stomp.Frame) error {
+	commandsReceived.WithLabelValues(commandLabel(command.Subscribe)).Inc()
+
+	id, ok := f.Get(stomp.HeaderID)
+	if !ok {
+		return fmt.Errorf("%s without id: %w", f.Command, errSTOMPProtocol)
+	}
+
+	destination, _ := f.Get(stomp.HeaderDestination)
+
+	topic, err := destinationTopic(destination)
+	if err != nil {
+		return err
+	}
+
+	ack, ok := f.Get(stomp.HeaderAck)
+	if !ok {
+		ack = stompAckAuto
+	}
+
+	if ack != stompAckAuto && ack != "client" && ack != "client-individual" {
+		return fmt.Errorf("ack mode %q: %w", ack, errSTOMPProtocol)
+	}
+
+	c.mu.Lock()
+	_, exists := c.subscriptions[id]
+
+	if !exists {
+		c.subscriptions[id] = stompSubscription{destination: destination, topic: topic, ack: ack}
+	}
+	c.mu.Unlock()
+
+	if exists {
+		return fmt.Errorf("subscription %q already exists: %w", id, errSTOMPProtocol)
+	}
+
+	c.hub.Subscribe(c, topic)
+
+	return nil
+}
+
+// unsubscribe removes subscription id, the topic is unsubscribed when no other subscription uses it.
+func (c *STOMPClient) unsubscribe(id string) {
+	c.mu.Lock()
+	sub, ok := c.subscriptions[id]
+	delete(c.subscriptions, id)
+
+	used := false
+
+	for _, other := range c.subscriptions {
+		if other.topic == sub.topic {
+			used = true
+
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if ok && !used {
+		c.hub.UnsubscribeTopic(c, sub.topic)
+	}
+}
+
+func (c *STOMPClient) send(f *stomp.Frame) error {
+	destination, _ := f.Get(stomp.HeaderDestination)
+
+	topic, err := destinationTopic(destination)
+	if err != nil {
+		return err
+	}
+
+	if topic == topicBroadcast {
+		return fmt.Errorf("send to %q: %w", destination, errBadTopic)
+	}
+
+	_, span := tracing.Tracer().Start(context.Background(), "pubsub.command", trace.WithAttributes(
+		attribute.String("pubsub.command", string(command.Publish)),
+		attribute.String("pubsub.client_id", c.id),
+	))
+
+	defer span.End()
+
+	commandsReceived.WithLabelValues(commandLabel(command.Publish)).Inc()
+
+	data := jsonPayload(f.Body)
+
+	// Text is published as JSON string even when it happens to be valid JSON.
+	contentType, _ := f.Get(stomp.HeaderContentType)
+	if strings.HasPrefix(contentType, "text/") {
+		data, _ = json.Marshal(string(f.Body))
+	}
+
+	c.hub.Cast(PublishData{
+		Topic:       topic,
+		Data:        data,
+		Raw:         f.Body,
+		ContentType: contentType,
+		SentAt:      time.Now(),
+		SpanContext: span.SpanContext(),
+	})
+
+	return nil
+}
+
+// destinationTopic maps destination /topic/NAME or NAME to topic NAME, other absolute destinations are rejected.
+func destinationTopic(destination string) (string, error) {
+	topic := strings.TrimPrefix(destination, stompTopicPrefix)
+	if topic == "" || strings.HasPrefix(topic, "/") {
+		return "", fmt.Errorf("destination %q: %w", destination, errSTOMPProtocol)
+	}
+
+	return topic, nil
+}
+
+// messageFrames returns MESSAGE for every subscription to the topic of message, nil when there is none.
+// It is called by the write goroutine.
+func (c *STOMPClient) messageFrames(message ResponseMessage) frame {
+	var (
+		topic       string
+		contentType string
+		body        []byte
+	)
+
+	switch m := message.(type) {
+	case ResponsePublish:
+		topic = m.Topic
+		contentType, body = stompBody(m)
+	case ResponseBroadcast:
+		topic, contentType = topicBroadcast, stompContentTypeJSON
+		body, _ = json.Marshal(operation.RespBroadcast{
+			ClientID:  m.ClientID,
+			Timestamp: int(m.Time.Unix()),
+			SentAt:    unixNano(m.Time),
+		})
+	default:
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var frames stompFrames
+
+	for id, sub := range c.subscriptions {
+		if sub.topic != topic {
+			continue
+		}
+
+		c.messageID++
+		messageID := strconv.FormatUint(c.messageID, 10)
+
+		f := stomp.New(stomp.Message,
+			stomp.HeaderSubscription, id,
+			stomp.HeaderMessageID, messageID,
+			stomp.HeaderDestination, sub.destination,
+		)
+
+		if contentType != "" {
+			f.Set(stomp.HeaderContentType, contentType)
+		}
+
+		if sub.ack != stompAckAuto {
+			f.Set(stomp.HeaderAck, messageID)
+		}
+
+		f.Body = body
+		frames = append(frames, f)
+	}
+
+	if len(frames) == 0 {
+		return nil
+	}
+
+	return frames
+}
+
+// stompBody returns content type and body of MESSAGE. Payloads of STOMP and MQTT publishers are delivered as is
+// with the content type of the publisher, JSON without content type is application/json and other payloads
+// have none, so that they are binary. Data of JSON publishers is application/json, JSON strings are delivered
+// as text.
+func stompBody(m ResponsePublish) (contentType string, body []byte) {
+	switch {
+	case m.Raw != nil && m.ContentType != "":
+		return m.ContentType, m.Raw
+	case m.Raw != nil && json.Valid(m.Raw):
+		return stompContentTypeJSON, m.Raw
+	case m.Raw != nil:
+		return "", m.Raw
+	case len(m.Data) > 0 && m.Data[0] == '"':
+		return stompContentTypeText, rawPayload(m.Data)
+	default:
+		return stompContentTypeJSON, m.Data
+	}
+}
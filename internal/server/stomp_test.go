@@ -0,0 +1,355 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/stomp"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+)
+
+func TestApp_STOMP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	browser := dialSTOMP(t, url)
+	browser.send(t, stomp.New(stomp.Connect, stomp.HeaderAcceptVersion, "1.1,1.2", stomp.HeaderHost, "localhost",
+		stomp.HeaderHeartBeat, "0,0"))
+
+	connected := browser.receive(t)
+	require.Equal(t, stomp.Connected, connected.Command)
+	assertHeader(t, connected, stomp.HeaderVersion, "1.2")
+	assertHeader(t, connected, stomp.HeaderHeartBeat, "10000,10000")
+
+	browser.send(t, stomp.New(stomp.Subscribe, stomp.HeaderID, "sub-0", stomp.HeaderDestination, "/topic/orders",
+		stomp.HeaderReceipt, "r-1"))
+	assert.Equal(t, stomp.New(stomp.Receipt, stomp.HeaderReceiptID, "r-1"), browser.receive(t))
+
+	web, _, err := gws.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+
+	defer web.Close()
+
+	require.NoError(t, web.WriteMessage(gws.TextMessage, []byte(`{"command":"SUBSCRIBE","topic":"orders"}`)))
+	require.NoError(t, web.WriteMessage(gws.TextMessage, []byte(`{"command":"NUM_CONNECTIONS"}`)))
+
+	_, resp, err := web.ReadMessage()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"num_connections":2}`, string(resp), "the browser is counted")
+
+	t.Run("message published by json client reaches the browser", func(t *testing.T) {
+		require.NoError(t, web.WriteMessage(gws.TextMessage,
+			[]byte(`{"command":"PUBLISH","topic":"orders","data":"hello"}`)))
+
+		_, _, err := web.ReadMessage()
+		require.NoError(t, err)
+
+		message := browser.receive(t)
+		require.Equal(t, stomp.Message, message.Command)
+		assertHeader(t, message, stomp.HeaderSubscription, "sub-0")
+		assertHeader(t, message, stomp.HeaderDestination, "/topic/orders")
+		assertHeader(t, message, stomp.HeaderContentType, "text/plain")
+		assert.Equal(t, "hello", string(message.Body), "JSON string is unquoted")
+	})
+
+	t.Run("message sent by the browser reaches json client", func(t *testing.T) {
+		send := stomp.New(stomp.Send, stomp.HeaderDestination, "/topic/orders",
+			stomp.HeaderContentType, "application/json")
+		send.Body = []byte(`{"id":1}`)
+		browser.send(t, send)
+
+		_, resp, err := web.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(resp), `"topic":"orders","data":{"id":1}`)
+
+		message := browser.receive(t)
+		require.Equal(t, stomp.Message, message.Command, "the browser is subscribed too")
+		assertHeader(t, message, stomp.HeaderContentType, "application/json")
+		assert.Equal(t, `{"id":1}`, string(message.Body))
+	})
+
+	t.Run("body and content type reach the browser as sent", func(t *testing.T) {
+		for contentType, body := range map[string][]byte{
+			"application/octet-stream":       {0xff, 0x00, 0xfe},
+			"application/json;charset=utf-8": []byte(`"quoted"`),
+		} {
+			send := stomp.New(stomp.Send, stomp.HeaderDestination, "/topic/orders",
+				stomp.HeaderContentType, contentType)
+			send.Body = body
+			browser.send(t, send)
+
+			messageType, message := browser.receiveMessage(t)
+			require.Equal(t, stomp.Message, message.Command)
+			assertHeader(t, message, stomp.HeaderContentType, contentType)
+			assert.Equal(t, body, message.Body)
+
+			if utf8.Valid(body) {
+				assert.Equal(t, gws.TextMessage, messageType, contentType)
+			} else {
+				assert.Equal(t, gws.BinaryMessage, messageType, "%s is not UTF-8", contentType)
+			}
+
+			_, _, err := web.ReadMessage()
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("unsubscribe stops delivery", func(t *testing.T) {
+		browser.send(t, stomp.New(stomp.Unsubscribe, stomp.HeaderID, "sub-0", stomp.HeaderReceipt, "r-2"))
+		assert.Equal(t, stomp.New(stomp.Receipt, stomp.HeaderReceiptID, "r-2"), browser.receive(t))
+
+		require.NoError(t, web.WriteMessage(gws.TextMessage,
+			[]byte(`{"command":"PUBLISH","topic":"orders","data":"bye"}`)))
+
+		// Subscribers receive the message at once, so the browser would have it queued by now.
+		_, _, err := web.ReadMessage()
+		require.NoError(t, err)
+
+		browser.send(t, stomp.New(stomp.Disconnect, stomp.HeaderReceipt, "r-3"))
+		assert.Equal(t, stomp.New(stomp.Receipt, stomp.HeaderReceiptID, "r-3"), browser.receive(t))
+	})
+
+	t.Run("disconnect closes the connection", func(t *testing.T) {
+		_, _, err := browser.conn.ReadMessage()
+		assert.True(t, gws.IsCloseError(err, gws.CloseNormalClosure), "got %v", err)
+	})
+}
+
+func TestApp_STOMPHeartbeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub,
+		server.WithSTOMPHeartbeat(20*time.Millisecond)))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	t.Run("server heart-beats at the interval the client wants", func(t *testing.T) {
+		browser := dialSTOMP(t, url)
+		browser.send(t, stomp.New(stomp.Connect, stomp.HeaderAcceptVersion, "1.2", stomp.HeaderHeartBeat, "0,30"))
+
+		connected := browser.receive(t)
+		require.Equal(t, stomp.Connected, connected.Command)
+		assertHeader(t, connected, stomp.HeaderHeartBeat, "20,20")
+
+		require.NoError(t, browser.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+		_, data, err := browser.conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, "\n", string(data))
+	})
+
+	t.Run("silent client is disconnected", func(t *testing.T) {
+		browser := dialSTOMP(t, url)
+		browser.send(t, stomp.New(stomp.Connect, stomp.HeaderAcceptVersion, "1.2", stomp.HeaderHeartBeat, "20,0"))
+		require.Equal(t, stomp.Connected, browser.receive(t).Command)
+
+		require.NoError(t, browser.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+		_, _, err := browser.conn.ReadMessage()
+
+		var closeErr *gws.CloseError
+		assert.ErrorAs(t, err, &closeErr, "connection is closed before the deadline")
+	})
+}
+
+func TestApp_STOMPError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	for name, tc := range map[string]struct {
+		frames  []*stomp.Frame
+		message string
+	}{
+		"unsupported version": {
+			frames:  []*stomp.Frame{stomp.New(stomp.Connect, stomp.HeaderAcceptVersion, "1.0,1.1")},
+			message: `accept-version "1.0,1.1" does not include 1.2`,
+		},
+		"send before connect": {
+			frames:  []*stomp.Frame{stomp.New(stomp.Send, stomp.HeaderDestination, "orders")},
+			message: "first frame is SEND",
+		},
+		"subscribe without id": {
+			frames: []*stomp.Frame{
+				stomp.New(stomp.Connect, stomp.HeaderAcceptVersion, "1.2"),
+				stomp.New(stomp.Subscribe, stomp.HeaderDestination, "orders"),
+			},
+			message: "SUBSCRIBE without id",
+		},
+		"queue destination": {
+			frames: []*stomp.Frame{
+				stomp.New(stomp.Connect, stomp.HeaderAcceptVersion, "1.2"),
+				stomp.New(stomp.Send, stomp.HeaderDestination, "/queue/orders"),
+			},
+			message: `destination "/queue/orders"`,
+		},
+		"send to broadcast": {
+			frames: []*stomp.Frame{
+				stomp.New(stomp.Connect, stomp.HeaderAcceptVersion, "1.2"),
+				stomp.New(stomp.Send, stomp.HeaderDestination, "/topic/broadcast"),
+			},
+			message: `send to "/topic/broadcast"`,
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			browser := dialSTOMP(t, url)
+
+			for _, f := range tc.frames {
+				browser.send(t, f)
+			}
+
+			if len(tc.frames) > 1 {
+				require.Equal(t, stomp.Connected, browser.receive(t).Command)
+			}
+
+			f := browser.receive(t)
+			require.Equal(t, stomp.Error, f.Command)
+
+			message, _ := f.Get(stomp.HeaderMessage)
+			assert.Contains(t, message, tc.message)
+
+			_, _, err := browser.conn.ReadMessage()
+			assert.Error(t, err, "connection is closed")
+		})
+	}
+}
+
+func TestApp_STOMPTooLarge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := server.NewHub(zap.NewNop(), time.Hour)
+
+	go hub.Run(ctx)
+
+	srv := httptest.NewServer(server.New(zap.NewNop(), "", hub,
+		server.WithMaxMessageSize(1024)))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	for name, message := range map[string][]byte{
+		"frame":             []byte("SEND\ndestination:orders\ncontent-length:9223372036854775807\n\n"),
+		"websocket message": make([]byte, 2048),
+	} {
+		message := message
+		t.Run(name, func(t *testing.T) {
+			browser := dialSTOMP(t, url)
+			browser.send(t, stomp.New(stomp.Connect, stomp.HeaderAcceptVersion, "1.2"))
+			require.Equal(t, stomp.Connected, browser.receive(t).Command)
+
+			require.NoError(t, browser.conn.WriteMessage(gws.TextMessage, message))
+			require.NoError(t, browser.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+			_, _, err := browser.conn.ReadMessage()
+
+			var closeErr *gws.CloseError
+			assert.ErrorAs(t, err, &closeErr, "connection is closed before the deadline")
+		})
+	}
+}
+
+type stompConn struct {
+	conn *gws.Conn
+}
+
+func dialSTOMP(t *testing.T, url string) *stompConn {
+	t.Helper()
+
+	dialer := *gws.DefaultDialer
+	dialer.Subprotocols = []string{stomp.Subprotocol}
+
+	conn, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.Equal(t, stomp.Subprotocol, conn.Subprotocol())
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return &stompConn{conn: conn}
+}
+
+func (c *stompConn) send(t *testing.T, f *stomp.Frame) {
+	t.Helper()
+
+	require.NoError(t, c.conn.WriteMessage(gws.TextMessage, f.Encode()))
+}
+
+// receive returns the next frame skipping heart-beats.
+func (c *stompConn) receive(t *testing.T) *stomp.Frame {
+	t.Helper()
+
+	_, f := c.receiveMessage(t)
+
+	return f
+}
+
+// receiveMessage returns the next frame skipping heart-beats with the type of websocket message carrying it.
+func (c *stompConn) receiveMessage(t *testing.T) (int, *stomp.Frame) {
+	t.Helper()
+
+	require.NoError(t, c.conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		require.NoError(t, err)
+
+		if messageType == gws.TextMessage {
+			// Browsers close the connection with 1007 on invalid UTF-8 in a text message.
+			require.True(t, utf8.Valid(data), "text message is not valid UTF-8")
+		} else {
+			require.Equal(t, gws.BinaryMessage, messageType)
+		}
+
+		if len(bytes.TrimLeft(data, "\r\n")) == 0 {
+			continue
+		}
+
+		f, err := stomp.ReadFrame(bufio.NewReader(bytes.NewReader(data)), len(data))
+		require.NoError(t, err)
+
+		return messageType, f
+	}
+}
+
+func assertHeader(t *testing.T, f *stomp.Frame, key, want string) {
+	t.Helper()
+
+	got, ok := f.Get(key)
+	if assert.True(t, ok, "%s has no %s header", f.Command, key) {
+		assert.Equal(t, want, got, "%s header", key)
+	}
+}
@@ -0,0 +1,94 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/alexandear/websocket-pubsub/internal/pkg/operation"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/tracing"
+	"github.com/alexandear/websocket-pubsub/internal/pkg/websocket"
+	"github.com/alexandear/websocket-pubsub/internal/server"
+	"github.com/alexandear/websocket-pubsub/internal/server/mock"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := tracing.NewProvider(recorder, "test", 1)
+	otel.SetTracerProvider(tp)
+
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	ctx, publisher := tp.Tracer("test").Start(context.Background(), "publisher")
+	publisher.End()
+	traceContext, err := json.Marshal(tracing.Inject(ctx))
+	require.NoError(t, err)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	connm := mock.NewMockWsConn(ctrl)
+	h := server.NewHub(zap.NewNop(), 100*time.Second)
+	client := server.NewClient(zap.NewNop(), h, connm)
+
+	hubCtx, hubCancel := context.WithCancel(context.Background())
+	defer hubCancel()
+
+	go h.Run(hubCtx)
+
+	var message []byte
+
+	written := make(chan struct{})
+
+	gomock.InOrder(
+		connm.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte(`{"command":"SUBSCRIBE"}`), nil),
+		connm.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte(
+			fmt.Sprintf(`{"command":"NUM_CONNECTIONS","trace_context":%s}`, traceContext)), nil),
+		connm.EXPECT().ReadMessage().DoAndReturn(func() (websocket.MessageType, []byte, error) {
+			<-written
+
+			return websocket.MessageType(0), nil, websocket.ErrClosedConn
+		}),
+	)
+	connm.EXPECT().WriteMessage(websocket.BinaryMessage, gomock.Any()).DoAndReturn(func(_ websocket.MessageType, data []byte) error {
+		message = data
+		close(written)
+
+		return nil
+	})
+	connm.EXPECT().WriteCloseMessage(gomock.Any(), gomock.Any()).AnyTimes()
+	connm.EXPECT().Close().MinTimes(1)
+
+	runCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	client.Run(runCtx)
+	cancel()
+
+	traceID := publisher.SpanContext().TraceID()
+
+	assert.Eventually(t, func() bool {
+		names := map[string]trace.TraceID{}
+		for _, span := range recorder.Ended() {
+			names[span.Name()] = span.SpanContext().TraceID()
+		}
+
+		return names["pubsub.command"] == traceID &&
+			names["pubsub.fanout"] == traceID &&
+			names["pubsub.write"] == traceID
+	}, time.Second, 10*time.Millisecond)
+
+	var resp operation.RespNumConnections
+	<-written
+	require.NoError(t, json.Unmarshal(message, &resp))
+	assert.Equal(t, 1, resp.NumConnections)
+	sc := trace.SpanContextFromContext(tracing.Extract(context.Background(), resp.TraceContext))
+	assert.Equal(t, traceID, sc.TraceID())
+}